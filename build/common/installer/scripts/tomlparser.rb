@@ -3,6 +3,8 @@
 
 @os_type = ENV["OS_TYPE"]
 require "tomlrb"
+require "json"
+require "base64"
 
 require_relative "ConfigParseErrorLogger"
 
@@ -13,9 +15,13 @@ require_relative "ConfigParseErrorLogger"
 @collectStdoutLogs = true
 @stdoutExcludeNamespaces = "kube-system,gatekeeper-system"
 @stdoutIncludeSystemPods = ""
+@stdoutExcludeNamespacePatterns = [] # glob, regex: and label: entries of exclude_namespaces
+@stdoutIncludeNamespacePatterns = []
 @collectStderrLogs = true
 @stderrExcludeNamespaces = "kube-system,gatekeeper-system"
 @stderrIncludeSystemPods = ""
+@stderrExcludeNamespacePatterns = []
+@stderrIncludeNamespacePatterns = []
 @collectClusterEnvVariables = true
 @logTailPath = "/var/log/containers/*.log"
 @logExclusionRegexPattern = "(^((?!stdout|stderr).)*$)"
@@ -26,6 +32,38 @@ require_relative "ConfigParseErrorLogger"
 @containerLogsRoute = "v2" # default for linux
 @logEnableMultiline = "false"
 @stacktraceLanguages = "go,java,python" #supported languages for multiline logs. java is also used for dotnet stacktraces
+@logEnableMultilineGrouping = false
+@multilineGroupingNamespaces = "" # empty means all namespaces
+@multilineGroupingLanguages = "go,java,python,dotnet"
+@multilineGroupingStartPatterns = "" # base64 encoded json array of start-of-record regexes
+@logEnableRedaction = false
+@redactionPresets = ""
+@redactionRules = "" # base64 encoded json array of {name, pattern, replacement} rules
+@redactionReplacement = "[REDACTED:{rule}]"
+@logEnableJsonParsing = false
+@jsonParsingMode = "logmessage" # logmessage or column
+@jsonParsingNamespaces = "" # empty means all namespaces
+@jsonParsingMaxSizeKB = 64
+@logEnableLogLevelDetection = false
+@logLevelDetectors = "json,logfmt,klog,bracket"
+@logLevelJsonKeys = "level,severity,lvl,loglevel"
+@logLevelCustomPatterns = "" # base64 encoded json array of regexes with a named capture group level
+@logEnableDedup = false
+@dedupWindowSeconds = 60
+@dedupMaxEntries = 10000
+@containerLogSamplingRatios = "" # comma separated namespace[/stream]:ratio entries
+@podAnnotationLogSettings = false
+@logEnableRouting = false
+@routingRules = "" # base64 encoded json array of routing rules
+@logEnableBudgets = false
+@logBudgets = "" # base64 encoded json array of namespace budgets
+@logEnableTee = false
+@logTeePercentage = 10
+@logTeeTag = ""
+@logTeeSocket = ""
+@logEnableFailover = false
+@logFailoverThreshold = 5
+@logFailbackIntervalSeconds = 60
 @logEnableKubernetesMetadata = false
 @logKubernetesMetadataIncludeFields = "podlabels,podannotations,poduid,image,imageid,imagerepo,imagetag"
 @annotationBasedLogFiltering = false
@@ -33,6 +71,7 @@ require_relative "ConfigParseErrorLogger"
 @isAzMonMultiTenancyLogCollectionEnabled = false
 @azMonMultiTenantNamespaces = []
 @azMonMultiTenancyMaxStorageChunksUp = 500
+@azMonMultiTenancyMaxParallelWrites = 8
 @namespace_to_settings = {}
 @azMonMultiTenancyServiceBufferChunkSize = "10m"
 @azMonMultiTenancyServiceBufferMaxSize = "30m"
@@ -195,6 +234,28 @@ def parseConfigMap
   end
 end
 
+# Namespace entries with glob characters or a regex:/label: prefix are patterns, the others are namespace names
+def isNamespacePattern(namespace)
+  return namespace.start_with?("regex:", "label:") || isNamespaceGlob(namespace)
+end
+
+def isNamespaceGlob(namespace)
+  return !namespace.start_with?("regex:", "label:") && namespace.match?(/[*?\[]/)
+end
+
+# Patterns are passed to the plugin as base64 encoded json arrays, since regexes & label selectors can contain commas
+def encodeNamespacePatterns(patterns)
+  return patterns.empty? ? "" : Base64.strict_encode64(patterns.to_json)
+end
+
+def getIncludeNamespacePatterns(streamSettings)
+  includeNamespaces = streamSettings[:include_namespaces]
+  if includeNamespaces.kind_of?(Array) && includeNamespaces.length > 0 && includeNamespaces[0].kind_of?(String)
+    return includeNamespaces.map { |namespace| namespace.strip }.reject { |namespace| namespace.empty? }
+  end
+  return []
+end
+
 # Use the ruby structure created after config parsing to set the right values to be used as environment variables
 def populateSettingValuesFromConfigMap(parsedConfig)
   if !parsedConfig.nil? && !parsedConfig[:log_collection_settings].nil?
@@ -218,7 +279,9 @@ def populateSettingValuesFromConfigMap(parsedConfig)
             if stdoutNamespaces.length > 0 && stdoutNamespaces[0].kind_of?(String)
               #Empty the array to use the values from configmap
               stdoutNamespaces.each do |namespace|
-                if @stdoutExcludeNamespaces.empty?
+                if isNamespacePattern(namespace)
+                  @stdoutExcludeNamespacePatterns.push(namespace)
+                elsif @stdoutExcludeNamespaces.empty?
                   # To not append , for the first element
                   @stdoutExcludeNamespaces.concat(namespace)
                 else
@@ -230,6 +293,11 @@ def populateSettingValuesFromConfigMap(parsedConfig)
           end
         end
 
+        if @collectStdoutLogs
+          @stdoutIncludeNamespacePatterns = getIncludeNamespacePatterns(parsedConfig[:log_collection_settings][:stdout])
+          puts "config::Using config map setting for stdout log collection to include namespaces" if @stdoutIncludeNamespacePatterns.any?
+        end
+
         if @collectStdoutLogs && stdoutSystemPods.is_a?(Array) && !stdoutSystemPods.empty?
           # Using is_a? for type checking and directly checking if the array is not empty
           filtered_entries = stdoutSystemPods.each_with_object([]) do |pod, entries|
@@ -284,14 +352,17 @@ def populateSettingValuesFromConfigMap(parsedConfig)
             # Checking only for the first element to be string because toml enforces the arrays to contain elements of same type
             if stderrNamespaces.length > 0 && stderrNamespaces[0].kind_of?(String)
               stderrNamespaces.each do |namespace|
-                if @stderrExcludeNamespaces.empty?
+                if isNamespacePattern(namespace)
+                  @stderrExcludeNamespacePatterns.push(namespace)
+                elsif @stderrExcludeNamespaces.empty?
                   # To not append , for the first element
                   @stderrExcludeNamespaces.concat(namespace)
                 else
                   @stderrExcludeNamespaces.concat("," + namespace)
                 end
                 # Add this namespace to excludepath if both stdout & stderr are excluded for this namespace, to ensure are optimized and dont tail these files at all
-                if stdoutNamespaces.include? namespace
+                # regex & label selector patterns cant be expressed as tail paths, so they are only filtered in the plugin
+                if stdoutNamespaces.include?(namespace) || (isNamespaceGlob(namespace) && @stdoutExcludeNamespacePatterns.include?(namespace))
                   @excludePath.concat("," + "*_" + namespace + "_*.log")
                 end
               end
@@ -300,6 +371,11 @@ def populateSettingValuesFromConfigMap(parsedConfig)
           end
         end
 
+        if @collectStderrLogs
+          @stderrIncludeNamespacePatterns = getIncludeNamespacePatterns(parsedConfig[:log_collection_settings][:stderr])
+          puts "config::Using config map setting for stderr log collection to include namespaces" if @stderrIncludeNamespacePatterns.any?
+        end
+
         if @collectStderrLogs && stderrSystemPods.is_a?(Array) && !stderrSystemPods.empty?
           # Using is_a? for type checking and directly checking if the array is not empty
           filtered_entries = stderrSystemPods.each_with_object([]) do |pod, entries|
@@ -398,6 +474,188 @@ def populateSettingValuesFromConfigMap(parsedConfig)
       ConfigParseErrorLogger.logError("Exception while reading config map settings for enabling multiline logs - #{errorStr}, using defaults, please check config map for errors")
     end
 
+    # Get multiline grouping setting (grouping of stack traces by the out_oms plugin)
+    begin
+      multilineGrouping = parsedConfig[:log_collection_settings][:multiline_grouping]
+      if !multilineGrouping.nil? && !multilineGrouping[:enabled].nil?
+        @logEnableMultilineGrouping = multilineGrouping[:enabled]
+        puts "config::Using config map setting for multiline grouping"
+
+        namespaces = multilineGrouping[:namespaces]
+        # Checking only for the first element to be string because toml enforces the arrays to contain elements of same type
+        if !namespaces.nil? && namespaces.kind_of?(Array) && namespaces.length > 0 && namespaces[0].kind_of?(String)
+          @multilineGroupingNamespaces = namespaces.map { |ns| ns.strip.downcase }.uniq.join(",")
+          puts "config::Using config map setting for multiline grouping namespaces"
+        end
+
+        languages = multilineGrouping[:stacktrace_languages]
+        if !languages.nil? && languages.kind_of?(Array)
+          if languages.length == 0
+            @multilineGroupingLanguages = ""
+          elsif languages[0].kind_of?(String) && languages.all? { |lang| ["java", "python", "go", "dotnet"].include?(lang.downcase) }
+            @multilineGroupingLanguages = languages.map(&:downcase).uniq.join(",")
+            puts "config::Using config map setting for multiline grouping languages"
+          else
+            puts "config::WARN: multiline grouping stacktrace languages contains invalid languages. Using defaults"
+          end
+        end
+
+        startPatterns = multilineGrouping[:start_patterns]
+        if !startPatterns.nil? && startPatterns.kind_of?(Array) && startPatterns.length > 0 && startPatterns[0].kind_of?(String)
+          invalidPattern = startPatterns.find { |pattern| (Regexp.new(pattern) rescue nil).nil? }
+          if invalidPattern.nil?
+            @multilineGroupingStartPatterns = Base64.strict_encode64(startPatterns.to_json)
+            puts "config::Using config map setting for multiline grouping start patterns"
+          else
+            puts "config::WARN: multiline grouping start pattern #{invalidPattern} is not a valid regex. Ignoring start patterns"
+          end
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for multiline grouping - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get container log redaction setting
+    begin
+      redaction = parsedConfig[:log_collection_settings][:redaction]
+      if !redaction.nil? && !redaction[:enabled].nil?
+        @logEnableRedaction = redaction[:enabled]
+        puts "config::Using config map setting for log redaction"
+
+        presets = redaction[:presets]
+        if !presets.nil? && presets.kind_of?(Array) && presets.length > 0 && presets[0].kind_of?(String)
+          validPresets = ["jwt", "azure_storage_key", "sas_token", "credit_card", "email"]
+          invalidPresets = presets.reject { |preset| validPresets.include?(preset.downcase) }
+          if invalidPresets.length > 0
+            puts "config::WARN: ignoring invalid log redaction presets: #{invalidPresets.join(",")}"
+          end
+          @redactionPresets = presets.map(&:downcase).select { |preset| validPresets.include?(preset) }.uniq.join(",")
+        end
+
+        rules = redaction[:rules]
+        if !rules.nil? && rules.kind_of?(Array) && rules.length > 0
+          validRules = rules.select { |rule| rule.kind_of?(Hash) && rule[:pattern].kind_of?(String) && !(Regexp.new(rule[:pattern]) rescue nil).nil? }
+          if validRules.length != rules.length
+            puts "config::WARN: ignoring #{rules.length - validRules.length} log redaction rule(s) without a valid pattern"
+          end
+          if validRules.length > 0
+            @redactionRules = Base64.strict_encode64(validRules.to_json)
+          end
+        end
+
+        replacement = redaction[:replacement]
+        if !replacement.nil? && replacement.kind_of?(String) && !replacement.empty?
+          @redactionReplacement = replacement
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log redaction - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get json log parsing setting
+    begin
+      jsonParsing = parsedConfig[:log_collection_settings][:json_parsing]
+      if !jsonParsing.nil? && !jsonParsing[:enabled].nil?
+        @logEnableJsonParsing = jsonParsing[:enabled]
+        puts "config::Using config map setting for json log parsing"
+
+        mode = jsonParsing[:mode]
+        if !mode.nil? && mode.kind_of?(String)
+          if ["logmessage", "column"].include?(mode.strip.downcase)
+            @jsonParsingMode = mode.strip.downcase
+          else
+            puts "config::WARN: json log parsing mode #{mode} is invalid. Using default: #{@jsonParsingMode}"
+          end
+        end
+
+        namespaces = jsonParsing[:namespaces]
+        if !namespaces.nil? && namespaces.kind_of?(Array) && namespaces.length > 0 && namespaces[0].kind_of?(String)
+          @jsonParsingNamespaces = namespaces.map { |ns| ns.strip.downcase }.uniq.join(",")
+        end
+
+        if is_valid_number?(jsonParsing[:max_size_kb])
+          @jsonParsingMaxSizeKB = jsonParsing[:max_size_kb].to_i
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for json log parsing - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get log level detection setting
+    begin
+      logLevel = parsedConfig[:log_collection_settings][:log_level]
+      if !logLevel.nil? && !logLevel[:enabled].nil?
+        @logEnableLogLevelDetection = logLevel[:enabled]
+        puts "config::Using config map setting for log level detection"
+
+        detectors = logLevel[:detectors]
+        if !detectors.nil? && detectors.kind_of?(Array)
+          if detectors.length == 0
+            @logLevelDetectors = ""
+          elsif detectors[0].kind_of?(String) && detectors.all? { |detector| ["json", "logfmt", "klog", "bracket"].include?(detector.downcase) }
+            @logLevelDetectors = detectors.map(&:downcase).uniq.join(",")
+          else
+            puts "config::WARN: log level detectors contains invalid detectors. Using defaults"
+          end
+        end
+
+        jsonKeys = logLevel[:json_keys]
+        if !jsonKeys.nil? && jsonKeys.kind_of?(Array) && jsonKeys.length > 0 && jsonKeys[0].kind_of?(String)
+          @logLevelJsonKeys = jsonKeys.map(&:strip).join(",")
+        end
+
+        customPatterns = logLevel[:custom_patterns]
+        if !customPatterns.nil? && customPatterns.kind_of?(Array) && customPatterns.length > 0 && customPatterns[0].kind_of?(String)
+          invalidPattern = customPatterns.find { |pattern| !pattern.include?("?P<level>") || (Regexp.new(pattern.gsub("?P<level>", "?<level>")) rescue nil).nil? }
+          if invalidPattern.nil?
+            @logLevelCustomPatterns = Base64.strict_encode64(customPatterns.to_json)
+          else
+            puts "config::WARN: log level pattern #{invalidPattern} is not a valid regex with a (?P<level>...) group. Ignoring custom patterns"
+          end
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log level detection - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get log deduplication setting
+    begin
+      dedup = parsedConfig[:log_collection_settings][:deduplication]
+      if !dedup.nil? && !dedup[:enabled].nil?
+        @logEnableDedup = dedup[:enabled]
+        puts "config::Using config map setting for log deduplication"
+        if is_valid_number?(dedup[:window_seconds])
+          @dedupWindowSeconds = dedup[:window_seconds].to_i
+        end
+        if is_valid_number?(dedup[:max_entries])
+          @dedupMaxEntries = dedup[:max_entries].to_i
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log deduplication - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get log sampling setting
+    begin
+      sampling = parsedConfig[:log_collection_settings][:sampling]
+      if !sampling.nil? && !sampling[:ratios].nil?
+        ratios = sampling[:ratios]
+        if ratios.kind_of?(Array) && ratios.length > 0 && ratios[0].kind_of?(String)
+          validRatios = ratios.select { |entry|
+            parts = entry.strip.rpartition(":")
+            !parts[0].empty? && !(Float(parts[2]) rescue nil).nil? && Float(parts[2]) >= 0 && Float(parts[2]) <= 1
+          }
+          if validRatios.length != ratios.length
+            puts "config::WARN: ignoring sampling ratios which are not in namespace[/stream]:ratio format: #{(ratios - validRatios).join(",")}"
+          end
+          @containerLogSamplingRatios = validRatios.map(&:strip).join(",")
+          puts "config::Using config map setting for log sampling"
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log sampling - #{errorStr}, using defaults, please check config map for errors")
+    end
+
     #Get kube events enrichment setting
     begin
       if !parsedConfig[:log_collection_settings][:collect_all_kube_events].nil? && !parsedConfig[:log_collection_settings][:collect_all_kube_events][:enabled].nil?
@@ -460,6 +718,139 @@ def populateSettingValuesFromConfigMap(parsedConfig)
       ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for annotation based log filtering - #{errorStr}, please check config map for errors")
     end
 
+    #Get pod annotation based log collection settings
+    begin
+      if !parsedConfig[:log_collection_settings][:pod_annotation_settings].nil? && !parsedConfig[:log_collection_settings][:pod_annotation_settings][:enabled].nil?
+        puts "config::INFO: Using config map setting for pod annotation based log collection settings"
+        @podAnnotationLogSettings = parsedConfig[:log_collection_settings][:pod_annotation_settings][:enabled]
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for pod annotation based log collection settings - #{errorStr}, please check config map for errors")
+    end
+
+    # Get container log routing setting
+    begin
+      routing = parsedConfig[:log_collection_settings][:routing]
+      if !routing.nil? && !routing[:enabled].nil?
+        @logEnableRouting = routing[:enabled]
+        puts "config::Using config map setting for log routing"
+
+        rules = routing[:rules]
+        if !rules.nil? && rules.kind_of?(Array) && rules.length > 0
+          validRules = rules.select { |rule| rule.kind_of?(Hash) && rule[:tag].kind_of?(String) && !rule[:tag].empty? && (rule[:message_pattern].nil? || !(Regexp.new(rule[:message_pattern]) rescue nil).nil?) }
+          if validRules.length != rules.length
+            puts "config::WARN: ignoring #{rules.length - validRules.length} log routing rule(s) without a tag or with an invalid message_pattern"
+          end
+          routingRules = validRules.map do |rule|
+            {
+              "name" => rule[:name],
+              "namespaces" => rule[:namespaces],
+              "podLabelSelector" => rule[:pod_label_selector],
+              "containers" => rule[:containers],
+              "streams" => rule[:streams],
+              "logLevels" => rule[:log_levels],
+              "messagePattern" => rule[:message_pattern],
+              "tag" => rule[:tag],
+              "namedPipe" => rule[:named_pipe],
+            }.compact
+          end
+          if routingRules.length > 0
+            @routingRules = Base64.strict_encode64(routingRules.to_json)
+          end
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log routing - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get container log ingestion budgets setting
+    begin
+      budgets = parsedConfig[:log_collection_settings][:budgets]
+      if !budgets.nil? && !budgets[:enabled].nil?
+        @logEnableBudgets = budgets[:enabled]
+        puts "config::Using config map setting for log ingestion budgets"
+
+        namespaces = budgets[:namespaces]
+        if !namespaces.nil? && namespaces.kind_of?(Array) && namespaces.length > 0
+          validBudgets = namespaces.select do |budget|
+            budget.kind_of?(Hash) && budget[:namespace].kind_of?(String) && !budget[:namespace].empty? &&
+              ["hour", "day"].include?(budget[:period].to_s.downcase) &&
+              (budget[:max_bytes].to_i > 0 || budget[:max_lines].to_i > 0)
+          end
+          if validBudgets.length != namespaces.length
+            puts "config::WARN: ignoring #{namespaces.length - validBudgets.length} log ingestion budget(s) without a namespace, a period of hour or day, or a max_bytes or max_lines limit"
+          end
+          logBudgets = validBudgets.map do |budget|
+            {
+              "namespace" => budget[:namespace],
+              "perController" => budget[:per_controller] == true,
+              "period" => budget[:period].to_s.downcase,
+              "maxBytes" => budget[:max_bytes].to_i,
+              "maxLines" => budget[:max_lines].to_i,
+            }
+          end
+          if logBudgets.length > 0
+            @logBudgets = Base64.strict_encode64(logBudgets.to_json)
+          end
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log ingestion budgets - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get container log tee setting
+    begin
+      tee = parsedConfig[:log_collection_settings][:tee]
+      if !tee.nil? && !tee[:enabled].nil?
+        @logEnableTee = tee[:enabled]
+        puts "config::Using config map setting for log tee"
+        if !tee[:percentage].nil?
+          percentage = tee[:percentage].to_f
+          if percentage > 0 && percentage <= 100
+            @logTeePercentage = percentage
+          else
+            puts "config::WARN: log tee percentage #{tee[:percentage]} is not between 0 and 100, using default #{@logTeePercentage}"
+          end
+        end
+        if tee[:tag].kind_of?(String)
+          @logTeeTag = tee[:tag].strip
+        end
+        if tee[:socket].kind_of?(String)
+          @logTeeSocket = tee[:socket].strip
+        end
+        if @logEnableTee && @logTeeTag.empty? && @logTeeSocket.empty?
+          puts "config::WARN: log tee is enabled but has neither a tag nor a socket, it will be disabled"
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for log tee - #{errorStr}, using defaults, please check config map for errors")
+    end
+
+    # Get container logs failover setting
+    begin
+      failover = parsedConfig[:log_collection_settings][:failover]
+      if !failover.nil? && !failover[:enabled].nil?
+        @logEnableFailover = failover[:enabled]
+        puts "config::Using config map setting for container logs failover"
+        if !failover[:threshold].nil?
+          if failover[:threshold].to_i > 0
+            @logFailoverThreshold = failover[:threshold].to_i
+          else
+            puts "config::WARN: container logs failover threshold #{failover[:threshold]} is not a positive number, using default #{@logFailoverThreshold}"
+          end
+        end
+        if !failover[:failback_interval_seconds].nil?
+          if failover[:failback_interval_seconds].to_i > 0
+            @logFailbackIntervalSeconds = failover[:failback_interval_seconds].to_i
+          else
+            puts "config::WARN: container logs failback interval #{failover[:failback_interval_seconds]} is not a positive number, using default #{@logFailbackIntervalSeconds}"
+          end
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for container logs failover - #{errorStr}, using defaults, please check config map for errors")
+    end
+
     #Get Multi-tenancy log collection settings
     begin
         if !parsedConfig[:log_collection_settings][:multi_tenancy].nil? && !parsedConfig[:log_collection_settings][:multi_tenancy][:enabled].nil?
@@ -480,6 +871,12 @@ def populateSettingValuesFromConfigMap(parsedConfig)
                @azMonMultiTenancyMaxStorageChunksUp = storage_max_chunks_up.to_i
             end
             puts "config::INFO:multi_tenancy storage_max_chunks_up: #{@azMonMultiTenancyMaxStorageChunksUp}"
+            # max number of tenant streams written in parallel
+            max_parallel_writes = parsedConfig[:log_collection_settings][:multi_tenancy][:max_parallel_writes]
+            if is_valid_number?(max_parallel_writes)
+               @azMonMultiTenancyMaxParallelWrites = max_parallel_writes.to_i
+            end
+            puts "config::INFO:multi_tenancy max_parallel_writes: #{@azMonMultiTenancyMaxParallelWrites}"
 
             # default settings
             storage_type =  parsedConfig[:log_collection_settings][:multi_tenancy][:storage_type]
@@ -579,9 +976,13 @@ if !file.nil?
   file.write("export AZMON_LOG_EXCLUSION_REGEX_PATTERN=\"#{@logExclusionRegexPattern}\"\n")
   file.write("export AZMON_STDOUT_EXCLUDED_NAMESPACES=#{@stdoutExcludeNamespaces}\n")
   file.write("export AZMON_STDOUT_INCLUDED_SYSTEM_PODS=#{@stdoutIncludeSystemPods}\n")
+  file.write("export AZMON_STDOUT_EXCLUDED_NAMESPACE_PATTERNS=#{encodeNamespacePatterns(@stdoutExcludeNamespacePatterns)}\n")
+  file.write("export AZMON_STDOUT_INCLUDED_NAMESPACE_PATTERNS=#{encodeNamespacePatterns(@stdoutIncludeNamespacePatterns)}\n")
   file.write("export AZMON_COLLECT_STDERR_LOGS=#{@collectStderrLogs}\n")
   file.write("export AZMON_STDERR_EXCLUDED_NAMESPACES=#{@stderrExcludeNamespaces}\n")
   file.write("export AZMON_STDERR_INCLUDED_SYSTEM_PODS=#{@stderrIncludeSystemPods}\n")
+  file.write("export AZMON_STDERR_EXCLUDED_NAMESPACE_PATTERNS=#{encodeNamespacePatterns(@stderrExcludeNamespacePatterns)}\n")
+  file.write("export AZMON_STDERR_INCLUDED_NAMESPACE_PATTERNS=#{encodeNamespacePatterns(@stderrIncludeNamespacePatterns)}\n")
   file.write("export AZMON_CLUSTER_COLLECT_ENV_VAR=#{@collectClusterEnvVariables}\n")
   file.write("export AZMON_CLUSTER_LOG_TAIL_EXCLUDE_PATH=#{@excludePath}\n")
   file.write("export AZMON_CLUSTER_CONTAINER_LOG_ENRICH=#{@enrichContainerLogs}\n")
@@ -590,14 +991,47 @@ if !file.nil?
   file.write("export AZMON_CONTAINER_LOG_SCHEMA_VERSION=#{@containerLogSchemaVersion}\n")
   file.write("export AZMON_MULTILINE_ENABLED=#{@logEnableMultiline}\n")
   file.write("export AZMON_MULTILINE_LANGUAGES=#{@stacktraceLanguages}\n")
+  file.write("export AZMON_MULTILINE_GROUPING_ENABLED=#{@logEnableMultilineGrouping}\n")
+  file.write("export AZMON_MULTILINE_GROUPING_NAMESPACES=#{@multilineGroupingNamespaces}\n")
+  file.write("export AZMON_MULTILINE_GROUPING_LANGUAGES=#{@multilineGroupingLanguages}\n")
+  file.write("export AZMON_MULTILINE_GROUPING_START_PATTERNS=#{@multilineGroupingStartPatterns}\n")
+  file.write("export AZMON_JSON_LOG_PARSING_ENABLED=#{@logEnableJsonParsing}\n")
+  file.write("export AZMON_JSON_LOG_PARSING_MODE=#{@jsonParsingMode}\n")
+  file.write("export AZMON_JSON_LOG_PARSING_NAMESPACES=#{@jsonParsingNamespaces}\n")
+  file.write("export AZMON_JSON_LOG_PARSING_MAX_SIZE_KB=#{@jsonParsingMaxSizeKB}\n")
+  file.write("export AZMON_LOG_LEVEL_DETECTION_ENABLED=#{@logEnableLogLevelDetection}\n")
+  file.write("export AZMON_LOG_LEVEL_DETECTORS=#{@logLevelDetectors}\n")
+  file.write("export AZMON_LOG_LEVEL_JSON_KEYS=#{@logLevelJsonKeys}\n")
+  file.write("export AZMON_LOG_LEVEL_CUSTOM_PATTERNS=#{@logLevelCustomPatterns}\n")
+  file.write("export AZMON_LOG_DEDUP_ENABLED=#{@logEnableDedup}\n")
+  file.write("export AZMON_LOG_DEDUP_WINDOW_SECONDS=#{@dedupWindowSeconds}\n")
+  file.write("export AZMON_LOG_DEDUP_MAX_ENTRIES=#{@dedupMaxEntries}\n")
+  file.write("export AZMON_CONTAINER_LOG_SAMPLING_RATIOS=#{@containerLogSamplingRatios}\n")
+  file.write("export AZMON_LOG_REDACTION_ENABLED=#{@logEnableRedaction}\n")
+  file.write("export AZMON_LOG_REDACTION_PRESETS=#{@redactionPresets}\n")
+  file.write("export AZMON_LOG_REDACTION_RULES=#{@redactionRules}\n")
+  file.write("export AZMON_LOG_REDACTION_REPLACEMENT=\"#{@redactionReplacement.gsub(/["\\$`]/) { |c| "\\" + c }}\"\n")
   file.write("export AZMON_KUBERNETES_METADATA_ENABLED=#{@logEnableKubernetesMetadata}\n")
   file.write("export AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS=#{@logKubernetesMetadataIncludeFields}\n")
   file.write("export AZMON_ANNOTATION_BASED_LOG_FILTERING=#{@annotationBasedLogFiltering}\n")
+  file.write("export AZMON_POD_ANNOTATION_LOG_SETTINGS_ENABLED=#{@podAnnotationLogSettings}\n")
+  file.write("export AZMON_LOG_ROUTING_ENABLED=#{@logEnableRouting}\n")
+  file.write("export AZMON_LOG_ROUTING_RULES=#{@routingRules}\n")
+  file.write("export AZMON_LOG_BUDGETS_ENABLED=#{@logEnableBudgets}\n")
+  file.write("export AZMON_LOG_BUDGETS=#{@logBudgets}\n")
+  file.write("export AZMON_CONTAINER_LOG_TEE_ENABLED=#{@logEnableTee}\n")
+  file.write("export AZMON_CONTAINER_LOG_TEE_PERCENTAGE=#{@logTeePercentage}\n")
+  file.write("export AZMON_CONTAINER_LOG_TEE_TAG=#{@logTeeTag}\n")
+  file.write("export AZMON_CONTAINER_LOG_TEE_SOCKET=#{@logTeeSocket}\n")
+  file.write("export AZMON_CONTAINER_LOGS_FAILOVER_ENABLED=#{@logEnableFailover}\n")
+  file.write("export AZMON_CONTAINER_LOGS_FAILOVER_THRESHOLD=#{@logFailoverThreshold}\n")
+  file.write("export AZMON_CONTAINER_LOGS_FAILBACK_INTERVAL_SECONDS=#{@logFailbackIntervalSeconds}\n")
   if @isAzMonMultiTenancyLogCollectionEnabled
     file.write("export AZMON_MULTI_TENANCY_LOG_COLLECTION=#{@isAzMonMultiTenancyLogCollectionEnabled}\n")
     azMonMultiTenantNamespacesString = @azMonMultiTenantNamespaces.join(",")
     file.write("export AZMON_MULTI_TENANCY_NAMESPACES=#{azMonMultiTenantNamespacesString}\n")
     file.write("export AZMON_MULTI_TENANCY_STORAGE_MAX_CHUNKS_UP=#{@azMonMultiTenancyMaxStorageChunksUp}\n")
+    file.write("export AZMON_MULTI_TENANCY_MAX_PARALLEL_WRITES=#{@azMonMultiTenancyMaxParallelWrites}\n")
     file.write("export AZMON_MULTI_TENANCY_SVC_BUFFER_CHUNK_SIZE=#{@azMonMultiTenancyServiceBufferChunkSize}\n")
     file.write("export AZMON_MULTI_TENANCY_SVC_BUFFER_MAX_SIZE=#{@azMonMultiTenancyServiceBufferMaxSize}\n")
   end
@@ -648,12 +1082,20 @@ if !@os_type.nil? && !@os_type.empty? && @os_type.strip.casecmp("windows") == 0
     file.write(commands)
     commands = get_command_windows("AZMON_STDOUT_INCLUDED_SYSTEM_PODS", @stdoutIncludeSystemPods)
     file.write(commands)
+    commands = get_command_windows("AZMON_STDOUT_EXCLUDED_NAMESPACE_PATTERNS", encodeNamespacePatterns(@stdoutExcludeNamespacePatterns))
+    file.write(commands)
+    commands = get_command_windows("AZMON_STDOUT_INCLUDED_NAMESPACE_PATTERNS", encodeNamespacePatterns(@stdoutIncludeNamespacePatterns))
+    file.write(commands)
     commands = get_command_windows("AZMON_COLLECT_STDERR_LOGS", @collectStderrLogs)
     file.write(commands)
     commands = get_command_windows("AZMON_STDERR_EXCLUDED_NAMESPACES", @stderrExcludeNamespaces)
     file.write(commands)
     commands = get_command_windows("AZMON_STDERR_INCLUDED_SYSTEM_PODS", @stderrIncludeSystemPods)
     file.write(commands)
+    commands = get_command_windows("AZMON_STDERR_EXCLUDED_NAMESPACE_PATTERNS", encodeNamespacePatterns(@stderrExcludeNamespacePatterns))
+    file.write(commands)
+    commands = get_command_windows("AZMON_STDERR_INCLUDED_NAMESPACE_PATTERNS", encodeNamespacePatterns(@stderrIncludeNamespacePatterns))
+    file.write(commands)
     commands = get_command_windows("AZMON_CLUSTER_COLLECT_ENV_VAR", @collectClusterEnvVariables)
     file.write(commands)
     commands = get_command_windows("AZMON_CLUSTER_LOG_TAIL_EXCLUDE_PATH", @excludePath)
@@ -670,12 +1112,76 @@ if !@os_type.nil? && !@os_type.empty? && @os_type.strip.casecmp("windows") == 0
     file.write(commands)
     commands = get_command_windows("AZMON_MULTILINE_LANGUAGES", @stacktraceLanguages)
     file.write(commands)
+    commands = get_command_windows("AZMON_MULTILINE_GROUPING_ENABLED", @logEnableMultilineGrouping)
+    file.write(commands)
+    commands = get_command_windows("AZMON_MULTILINE_GROUPING_NAMESPACES", @multilineGroupingNamespaces)
+    file.write(commands)
+    commands = get_command_windows("AZMON_MULTILINE_GROUPING_LANGUAGES", @multilineGroupingLanguages)
+    file.write(commands)
+    commands = get_command_windows("AZMON_MULTILINE_GROUPING_START_PATTERNS", @multilineGroupingStartPatterns)
+    file.write(commands)
+    commands = get_command_windows("AZMON_JSON_LOG_PARSING_ENABLED", @logEnableJsonParsing)
+    file.write(commands)
+    commands = get_command_windows("AZMON_JSON_LOG_PARSING_MODE", @jsonParsingMode)
+    file.write(commands)
+    commands = get_command_windows("AZMON_JSON_LOG_PARSING_NAMESPACES", @jsonParsingNamespaces)
+    file.write(commands)
+    commands = get_command_windows("AZMON_JSON_LOG_PARSING_MAX_SIZE_KB", @jsonParsingMaxSizeKB)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_LEVEL_DETECTION_ENABLED", @logEnableLogLevelDetection)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_LEVEL_DETECTORS", @logLevelDetectors)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_LEVEL_JSON_KEYS", @logLevelJsonKeys)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_LEVEL_CUSTOM_PATTERNS", @logLevelCustomPatterns)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_DEDUP_ENABLED", @logEnableDedup)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_DEDUP_WINDOW_SECONDS", @dedupWindowSeconds)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_DEDUP_MAX_ENTRIES", @dedupMaxEntries)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOG_SAMPLING_RATIOS", @containerLogSamplingRatios)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_REDACTION_ENABLED", @logEnableRedaction)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_REDACTION_PRESETS", @redactionPresets)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_REDACTION_RULES", @redactionRules)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_REDACTION_REPLACEMENT", @redactionReplacement)
+    file.write(commands)
     commands = get_command_windows("AZMON_KUBERNETES_METADATA_ENABLED", @logEnableKubernetesMetadata)
     file.write(commands)
     commands = get_command_windows("AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS", @logKubernetesMetadataIncludeFields)
     file.write(commands)
     commands = get_command_windows("AZMON_ANNOTATION_BASED_LOG_FILTERING", @annotationBasedLogFiltering)
     file.write(commands)
+    commands = get_command_windows("AZMON_POD_ANNOTATION_LOG_SETTINGS_ENABLED", @podAnnotationLogSettings)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_ROUTING_ENABLED", @logEnableRouting)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_ROUTING_RULES", @routingRules)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_BUDGETS_ENABLED", @logEnableBudgets)
+    file.write(commands)
+    commands = get_command_windows("AZMON_LOG_BUDGETS", @logBudgets)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOG_TEE_ENABLED", @logEnableTee)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOG_TEE_PERCENTAGE", @logTeePercentage)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOG_TEE_TAG", @logTeeTag)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOG_TEE_SOCKET", @logTeeSocket)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOGS_FAILOVER_ENABLED", @logEnableFailover)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOGS_FAILOVER_THRESHOLD", @logFailoverThreshold)
+    file.write(commands)
+    commands = get_command_windows("AZMON_CONTAINER_LOGS_FAILBACK_INTERVAL_SECONDS", @logFailbackIntervalSeconds)
+    file.write(commands)
     if @isAzMonMultiTenancyLogCollectionEnabled
       commands = get_command_windows("AZMON_MULTI_TENANCY_LOG_COLLECTION", @isAzMonMultiTenancyLogCollectionEnabled)
       file.write(commands)
@@ -684,6 +1190,8 @@ if !@os_type.nil? && !@os_type.empty? && @os_type.strip.casecmp("windows") == 0
       file.write(commands)
       commands = get_command_windows("AZMON_MULTI_TENANCY_STORAGE_MAX_CHUNKS_UP", @azMonMultiTenancyMaxStorageChunksUp)
       file.write(commands)
+      commands = get_command_windows("AZMON_MULTI_TENANCY_MAX_PARALLEL_WRITES", @azMonMultiTenancyMaxParallelWrites)
+      file.write(commands)
     end
     # Close file after writing all environment variables
     file.close
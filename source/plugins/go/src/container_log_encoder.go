@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// number of columns of a container log record held without allocating, the schemas have a fixed set of columns well below it
+const maxRecordFields = 24
+
+// room left at the start of the encoder buffer for the [tag, entries] header, so the frame doesnt need to be copied.
+// Frames with longer tags are copied into a new buffer
+const forwardFrameHeaderRoom = 256
+
+const defaultForwardFrameBufferSize = 64 * 1024
+
+// buffers above this size arent pooled, so that a burst doesnt keep its memory around
+const maxPooledForwardFrameBufferSize = 8 * 1024 * 1024
+
+// recordField is a column of a record
+type recordField struct {
+	key   string
+	value string
+}
+
+// recordFields holds the columns of a record in the order they are set without allocating a map
+type recordFields struct {
+	n      int
+	fields [maxRecordFields]recordField
+	// columns beyond the first maxRecordFields
+	overflow []recordField
+}
+
+// field returns the i-th column
+func (r *recordFields) field(i int) *recordField {
+	if i < len(r.fields) {
+		return &r.fields[i]
+	}
+	return &r.overflow[i-len(r.fields)]
+}
+
+// Set sets the value of the column
+func (r *recordFields) Set(key, value string) {
+	for i := 0; i < r.n; i++ {
+		if field := r.field(i); field.key == key {
+			field.value = value
+			return
+		}
+	}
+	if r.n < len(r.fields) {
+		r.fields[r.n] = recordField{key: key, value: value}
+	} else {
+		r.overflow = append(r.overflow, recordField{key: key, value: value})
+	}
+	r.n++
+}
+
+// Get returns the value of the column, empty if it isnt set
+func (r *recordFields) Get(key string) string {
+	for i := 0; i < r.n; i++ {
+		if field := r.field(i); field.key == key {
+			return field.value
+		}
+	}
+	return ""
+}
+
+// Map returns the columns as the map used by the MsgPackEntry records
+func (r *recordFields) Map() map[string]string {
+	record := make(map[string]string, r.n)
+	for i := 0; i < r.n; i++ {
+		field := r.field(i)
+		record[field.key] = field.value
+	}
+	return record
+}
+
+// toStringView returns the []byte value of a record as a string sharing its memory. The values decoded from the chunk
+// are never modified, the string is only valid as long as that holds
+func toStringView(s interface{}) string {
+	b, ok := s.([]byte)
+	if !ok || len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+var forwardFrameEncoderPool = sync.Pool{
+	New: func() interface{} {
+		return &ForwardFrameEncoder{buf: make([]byte, forwardFrameHeaderRoom, defaultForwardFrameBufferSize)}
+	},
+}
+
+// ForwardFrameEncoder encodes the records of a flush into a pooled msgpack forward message as they are read,
+// instead of collecting them as MsgPackEntry maps and encoding them once all of them are read
+type ForwardFrameEncoder struct {
+	// buf holds the header room followed by the encoded entries
+	buf       []byte
+	header    []byte
+	entries   int
+	flushTime time.Time
+}
+
+// NewForwardFrameEncoder returns an encoder from the pool, it must be released once its frame is written
+func NewForwardFrameEncoder() *ForwardFrameEncoder {
+	e := forwardFrameEncoderPool.Get().(*ForwardFrameEncoder)
+	e.flushTime = time.Now()
+	return e
+}
+
+// AppendRecord encodes the record as a [time, record] entry, the flush time is used if the time is zero
+func (e *ForwardFrameEncoder) AppendRecord(t time.Time, record *recordFields) {
+	if t.IsZero() {
+		t = e.flushTime
+	}
+	e.buf = append(e.buf, 0x92)
+	e.buf = appendEventTime(e.buf, t)
+	e.buf = msgp.AppendMapHeader(e.buf, uint32(record.n))
+	for i := 0; i < record.n; i++ {
+		field := record.field(i)
+		e.buf = msgp.AppendString(e.buf, field.key)
+		e.buf = msgp.AppendString(e.buf, field.value)
+	}
+	e.entries++
+}
+
+// Len returns the number of records encoded
+func (e *ForwardFrameEncoder) Len() int {
+	return e.entries
+}
+
+// Frame returns the [tag, entries] forward message of the records. It is only valid until the encoder is released
+func (e *ForwardFrameEncoder) Frame(tag string) []byte {
+	e.header = append(e.header[:0], 0x92)
+	e.header = msgp.AppendString(e.header, tag)
+	e.header = msgp.AppendArrayHeader(e.header, uint32(e.entries))
+	if len(e.header) <= forwardFrameHeaderRoom {
+		start := forwardFrameHeaderRoom - len(e.header)
+		copy(e.buf[start:], e.header)
+		return e.buf[start:]
+	}
+	frame := make([]byte, 0, len(e.header)+len(e.buf)-forwardFrameHeaderRoom)
+	frame = append(frame, e.header...)
+	return append(frame, e.buf[forwardFrameHeaderRoom:]...)
+}
+
+// Release returns the encoder to the pool
+func (e *ForwardFrameEncoder) Release() {
+	if cap(e.buf) > maxPooledForwardFrameBufferSize {
+		return
+	}
+	e.buf = e.buf[:forwardFrameHeaderRoom]
+	e.entries = 0
+	forwardFrameEncoderPool.Put(e)
+}
+
+// newContainerLogFrameEncoder returns an encoder for the container log records of a flush, nil if they are collected as MsgPackEntry records
+func newContainerLogFrameEncoder() *ForwardFrameEncoder {
+	if !ContainerLogFrameStreaming {
+		return nil
+	}
+	return NewForwardFrameEncoder()
+}
+
+// initializeContainerLogFrameStreaming enables the streaming encoding of the container log records when the records are
+// only written to the agent as a single forward message. The features reading the records of a flush keep the MsgPackEntry records
+func initializeContainerLogFrameStreaming() {
+	ContainerLogFrameStreaming = false
+	switch ContainerLogSink.(type) {
+	case *ForwardSocketSink, *NamedPipeSink:
+	default:
+		Log("Container log streaming encoding is disabled since the sink isnt the agent")
+		return
+	}
+	if !ContainerLogsRouteV2 || !ContainerLogSchemaV2 || !ContainerLogV2ConfigMap {
+		Log("Container log streaming encoding is only supported with the v2 route and the ContainerLogV2 schema")
+		return
+	}
+	if IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode || ContainerLogRouter != nil || ContainerLogTee != nil || AlongsideFileSink != nil {
+		Log("Container log streaming encoding is disabled since multi-tenancy, routing, tee or the file sink read the records")
+		return
+	}
+	ContainerLogFrameStreaming = true
+	Log("Container log streaming encoding is enabled")
+}
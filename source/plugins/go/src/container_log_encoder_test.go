@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+// frameCaptureSink encodes the batches like the agent sinks and keeps a copy of the last frame
+type frameCaptureSink struct {
+	fakeSink
+	lastFrame []byte
+	// streamed is true if the last batch was encoded while the records were read
+	streamed bool
+}
+
+func (s *frameCaptureSink) Write(batch *SinkBatch) (int, error) {
+	s.streamed = batch.Frame != nil
+	frame := getSinkBatchFrame(batch)
+	s.lastFrame = append(s.lastFrame[:0], frame...)
+	return len(frame), nil
+}
+
+// setupContainerLogFlush configures PostDataHelper to write ContainerLogV2 records to the returned sink
+func setupContainerLogFlush(tb testing.TB, streaming bool) *frameCaptureSink {
+	routeV2, schemaV2, v2ConfigMap, aadMSIAuthMode := ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap, IsAADMSIAuthMode
+	sink, frameStreaming, computer, metadataEnabled := ContainerLogSink, ContainerLogFrameStreaming, Computer, KubernetesMetadataEnabled
+	tb.Cleanup(func() {
+		ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap, IsAADMSIAuthMode = routeV2, schemaV2, v2ConfigMap, aadMSIAuthMode
+		ContainerLogSink, ContainerLogFrameStreaming, Computer, KubernetesMetadataEnabled = sink, frameStreaming, computer, metadataEnabled
+	})
+	ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap, IsAADMSIAuthMode = true, true, true, false
+	KubernetesMetadataEnabled = false
+	Computer = "aks-nodepool1-00000000-vmss000000"
+	captureSink := &frameCaptureSink{fakeSink: fakeSink{connected: true}}
+	ContainerLogSink = captureSink
+	ContainerLogFrameStreaming = streaming
+	return captureSink
+}
+
+// containerLogRecords returns tail plugin records of the given number of pods
+func containerLogRecords(count int) []map[interface{}]interface{} {
+	records := make([]map[interface{}]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		records = append(records, map[interface{}]interface{}{
+			"filepath": []byte(fmt.Sprintf("/var/log/containers/web-7d4b9c8f6-%05d_default_nginx-4f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f80.log", i%50)),
+			"stream":   []byte("stdout"),
+			"log":      []byte(fmt.Sprintf("10.244.0.1 - - [01/May/2024:10:15:00 +0000] \"GET /api/orders/%d HTTP/1.1\" 200 612 \"-\" \"kube-probe/1.29\"", i)),
+			"time":     []byte(time.Date(2024, 5, 1, 10, 15, 0, i*1000, time.UTC).Format(time.RFC3339Nano)),
+		})
+	}
+	return records
+}
+
+func TestRecordFields(t *testing.T) {
+	var columns recordFields
+	columns.Set("LogMessage", "raw")
+	columns.Set("LogSource", "stdout")
+	columns.Set("LogMessage", "parsed")
+	assert.Equal(t, 2, columns.n)
+	assert.Equal(t, "parsed", columns.Get("LogMessage"))
+	assert.Equal(t, "", columns.Get("PodName"))
+	assert.Equal(t, map[string]string{"LogMessage": "parsed", "LogSource": "stdout"}, columns.Map())
+}
+
+func TestRecordFieldsBeyondMaxRecordFields(t *testing.T) {
+	var columns recordFields
+	expected := map[string]string{}
+	for i := 0; i < maxRecordFields+3; i++ {
+		key := fmt.Sprintf("Column%d", i)
+		columns.Set(key, "a")
+		expected[key] = "a"
+	}
+	columns.Set("Column1", "b")
+	columns.Set(fmt.Sprintf("Column%d", maxRecordFields+1), "b")
+	expected["Column1"], expected[fmt.Sprintf("Column%d", maxRecordFields+1)] = "b", "b"
+	assert.Equal(t, maxRecordFields+3, columns.n)
+	assert.Equal(t, "b", columns.Get(fmt.Sprintf("Column%d", maxRecordFields+1)))
+	assert.Equal(t, expected, columns.Map())
+
+	encoder := NewForwardFrameEncoder()
+	defer encoder.Release()
+	encoder.AppendRecord(time.Time{}, &columns)
+	_, _, records := readForwardEntries(t, encoder.Frame("ContainerLogV2Source"))
+	assert.Equal(t, maxRecordFields+3, len(records[0]))
+}
+
+func TestForwardFrameEncoderMatchesMsgPackEntries(t *testing.T) {
+	recordTime := time.Date(2024, 5, 1, 10, 15, 0, 123456789, time.UTC)
+	var first, second recordFields
+	first.Set("LogMessage", "a")
+	first.Set("PodNamespace", "default")
+	second.Set("LogMessage", strings.Repeat("b", 300))
+
+	encoder := NewForwardFrameEncoder()
+	defer encoder.Release()
+	encoder.AppendRecord(recordTime, &first)
+	encoder.AppendRecord(time.Time{}, &second)
+	assert.Equal(t, 2, encoder.Len())
+
+	// the header of the long tag doesnt fit in the header room, so the frame is copied
+	for _, forwardTag := range []string{"ContainerLogV2Source", strings.Repeat("t", forwardFrameHeaderRoom)} {
+		tag, times, records := readForwardEntries(t, encoder.Frame(forwardTag))
+		expectedTag, expectedTimes, expectedRecords := readForwardEntries(t, convertMsgPackEntriesToMsgpBytes(forwardTag, []MsgPackEntry{
+			{Time: recordTime, Record: first.Map()},
+			{Time: encoder.flushTime, Record: second.Map()},
+		}))
+		assert.Equal(t, expectedTag, tag)
+		assert.Equal(t, expectedTimes, times)
+		assert.Equal(t, expectedRecords, records)
+	}
+}
+
+func TestForwardFrameEncoderIsResetOnRelease(t *testing.T) {
+	var columns recordFields
+	columns.Set("LogMessage", "a")
+	encoder := NewForwardFrameEncoder()
+	encoder.AppendRecord(time.Time{}, &columns)
+	encoder.Release()
+
+	encoder = NewForwardFrameEncoder()
+	defer encoder.Release()
+	assert.Equal(t, 0, encoder.Len())
+	_, _, records := readForwardEntries(t, encoder.Frame("ContainerLogV2Source"))
+	assert.Equal(t, 0, len(records))
+}
+
+func TestPostDataHelperStreamsContainerLogFrame(t *testing.T) {
+	records := containerLogRecords(20)
+	sink := setupContainerLogFlush(t, false)
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	expectedTag, expectedTimes, expectedRecords := readForwardEntries(t, sink.lastFrame)
+	assert.Equal(t, 20, len(expectedRecords))
+	assert.False(t, sink.streamed)
+
+	sink = setupContainerLogFlush(t, true)
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	assert.True(t, sink.streamed)
+	tag, times, streamedRecords := readForwardEntries(t, sink.lastFrame)
+	assert.Equal(t, expectedTag, tag)
+	assert.Equal(t, expectedTimes, times)
+	assert.Equal(t, expectedRecords, streamedRecords)
+}
+
+func TestInitializeContainerLogFrameStreaming(t *testing.T) {
+	setupContainerLogFlush(t, false)
+	router := ContainerLogRouter
+	defer func() { ContainerLogRouter = router }()
+
+	ContainerLogSink = NewForwardSocketSink("tcp://ama:24224")
+	initializeContainerLogFrameStreaming()
+	assert.True(t, ContainerLogFrameStreaming)
+
+	ContainerLogRouter = &LogRouter{}
+	initializeContainerLogFrameStreaming()
+	assert.False(t, ContainerLogFrameStreaming, "the router reads the records of the flush")
+
+	ContainerLogRouter = nil
+	ContainerLogSink = &FailoverSink{primary: NewForwardSocketSink("tcp://ama:24224")}
+	initializeContainerLogFrameStreaming()
+	assert.False(t, ContainerLogFrameStreaming, "the failover sinks need the records")
+}
+
+// BenchmarkPostDataHelperContainerLogs flushes 1000 container log records collected as MsgPackEntry maps and streamed into the forward message
+func BenchmarkPostDataHelperContainerLogs(b *testing.B) {
+	records := containerLogRecords(1000)
+	logBytes := 0
+	for _, record := range records {
+		logBytes += len(record["log"].([]byte))
+	}
+	for _, streaming := range []bool{false, true} {
+		name := "msgpack-entries"
+		if streaming {
+			name = "streaming"
+		}
+		b.Run(name, func(b *testing.B) {
+			setupContainerLogFlush(b, streaming)
+			b.ReportAllocs()
+			b.SetBytes(int64(logBytes))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				PostDataHelper(records)
+			}
+		})
+	}
+}
+
+// BenchmarkContainerLogFrameEncoding encodes 1000 container log records into a forward message
+func BenchmarkContainerLogFrameEncoding(b *testing.B) {
+	columns := make([]recordFields, 1000)
+	for i := range columns {
+		columns[i].Set("Computer", "aks-nodepool1-00000000-vmss000000")
+		columns[i].Set("ContainerId", "4f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f80")
+		columns[i].Set("ContainerName", "nginx")
+		columns[i].Set("PodName", "web-7d4b9c8f6-xk2lp")
+		columns[i].Set("PodNamespace", "default")
+		columns[i].Set("LogMessage", fmt.Sprintf("GET /api/orders/%d HTTP/1.1 200", i))
+		columns[i].Set("LogSource", "stdout")
+		columns[i].Set("TimeGenerated", "2024-05-01T10:15:00.123456789Z")
+		columns[i].Set("KubernetesMetadata", "")
+	}
+	b.Run("msgpack-entries", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var entries []MsgPackEntry
+			for j := range columns {
+				record := columns[j].Map()
+				entries = append(entries, MsgPackEntry{Time: getEventTime(record["TimeGenerated"]), Record: record})
+			}
+			convertMsgPackEntriesToMsgpBytes("ContainerLogV2Source", entries)
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encoder := NewForwardFrameEncoder()
+			for j := range columns {
+				encoder.AppendRecord(getEventTime(columns[j].Get("TimeGenerated")), &columns[j])
+			}
+			encoder.Frame("ContainerLogV2Source")
+			encoder.Release()
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// env variables to configure the mirroring of container log batches (set from log_collection_settings.tee in the configmap)
+const ContainerLogTeeEnabledEnv = "AZMON_CONTAINER_LOG_TEE_ENABLED"
+const ContainerLogTeePercentageEnv = "AZMON_CONTAINER_LOG_TEE_PERCENTAGE"
+
+// output stream tag of the mirrored batches, the tag of the primary batch if not set
+const ContainerLogTeeTagEnv = "AZMON_CONTAINER_LOG_TEE_TAG"
+
+// unix socket (linux) or named pipe (windows) the mirrored batches are written to, the primary destination if not set
+const ContainerLogTeeSocketEnv = "AZMON_CONTAINER_LOG_TEE_SOCKET"
+
+// number of mirrored batches which can wait for the secondary destination. Batches are not mirrored while the queue is full
+const containerLogTeeQueueSize = 16
+
+// LogTee mirrors a percentage of the container log batches written to the primary destination to a secondary stream tag or socket.
+// The batches are written by a background worker over a separate connection, so the secondary destination never fails or slows down the primary
+type LogTee struct {
+	percentage float64
+	tag        string
+	namedPipe  string
+	sink       Sink
+	queue      chan []*SinkBatch
+	random     func() float64
+}
+
+// NewLogTee creates a tee which writes the mirrored batches to the sink
+func NewLogTee(percentage float64, tag string, namedPipe string, sink Sink) *LogTee {
+	return &LogTee{
+		percentage: percentage,
+		tag:        tag,
+		namedPipe:  namedPipe,
+		sink:       sink,
+		queue:      make(chan []*SinkBatch, containerLogTeeQueueSize),
+		random:     rand.Float64,
+	}
+}
+
+// Mirror queues the copies of the batches for the secondary destination if the batches are selected by the percentage.
+// Returns false if the batches were selected but couldnt be queued
+func (t *LogTee) Mirror(batches []*SinkBatch) bool {
+	if t == nil || len(batches) == 0 || t.random()*100 >= t.percentage {
+		return true
+	}
+	mirrored := make([]*SinkBatch, 0, len(batches))
+	for _, batch := range batches {
+		copied := *batch
+		if t.tag != "" {
+			copied.Tag = t.tag
+		}
+		if t.namedPipe != "" {
+			copied.NamedPipe = t.namedPipe
+		}
+		mirrored = append(mirrored, &copied)
+	}
+	select {
+	case t.queue <- mirrored:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes the queued batches to the secondary destination. Write errors are only logged & counted
+func (t *LogTee) run() {
+	for batches := range t.queue {
+		records := 0
+		for _, batch := range batches {
+			records += len(batch.Entries)
+		}
+		bts, _, err := writeBatchesToSink(t.sink, batches)
+		ContainerLogTelemetryMutex.Lock()
+		if err != nil {
+			ContainerLogsTeeErrorsCount += 1
+		} else {
+			ContainerLogsTeeBatchesCount += float64(len(batches))
+		}
+		ContainerLogTelemetryMutex.Unlock()
+		if err != nil {
+			Log("Error::tee::%s::Failed to mirror %d container log records. error: %s", t.sink.Name(), records, err.Error())
+		} else {
+			Log("Success::tee::%s::Mirrored %d container log records that was %d bytes", t.sink.Name(), records, bts)
+		}
+	}
+}
+
+// mirrorContainerLogBatches mirrors the batches which were written to the primary destination
+func mirrorContainerLogBatches(batches []*SinkBatch) {
+	if ContainerLogTee == nil {
+		return
+	}
+	if !ContainerLogTee.Mirror(batches) {
+		Log("Warn::tee::Secondary destination is behind, not mirroring %d container log batches", len(batches))
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsTeeErrorsCount += 1
+		ContainerLogTelemetryMutex.Unlock()
+	}
+}
+
+// initializeContainerLogTee creates the tee if enabled through the configmap settings
+func initializeContainerLogTee() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogTeeEnabledEnv))), "true") != 0 {
+		Log("Container log tee is disabled")
+		return
+	}
+	if !ContainerLogsRouteV2 || isODSSink(ContainerLogSink) {
+		Log("Container log tee is only supported with the v2 (ama) route, disabling it")
+		return
+	}
+	percentage, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv(ContainerLogTeePercentageEnv)), 64)
+	if err != nil || percentage <= 0 || percentage > 100 {
+		message := fmt.Sprintf("Error::tee::Container log tee percentage %s is not a number between 0 and 100, disabling the tee", os.Getenv(ContainerLogTeePercentageEnv))
+		Log(message)
+		SendException(message)
+		return
+	}
+	tag := strings.TrimSpace(os.Getenv(ContainerLogTeeTagEnv))
+	socket := strings.TrimSpace(os.Getenv(ContainerLogTeeSocketEnv))
+	if tag == "" && socket == "" {
+		Log("Container log tee is enabled but has neither a tag nor a socket, disabling it")
+		return
+	}
+
+	// the secondary destination always has its own connection, so its failures dont close the primary connection
+	var sink Sink
+	namedPipe := ""
+	if socket != "" && !IsWindows {
+		sink = NewForwardSocketSink(socket)
+	} else {
+		sink = createSinkOfType(getDefaultSinkType(ContainerLogV2), ContainerLogV2)
+		if IsWindows {
+			namedPipe = socket
+		}
+	}
+	ContainerLogTee = NewLogTee(percentage, tag, namedPipe, sink)
+	go ContainerLogTee.run()
+	Log("Container log tee enabled. percentage: %v, tag: %s, socket: %s", percentage, tag, socket)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogTeeMirror(t *testing.T) {
+	tee := NewLogTee(25, "dcr-1:Custom-Mirror", "", &fakeSink{})
+	batch := &SinkBatch{DataType: ContainerLogV2DataType, Tag: "dcr-1:Custom-ContainerLogV2", Entries: make([]MsgPackEntry, 2)}
+
+	tee.random = func() float64 { return 0.5 }
+	assert.True(t, tee.Mirror([]*SinkBatch{batch}))
+	assert.Equal(t, 0, len(tee.queue), "batches outside the percentage are not mirrored")
+
+	tee.random = func() float64 { return 0.1 }
+	assert.True(t, tee.Mirror([]*SinkBatch{batch}))
+	mirrored := <-tee.queue
+	assert.Equal(t, "dcr-1:Custom-Mirror", mirrored[0].Tag)
+	assert.Equal(t, 2, len(mirrored[0].Entries))
+	assert.Equal(t, "dcr-1:Custom-ContainerLogV2", batch.Tag, "primary batch is not modified")
+
+	for i := 0; i < containerLogTeeQueueSize; i++ {
+		assert.True(t, tee.Mirror([]*SinkBatch{batch}))
+	}
+	assert.False(t, tee.Mirror([]*SinkBatch{batch}), "batches are not mirrored while the queue is full")
+
+	var nilTee *LogTee
+	assert.True(t, nilTee.Mirror([]*SinkBatch{batch}))
+}
+
+func TestLogTeeRunCountsErrors(t *testing.T) {
+	sink := &fakeSink{writeErrs: []error{nil, newSinkWriteError(errors.New("broken pipe")), newSinkWriteError(errors.New("broken pipe"))}}
+	tee := NewLogTee(100, "", "mirror-pipe", sink)
+	tee.random = func() float64 { return 0 }
+	ContainerLogsTeeBatchesCount = 0
+	ContainerLogsTeeErrorsCount = 0
+
+	assert.True(t, tee.Mirror([]*SinkBatch{{Tag: "primary", Entries: make([]MsgPackEntry, 1)}}))
+	assert.True(t, tee.Mirror([]*SinkBatch{{Tag: "primary", Entries: make([]MsgPackEntry, 1)}}))
+	close(tee.queue)
+	tee.run()
+
+	assert.Equal(t, "primary", sink.lastBatches[0].Tag)
+	assert.Equal(t, "mirror-pipe", sink.lastBatches[0].NamedPipe)
+	assert.Equal(t, float64(1), ContainerLogsTeeBatchesCount)
+	assert.Equal(t, float64(1), ContainerLogsTeeErrorsCount)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/extension"
+)
+
+// interval to refresh the namespace filtering settings of the ContainerInsights extension (dataCollectionSettings of the DCR)
+const defaultDataCollectionNamespaceFilterRefreshIntervalSeconds = 300
+
+// namespace filtering modes of the dataCollectionSettings
+const namespaceFilteringModeOff = "off"
+const namespaceFilteringModeInclude = "include"
+const namespaceFilteringModeExclude = "exclude"
+
+// DataCollectionNamespaceFilter is the namespaceFilteringMode & namespaces of the DCR dataCollectionSettings.
+// It is the same filtering the perf & containerinventory input plugins apply through IsExcludeResourceItem
+type DataCollectionNamespaceFilter struct {
+	mode       string
+	namespaces map[string]bool
+}
+
+var (
+	// ContainerLogDataCollectionNamespaceFilter is the cached DCR namespace filter, nil if the DCR has no namespace filtering
+	ContainerLogDataCollectionNamespaceFilter *DataCollectionNamespaceFilter
+	// DataCollectionNamespaceFilterMutex read and write mutex access to the ContainerLogDataCollectionNamespaceFilter
+	DataCollectionNamespaceFilterMutex = &sync.RWMutex{}
+	// DataCollectionNamespaceFilterRefreshTicker to refresh the DCR namespace filter
+	DataCollectionNamespaceFilterRefreshTicker *time.Ticker
+)
+
+// NewDataCollectionNamespaceFilter creates the filter, or returns nil if the mode & namespaces dont filter any namespace
+func NewDataCollectionNamespaceFilter(mode string, namespaces []string) *DataCollectionNamespaceFilter {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != namespaceFilteringModeInclude && mode != namespaceFilteringModeExclude {
+		return nil
+	}
+	f := &DataCollectionNamespaceFilter{mode: mode, namespaces: make(map[string]bool)}
+	for _, namespace := range namespaces {
+		namespace = strings.ToLower(strings.TrimSpace(namespace))
+		if namespace != "" {
+			f.namespaces[namespace] = true
+		}
+	}
+	if len(f.namespaces) == 0 {
+		return nil
+	}
+	return f
+}
+
+// Excludes returns true if the logs of the pod are not collected. The ama-logs pods are never excluded.
+// A nil filter doesnt exclude any pod
+func (f *DataCollectionNamespaceFilter) Excludes(k8sPodName string, k8sNamespace string) bool {
+	if f == nil || k8sNamespace == "" {
+		return false
+	}
+	if strings.HasPrefix(k8sPodName, "ama-logs") && k8sNamespace == "kube-system" {
+		return false
+	}
+	listed := f.namespaces[strings.ToLower(k8sNamespace)]
+	if f.mode == namespaceFilteringModeExclude {
+		return listed
+	}
+	return !listed
+}
+
+func getDataCollectionNamespaceFilter() *DataCollectionNamespaceFilter {
+	DataCollectionNamespaceFilterMutex.RLock()
+	defer DataCollectionNamespaceFilterMutex.RUnlock()
+	return ContainerLogDataCollectionNamespaceFilter
+}
+
+// updateDataCollectionNamespaceFilter periodically refreshes the namespace filter from the ContainerInsights extension settings
+func updateDataCollectionNamespaceFilter() {
+	for ; true; <-DataCollectionNamespaceFilterRefreshTicker.C {
+		e := extension.GetInstance(FLBLogger, ContainerType)
+		mode := namespaceFilteringModeOff
+		var namespaces []string
+		if e.IsDataCollectionSettingsConfigured() {
+			mode = e.GetNamespaceFilteringModeForDataCollection()
+			namespaces = e.GetNamespacesForDataCollection()
+		}
+		filter := NewDataCollectionNamespaceFilter(mode, namespaces)
+		DataCollectionNamespaceFilterMutex.Lock()
+		ContainerLogDataCollectionNamespaceFilter = filter
+		DataCollectionNamespaceFilterMutex.Unlock()
+		Log("updateDataCollectionNamespaceFilter::Info: using data collection filtering mode: %s for namespaces: %v", mode, namespaces)
+	}
+}
+
+// initializeDataCollectionNamespaceFilter starts refreshing the DCR namespace filter when the agent gets its settings from the extension
+func initializeDataCollectionNamespaceFilter() {
+	if !IsAADMSIAuthMode || IsGenevaLogsIntegrationEnabled {
+		Log("Container log DCR namespace filtering is disabled")
+		return
+	}
+	Log("DataCollectionNamespaceFilterRefreshIntervalSeconds = %d \n", defaultDataCollectionNamespaceFilterRefreshIntervalSeconds)
+	DataCollectionNamespaceFilterRefreshTicker = time.NewTicker(time.Second * time.Duration(defaultDataCollectionNamespaceFilterRefreshIntervalSeconds))
+	go updateDataCollectionNamespaceFilter()
+}
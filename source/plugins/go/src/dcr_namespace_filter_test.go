@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataCollectionNamespaceFilter(t *testing.T) {
+	assert.Nil(t, NewDataCollectionNamespaceFilter("off", []string{"default"}))
+	assert.Nil(t, NewDataCollectionNamespaceFilter("include", nil))
+
+	exclude := NewDataCollectionNamespaceFilter("Exclude", []string{"Batch", "kube-system"})
+	assert.True(t, exclude.Excludes("job-1", "batch"))
+	assert.False(t, exclude.Excludes("web-1", "default"))
+	assert.False(t, exclude.Excludes("ama-logs-xyz12", "kube-system"))
+	assert.True(t, exclude.Excludes("coredns-abc", "kube-system"))
+
+	include := NewDataCollectionNamespaceFilter("include", []string{"default"})
+	assert.False(t, include.Excludes("web-1", "default"))
+	assert.True(t, include.Excludes("job-1", "batch"))
+	assert.False(t, include.Excludes("ama-logs-xyz12", "kube-system"))
+
+	var nilFilter *DataCollectionNamespaceFilter
+	assert.False(t, nilFilter.Excludes("job-1", "batch"))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the batches delivered by a flush which is retried are remembered for an hour, the retries of fluent bit are well within it
+const deliveredBatchesTTL = time.Hour
+
+// max number of delivered batches remembered, the oldest are forgotten first
+const maxDeliveredBatches = 10000
+
+// DeliveredBatchTracker remembers the batches which were delivered by a flush that is retried since some other of its batches failed.
+// Fluent Bit resends the whole chunk, so the batches delivered by the earlier attempt are skipped instead of being sent again
+type DeliveredBatchTracker struct {
+	ttl        time.Duration
+	maxBatches int
+	mutex      sync.Mutex
+	// delivered batches by their fingerprint
+	delivered map[uint64]deliveredBatch
+}
+
+type deliveredBatch struct {
+	deliveredTime time.Time
+	// number of leading records delivered, less than the records of the batch if its write failed midway
+	records int
+}
+
+// NewDeliveredBatchTracker creates a tracker which remembers at most maxBatches batches for ttl
+func NewDeliveredBatchTracker(ttl time.Duration, maxBatches int) *DeliveredBatchTracker {
+	return &DeliveredBatchTracker{
+		ttl:        ttl,
+		maxBatches: maxBatches,
+		delivered:  make(map[uint64]deliveredBatch),
+	}
+}
+
+// Add remembers the batches delivered by a flush which is retried
+func (t *DeliveredBatchTracker) Add(batches []*SinkBatch) {
+	if len(batches) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.expireLocked(now)
+	for _, batch := range batches {
+		t.delivered[getSinkBatchFingerprint(batch)] = deliveredBatch{deliveredTime: now, records: len(batch.Entries)}
+	}
+}
+
+// AddPartial remembers the leading records of a batch which were delivered before its write failed
+func (t *DeliveredBatchTracker) AddPartial(batch *SinkBatch, deliveredRecords int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.expireLocked(now)
+	t.delivered[getSinkBatchFingerprint(batch)] = deliveredBatch{deliveredTime: now, records: deliveredRecords}
+}
+
+// Pending returns the batches which werent delivered by an earlier attempt of the flush and the number of records skipped.
+// Batches delivered in part are returned with the records which werent delivered. The skipped batches are forgotten,
+// so a later flush of the same records is delivered
+func (t *DeliveredBatchTracker) Pending(batches []*SinkBatch) ([]*SinkBatch, int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.delivered) == 0 {
+		return batches, 0
+	}
+	t.expireLocked(time.Now())
+	pending := make([]*SinkBatch, 0, len(batches))
+	skippedRecords := 0
+	for _, batch := range batches {
+		fingerprint := getSinkBatchFingerprint(batch)
+		if delivered, ok := t.delivered[fingerprint]; ok {
+			delete(t.delivered, fingerprint)
+			if delivered.records < len(batch.Entries) {
+				pending = append(pending, getUndeliveredSinkBatch(batch, delivered.records))
+				skippedRecords += delivered.records
+				continue
+			}
+			skippedRecords += len(batch.Entries)
+			continue
+		}
+		pending = append(pending, batch)
+	}
+	return pending, skippedRecords
+}
+
+// Len returns the number of delivered batches remembered
+func (t *DeliveredBatchTracker) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.delivered)
+}
+
+func (t *DeliveredBatchTracker) expireLocked(now time.Time) {
+	for fingerprint, delivered := range t.delivered {
+		if now.Sub(delivered.deliveredTime) >= t.ttl {
+			delete(t.delivered, fingerprint)
+		}
+	}
+	if len(t.delivered) < t.maxBatches {
+		return
+	}
+	// keep room for the batches being added by forgetting the oldest half
+	fingerprints := make([]uint64, 0, len(t.delivered))
+	for fingerprint := range t.delivered {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return t.delivered[fingerprints[i]].deliveredTime.Before(t.delivered[fingerprints[j]].deliveredTime)
+	})
+	for _, fingerprint := range fingerprints[:len(fingerprints)-t.maxBatches/2] {
+		delete(t.delivered, fingerprint)
+	}
+}
+
+// getSinkBatchFingerprint hashes the destination and the records of the batch, the columns of each record are hashed in key order
+func getSinkBatchFingerprint(batch *SinkBatch) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(batch.DataType))
+	h.Write([]byte{0})
+	h.Write([]byte(batch.Tag))
+	h.Write([]byte{0})
+	h.Write([]byte(batch.NamedPipe))
+	h.Write([]byte{0})
+	if batch.Frame != nil {
+		h.Write(batch.Frame)
+		return h.Sum64()
+	}
+	var timestamp [8]byte
+	var keys []string
+	for _, entry := range batch.Entries {
+		binary.BigEndian.PutUint64(timestamp[:], uint64(entry.Time.UnixNano()))
+		h.Write(timestamp[:])
+		keys = keys[:0]
+		for key := range entry.Record {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(entry.Record[key]))
+			h.Write([]byte{0})
+		}
+	}
+	return h.Sum64()
+}
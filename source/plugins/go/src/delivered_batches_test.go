@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func deliveredBatchesTestBatch(tag string, messages ...string) *SinkBatch {
+	batch := &SinkBatch{DataType: ContainerLogV2DataType, Tag: tag}
+	for _, message := range messages {
+		batch.Entries = append(batch.Entries, MsgPackEntry{
+			Time:   time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC),
+			Record: map[string]string{"LogMessage": message, "LogSource": "stdout"},
+		})
+	}
+	return batch
+}
+
+func TestDeliveredBatchTrackerSkipsDeliveredBatchesOnce(t *testing.T) {
+	tracker := NewDeliveredBatchTracker(time.Minute, 100)
+	tracker.Add([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a", "b")})
+
+	// the batches of the retry are rebuilt from the resent chunk, so they are matched by their content
+	failed := deliveredBatchesTestBatch("dcr-2", "a", "b")
+	pending, skippedRecords := tracker.Pending([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a", "b"), failed})
+	assert.Equal(t, []*SinkBatch{failed}, pending)
+	assert.Equal(t, 2, skippedRecords)
+	assert.Equal(t, 0, tracker.Len())
+
+	pending, skippedRecords = tracker.Pending([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a", "b")})
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, 0, skippedRecords)
+}
+
+func TestDeliveredBatchTrackerReturnsTheUndeliveredRecords(t *testing.T) {
+	tracker := NewDeliveredBatchTracker(time.Minute, 100)
+	tracker.AddPartial(deliveredBatchesTestBatch("dcr-1", "a", "b", "c"), 2)
+
+	pending, skippedRecords := tracker.Pending([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a", "b", "c")})
+	assert.Equal(t, 2, skippedRecords)
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, "dcr-1", pending[0].Tag)
+	assert.Equal(t, deliveredBatchesTestBatch("dcr-1", "c").Entries, pending[0].Entries)
+}
+
+func TestDeliveredBatchTrackerForgetsExpiredBatches(t *testing.T) {
+	tracker := NewDeliveredBatchTracker(time.Millisecond, 100)
+	tracker.Add([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a")})
+	time.Sleep(5 * time.Millisecond)
+	pending, _ := tracker.Pending([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", "a")})
+	assert.Equal(t, 1, len(pending))
+}
+
+func TestDeliveredBatchTrackerIsBounded(t *testing.T) {
+	tracker := NewDeliveredBatchTracker(time.Minute, 4)
+	for i := 0; i < 10; i++ {
+		tracker.Add([]*SinkBatch{deliveredBatchesTestBatch("dcr-1", strings.Repeat("a", i+1))})
+	}
+	assert.True(t, tracker.Len() <= 4)
+}
+
+// setupMultiTenantContainerLogFlush configures PostDataHelper to write the records of the default namespace to the dcr-default stream,
+// the records of the other namespaces are written to the default stream
+func setupMultiTenantContainerLogFlush(t *testing.T, sink Sink) []map[interface{}]interface{} {
+	setupContainerLogFlush(t, false)
+	multiTenancy, namespaceStreamIds, delivered := IsAzMonMultiTenancyLogCollectionEnabled, NamespaceStreamIdsMap, ContainerLogDeliveredBatches
+	t.Cleanup(func() {
+		IsAzMonMultiTenancyLogCollectionEnabled, NamespaceStreamIdsMap, ContainerLogDeliveredBatches = multiTenancy, namespaceStreamIds, delivered
+	})
+	IsAzMonMultiTenancyLogCollectionEnabled = true
+	NamespaceStreamIdsMap = map[string][]string{"default": {"dcr-default"}}
+	ContainerLogDeliveredBatches = NewDeliveredBatchTracker(time.Minute, 100)
+	ContainerLogSink = sink
+
+	records := containerLogRecords(2)
+	records[1]["filepath"] = []byte(strings.Replace(string(records[1]["filepath"].([]byte)), "_default_", "_kube-system_", 1))
+	return records
+}
+
+func TestPostDataHelperRetrySendsOnlyTheFailedBatches(t *testing.T) {
+	sink := &fakeSink{connected: true, writeErrs: []error{nil, &SinkError{Op: "write", Retriable: false, Err: errors.New("stream opted out")}}}
+	records := setupMultiTenantContainerLogFlush(t, sink)
+
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+	assert.Equal(t, 2, len(sink.lastBatches))
+	failed := sink.lastBatches[1]
+
+	sink.lastBatches = nil
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	assert.Equal(t, 1, len(sink.lastBatches))
+	assert.Equal(t, failed.Tag, sink.lastBatches[0].Tag)
+	assert.Equal(t, failed.Entries, sink.lastBatches[0].Entries)
+}
+
+func TestPostDataHelperRetrySendsOnlyTheUndeliveredRecords(t *testing.T) {
+	setupContainerLogFlush(t, false)
+	delivered := ContainerLogDeliveredBatches
+	defer func() { ContainerLogDeliveredBatches = delivered }()
+	ContainerLogDeliveredBatches = NewDeliveredBatchTracker(time.Minute, 100)
+	sink := &fakeSink{connected: true, writeErrs: []error{&SinkError{Op: "write", StatusCode: http.StatusInternalServerError, Retriable: true, DeliveredRecords: 2, Err: errors.New("internal server error")}}}
+	ContainerLogSink = sink
+	records := containerLogRecords(3)
+
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	assert.Equal(t, 2, len(sink.lastBatches))
+	assert.Equal(t, sink.lastBatches[0].Entries[2:], sink.lastBatches[1].Entries)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// env variable of the time of the entries of the forward messages. record (default) uses the time of each record and the flush time
+// for the records without one, flush uses the flush time for all the entries
+const ForwardEventTimeSourceEnv = "AZMON_FORWARD_EVENT_TIME_SOURCE"
+
+const (
+	ForwardEventTimeSourceRecord = "record"
+	ForwardEventTimeSourceFlush  = "flush"
+)
+
+// size of the fluent forward EventTime ext type (fixext 8 header, ext type 0, 4 bytes of seconds & 4 bytes of nanoseconds)
+const eventTimeSize = 10
+
+// fields with the time of the records of each data type
+var (
+	collectionTimeFields        = []string{"CollectionTime"}
+	inputPluginRecordTimeFields = []string{"TimeGenerated", "CollectionTime"}
+)
+
+// ForwardEventTimeFromRecord is false if the entries of the forward messages use the flush time
+var ForwardEventTimeFromRecord = true
+
+// getRecordEventTime returns the time of the first field of the record holding an RFC3339 time, zero if none does or the flush time is used
+func getRecordEventTime(record map[string]string, fields ...string) time.Time {
+	if !ForwardEventTimeFromRecord {
+		return time.Time{}
+	}
+	for _, field := range fields {
+		if recordTime := getEventTime(record[field]); !recordTime.IsZero() {
+			return recordTime
+		}
+	}
+	return time.Time{}
+}
+
+// getEventTime returns the RFC3339 time, zero if the value isnt one or the flush time is used
+func getEventTime(value string) time.Time {
+	if !ForwardEventTimeFromRecord || value == "" {
+		return time.Time{}
+	}
+	recordTime, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return recordTime
+}
+
+// appendEventTime appends the time as the fluent forward EventTime ext type
+func appendEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// initializeForwardEventTime reads the source of the time of the forward message entries
+func initializeForwardEventTime() {
+	source := strings.ToLower(strings.TrimSpace(os.Getenv(ForwardEventTimeSourceEnv)))
+	switch source {
+	case "", ForwardEventTimeSourceRecord:
+		ForwardEventTimeFromRecord = true
+	case ForwardEventTimeSourceFlush:
+		ForwardEventTimeFromRecord = false
+	default:
+		message := fmt.Sprintf("Error::Invalid %s value %s, using the time of the records", ForwardEventTimeSourceEnv, source)
+		Log(message)
+		SendException(message)
+		ForwardEventTimeFromRecord = true
+	}
+	Log("Forward event time from record: %v", ForwardEventTimeFromRecord)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// readForwardEntries returns the tag and the EventTimes and records of the entries of a [tag, entries] forward message
+func readForwardEntries(t *testing.T, frame []byte) (string, []time.Time, []map[string]interface{}) {
+	_, rest, err := msgp.ReadArrayHeaderBytes(frame)
+	assert.NoError(t, err)
+	tag, rest, err := msgp.ReadStringBytes(rest)
+	assert.NoError(t, err)
+	entries, rest, err := msgp.ReadArrayHeaderBytes(rest)
+	assert.NoError(t, err)
+	var times []time.Time
+	var records []map[string]interface{}
+	for i := uint32(0); i < entries; i++ {
+		_, rest, err = msgp.ReadArrayHeaderBytes(rest)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xd7, 0x00}, rest[:2], "entry time is an EventTime ext")
+		seconds, nanoseconds := binary.BigEndian.Uint32(rest[2:6]), binary.BigEndian.Uint32(rest[6:10])
+		times = append(times, time.Unix(int64(seconds), int64(nanoseconds)))
+		var record map[string]interface{}
+		record, rest, err = msgp.ReadMapStrIntfBytes(rest[eventTimeSize:], nil)
+		assert.NoError(t, err)
+		records = append(records, record)
+	}
+	assert.Equal(t, 0, len(rest))
+	return tag, times, records
+}
+
+func TestConvertMsgPackEntriesUsesEventTime(t *testing.T) {
+	recordTime := time.Date(2024, 5, 1, 10, 15, 0, 123456789, time.UTC)
+	before := time.Now()
+	frame := convertMsgPackEntriesToMsgpBytes("ContainerLogV2Source", []MsgPackEntry{
+		{Time: recordTime, Record: map[string]string{"LogMessage": "a"}},
+		{Record: map[string]string{"LogMessage": "b"}},
+	})
+
+	_, times, _ := readForwardEntries(t, frame)
+	assert.Equal(t, 2, len(times))
+	assert.True(t, recordTime.Equal(times[0]), "nanoseconds of the record time are kept")
+	assert.False(t, times[1].Before(before.Truncate(time.Second)), "entries without a time use the flush time")
+}
+
+func TestGetRecordEventTime(t *testing.T) {
+	defer func() { ForwardEventTimeFromRecord = true }()
+	record := map[string]string{"TimeGenerated": "not a time", "CollectionTime": "2024-05-01T10:15:00.5Z"}
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 15, 0, 500000000, time.UTC), getRecordEventTime(record, inputPluginRecordTimeFields...))
+	assert.True(t, getRecordEventTime(record, "LogEntryTimeStamp").IsZero())
+	assert.True(t, getEventTime("").IsZero())
+
+	t.Setenv(ForwardEventTimeSourceEnv, "flush")
+	initializeForwardEventTime()
+	assert.True(t, getRecordEventTime(record, inputPluginRecordTimeFields...).IsZero())
+	assert.True(t, getEventTime("2024-05-01T10:15:00.5Z").IsZero())
+}
@@ -12,6 +12,9 @@ import (
 const FluentSocketName = "/var/run/mdsd-ci/default_fluent.socket"
 const FluentSocketNamePrometheusSidecar = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
 
+// FluentSocketAddress overrides the socket used for the config queries if set
+var FluentSocketAddress string
+
 func getExtensionConfigResponse(jsonBytes []byte) ([]byte, error) {
 	var data []byte
 	enc := codec.NewEncoderBytes(&data, new(codec.MsgpackHandle))
@@ -26,6 +29,9 @@ func getExtensionConfigResponse(jsonBytes []byte) ([]byte, error) {
 		(genevaLogsIntegrationEnabled != "" && strings.Compare(strings.ToLower(genevaLogsIntegrationEnabled), "true") == 0) {
 		fs.sockAddress = FluentSocketNamePrometheusSidecar
 	}
+	if FluentSocketAddress != "" {
+		fs.sockAddress = FluentSocketAddress
+	}
 	responseBytes, err := FluentSocketWriter.writeAndRead(fs, data)
 	defer FluentSocketWriter.disconnect(fs)
 	if err != nil {
@@ -6,6 +6,9 @@ import (
 	winio "github.com/Microsoft/go-winio"
 )
 
+// FluentSocketAddress overrides the socket used for the config queries on linux, the config is queried over the named pipe on windows
+var FluentSocketAddress string
+
 func getExtensionConfigResponse(jsonBytes []byte) ([]byte, error) {
 	pipePath := "\\\\.\\\\pipe\\\\CAgentStream_CloudAgentInfo_AzureMonitorAgent"
 	config_namedpipe, err := winio.DialPipe(pipePath, nil)
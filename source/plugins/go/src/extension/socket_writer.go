@@ -43,8 +43,13 @@ func init() {
 
 // end mocking boilerplate
 
+// DialFluentSocket connects to the agent's fluent endpoint. The plugin overrides it to support tcp & tls endpoints
+var DialFluentSocket = func(address string) (net.Conn, error) {
+	return net.Dial("unix", address)
+}
+
 func (FluentSocketWriterImpl) connect(fs *FluentSocket) error {
-	c, err := net.Dial("unix", fs.sockAddress)
+	c, err := DialFluentSocket(fs.sockAddress)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variables to configure the failover of container logs from the agent (mdsd/ama) route to the direct ODS route
+const ContainerLogsFailoverEnabledEnv = "AZMON_CONTAINER_LOGS_FAILOVER_ENABLED"
+
+// number of consecutive failed writes to the agent after which the container logs are sent to ODS
+const ContainerLogsFailoverThresholdEnv = "AZMON_CONTAINER_LOGS_FAILOVER_THRESHOLD"
+
+// interval at which the agent is checked while failed over, the container logs are sent to the agent again once it accepts connections
+const ContainerLogsFailbackIntervalSecondsEnv = "AZMON_CONTAINER_LOGS_FAILBACK_INTERVAL_SECONDS"
+
+const defaultContainerLogsFailoverThreshold = 5
+const defaultContainerLogsFailbackIntervalSeconds = 60
+
+const RouteSwitchEventCategory = "container.azm.ms/routeswitch"
+
+// RouteSwitchEvent records a failover to or a failback from the secondary sink
+type RouteSwitchEvent struct {
+	From                string
+	To                  string
+	ConsecutiveFailures int
+	Time                time.Time
+}
+
+// FailoverSink writes to the primary sink and switches to the secondary sink after threshold consecutive failures of the primary.
+// While failed over, the primary is reconnected every failbackInterval and used again once connected
+type FailoverSink struct {
+	primary          Sink
+	secondary        Sink
+	threshold        int
+	failbackInterval time.Duration
+	mutex            sync.Mutex
+	// consecutiveFailures of the primary since its last successful write
+	consecutiveFailures int
+	failedOver          bool
+	lastFailbackCheck   time.Time
+	// events of the switches since the last DrainEvents
+	events []RouteSwitchEvent
+	now    func() time.Time
+}
+
+// NewFailoverSink creates a failover sink from the primary to the secondary sink
+func NewFailoverSink(primary Sink, secondary Sink, threshold int, failbackInterval time.Duration) *FailoverSink {
+	return &FailoverSink{
+		primary:          primary,
+		secondary:        secondary,
+		threshold:        threshold,
+		failbackInterval: failbackInterval,
+		now:              time.Now,
+	}
+}
+
+func (s *FailoverSink) Name() string {
+	return s.active().Name()
+}
+
+func (s *FailoverSink) active() Sink {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failedOver {
+		return s.secondary
+	}
+	return s.primary
+}
+
+// IsFailedOver returns true while the secondary sink is used
+func (s *FailoverSink) IsFailedOver() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failedOver
+}
+
+// Connect connects the primary sink, or the secondary sink if failed over (or failing over because the primary couldnt be connected)
+func (s *FailoverSink) Connect() error {
+	if s.IsFailedOver() {
+		return s.secondary.Connect()
+	}
+	if err := s.primary.Connect(); err != nil {
+		if !s.recordFailure() {
+			return err
+		}
+		return s.secondary.Connect()
+	}
+	return nil
+}
+
+func (s *FailoverSink) Write(batch *SinkBatch) (int, error) {
+	if s.IsFailedOver() && !s.tryFailback() {
+		bts, err := s.secondary.Write(batch)
+		if err == nil {
+			ContainerLogTelemetryMutex.Lock()
+			ContainerLogsFailoverRecordsCount += float64(len(batch.Entries))
+			ContainerLogTelemetryMutex.Unlock()
+		}
+		return bts, err
+	}
+	bts, err := s.primary.Write(batch)
+	if err == nil {
+		s.mutex.Lock()
+		s.consecutiveFailures = 0
+		s.mutex.Unlock()
+		return bts, nil
+	}
+	if !s.recordFailure() {
+		return bts, err
+	}
+	s.primary.Close()
+	return s.Write(batch)
+}
+
+// recordFailure counts a failure of the primary and fails over once the threshold is reached. Returns true if failed over
+func (s *FailoverSink) recordFailure() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.consecutiveFailures += 1
+	if s.failedOver || s.consecutiveFailures < s.threshold {
+		return s.failedOver
+	}
+	s.failedOver = true
+	s.lastFailbackCheck = s.now()
+	s.switched(s.primary.Name(), s.secondary.Name())
+	return true
+}
+
+// tryFailback reconnects the primary if the failback interval passed and switches back to it once connected
+func (s *FailoverSink) tryFailback() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	if now.Sub(s.lastFailbackCheck) < s.failbackInterval {
+		return false
+	}
+	s.lastFailbackCheck = now
+	if !s.primary.IsHealthy() {
+		if err := s.primary.Connect(); err != nil {
+			Log("Info::failover::%s is still unavailable, staying on %s. error: %s", s.primary.Name(), s.secondary.Name(), err.Error())
+			return false
+		}
+	}
+	s.failedOver = false
+	s.consecutiveFailures = 0
+	s.switched(s.secondary.Name(), s.primary.Name())
+	return true
+}
+
+// switched records a route switch, must be called with the mutex held
+func (s *FailoverSink) switched(from string, to string) {
+	event := RouteSwitchEvent{From: from, To: to, ConsecutiveFailures: s.consecutiveFailures, Time: s.now()}
+	s.events = append(s.events, event)
+	Log("Warn::failover::%s", event.Message())
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsRouteSwitchesByRoute[to] += 1
+	ContainerLogTelemetryMutex.Unlock()
+	if TelemetryClient != nil {
+		go SendEvent("ContainerLogsRouteSwitch", map[string]string{"From": from, "To": to, "ConsecutiveFailures": strconv.Itoa(event.ConsecutiveFailures)})
+	}
+}
+
+func (s *FailoverSink) IsHealthy() bool {
+	return s.active().IsHealthy()
+}
+
+func (s *FailoverSink) Close() {
+	s.primary.Close()
+	s.secondary.Close()
+}
+
+// Active returns the sink currently written to
+func (s *FailoverSink) Active() Sink {
+	return s.active()
+}
+
+// DrainEvents returns the route switches since the last call
+func (s *FailoverSink) DrainEvents() []RouteSwitchEvent {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+// Message of the KubeMonAgentEvents record of the event
+func (event *RouteSwitchEvent) Message() string {
+	if event.ConsecutiveFailures > 0 {
+		return fmt.Sprintf("Container logs switched from %s to %s after %d consecutive failures", event.From, event.To, event.ConsecutiveFailures)
+	}
+	return fmt.Sprintf("Container logs switched back from %s to %s", event.From, event.To)
+}
+
+// getRouteSwitchEventRecords returns the KubeMonAgentEvents records of the container log route switches since the last flush
+func getRouteSwitchEventRecords(collectionTime string) []laKubeMonAgentEvents {
+	failoverSink, ok := ContainerLogSink.(*FailoverSink)
+	if !ok {
+		return nil
+	}
+	var records []laKubeMonAgentEvents
+	for _, event := range failoverSink.DrainEvents() {
+		tagJson, err := json.Marshal(KubeMonAgentEventTags{
+			FirstOccurrence: event.Time.UTC().Format(time.RFC3339),
+			LastOccurrence:  event.Time.UTC().Format(time.RFC3339),
+			Count:           1,
+		})
+		if err != nil {
+			message := fmt.Sprintf("Error while Marshalling route switch event tags: %s", err.Error())
+			Log(message)
+			SendException(message)
+			continue
+		}
+		level := KubeMonAgentEventInfo
+		if event.ConsecutiveFailures > 0 {
+			level = KubeMonAgentEventWarning
+		}
+		records = append(records, laKubeMonAgentEvents{
+			Computer:       Computer,
+			CollectionTime: collectionTime,
+			Category:       RouteSwitchEventCategory,
+			Level:          level,
+			ClusterId:      ResourceID,
+			ClusterName:    ResourceName,
+			Message:        event.Message(),
+			Tags:           fmt.Sprintf("%s", tagJson),
+		})
+	}
+	return records
+}
+
+// initializeContainerLogsFailover wraps the container log sink with a failover to ODS if enabled through the env settings.
+// Failover is disabled with multi-tenancy or routing, since the ODS route only posts to the default workspace
+func initializeContainerLogsFailover() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogsFailoverEnabledEnv))), "true") != 0 {
+		Log("Container logs failover is disabled")
+		return
+	}
+	if !ContainerLogsRouteV2 || ContainerLogSink == nil || isODSSink(ContainerLogSink) {
+		Log("Container logs failover is only supported with the v2 (ama) route, disabling it")
+		return
+	}
+	if IsGenevaLogsIntegrationEnabled || OMSEndpoint == "" {
+		Log("Container logs failover requires a log analytics workspace, disabling it")
+		return
+	}
+	if IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode {
+		// the ODS route posts to the default workspace, which would send the logs of the tenants to it
+		Log("Container logs failover isnt supported with multi-tenancy, disabling it")
+		return
+	}
+	if ContainerLogRouter != nil {
+		// the ODS route posts to the default workspace, which would send the records routed to other streams to it
+		Log("Container logs failover isnt supported with container log routing, disabling it")
+		return
+	}
+	threshold, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogsFailoverThresholdEnv)))
+	if err != nil || threshold <= 0 {
+		threshold = defaultContainerLogsFailoverThreshold
+	}
+	failbackIntervalSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogsFailbackIntervalSecondsEnv)))
+	if err != nil || failbackIntervalSeconds <= 0 {
+		failbackIntervalSeconds = defaultContainerLogsFailbackIntervalSeconds
+	}
+
+	// the ODS route needs the http client & with AAD MSI auth the ingestion token, which only exist for the windows or ODS routes
+	if HTTPClient.Transport == nil {
+		CreateHTTPClient()
+	}
+	if IsAADMSIAuthMode && IngestionAuthTokenRefreshTicker == nil {
+		IngestionAuthTokenRefreshTicker = time.NewTicker(time.Second * time.Duration(defaultIngestionAuthTokenRefreshIntervalSeconds))
+		go refreshIngestionAuthToken()
+	}
+
+	ContainerLogSink = NewFailoverSink(ContainerLogSink, NewODSHTTPSink(), threshold, time.Duration(failbackIntervalSeconds)*time.Second)
+	Log("Container logs failover enabled. threshold: %d, failback interval: %ds", threshold, failbackIntervalSeconds)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type namedFakeSink struct {
+	fakeSink
+	name string
+}
+
+func (s *namedFakeSink) Name() string { return s.name }
+
+func TestFailoverSinkFailsOverAndBack(t *testing.T) {
+	primary := &namedFakeSink{name: "mdsd", fakeSink: fakeSink{connected: true}}
+	secondary := &namedFakeSink{name: "ods", fakeSink: fakeSink{connected: true}}
+	s := NewFailoverSink(primary, secondary, 2, time.Minute)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	batch := &SinkBatch{Entries: make([]MsgPackEntry, 3)}
+
+	primary.writeErrs = []error{newSinkWriteError(errors.New("broken pipe"))}
+	_, err := s.Write(batch)
+	assert.Error(t, err, "failures below the threshold are returned")
+	assert.Equal(t, "mdsd", s.Name())
+
+	primary.writeErrs = []error{newSinkWriteError(errors.New("broken pipe"))}
+	bts, err := s.Write(batch)
+	assert.NoError(t, err, "batch is written to the secondary once failed over")
+	assert.Equal(t, 3, bts)
+	assert.Equal(t, "ods", s.Name())
+	assert.Equal(t, 1, secondary.writes)
+
+	primary.connectErr = errors.New("no such file")
+	now = now.Add(2 * time.Minute)
+	_, err = s.Write(batch)
+	assert.NoError(t, err)
+	assert.True(t, s.IsFailedOver(), "stays failed over while the primary cant be connected")
+
+	primary.connectErr = nil
+	now = now.Add(30 * time.Second)
+	s.Write(batch)
+	assert.True(t, s.IsFailedOver(), "primary is not checked before the failback interval")
+	now = now.Add(time.Minute)
+	_, err = s.Write(batch)
+	assert.NoError(t, err)
+	assert.False(t, s.IsFailedOver())
+	assert.Equal(t, 3, secondary.writes)
+
+	events := s.DrainEvents()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "Container logs switched from mdsd to ods after 2 consecutive failures", events[0].Message())
+	assert.Equal(t, "Container logs switched back from ods to mdsd", events[1].Message())
+	assert.Empty(t, s.DrainEvents())
+}
+
+func TestFailoverSinkFailsOverOnConnectErrors(t *testing.T) {
+	primary := &namedFakeSink{name: "mdsd", fakeSink: fakeSink{connectErr: errors.New("connection refused")}}
+	secondary := &namedFakeSink{name: "ods"}
+	s := NewFailoverSink(primary, secondary, 2, time.Minute)
+
+	_, err := writeToSink(s, &SinkBatch{Entries: make([]MsgPackEntry, 1)})
+	assert.True(t, IsSinkConnectError(err))
+	bts, err := writeToSink(s, &SinkBatch{Entries: make([]MsgPackEntry, 1)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bts)
+	assert.Equal(t, 1, secondary.writes)
+}
+
+func TestInitializeContainerLogsFailoverIsDisabledWithMultiTenancy(t *testing.T) {
+	sink, routeV2, omsEndpoint, multiTenancy := ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint, IsAzMonMultiTenancyLogCollectionEnabled
+	defer func() {
+		ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint, IsAzMonMultiTenancyLogCollectionEnabled = sink, routeV2, omsEndpoint, multiTenancy
+	}()
+	t.Setenv(ContainerLogsFailoverEnabledEnv, "true")
+	agentSink := NewForwardSocketSink("tcp://ama:24224")
+	ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint = agentSink, true, "https://workspace.ods.opinsights.azure.com/OperationalData.svc/PostJsonDataItems"
+	IsAzMonMultiTenancyLogCollectionEnabled = true
+
+	initializeContainerLogsFailover()
+	assert.True(t, ContainerLogSink == Sink(agentSink), "the tenant streams arent failed over to the default workspace")
+}
+
+func TestInitializeContainerLogsFailoverIsDisabledWithRouting(t *testing.T) {
+	sink, routeV2, omsEndpoint, router := ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint, ContainerLogRouter
+	defer func() {
+		ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint, ContainerLogRouter = sink, routeV2, omsEndpoint, router
+	}()
+	t.Setenv(ContainerLogsFailoverEnabledEnv, "true")
+	agentSink := NewForwardSocketSink("tcp://ama:24224")
+	ContainerLogSink, ContainerLogsRouteV2, OMSEndpoint = agentSink, true, "https://workspace.ods.opinsights.azure.com/OperationalData.svc/PostJsonDataItems"
+	ContainerLogRouter = &LogRouter{}
+
+	initializeContainerLogsFailover()
+	assert.True(t, ContainerLogSink == Sink(agentSink), "the routed streams arent failed over to the default workspace")
+}
+
+func TestGetAccessTokenFromIMDSOnLinuxAKS(t *testing.T) {
+	endpoint, isWindows := IMDSTokenEndpoint, IsWindows
+	defer func() { IMDSTokenEndpoint, IsWindows = endpoint, isWindows }()
+	var resource string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource = r.URL.Query().Get("resource")
+		fmt.Fprint(w, `{"access_token":"imds-token","expires_on":"1700000000"}`)
+	}))
+	defer server.Close()
+	IMDSTokenEndpoint, IsWindows = server.URL, false
+	t.Setenv("USE_IMDS_TOKEN_PROXY_END_POINT", "")
+	t.Setenv("AKS_RESOURCE_ID", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/cluster")
+	t.Setenv("MCS_ENDPOINT", "handler.control.monitor.azure.com")
+
+	token, expiration, err := getAccessTokenFromIMDS()
+	assert.NoError(t, err, "the token is requested from IMDS instead of the windows token file")
+	assert.Equal(t, "imds-token", token)
+	assert.Equal(t, int64(1700000000), expiration)
+	assert.Equal(t, "https://handler.control.monitor.azure.com/", resource)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// env variables to configure the file sink (AZMON_<DATA TYPE>_SINK=file, or alongside the configured sinks)
+const FileSinkDirEnv = "AZMON_FILE_SINK_DIR"
+const FileSinkMaxSizeMBEnv = "AZMON_FILE_SINK_MAX_SIZE_MB"
+const FileSinkMaxBackupsEnv = "AZMON_FILE_SINK_MAX_BACKUPS"
+
+// if true, the batches successfully written to the sinks of all data types are also written to the file sink
+const FileSinkAlongsideEnv = "AZMON_FILE_SINK_ALONGSIDE"
+
+const defaultFileSinkDirLinux = "/var/opt/microsoft/docker-cimprov/state/filesink"
+const defaultFileSinkDirWindows = "/etc/amalogswindows/filesink"
+const defaultFileSinkMaxSizeMB = 100
+const defaultFileSinkMaxBackups = 5
+
+var fileSinkNameRegex = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// FileSink writes the batches as json lines to a file per data type, rotated by size
+type FileSink struct {
+	dir        string
+	maxSizeMB  int
+	maxBackups int
+	mutex      sync.Mutex
+	// files by data type
+	files map[string]*lumberjack.Logger
+	now   func() time.Time
+}
+
+// fileSinkLine is a line of the file sink, with either a record of the batch or the payload of a batch without records
+type fileSinkLine struct {
+	Time     string            `json:"time"`
+	DataType string            `json:"dataType"`
+	Tag      string            `json:"tag,omitempty"`
+	Record   map[string]string `json:"record,omitempty"`
+	Payload  interface{}       `json:"payload,omitempty"`
+}
+
+var (
+	// FileSinkInstance is shared by the data types using the file sink
+	FileSinkInstance *FileSink
+	// FileSinkInstanceMutex guards the creation of FileSinkInstance
+	FileSinkInstanceMutex = &sync.Mutex{}
+	// AlongsideFileSink receives the batches written to the sinks of all data types, nil unless enabled
+	AlongsideFileSink *FileSink
+)
+
+// NewFileSink creates a file sink writing to the directory
+func NewFileSink(dir string, maxSizeMB int, maxBackups int) *FileSink {
+	return &FileSink{
+		dir:        dir,
+		maxSizeMB:  maxSizeMB,
+		maxBackups: maxBackups,
+		files:      make(map[string]*lumberjack.Logger),
+		now:        time.Now,
+	}
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Connect() error {
+	return os.MkdirAll(s.dir, 0700)
+}
+
+// file returns the rotated file of the data type
+func (s *FileSink) file(dataType string) *lumberjack.Logger {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, ok := s.files[dataType]
+	if !ok {
+		name := strings.Trim(fileSinkNameRegex.ReplaceAllString(strings.ToLower(dataType), "_"), "_.")
+		if name == "" {
+			name = "records"
+		}
+		file = &lumberjack.Logger{
+			Filename:   filepath.Join(s.dir, name+".jsonl"),
+			MaxSize:    s.maxSizeMB,
+			MaxBackups: s.maxBackups,
+			Compress:   true,
+		}
+		s.files[dataType] = file
+	}
+	return file
+}
+
+func (s *FileSink) Write(batch *SinkBatch) (int, error) {
+	file := s.file(batch.DataType)
+	flushTime := s.now().UTC().Format(time.RFC3339Nano)
+	lines := make([]fileSinkLine, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		lines = append(lines, fileSinkLine{Time: flushTime, DataType: batch.DataType, Tag: batch.Tag, Record: entry.Record})
+	}
+	if len(lines) == 0 && batch.Payload != nil {
+		lines = append(lines, fileSinkLine{Time: flushTime, DataType: batch.DataType, Tag: batch.Tag, Payload: batch.Payload})
+	}
+	bts := 0
+	for _, line := range lines {
+		marshalled, err := json.Marshal(line)
+		if err != nil {
+			return bts, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		// lines are written one at a time since lumberjack rotates between writes
+		n, err := file.Write(append(marshalled, '\n'))
+		bts += n
+		if err != nil {
+			return bts, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+	}
+	return bts, nil
+}
+
+func (s *FileSink) IsHealthy() bool {
+	return true
+}
+
+func (s *FileSink) Close() {
+}
+
+// mirrorBatchToFile writes the batch written to the sink of a data type to the alongside file sink. Errors are only logged
+func mirrorBatchToFile(sink Sink, batch *SinkBatch) {
+	if AlongsideFileSink == nil || sink == Sink(AlongsideFileSink) {
+		return
+	}
+	if sink != ContainerLogSink && sink != KubeMonAgentEventsSink && sink != InsightsMetricsSink && sink != InputPluginRecordsSink {
+		return
+	}
+	if _, err := AlongsideFileSink.Write(batch); err != nil {
+		Log("Error::file::Failed to write %s batch to the file sink. error: %s", batch.DataType, err.Error())
+	}
+}
+
+// getFileSink returns the file sink configured through the env settings, shared by all the data types
+func getFileSink() *FileSink {
+	FileSinkInstanceMutex.Lock()
+	defer FileSinkInstanceMutex.Unlock()
+	if FileSinkInstance != nil {
+		return FileSinkInstance
+	}
+	dir := strings.TrimSpace(os.Getenv(FileSinkDirEnv))
+	if dir == "" {
+		dir = defaultFileSinkDirLinux
+		if IsWindows {
+			dir = defaultFileSinkDirWindows
+		}
+	}
+	maxSizeMB, err := strconv.Atoi(strings.TrimSpace(os.Getenv(FileSinkMaxSizeMBEnv)))
+	if err != nil || maxSizeMB <= 0 {
+		maxSizeMB = defaultFileSinkMaxSizeMB
+	}
+	maxBackups, err := strconv.Atoi(strings.TrimSpace(os.Getenv(FileSinkMaxBackupsEnv)))
+	if err != nil || maxBackups < 0 {
+		maxBackups = defaultFileSinkMaxBackups
+	}
+	FileSinkInstance = NewFileSink(dir, maxSizeMB, maxBackups)
+	Log("Using file sink. dir: %s, maxSizeMB: %d, maxBackups: %d", dir, maxSizeMB, maxBackups)
+	return FileSinkInstance
+}
+
+// initializeAlongsideFileSink enables writing the batches of all data types to the file sink in addition to their sinks
+func initializeAlongsideFileSink() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(FileSinkAlongsideEnv))), "true") != 0 {
+		return
+	}
+	sink := getFileSink()
+	if err := sink.Connect(); err != nil {
+		message := fmt.Sprintf("Error::file::Unable to create the file sink directory %s, disabling it: %s", sink.dir, err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	AlongsideFileSink = sink
+	Log("File sink enabled alongside the configured sinks")
+}
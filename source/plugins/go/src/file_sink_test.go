@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFileSinkLines(t *testing.T, path string) []fileSinkLine {
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var lines []fileSinkLine
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var parsed fileSinkLine
+		assert.NoError(t, json.Unmarshal([]byte(line), &parsed))
+		lines = append(lines, parsed)
+	}
+	return lines
+}
+
+func TestFileSinkWritesJSONLinesPerDataType(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(dir, 10, 1)
+	sink.now = func() time.Time { return time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC) }
+
+	_, err := writeToSink(sink, &SinkBatch{DataType: ContainerLogV2DataType, Tag: "dcr-1:Microsoft-ContainerLogV2", Entries: []MsgPackEntry{
+		{Record: map[string]string{"LogMessage": "a"}},
+		{Record: map[string]string{"LogMessage": "b"}},
+	}})
+	assert.NoError(t, err)
+	_, err = writeToSink(sink, &SinkBatch{DataType: KubeMonAgentEventDataType, Payload: map[string]string{"Message": "No errors"}})
+	assert.NoError(t, err)
+
+	lines := readFileSinkLines(t, filepath.Join(dir, strings.ToLower(ContainerLogV2DataType)+".jsonl"))
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "2024-05-01T10:15:00Z", lines[0].Time)
+	assert.Equal(t, "dcr-1:Microsoft-ContainerLogV2", lines[0].Tag)
+	assert.Equal(t, "b", lines[1].Record["LogMessage"])
+
+	lines = readFileSinkLines(t, filepath.Join(dir, strings.ToLower(KubeMonAgentEventDataType)+".jsonl"))
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, "No errors", lines[0].Payload.(map[string]interface{})["Message"])
+}
+
+func TestMirrorBatchToFile(t *testing.T) {
+	dir := t.TempDir()
+	primary := &fakeSink{}
+	other := &fakeSink{}
+	previousSink := ContainerLogSink
+	ContainerLogSink = primary
+	AlongsideFileSink = NewFileSink(dir, 10, 1)
+	defer func() {
+		ContainerLogSink = previousSink
+		AlongsideFileSink = nil
+	}()
+
+	batch := &SinkBatch{DataType: ContainerLogV2DataType, Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}}}
+	_, err := writeToSink(primary, batch)
+	assert.NoError(t, err)
+	_, err = writeToSink(other, batch)
+	assert.NoError(t, err)
+	primary.writeErrs = []error{newSinkWriteError(assert.AnError), newSinkWriteError(assert.AnError)}
+	_, err = writeToSink(primary, batch)
+	assert.Error(t, err)
+
+	lines := readFileSinkLines(t, filepath.Join(dir, strings.ToLower(ContainerLogV2DataType)+".jsonl"))
+	assert.Equal(t, 1, len(lines), "only successful writes of the data type sinks are mirrored")
+}
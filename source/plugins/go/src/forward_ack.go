@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// env variables to enable the fluent forward acknowledgements of the writes to the agent (mdsd/ama unix socket or tcp endpoint)
+const AMAForwardAckEnabledEnv = "AZMON_AMA_FORWARD_ACK_ENABLED"
+const AMAForwardAckTimeoutSecondsEnv = "AZMON_AMA_FORWARD_ACK_TIMEOUT_SECONDS"
+
+const defaultAMAForwardAckTimeoutSeconds = 30
+
+// AMAForwardAckTimeout is how long the forward socket sinks created after the plugin initialization wait for the ack of a write, 0 if acks are disabled
+var AMAForwardAckTimeout time.Duration
+
+// newForwardChunkId returns a unique chunk id for the option of a forward message
+func newForwardChunkId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id), nil
+}
+
+// forwardMessageWithOptionHeader is the fixarray header of the [tag, entries, option] forward message
+var forwardMessageWithOptionHeader = []byte{0x93}
+
+// forwardChunkOption returns the {"chunk": chunk} option which turns the [tag, entries] forward message into [tag, entries, option]
+// when it is written after the frame, with the header of the frame replaced by forwardMessageWithOptionHeader
+func forwardChunkOption(frame []byte, chunk string) ([]byte, error) {
+	// the frames are built by convertMsgPackEntriesToMsgpBytes or the ForwardFrameEncoder and always start with the fixarray header of 2 elements
+	if len(frame) == 0 || frame[0] != 0x92 {
+		return nil, errors.New("frame is not a [tag, entries] forward message")
+	}
+	option := msgp.AppendMapHeader(make([]byte, 0, len(chunk)+16), 1)
+	option = msgp.AppendString(option, "chunk")
+	return msgp.AppendString(option, chunk), nil
+}
+
+// readForwardAck reads the {"ack": chunk} response of the agent and checks it acknowledges the chunk
+func readForwardAck(reader *msgp.Reader, chunk string) error {
+	value, err := reader.ReadIntf()
+	if err != nil {
+		return err
+	}
+	response, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected ack response %v", value)
+	}
+	if ack := string(forwardHandshakeBytes(response["ack"])); ack != chunk {
+		return fmt.Errorf("ack %s does not match chunk %s", ack, chunk)
+	}
+	return nil
+}
+
+// initializeAMAForwardAck enables the acks for the forward socket sinks
+func initializeAMAForwardAck() {
+	AMAForwardAckTimeout = 0
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(AMAForwardAckEnabledEnv))), "true") != 0 {
+		return
+	}
+	timeoutSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(AMAForwardAckTimeoutSecondsEnv)))
+	if err != nil || timeoutSeconds <= 0 {
+		timeoutSeconds = defaultAMAForwardAckTimeoutSeconds
+	}
+	AMAForwardAckTimeout = time.Duration(timeoutSeconds) * time.Second
+	Log("AMA forward acks enabled. timeout: %d seconds", timeoutSeconds)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// serveForwardAcks reads forward messages from the connections and acks their chunks unless ack returns false
+func serveForwardAcks(listener net.Listener, ack func(chunk string) bool) chan []interface{} {
+	received := make(chan []interface{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := msgp.NewReader(conn)
+			for {
+				value, err := reader.ReadIntf()
+				if err != nil {
+					conn.Close()
+					break
+				}
+				message := value.([]interface{})
+				received <- message
+				option := message[2].(map[string]interface{})
+				chunk := option["chunk"].(string)
+				if ack(chunk) {
+					response := msgp.AppendMapHeader(nil, 1)
+					response = msgp.AppendString(response, "ack")
+					response = msgp.AppendString(response, chunk)
+					conn.Write(response)
+				}
+			}
+		}
+	}()
+	return received
+}
+
+func TestForwardChunkOption(t *testing.T) {
+	frame := convertMsgPackEntriesToMsgpBytes("ContainerLogV2Source", []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}})
+	option, err := forwardChunkOption(frame, "chunk-1")
+	assert.NoError(t, err)
+	withOption := append(append(append([]byte{}, forwardMessageWithOptionHeader...), frame[1:]...), option...)
+
+	value, rest, err := msgp.ReadIntfBytes(withOption)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(rest))
+	message := value.([]interface{})
+	assert.Equal(t, 3, len(message))
+	assert.Equal(t, "ContainerLogV2Source", message[0])
+	assert.Equal(t, "chunk-1", message[2].(map[string]interface{})["chunk"])
+
+	_, err = forwardChunkOption(withOption, "chunk-2")
+	assert.Error(t, err)
+}
+
+func TestSpilledFramesAreAckedOneAtATime(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "fluent.socket"))
+	assert.NoError(t, err)
+	defer listener.Close()
+	received := serveForwardAcks(listener, func(chunk string) bool { return true })
+
+	spillBuffer := ContainerLogSpillBuffer
+	defer func() { ContainerLogSpillBuffer = spillBuffer }()
+	ContainerLogSpillBuffer, err = NewSpillBuffer(t.TempDir(), 1024*1024, time.Hour)
+	assert.NoError(t, err)
+	// the streams of a multi-tenancy flush are spilled together
+	assert.True(t, spillContainerLogBatches([]*SinkBatch{
+		{Tag: "dcr-1", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}}},
+		{Tag: "dcr-2", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "b"}}}},
+	}, 1))
+
+	sink := NewForwardSocketSink(listener.Addr().String())
+	sink.ackTimeout = time.Second
+	drained, err := replayContainerLogSpillBuffer(sink)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+	sink.Close()
+
+	first, second := <-received, <-received
+	assert.Equal(t, "dcr-1", first[0])
+	assert.Equal(t, "dcr-2", second[0])
+	assert.NotEqual(t, first[2].(map[string]interface{})["chunk"], second[2].(map[string]interface{})["chunk"])
+}
+
+func TestForwardSocketSinkWaitsForAck(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "fluent.socket"))
+	assert.NoError(t, err)
+	defer listener.Close()
+	received := serveForwardAcks(listener, func(chunk string) bool { return true })
+
+	sink := NewForwardSocketSink(listener.Addr().String())
+	sink.ackTimeout = time.Second
+	_, err = writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}}})
+	assert.NoError(t, err)
+	_, err = writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "b"}}}})
+	assert.NoError(t, err)
+	sink.Close()
+
+	first, second := <-received, <-received
+	assert.NotEqual(t, first[2].(map[string]interface{})["chunk"], second[2].(map[string]interface{})["chunk"])
+}
+
+func TestForwardSocketSinkRetriesMissingAck(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "fluent.socket"))
+	assert.NoError(t, err)
+	defer listener.Close()
+	var acks int32
+	received := serveForwardAcks(listener, func(chunk string) bool {
+		// every other chunk is acked, starting with the second one
+		return atomic.AddInt32(&acks, 1)%2 == 0
+	})
+
+	sink := NewForwardSocketSink(listener.Addr().String())
+	sink.ackTimeout = 100 * time.Millisecond
+	assert.NoError(t, sink.Connect())
+	_, err = writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}}})
+	assert.NoError(t, err, "the batch is resent on a new connection after the ack timeout")
+	assert.Equal(t, 2, len(received))
+	sink.Close()
+
+	atomic.StoreInt32(&acks, 0)
+	_, err = writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}}})
+	assert.True(t, IsRetriableSinkError(err), "the write fails if the ack is missing on a new connection")
+	assert.False(t, sink.IsHealthy())
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/extension"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// env variables to override the AMA (mdsd) fluent endpoints. Values are either unix socket paths (optionally prefixed with unix://),
+// tcp://host:port or tls://host:port. AZMON_AMA_ENDPOINT applies to all the data types and the extension config queries
+const AMAEndpointEnv = "AZMON_AMA_ENDPOINT"
+const ContainerLogsAMAEndpointEnv = "AZMON_CONTAINER_LOGS_AMA_ENDPOINT"
+const KubeMonAgentEventsAMAEndpointEnv = "AZMON_KUBE_MON_AGENT_EVENTS_AMA_ENDPOINT"
+const InsightsMetricsAMAEndpointEnv = "AZMON_INSIGHTS_METRICS_AMA_ENDPOINT"
+const InputPluginRecordsAMAEndpointEnv = "AZMON_INPUT_PLUGIN_RECORDS_AMA_ENDPOINT"
+const AMAConfigEndpointEnv = "AZMON_AMA_CONFIG_ENDPOINT"
+
+// env variables to configure tls for the tcp AMA endpoints
+const AMAForwardTLSEnabledEnv = "AZMON_AMA_FORWARD_TLS_ENABLED"
+const AMAForwardTLSCAFileEnv = "AZMON_AMA_FORWARD_TLS_CA_FILE"
+const AMAForwardTLSCertFileEnv = "AZMON_AMA_FORWARD_TLS_CERT_FILE"
+const AMAForwardTLSKeyFileEnv = "AZMON_AMA_FORWARD_TLS_KEY_FILE"
+const AMAForwardTLSServerNameEnv = "AZMON_AMA_FORWARD_TLS_SERVER_NAME"
+const AMAForwardTLSInsecureSkipVerifyEnv = "AZMON_AMA_FORWARD_TLS_INSECURE_SKIP_VERIFY"
+
+// env variables to configure the fluent forward shared key authentication for the tcp AMA endpoints
+const AMAForwardSharedKeyEnv = "AZMON_AMA_FORWARD_SHARED_KEY"
+const AMAForwardSelfHostnameEnv = "AZMON_AMA_FORWARD_SELF_HOSTNAME"
+const AMAForwardUsernameEnv = "AZMON_AMA_FORWARD_USERNAME"
+const AMAForwardPasswordEnv = "AZMON_AMA_FORWARD_PASSWORD"
+
+const unixEndpointPrefix = "unix://"
+const tcpEndpointPrefix = "tcp://"
+const tlsEndpointPrefix = "tls://"
+
+// ForwardSecurity is the tls and shared key configuration used to connect to the tcp endpoints
+type ForwardSecurity struct {
+	// TLSConfig enables tls for all the tcp endpoints if set. tls:// endpoints use a default config otherwise
+	TLSConfig *tls.Config
+	// SharedKey enables the fluent forward handshake if set
+	SharedKey    string
+	SelfHostname string
+	Username     string
+	Password     string
+}
+
+// ForwardEndpoint is a parsed unix socket or tcp endpoint
+type ForwardEndpoint struct {
+	Network string
+	Address string
+	TLS     bool
+}
+
+// AMAForwardSecurity is used by the forward socket sinks created after the plugin initialization, nil if neither tls nor shared key is configured
+var AMAForwardSecurity *ForwardSecurity
+
+// AMAForwardTLSConfigError is the error of the tls settings if tls is enabled but misconfigured. The tcp endpoints arent used then,
+// so that the records arent sent in plaintext
+var AMAForwardTLSConfigError error
+
+// parseForwardEndpoint parses a unix socket path, unix://path, tcp://host:port or tls://host:port
+func parseForwardEndpoint(endpoint string) (ForwardEndpoint, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	switch {
+	case strings.HasPrefix(endpoint, unixEndpointPrefix):
+		endpoint = strings.TrimPrefix(endpoint, unixEndpointPrefix)
+		if endpoint == "" {
+			return ForwardEndpoint{}, errors.New("unix endpoint has no socket path")
+		}
+		return ForwardEndpoint{Network: "unix", Address: endpoint}, nil
+	case strings.HasPrefix(endpoint, tcpEndpointPrefix), strings.HasPrefix(endpoint, tlsEndpointPrefix):
+		address := strings.TrimPrefix(strings.TrimPrefix(endpoint, tcpEndpointPrefix), tlsEndpointPrefix)
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return ForwardEndpoint{}, fmt.Errorf("invalid endpoint %s: %s", endpoint, err.Error())
+		}
+		return ForwardEndpoint{Network: "tcp", Address: address, TLS: strings.HasPrefix(endpoint, tlsEndpointPrefix)}, nil
+	case strings.HasPrefix(endpoint, "/"):
+		return ForwardEndpoint{Network: "unix", Address: endpoint}, nil
+	}
+	return ForwardEndpoint{}, fmt.Errorf("unsupported endpoint %s, expected a unix socket path or tcp://host:port", endpoint)
+}
+
+// dialForwardEndpoint connects to the endpoint. Connections to tcp endpoints use tls & the shared key handshake when configured
+func dialForwardEndpoint(endpoint string, security *ForwardSecurity) (net.Conn, error) {
+	parsed, err := parseForwardEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(parsed.Network, parsed.Address, sinkDialTimeout)
+	if err != nil || parsed.Network != "tcp" {
+		return conn, err
+	}
+	if security == nil {
+		security = &ForwardSecurity{}
+	}
+	if parsed.TLS || security.TLSConfig != nil {
+		tlsConfig := &tls.Config{}
+		if security.TLSConfig != nil {
+			tlsConfig = security.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(parsed.Address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(sinkDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with %s failed: %s", parsed.Address, err.Error())
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if security.SharedKey != "" {
+		conn.SetDeadline(time.Now().Add(sinkDialTimeout))
+		if err := forwardHandshake(conn, security); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("forward handshake with %s failed: %s", parsed.Address, err.Error())
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// forwardHandshake authenticates the connection with the shared key as per the fluent forward protocol spec (HELO, PING & PONG)
+func forwardHandshake(conn net.Conn, security *ForwardSecurity) error {
+	reader := msgp.NewReader(conn)
+	helo, err := readForwardHandshakeMessage(reader, "HELO", 2)
+	if err != nil {
+		return err
+	}
+	options, _ := helo[1].(map[string]interface{})
+	nonce := forwardHandshakeBytes(options["nonce"])
+	authSalt := forwardHandshakeBytes(options["auth"])
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	sharedKeySalt := hex.EncodeToString(salt)
+	username, passwordDigest := "", ""
+	if len(authSalt) > 0 {
+		username = security.Username
+		passwordDigest = forwardHandshakeDigest(string(authSalt), security.Username, security.Password)
+	}
+	ping := msgp.AppendArrayHeader(nil, 6)
+	ping = msgp.AppendString(ping, "PING")
+	ping = msgp.AppendString(ping, security.SelfHostname)
+	ping = msgp.AppendString(ping, sharedKeySalt)
+	ping = msgp.AppendString(ping, forwardHandshakeDigest(sharedKeySalt, security.SelfHostname, string(nonce), security.SharedKey))
+	ping = msgp.AppendString(ping, username)
+	ping = msgp.AppendString(ping, passwordDigest)
+	if _, err := conn.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := readForwardHandshakeMessage(reader, "PONG", 5)
+	if err != nil {
+		return err
+	}
+	if authenticated, _ := pong[1].(bool); !authenticated {
+		return fmt.Errorf("authentication failed: %s", forwardHandshakeBytes(pong[2]))
+	}
+	serverHostname := string(forwardHandshakeBytes(pong[3]))
+	expected := forwardHandshakeDigest(sharedKeySalt, serverHostname, string(nonce), security.SharedKey)
+	if !bytes.Equal(forwardHandshakeBytes(pong[4]), []byte(expected)) {
+		return errors.New("shared key mismatch in the server response")
+	}
+	return nil
+}
+
+// readForwardHandshakeMessage reads an array message of the handshake with the given type and minimum length
+func readForwardHandshakeMessage(reader *msgp.Reader, messageType string, length int) ([]interface{}, error) {
+	value, err := reader.ReadIntf()
+	if err != nil {
+		return nil, err
+	}
+	message, ok := value.([]interface{})
+	if !ok || len(message) < length || string(forwardHandshakeBytes(message[0])) != messageType {
+		return nil, fmt.Errorf("expected %s message, got %v", messageType, value)
+	}
+	return message, nil
+}
+
+// forwardHandshakeBytes returns the str or bin value of the handshake message
+func forwardHandshakeBytes(value interface{}) []byte {
+	switch value := value.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	}
+	return nil
+}
+
+func forwardHandshakeDigest(values ...string) string {
+	hash := sha512.New()
+	for _, value := range values {
+		hash.Write([]byte(value))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func getAMAEndpointEnvForDataType(dataType DataType) string {
+	switch dataType {
+	case ContainerLogV2:
+		return ContainerLogsAMAEndpointEnv
+	case KubeMonAgentEvents:
+		return KubeMonAgentEventsAMAEndpointEnv
+	case InsightsMetrics:
+		return InsightsMetricsAMAEndpointEnv
+	case InputPluginRecords:
+		return InputPluginRecordsAMAEndpointEnv
+	}
+	return ""
+}
+
+// getAMAEndpoint returns the configured endpoint of the data type, or the mdsd fluent socket if none is configured
+// or the tcp endpoint cant be used since the tls settings are invalid
+func getAMAEndpoint(dataType DataType, containerType string) string {
+	endpoint := strings.TrimSpace(os.Getenv(getAMAEndpointEnvForDataType(dataType)))
+	if endpoint == "" {
+		endpoint = strings.TrimSpace(os.Getenv(AMAEndpointEnv))
+	}
+	if endpoint == "" {
+		return getMdsdFluentSocketPath(dataType, containerType)
+	}
+	if err := checkForwardEndpointTLS(endpoint); err != nil {
+		message := fmt.Sprintf("Error::mdsd::%s, using the default socket", err.Error())
+		Log(message)
+		SendException(message)
+		return getMdsdFluentSocketPath(dataType, containerType)
+	}
+	return endpoint
+}
+
+// checkForwardEndpointTLS returns an error for the tcp endpoints when the tls settings are invalid
+func checkForwardEndpointTLS(endpoint string) error {
+	if AMAForwardTLSConfigError == nil {
+		return nil
+	}
+	if parsed, err := parseForwardEndpoint(endpoint); err == nil && parsed.Network == "tcp" {
+		return fmt.Errorf("Not using the tcp AMA endpoint %s since the tls settings are invalid: %s", endpoint, AMAForwardTLSConfigError.Error())
+	}
+	return nil
+}
+
+// getAMAForwardTLSConfig reads the tls settings. Returns nil if tls isnt enabled
+func getAMAForwardTLSConfig() (*tls.Config, error) {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(AMAForwardTLSEnabledEnv))), "true") != 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         strings.TrimSpace(os.Getenv(AMAForwardTLSServerNameEnv)),
+		InsecureSkipVerify: strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(AMAForwardTLSInsecureSkipVerifyEnv))), "true") == 0,
+	}
+	if caFile := strings.TrimSpace(os.Getenv(AMAForwardTLSCAFileEnv)); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the ca file %s: %s", caFile, err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in the ca file %s", caFile)
+		}
+	}
+	certFile, keyFile := strings.TrimSpace(os.Getenv(AMAForwardTLSCertFileEnv)), strings.TrimSpace(os.Getenv(AMAForwardTLSKeyFileEnv))
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate %s: %s", certFile, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// initializeAMAForwardEndpoints reads the tls & shared key settings of the AMA endpoints and points the extension config queries to the configured endpoint
+func initializeAMAForwardEndpoints() {
+	tlsConfig, err := getAMAForwardTLSConfig()
+	AMAForwardTLSConfigError = err
+	if err != nil {
+		message := fmt.Sprintf("Error::mdsd::Invalid AMA forward tls settings, the tcp endpoints are disabled: %s", err.Error())
+		Log(message)
+		SendException(message)
+	}
+	sharedKey := os.Getenv(AMAForwardSharedKeyEnv)
+	AMAForwardSecurity = nil
+	if tlsConfig != nil || sharedKey != "" {
+		selfHostname := strings.TrimSpace(os.Getenv(AMAForwardSelfHostnameEnv))
+		if selfHostname == "" {
+			selfHostname = Computer
+		}
+		AMAForwardSecurity = &ForwardSecurity{
+			TLSConfig:    tlsConfig,
+			SharedKey:    sharedKey,
+			SelfHostname: selfHostname,
+			Username:     os.Getenv(AMAForwardUsernameEnv),
+			Password:     os.Getenv(AMAForwardPasswordEnv),
+		}
+		Log("AMA forward security enabled. tls: %v, shared key: %v", tlsConfig != nil, sharedKey != "")
+	}
+
+	configEndpoint := strings.TrimSpace(os.Getenv(AMAConfigEndpointEnv))
+	if configEndpoint == "" {
+		configEndpoint = strings.TrimSpace(os.Getenv(AMAEndpointEnv))
+	}
+	if configEndpoint == "" {
+		return
+	}
+	if _, err := parseForwardEndpoint(configEndpoint); err != nil {
+		message := fmt.Sprintf("Error::mdsd::Invalid AMA config endpoint, using the default socket: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	if err := checkForwardEndpointTLS(configEndpoint); err != nil {
+		message := fmt.Sprintf("Error::mdsd::%s, using the default socket for the config queries", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	extension.FluentSocketAddress = configEndpoint
+	extension.DialFluentSocket = func(address string) (net.Conn, error) {
+		return dialForwardEndpoint(address, AMAForwardSecurity)
+	}
+	Log("Using AMA config endpoint %s", configEndpoint)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestParseForwardEndpoint(t *testing.T) {
+	endpoint, err := parseForwardEndpoint("/var/run/mdsd-ci/default_fluent.socket")
+	assert.NoError(t, err)
+	assert.Equal(t, ForwardEndpoint{Network: "unix", Address: "/var/run/mdsd-ci/default_fluent.socket"}, endpoint)
+	endpoint, err = parseForwardEndpoint("unix:///tmp/fluent.socket")
+	assert.NoError(t, err)
+	assert.Equal(t, ForwardEndpoint{Network: "unix", Address: "/tmp/fluent.socket"}, endpoint)
+	endpoint, err = parseForwardEndpoint(" tcp://ama.monitoring.svc:24224 ")
+	assert.NoError(t, err)
+	assert.Equal(t, ForwardEndpoint{Network: "tcp", Address: "ama.monitoring.svc:24224"}, endpoint)
+	endpoint, err = parseForwardEndpoint("tls://10.0.0.4:24224")
+	assert.NoError(t, err)
+	assert.Equal(t, ForwardEndpoint{Network: "tcp", Address: "10.0.0.4:24224", TLS: true}, endpoint)
+
+	for _, invalid := range []string{"", "unix://", "tcp://ama", "http://ama:24224", "fluent.socket"} {
+		_, err = parseForwardEndpoint(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestGetAMAEndpoint(t *testing.T) {
+	isGenevaLogsIntegrationEnabled := IsGenevaLogsIntegrationEnabled
+	defer func() { IsGenevaLogsIntegrationEnabled = isGenevaLogsIntegrationEnabled }()
+	IsGenevaLogsIntegrationEnabled = false
+	assert.Equal(t, "/var/run/mdsd-ci/default_fluent.socket", getAMAEndpoint(InsightsMetrics, ""))
+
+	t.Setenv(AMAEndpointEnv, "tcp://ama:24224")
+	t.Setenv(ContainerLogsAMAEndpointEnv, "tcp://ama-logs:24224")
+	assert.Equal(t, "tcp://ama-logs:24224", getAMAEndpoint(ContainerLogV2, ""))
+	assert.Equal(t, "tcp://ama:24224", getAMAEndpoint(InsightsMetrics, ""))
+}
+
+func TestGetAMAEndpointFailsClosedOnInvalidTLSSettings(t *testing.T) {
+	isGenevaLogsIntegrationEnabled := IsGenevaLogsIntegrationEnabled
+	defer func() { IsGenevaLogsIntegrationEnabled, AMAForwardTLSConfigError = isGenevaLogsIntegrationEnabled, nil }()
+	IsGenevaLogsIntegrationEnabled = false
+	t.Setenv(AMAForwardTLSEnabledEnv, "true")
+	t.Setenv(AMAForwardTLSCAFileEnv, filepath.Join(t.TempDir(), "missing-ca.pem"))
+	initializeAMAForwardEndpoints()
+	assert.Error(t, AMAForwardTLSConfigError)
+
+	t.Setenv(AMAEndpointEnv, "tcp://ama:24224")
+	t.Setenv(ContainerLogsAMAEndpointEnv, "/var/run/ama/fluent.socket")
+	assert.Equal(t, "/var/run/mdsd-ci/default_fluent.socket", getAMAEndpoint(InsightsMetrics, ""), "the tcp endpoint isnt used without tls")
+	assert.Equal(t, "/var/run/ama/fluent.socket", getAMAEndpoint(ContainerLogV2, ""))
+}
+
+// serveForwardHandshake accepts a connection, authenticates it with the shared key and sends the data read afterwards to the channel
+func serveForwardHandshake(listener net.Listener, sharedKey string) chan []byte {
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := "nonce-0123"
+		helo := msgp.AppendArrayHeader(nil, 2)
+		helo = msgp.AppendString(helo, "HELO")
+		helo = msgp.AppendMapHeader(helo, 3)
+		helo = msgp.AppendString(helo, "nonce")
+		helo = msgp.AppendBytes(helo, []byte(nonce))
+		helo = msgp.AppendString(helo, "auth")
+		helo = msgp.AppendBytes(helo, []byte{})
+		helo = msgp.AppendString(helo, "keepalive")
+		helo = msgp.AppendBool(helo, true)
+		conn.Write(helo)
+
+		reader := msgp.NewReader(conn)
+		ping, err := readForwardHandshakeMessage(reader, "PING", 6)
+		if err != nil {
+			received <- nil
+			return
+		}
+		hostname, salt := ping[1].(string), ping[2].(string)
+		authenticated := ping[3].(string) == forwardHandshakeDigest(salt, hostname, nonce, sharedKey)
+		pong := msgp.AppendArrayHeader(nil, 5)
+		pong = msgp.AppendString(pong, "PONG")
+		pong = msgp.AppendBool(pong, authenticated)
+		pong = msgp.AppendString(pong, "")
+		pong = msgp.AppendString(pong, "ama")
+		pong = msgp.AppendString(pong, forwardHandshakeDigest(salt, "ama", nonce, sharedKey))
+		conn.Write(pong)
+		if !authenticated {
+			received <- nil
+			return
+		}
+		data, _ := ioutil.ReadAll(reader)
+		received <- data
+	}()
+	return received
+}
+
+func TestForwardSocketSinkOverTLSWithSharedKey(t *testing.T) {
+	// reuse the certificate of the httptest tls server, issued for 127.0.0.1
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	assert.NoError(t, err)
+	defer listener.Close()
+	received := serveForwardHandshake(listener, "secret")
+
+	sink := NewForwardSocketSink("tls://" + listener.Addr().String())
+	sink.security = &ForwardSecurity{
+		TLSConfig:    &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+		SharedKey:    "secret",
+		SelfHostname: "aks-node-1",
+	}
+	bts, err := writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}}})
+	assert.NoError(t, err)
+	sink.Close()
+
+	data := <-received
+	assert.Equal(t, bts, len(data))
+	tag, _, err := msgp.ReadStringBytes(data[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, "ContainerLogV2Source", tag)
+}
+
+func TestForwardSocketSinkRejectedSharedKey(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	received := serveForwardHandshake(listener, "secret")
+
+	sink := NewForwardSocketSink("tcp://" + listener.Addr().String())
+	sink.security = &ForwardSecurity{SharedKey: "wrong", SelfHostname: "aks-node-1"}
+	_, err = writeToSink(sink, &SinkBatch{Tag: "ContainerLogV2Source"})
+	assert.True(t, IsSinkConnectError(err))
+	assert.Nil(t, <-received)
+	assert.False(t, sink.IsHealthy())
+}
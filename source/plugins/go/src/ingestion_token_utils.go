@@ -23,6 +23,9 @@ const AMCSAgentConfigAPIVersion = "2020-08-01-preview"
 const AMCSIngestionTokenAPIVersion = "2020-04-01-preview"
 const MaxRetries = 3
 
+// IMDSTokenEndpoint of the managed identity tokens
+var IMDSTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
 var IMDSToken string
 var IMDSTokenExpiration int64
 
@@ -143,89 +146,106 @@ type ContainerInsightsIdentityRequest struct {
 	} `json:"status"`
 }
 
-func getAccessTokenFromIMDS() (string, int64, error) {
-	Log("Info getAccessTokenFromIMDS: start")
-	useIMDSTokenProxyEndPoint := os.Getenv("USE_IMDS_TOKEN_PROXY_END_POINT")
-	imdsAccessToken := ""
-	var expiration int64
-	var responseBytes []byte
-	var err error
+// requestIMDSAccessToken requests an access token for the resource from IMDS and returns the response body.
+// The token is of the user assigned identity with the client id if set, otherwise of the system assigned identity
+func requestIMDSAccessToken(resource string, clientId string) ([]byte, error) {
+	msi_endpoint_string := fmt.Sprintf("%s?api-version=2018-02-01&resource=%s", IMDSTokenEndpoint, resource)
+	if clientId != "" {
+		msi_endpoint_string = msi_endpoint_string + "&client_id=" + url.QueryEscape(clientId)
+	}
+	msi_endpoint, err := url.Parse(msi_endpoint_string)
+	if err != nil {
+		Log("getAccessTokenFromIMDS: Error creating IMDS endpoint URL: %s", err.Error())
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", msi_endpoint.String(), nil)
+	if err != nil {
+		Log("getAccessTokenFromIMDS: Error creating HTTP request: %s", err.Error())
+		return nil, err
+	}
+	req.Header.Add("Metadata", "true")
 
-	if useIMDSTokenProxyEndPoint != "" && strings.Compare(strings.ToLower(useIMDSTokenProxyEndPoint), "true") == 0 {
-		Log("Info Reading IMDS Access Token from IMDS Token proxy endpoint")
-		mcsEndpoint := os.Getenv("MCS_ENDPOINT")
-		msi_endpoint_string := fmt.Sprintf("http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://%s/", mcsEndpoint)
-		var msi_endpoint *url.URL
-		msi_endpoint, err := url.Parse(msi_endpoint_string)
-		if err != nil {
-			Log("getAccessTokenFromIMDS: Error creating IMDS endpoint URL: %s", err.Error())
-			return imdsAccessToken, expiration, err
-		}
-		req, err := http.NewRequest("GET", msi_endpoint.String(), nil)
+	//IMDS endpoint nonroutable endpoint and requests doesnt go through proxy hence using dedicated http client
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	// Call managed services for Azure resources token endpoint
+	var resp *http.Response = nil
+	IsSuccess := false
+	for retryCount := 0; retryCount < MaxRetries; retryCount++ {
+		resp, err = httpClient.Do(req)
 		if err != nil {
-			Log("getAccessTokenFromIMDS: Error creating HTTP request: %s", err.Error())
-			return imdsAccessToken, expiration, err
+			message := fmt.Sprintf("getAccessTokenFromIMDS: Error calling token endpoint: %s, retryCount: %d", err.Error(), retryCount)
+			Log(message)
+			SendException(message)
+			continue
 		}
-		req.Header.Add("Metadata", "true")
-
-		//IMDS endpoint nonroutable endpoint and requests doesnt go through proxy hence using dedicated http client
-		httpClient := &http.Client{Timeout: 30 * time.Second}
 
-		// Call managed services for Azure resources token endpoint
-		var resp *http.Response = nil
-		IsSuccess := false
-		for retryCount := 0; retryCount < MaxRetries; retryCount++ {
-			resp, err = httpClient.Do(req)
-			if err != nil {
-				message := fmt.Sprintf("getAccessTokenFromIMDS: Error calling token endpoint: %s, retryCount: %d", err.Error(), retryCount)
-				Log(message)
-				SendException(message)
-				continue
-			}
-
-			if resp != nil && resp.Body != nil {
-				defer resp.Body.Close()
-			}
+		if resp != nil && resp.Body != nil {
+			defer resp.Body.Close()
+		}
 
-			Log("getAccessTokenFromIMDS: IMDS Response Status: %d, retryCount: %d", resp.StatusCode, retryCount)
-			if IsRetriableError(resp.StatusCode) {
-				message := fmt.Sprintf("getAccessTokenFromIMDS: IMDS Request failed with an error code: %d, retryCount: %d", resp.StatusCode, retryCount)
-				Log(message)
-				retryDelay := time.Duration((retryCount+1)*100) * time.Millisecond
-				if resp.StatusCode == 429 {
-					if resp != nil && resp.Header.Get("Retry-After") != "" {
-						after, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
-						if err != nil && after > 0 {
-							retryDelay = time.Duration(after) * time.Second
-						}
+		Log("getAccessTokenFromIMDS: IMDS Response Status: %d, retryCount: %d", resp.StatusCode, retryCount)
+		if IsRetriableError(resp.StatusCode) {
+			message := fmt.Sprintf("getAccessTokenFromIMDS: IMDS Request failed with an error code: %d, retryCount: %d", resp.StatusCode, retryCount)
+			Log(message)
+			retryDelay := time.Duration((retryCount+1)*100) * time.Millisecond
+			if resp.StatusCode == 429 {
+				if resp != nil && resp.Header.Get("Retry-After") != "" {
+					after, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+					if err != nil && after > 0 {
+						retryDelay = time.Duration(after) * time.Second
 					}
 				}
-				time.Sleep(retryDelay)
-				continue
-			} else if resp.StatusCode != 200 {
-				message := fmt.Sprintf("getAccessTokenFromIMDS: IMDS Request failed with nonretryable error code: %d, retryCount: %d", resp.StatusCode, retryCount)
-				Log(message)
-				SendException(message)
-				return imdsAccessToken, expiration, err
 			}
-			IsSuccess = true
-			break // call succeeded, don't retry any more
+			time.Sleep(retryDelay)
+			continue
+		} else if resp.StatusCode != 200 {
+			message := fmt.Sprintf("getAccessTokenFromIMDS: IMDS Request failed with nonretryable error code: %d, retryCount: %d", resp.StatusCode, retryCount)
+			Log(message)
+			SendException(message)
+			return nil, errors.New(message)
 		}
-		if !IsSuccess || resp == nil || resp.Body == nil {
-			Log("getAccessTokenFromIMDS: IMDS Request ran out of retries")
-			return imdsAccessToken, expiration, err
+		IsSuccess = true
+		break // call succeeded, don't retry any more
+	}
+	if !IsSuccess || resp == nil || resp.Body == nil {
+		Log("getAccessTokenFromIMDS: IMDS Request ran out of retries")
+		if err == nil {
+			err = errors.New("IMDS Request ran out of retries")
 		}
+		return nil, err
+	}
 
-		// Pull out response body
-		responseBytes, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			Log("getAccessTokenFromIMDS: Error reading response body: %s", err.Error())
+	// Pull out response body
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Log("getAccessTokenFromIMDS: Error reading response body: %s", err.Error())
+		return nil, err
+	}
+	return responseBytes, nil
+}
+
+func getAccessTokenFromIMDS() (string, int64, error) {
+	Log("Info getAccessTokenFromIMDS: start")
+	useIMDSTokenProxyEndPoint := os.Getenv("USE_IMDS_TOKEN_PROXY_END_POINT")
+	imdsAccessToken := ""
+	var expiration int64
+	var responseBytes []byte
+	var err error
+
+	resourceId := os.Getenv("AKS_RESOURCE_ID")
+	isAKSCluster := resourceId != "" && strings.Contains(strings.ToLower(resourceId), strings.ToLower("Microsoft.ContainerService/managedClusters"))
+	// the token file is only written on the windows nodes, the linux nodes of AKS (container logs failover to ODS) call IMDS directly
+	if (useIMDSTokenProxyEndPoint != "" && strings.Compare(strings.ToLower(useIMDSTokenProxyEndPoint), "true") == 0) || (isAKSCluster && !IsWindows) {
+		Log("Info Reading IMDS Access Token from IMDS endpoint")
+		mcsEndpoint := os.Getenv("MCS_ENDPOINT")
+		responseBytes, err = requestIMDSAccessToken(fmt.Sprintf("https://%s/", mcsEndpoint), "")
+		if err != nil || responseBytes == nil {
 			return imdsAccessToken, expiration, err
 		}
 
 	} else {
-		resourceId := os.Getenv("AKS_RESOURCE_ID")
-		if resourceId != "" && strings.Contains(strings.ToLower(resourceId), strings.ToLower("Microsoft.ContainerService/managedClusters")) {
+		if isAKSCluster {
 			Log("Info Reading IMDS Access Token from file : %s", IMDSTokenPathForWindows)
 			if _, err = os.Stat(IMDSTokenPathForWindows); os.IsNotExist(err) {
 				Log("getAccessTokenFromIMDS: IMDS token file doesnt exist: %s", err.Error())
@@ -305,22 +325,30 @@ func getAccessTokenFromIMDS() (string, int64, error) {
 		return imdsAccessToken, expiration, err
 	}
 
+	imdsAccessToken, expiration, err = parseIMDSResponse(responseBytes)
+	if err != nil {
+		return imdsAccessToken, expiration, err
+	}
+	Log("Info getAccessTokenFromIMDS: end")
+	return imdsAccessToken, expiration, nil
+}
+
+// parseIMDSResponse returns the access token and its expiration (unix seconds) from the IMDS response body
+func parseIMDSResponse(responseBytes []byte) (string, int64, error) {
 	// Unmarshall response body into struct
 	var imdsResponse IMDSResponse
-	err = json.Unmarshal(responseBytes, &imdsResponse)
+	err := json.Unmarshal(responseBytes, &imdsResponse)
 	if err != nil {
 		Log("getAccessTokenFromIMDS: Error unmarshalling the response: %s", err.Error())
-		return imdsAccessToken, expiration, err
+		return "", 0, err
 	}
-	imdsAccessToken = imdsResponse.AccessToken
 
-	expiration, err = strconv.ParseInt(imdsResponse.ExpiresOn, 10, 64)
+	expiration, err := strconv.ParseInt(imdsResponse.ExpiresOn, 10, 64)
 	if err != nil {
 		Log("getAccessTokenFromIMDS: Error parsing ExpiresOn field from IMDS response: %s", err.Error())
-		return imdsAccessToken, expiration, err
+		return imdsResponse.AccessToken, expiration, err
 	}
-	Log("Info getAccessTokenFromIMDS: end")
-	return imdsAccessToken, expiration, nil
+	return imdsResponse.AccessToken, expiration, nil
 }
 
 func getAgentConfiguration(imdsAccessToken string) (configurationId string, channelId string, err error) {
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// env variables to configure the parsing of json log lines (set from log_collection_settings.json_parsing in the configmap)
+const ContainerLogJSONParsingEnabledEnv = "AZMON_JSON_LOG_PARSING_ENABLED"
+const ContainerLogJSONParsingModeEnv = "AZMON_JSON_LOG_PARSING_MODE"
+const ContainerLogJSONParsingNamespacesEnv = "AZMON_JSON_LOG_PARSING_NAMESPACES"
+const ContainerLogJSONParsingMaxSizeKBEnv = "AZMON_JSON_LOG_PARSING_MAX_SIZE_KB"
+
+// JSONLogParsingModeLogMessage emits the parsed json as the (dynamic) LogMessage column
+const JSONLogParsingModeLogMessage = "logmessage"
+
+// JSONLogParsingModeColumn keeps LogMessage as is and emits the parsed json in the ParsedLogMessage column
+const JSONLogParsingModeColumn = "column"
+
+// ParsedLogMessageColumn is the ContainerLogV2 column for the parsed json in JSONLogParsingModeColumn
+const ParsedLogMessageColumn = "ParsedLogMessage"
+
+const defaultContainerLogJSONParsingMaxSizeKB = 64
+
+// JSONLogParser parses the log lines which are json objects or arrays
+type JSONLogParser struct {
+	mode    string
+	maxSize int
+	// namespaces for which parsing is enabled, all namespaces if empty
+	namespaces map[string]bool
+}
+
+// NewJSONLogParser creates a parser which skips lines larger than maxSize bytes
+func NewJSONLogParser(mode string, namespaces []string, maxSize int) *JSONLogParser {
+	p := &JSONLogParser{
+		mode:       mode,
+		maxSize:    maxSize,
+		namespaces: make(map[string]bool),
+	}
+	for _, namespace := range namespaces {
+		namespace = strings.ToLower(strings.TrimSpace(namespace))
+		if namespace != "" {
+			p.namespaces[namespace] = true
+		}
+	}
+	return p
+}
+
+// IsEnabledForNamespace returns true if json parsing is enabled for the namespace
+func (p *JSONLogParser) IsEnabledForNamespace(k8sNamespace string) bool {
+	return len(p.namespaces) == 0 || p.namespaces[strings.ToLower(k8sNamespace)]
+}
+
+// ParseLine returns the compacted json of the log line, or nil if the line is not valid json.
+// oversized is true if the line looked like json but was larger than the size limit
+func (p *JSONLogParser) ParseLine(logEntry string) (parsed json.RawMessage, oversized bool) {
+	line := strings.TrimSpace(logEntry)
+	if len(line) < 2 || !((line[0] == '{' && line[len(line)-1] == '}') || (line[0] == '[' && line[len(line)-1] == ']')) {
+		return nil, false
+	}
+	if len(line) > p.maxSize {
+		return nil, true
+	}
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, []byte(line)); err != nil {
+		return nil, false
+	}
+	return json.RawMessage(buffer.Bytes()), false
+}
+
+// getContainerLogJSONParser returns the parser for the log lines of the namespace, the parser annotation of the pod takes precedence
+// over the cluster settings. Returns nil if the lines arent parsed
+func getContainerLogJSONParser(k8sNamespace string, workloadSettings *WorkloadLogSettings) *JSONLogParser {
+	if workloadSettings != nil && workloadSettings.Parser == WorkloadLogParserJSON {
+		return WorkloadJSONLogParser
+	}
+	if workloadSettings != nil && workloadSettings.Parser == WorkloadLogParserRaw {
+		return nil
+	}
+	if ContainerLogJSONParser == nil || !ContainerLogJSONParser.IsEnabledForNamespace(k8sNamespace) {
+		return nil
+	}
+	return ContainerLogJSONParser
+}
+
+// initializeContainerLogJSONParser creates the json log parser if enabled through the configmap settings
+func initializeContainerLogJSONParser() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogJSONParsingEnabledEnv))), "true") != 0 {
+		Log("Container log json parsing is disabled")
+		return
+	}
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogJSONParsingModeEnv)))
+	if mode != JSONLogParsingModeColumn {
+		mode = JSONLogParsingModeLogMessage
+	}
+	namespaces := strings.Split(os.Getenv(ContainerLogJSONParsingNamespacesEnv), ",")
+	maxSizeKB, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogJSONParsingMaxSizeKBEnv)))
+	if err != nil || maxSizeKB <= 0 {
+		maxSizeKB = defaultContainerLogJSONParsingMaxSizeKB
+	}
+	ContainerLogJSONParser = NewJSONLogParser(mode, namespaces, maxSizeKB*1024)
+	Log("Container log json parsing enabled. mode: %s, namespaces: %v, maxSizeKB: %d", mode, namespaces, maxSizeKB)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLogParserCompactsValidJSON(t *testing.T) {
+	p := NewJSONLogParser(JSONLogParsingModeLogMessage, nil, 1024)
+	parsed, oversized := p.ParseLine("{ \"level\": \"info\", \"msg\": \"started\" }\n")
+	assert.False(t, oversized)
+	assert.Equal(t, `{"level":"info","msg":"started"}`, string(parsed))
+}
+
+func TestJSONLogParserFallsBackToRawLine(t *testing.T) {
+	p := NewJSONLogParser(JSONLogParsingModeLogMessage, nil, 1024)
+	for _, line := range []string{"plain text", "{not json}", "\"quoted\"", "42"} {
+		parsed, oversized := p.ParseLine(line)
+		assert.Nil(t, parsed, line)
+		assert.False(t, oversized, line)
+	}
+}
+
+func TestJSONLogParserSkipsOversizedLines(t *testing.T) {
+	p := NewJSONLogParser(JSONLogParsingModeLogMessage, nil, 8)
+	parsed, oversized := p.ParseLine(`{"msg":"too long"}`)
+	assert.Nil(t, parsed)
+	assert.True(t, oversized)
+}
+
+func TestGetContainerLogJSONParserOnlyParsesConfiguredNamespaces(t *testing.T) {
+	clusterParser, workloadParser := ContainerLogJSONParser, WorkloadJSONLogParser
+	defer func() { ContainerLogJSONParser, WorkloadJSONLogParser = clusterParser, workloadParser }()
+	ContainerLogJSONParser = NewJSONLogParser(JSONLogParsingModeColumn, []string{"app"}, 1024)
+	WorkloadJSONLogParser = NewJSONLogParser(JSONLogParsingModeLogMessage, nil, 1024)
+
+	assert.Nil(t, getContainerLogJSONParser("kube-system", nil))
+	assert.True(t, ContainerLogJSONParser == getContainerLogJSONParser("App", nil))
+	// the parser annotation of the pod takes precedence over the namespaces of the cluster settings
+	assert.True(t, WorkloadJSONLogParser == getContainerLogJSONParser("kube-system", &WorkloadLogSettings{Parser: WorkloadLogParserJSON}))
+	assert.Nil(t, getContainerLogJSONParser("app", &WorkloadLogSettings{Parser: WorkloadLogParserRaw}))
+
+	ContainerLogJSONParser = nil
+	assert.Nil(t, getContainerLogJSONParser("app", nil))
+}
+
+func TestDataItemLAv2MarshalsParsedLogMessage(t *testing.T) {
+	item := DataItemLAv2{LogMessage: json.RawMessage(`{"msg":"x"}`)}
+	bytes, err := json.Marshal(item)
+	assert.NoError(t, err)
+	assert.Contains(t, string(bytes), `"LogMessage":{"msg":"x"}`)
+	assert.NotContains(t, string(bytes), ParsedLogMessageColumn)
+}
+
+func TestPostDataHelperParsesJSONLogsOfConfiguredNamespaces(t *testing.T) {
+	captureSink := setupContainerLogFlush(t, false)
+	clusterParser := ContainerLogJSONParser
+	defer func() { ContainerLogJSONParser = clusterParser }()
+	records := containerLogRecords(1)
+	records[0]["log"] = []byte(`{ "msg": "started" }`)
+
+	for _, test := range []struct {
+		namespaces []string
+		logMessage string
+	}{
+		{namespaces: []string{"default"}, logMessage: `{"msg":"started"}`},
+		{namespaces: []string{"app"}, logMessage: `{ "msg": "started" }`},
+	} {
+		ContainerLogJSONParser = NewJSONLogParser(JSONLogParsingModeLogMessage, test.namespaces, 1024)
+		assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+		_, _, sent := readForwardEntries(t, captureSink.lastFrame)
+		assert.Equal(t, test.logMessage, sent[0]["LogMessage"], test.namespaces)
+	}
+}
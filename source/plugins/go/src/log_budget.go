@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// env variables to configure the ingestion budgets of container logs (set from log_collection_settings.budgets in the configmap)
+const ContainerLogBudgetsEnabledEnv = "AZMON_LOG_BUDGETS_ENABLED"
+
+// base64 encoded json array of LogBudgetConfig
+const ContainerLogBudgetsEnv = "AZMON_LOG_BUDGETS"
+
+const LogBudgetExceededEventCategory = "container.azm.ms/logbudget"
+
+// budget periods
+const LogBudgetPeriodHour = "hour"
+const LogBudgetPeriodDay = "day"
+
+// LogBudgetConfig is a user supplied ingestion budget
+type LogBudgetConfig struct {
+	// namespace name or glob. Every matching namespace has its own budget
+	Namespace string `json:"namespace"`
+	// PerController gives every pod controller of the namespace its own budget
+	PerController bool   `json:"perController,omitempty"`
+	Period        string `json:"period"`
+	// MaxBytes & MaxLines are the limits per period, 0 for no limit
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	MaxLines int64 `json:"maxLines,omitempty"`
+}
+
+type logBudget struct {
+	config      LogBudgetConfig
+	windowStart time.Time
+	// usage of the current window by namespace or namespace/controller
+	usage map[string]*logBudgetUsage
+}
+
+type logBudgetUsage struct {
+	bytes int64
+	lines int64
+}
+
+// LogBudgetEvent summarizes the records dropped because a budget was exhausted
+type LogBudgetEvent struct {
+	Namespace    string
+	Controller   string
+	Budget       string
+	DroppedLines int64
+	DroppedBytes int64
+	FirstDrop    time.Time
+	LastDrop     time.Time
+}
+
+// LogBudgetEnforcer drops the container log records of the namespaces (or controllers) which exhausted their budget
+// for the current hour or day. The budget of a namespace is the first budget matching the namespace
+type LogBudgetEnforcer struct {
+	budgets []*logBudget
+	// usesControllers indicates whether any budget is per controller
+	usesControllers bool
+	mutex           sync.Mutex
+	// events of the drops since the last DrainEvents by namespace or namespace/controller
+	events map[string]*LogBudgetEvent
+	now    func() time.Time
+}
+
+var (
+	// ContainerControllerNameMap holds the pod controller names by container id when a budget is per controller
+	ContainerControllerNameMap = map[string]string{}
+	// ContainerControllerNameMutex read and write mutex access to the ContainerControllerNameMap
+	ContainerControllerNameMutex = &sync.RWMutex{}
+)
+
+// NewLogBudgetEnforcer validates the budgets
+func NewLogBudgetEnforcer(configs []LogBudgetConfig) (*LogBudgetEnforcer, error) {
+	e := &LogBudgetEnforcer{events: make(map[string]*LogBudgetEvent), now: time.Now}
+	for _, config := range configs {
+		config.Namespace = strings.ToLower(strings.TrimSpace(config.Namespace))
+		config.Period = strings.ToLower(strings.TrimSpace(config.Period))
+		if config.Namespace == "" {
+			return nil, fmt.Errorf("budget has no namespace")
+		}
+		if _, err := path.Match(config.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace glob %s of budget: %s", config.Namespace, err.Error())
+		}
+		if config.Period != LogBudgetPeriodHour && config.Period != LogBudgetPeriodDay {
+			return nil, fmt.Errorf("period %s of the budget of namespace %s is not hour or day", config.Period, config.Namespace)
+		}
+		if config.MaxBytes <= 0 && config.MaxLines <= 0 {
+			return nil, fmt.Errorf("budget of namespace %s has neither maxBytes nor maxLines", config.Namespace)
+		}
+		e.usesControllers = e.usesControllers || config.PerController
+		e.budgets = append(e.budgets, &logBudget{config: config, usage: make(map[string]*logBudgetUsage)})
+	}
+	return e, nil
+}
+
+func (b *logBudget) windowOf(t time.Time) time.Time {
+	t = t.UTC()
+	if b.config.Period == LogBudgetPeriodDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func (b *logBudget) String() string {
+	var limits []string
+	if b.config.MaxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", b.config.MaxBytes))
+	}
+	if b.config.MaxLines > 0 {
+		limits = append(limits, fmt.Sprintf("%d lines", b.config.MaxLines))
+	}
+	return fmt.Sprintf("%s per %s", strings.Join(limits, " or "), b.config.Period)
+}
+
+// Allow counts the record against the budget of its namespace & controller, and returns false if the budget is exhausted.
+// The returned undo takes the record back out of the usage (or the drops) when the flush is retried, nil if no budget applies.
+// A nil enforcer allows all records
+func (e *LogBudgetEnforcer) Allow(k8sNamespace string, controller string, size int) (bool, func()) {
+	if e == nil {
+		return true, nil
+	}
+	namespace := strings.ToLower(k8sNamespace)
+	for _, budget := range e.budgets {
+		if matched, _ := path.Match(budget.config.Namespace, namespace); !matched {
+			continue
+		}
+		key := namespace
+		if !budget.config.PerController {
+			controller = ""
+		} else {
+			key = namespace + "/" + controller
+		}
+
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		now := e.now()
+		if window := budget.windowOf(now); !window.Equal(budget.windowStart) {
+			budget.windowStart = window
+			budget.usage = make(map[string]*logBudgetUsage)
+		}
+		usage, ok := budget.usage[key]
+		if !ok {
+			usage = &logBudgetUsage{}
+			budget.usage[key] = usage
+		}
+		if (budget.config.MaxBytes > 0 && usage.bytes+int64(size) > budget.config.MaxBytes) ||
+			(budget.config.MaxLines > 0 && usage.lines+1 > budget.config.MaxLines) {
+			event, ok := e.events[key]
+			if !ok {
+				event = &LogBudgetEvent{Namespace: namespace, Controller: controller, Budget: budget.String(), FirstDrop: now}
+				e.events[key] = event
+			}
+			event.DroppedLines += 1
+			event.DroppedBytes += int64(size)
+			event.LastDrop = now
+			return false, func() { e.undoDrop(key, event, size) }
+		}
+		usage.bytes += int64(size)
+		usage.lines += 1
+		return true, func() { e.undoUsage(usage, size) }
+	}
+	return true, nil
+}
+
+// undoUsage takes an allowed record back out of the usage, the usage of an earlier window is no longer counted
+func (e *LogBudgetEnforcer) undoUsage(usage *logBudgetUsage, size int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	usage.bytes -= int64(size)
+	usage.lines -= 1
+}
+
+// undoDrop takes a dropped record back out of its event, the events already drained are no longer counted
+func (e *LogBudgetEnforcer) undoDrop(key string, event *LogBudgetEvent, size int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	event.DroppedLines -= 1
+	event.DroppedBytes -= int64(size)
+	if e.events[key] == event && event.DroppedLines <= 0 {
+		delete(e.events, key)
+	}
+}
+
+// DrainEvents returns the events of the drops since the last call
+func (e *LogBudgetEnforcer) DrainEvents() []LogBudgetEvent {
+	if e == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var events []LogBudgetEvent
+	for _, event := range e.events {
+		events = append(events, *event)
+	}
+	e.events = make(map[string]*LogBudgetEvent)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Namespace+"/"+events[i].Controller < events[j].Namespace+"/"+events[j].Controller
+	})
+	return events
+}
+
+// Message of the KubeMonAgentEvents record of the event
+func (event *LogBudgetEvent) Message() string {
+	target := "namespace " + event.Namespace
+	if event.Controller != "" {
+		target += " controller " + event.Controller
+	}
+	return fmt.Sprintf("Container log ingestion budget of %s exhausted for %s. Dropped %d log lines (%d bytes)", event.Budget, target, event.DroppedLines, event.DroppedBytes)
+}
+
+// getPodControllerName returns the name of the controller of the pod, with deployments resolved from their replica sets
+func getPodControllerName(pod *corev1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && owner.Kind == "ReplicaSet" {
+			return strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return owner.Name
+	}
+	return ""
+}
+
+// getContainerControllerName returns the controller name of the container from the pods of the node, or else guesses it from the pod name
+func getContainerControllerName(containerID string, k8sPodName string) string {
+	ContainerControllerNameMutex.RLock()
+	controller, ok := ContainerControllerNameMap[containerID]
+	ContainerControllerNameMutex.RUnlock()
+	if ok && controller != "" {
+		return controller
+	}
+	controller, _ = GetControllerNameFromK8sPodName(k8sPodName)
+	return controller
+}
+
+// getLogBudgetEventRecords returns the KubeMonAgentEvents records of the budget drops since the last flush
+func getLogBudgetEventRecords(collectionTime string) []laKubeMonAgentEvents {
+	var records []laKubeMonAgentEvents
+	for _, event := range ContainerLogBudgetEnforcer.DrainEvents() {
+		tagJson, err := json.Marshal(KubeMonAgentEventTags{
+			FirstOccurrence: event.FirstDrop.UTC().Format(time.RFC3339),
+			LastOccurrence:  event.LastDrop.UTC().Format(time.RFC3339),
+			Count:           int(event.DroppedLines),
+		})
+		if err != nil {
+			message := fmt.Sprintf("Error while Marshalling log budget event tags: %s", err.Error())
+			Log(message)
+			SendException(message)
+			continue
+		}
+		records = append(records, laKubeMonAgentEvents{
+			Computer:       Computer,
+			CollectionTime: collectionTime,
+			Category:       LogBudgetExceededEventCategory,
+			Level:          KubeMonAgentEventWarning,
+			ClusterId:      ResourceID,
+			ClusterName:    ResourceName,
+			Message:        event.Message(),
+			Tags:           fmt.Sprintf("%s", tagJson),
+		})
+	}
+	return records
+}
+
+// initializeContainerLogBudgetEnforcer creates the budget enforcer if enabled through the configmap settings
+func initializeContainerLogBudgetEnforcer() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogBudgetsEnabledEnv))), "true") != 0 {
+		Log("Container log ingestion budgets are disabled")
+		return
+	}
+	var budgets []LogBudgetConfig
+	if encodedBudgets := strings.TrimSpace(os.Getenv(ContainerLogBudgetsEnv)); encodedBudgets != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encodedBudgets)
+		if err == nil {
+			err = json.Unmarshal(decoded, &budgets)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Error::budgets::Unable to parse container log ingestion budgets, disabling them: %s", err.Error())
+			Log(message)
+			SendException(message)
+			return
+		}
+	}
+
+	enforcer, err := NewLogBudgetEnforcer(budgets)
+	if err != nil {
+		message := fmt.Sprintf("Error::budgets::Unable to initialize container log ingestion budgets: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	if len(enforcer.budgets) == 0 {
+		Log("Container log ingestion budgets are enabled but none is configured, disabling them")
+		return
+	}
+	ContainerLogBudgetEnforcer = enforcer
+	Log("Container log ingestion budgets enabled. budgets: %d", len(enforcer.budgets))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLogBudgetEnforcerAllow(t *testing.T) {
+	e, err := NewLogBudgetEnforcer([]LogBudgetConfig{
+		{Namespace: "batch", Period: "hour", MaxLines: 2},
+		{Namespace: "team-*", PerController: true, Period: "day", MaxBytes: 10},
+	})
+	assert.NoError(t, err)
+	assert.True(t, e.usesControllers)
+	now := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+	allow := func(e *LogBudgetEnforcer, namespace string, controller string, size int) bool {
+		allowed, _ := e.Allow(namespace, controller, size)
+		return allowed
+	}
+
+	assert.True(t, allow(e, "batch", "", 100))
+	assert.True(t, allow(e, "batch", "", 100))
+	assert.False(t, allow(e, "batch", "", 100))
+	assert.True(t, allow(e, "default", "", 100), "namespaces without a budget are not limited")
+
+	assert.True(t, allow(e, "team-a", "web", 6))
+	assert.False(t, allow(e, "team-a", "web", 6))
+	assert.True(t, allow(e, "team-a", "worker", 6), "each controller has its own budget")
+	assert.True(t, allow(e, "team-b", "web", 6), "each namespace has its own budget")
+
+	events := e.DrainEvents()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "batch", events[0].Namespace)
+	assert.Equal(t, int64(1), events[0].DroppedLines)
+	assert.Equal(t, int64(100), events[0].DroppedBytes)
+	assert.Equal(t, "Container log ingestion budget of 2 lines per hour exhausted for namespace batch. Dropped 1 log lines (100 bytes)", events[0].Message())
+	assert.Equal(t, "web", events[1].Controller)
+	assert.Empty(t, e.DrainEvents())
+
+	now = now.Add(time.Hour)
+	assert.True(t, allow(e, "batch", "", 100), "hourly budget is reset in the next hour")
+	assert.False(t, allow(e, "team-a", "web", 6), "daily budget is not reset in the next hour")
+
+	var nilEnforcer *LogBudgetEnforcer
+	assert.True(t, allow(nilEnforcer, "batch", "", 100))
+	assert.Nil(t, nilEnforcer.DrainEvents())
+}
+
+func TestLogBudgetEnforcerUndo(t *testing.T) {
+	e, err := NewLogBudgetEnforcer([]LogBudgetConfig{{Namespace: "batch", Period: "hour", MaxLines: 1}})
+	assert.NoError(t, err)
+
+	allowed, undo := e.Allow("batch", "", 100)
+	assert.True(t, allowed)
+	dropped, undoDrop := e.Allow("batch", "", 100)
+	assert.False(t, dropped)
+	undoDrop()
+	undo()
+	assert.Empty(t, e.DrainEvents(), "the drops of a retried flush arent reported")
+
+	allowed, _ = e.Allow("batch", "", 100)
+	assert.True(t, allowed, "the usage of a retried flush is taken back")
+	_, undo = e.Allow("default", "", 100)
+	assert.Nil(t, undo, "nothing to undo without a budget")
+}
+
+func TestPostDataHelperRetryIsntChargedAgain(t *testing.T) {
+	captureSink := setupContainerLogFlush(t, false)
+	enforcer := ContainerLogBudgetEnforcer
+	defer func() { ContainerLogBudgetEnforcer = enforcer }()
+	ContainerLogBudgetEnforcer, _ = NewLogBudgetEnforcer([]LogBudgetConfig{{Namespace: "default", Period: "day", MaxLines: 3}})
+	records := containerLogRecords(2)
+
+	ContainerLogSink = &fakeSink{connectErr: errors.New("connection refused")}
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+
+	ContainerLogSink = captureSink
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	_, _, sent := readForwardEntries(t, captureSink.lastFrame)
+	assert.Equal(t, 2, len(sent))
+	assert.Empty(t, ContainerLogBudgetEnforcer.DrainEvents())
+}
+
+func TestNewLogBudgetEnforcerInvalidBudgets(t *testing.T) {
+	_, err := NewLogBudgetEnforcer([]LogBudgetConfig{{Namespace: "batch", Period: "week", MaxLines: 1}})
+	assert.Error(t, err)
+	_, err = NewLogBudgetEnforcer([]LogBudgetConfig{{Namespace: "batch", Period: "hour"}})
+	assert.Error(t, err)
+	_, err = NewLogBudgetEnforcer([]LogBudgetConfig{{Period: "hour", MaxLines: 1}})
+	assert.Error(t, err)
+}
+
+func TestGetPodControllerName(t *testing.T) {
+	isController := true
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Labels:          map[string]string{"pod-template-hash": "5d4f8c7b9"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d4f8c7b9", Controller: &isController}},
+	}}
+	assert.Equal(t, "web", getPodControllerName(pod))
+
+	pod.Labels = nil
+	pod.OwnerReferences[0].Kind = "DaemonSet"
+	pod.OwnerReferences[0].Name = "node-exporter"
+	assert.Equal(t, "node-exporter", getPodControllerName(pod))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variables to configure the deduplication of repeated log lines (set from log_collection_settings.deduplication in the configmap)
+const ContainerLogDedupEnabledEnv = "AZMON_LOG_DEDUP_ENABLED"
+const ContainerLogDedupWindowSecondsEnv = "AZMON_LOG_DEDUP_WINDOW_SECONDS"
+const ContainerLogDedupMaxEntriesEnv = "AZMON_LOG_DEDUP_MAX_ENTRIES"
+
+const defaultContainerLogDedupWindowSeconds = 60
+const defaultContainerLogDedupMaxEntries = 10000
+
+// keys added to the summary record of suppressed duplicates
+const dedupRepeatCountKey = "repeat_count"
+const dedupFirstTimeKey = "first_time"
+const dedupLastTimeKey = "last_time"
+
+// ContainerLogV2 columns of the summary record of suppressed duplicates
+const RepeatCountColumn = "RepeatCount"
+const FirstTimeGeneratedColumn = "FirstTimeGenerated"
+const LastTimeGeneratedColumn = "LastTimeGenerated"
+
+// LogDeduplicator suppresses identical (container, stream, message) lines within a window.
+// The first line is passed through as is. Once the window ends, the duplicates are emitted as a single
+// summary record with the repeat count and the times of the first & last duplicate. The repeat count and
+// the first time are of the suppressed duplicates only, the first line was already sent on its own
+type LogDeduplicator struct {
+	window     time.Duration
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[uint64]*dedupEntry
+}
+
+type dedupEntry struct {
+	// record of the first duplicate
+	record    map[interface{}]interface{}
+	count     int
+	firstTime string
+	lastTime  string
+	firstSeen time.Time
+}
+
+// NewLogDeduplicator creates a deduplicator which tracks at most maxEntries distinct lines
+func NewLogDeduplicator(window time.Duration, maxEntries int) *LogDeduplicator {
+	return &LogDeduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[uint64]*dedupEntry),
+	}
+}
+
+// dedupUndo records the changes of a Process call, so that they can be rolled back if the flush is retried
+type dedupUndo struct {
+	added    []uint64
+	expired  map[uint64]*dedupEntry
+	modified map[*dedupEntry]dedupEntry
+}
+
+// Process returns the records without the duplicates seen within the window, plus the summary records of the windows which ended.
+// The rollback restores the state as it was before the call, so that a retried flush isnt suppressed as duplicates of itself
+func (d *LogDeduplicator) Process(records []map[interface{}]interface{}) (output []map[interface{}]interface{}, suppressedLines int, rollback func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	undo := &dedupUndo{expired: make(map[uint64]*dedupEntry), modified: make(map[*dedupEntry]dedupEntry)}
+	output = make([]map[interface{}]interface{}, 0, len(records))
+	output = d.flushExpiredLocked(output, now, undo)
+
+	for _, record := range records {
+		containerID, _, _, _ := GetContainerIDK8sNamespacePodNameFromFileName(ToString(record["filepath"]))
+		if containerID == "" {
+			output = append(output, record)
+			continue
+		}
+		key := dedupKey(containerID, ToString(record["stream"]), ToString(record["log"]))
+		entry, ok := d.entries[key]
+		if !ok {
+			if len(d.entries) < d.maxEntries {
+				d.entries[key] = &dedupEntry{firstSeen: now}
+				undo.added = append(undo.added, key)
+			}
+			output = append(output, record)
+			continue
+		}
+		if _, ok := undo.modified[entry]; !ok {
+			undo.modified[entry] = *entry
+		}
+		if entry.count == 0 {
+			entry.record = record
+			entry.firstTime = ToString(record["time"])
+		}
+		entry.count += 1
+		entry.lastTime = ToString(record["time"])
+		suppressedLines += 1
+	}
+	return output, suppressedLines, func() { d.rollback(undo) }
+}
+
+func (d *LogDeduplicator) rollback(undo *dedupUndo) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for entry, previous := range undo.modified {
+		*entry = previous
+	}
+	for _, key := range undo.added {
+		delete(d.entries, key)
+	}
+	for key, entry := range undo.expired {
+		d.entries[key] = entry
+	}
+}
+
+// Len returns the number of distinct lines being tracked
+func (d *LogDeduplicator) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.entries)
+}
+
+func (d *LogDeduplicator) flushExpiredLocked(output []map[interface{}]interface{}, now time.Time, undo *dedupUndo) []map[interface{}]interface{} {
+	var expired []*dedupEntry
+	for key, entry := range d.entries {
+		if now.Sub(entry.firstSeen) >= d.window {
+			if entry.count > 0 {
+				expired = append(expired, entry)
+			}
+			undo.expired[key] = entry
+			delete(d.entries, key)
+		}
+	}
+	// flush in the order the windows started
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].firstSeen.Before(expired[j].firstSeen)
+	})
+	for _, entry := range expired {
+		output = append(output, entry.toRecord())
+	}
+	return output
+}
+
+func (entry *dedupEntry) toRecord() map[interface{}]interface{} {
+	record := make(map[interface{}]interface{}, len(entry.record)+3)
+	for k, v := range entry.record {
+		record[k] = v
+	}
+	record["time"] = []byte(entry.lastTime)
+	record[dedupRepeatCountKey] = []byte(strconv.Itoa(entry.count))
+	record[dedupFirstTimeKey] = []byte(entry.firstTime)
+	record[dedupLastTimeKey] = []byte(entry.lastTime)
+	return record
+}
+
+// getDedupSummaryLogEntry returns the log line of a summary record for the ContainerLog (v1) schema, which has no columns for the summary
+func getDedupSummaryLogEntry(logEntry string, repeatCount string, firstTime string, lastTime string) string {
+	return fmt.Sprintf("%s (repeated %s more times from %s to %s)", strings.TrimRight(logEntry, "\r\n"), repeatCount, firstTime, lastTime)
+}
+
+func dedupKey(containerID string, stream string, message string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(containerID))
+	h.Write([]byte{0})
+	h.Write([]byte(stream))
+	h.Write([]byte{0})
+	h.Write([]byte(message))
+	return h.Sum64()
+}
+
+// initializeContainerLogDeduplicator creates the deduplicator if enabled through the configmap settings
+func initializeContainerLogDeduplicator() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogDedupEnabledEnv))), "true") != 0 {
+		Log("Container log deduplication is disabled")
+		return
+	}
+	windowSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogDedupWindowSecondsEnv)))
+	if err != nil || windowSeconds <= 0 {
+		windowSeconds = defaultContainerLogDedupWindowSeconds
+	}
+	maxEntries, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogDedupMaxEntriesEnv)))
+	if err != nil || maxEntries <= 0 {
+		maxEntries = defaultContainerLogDedupMaxEntries
+	}
+	ContainerLogDeduplicator = NewLogDeduplicator(time.Duration(windowSeconds)*time.Second, maxEntries)
+	Log("Container log deduplication enabled. windowSeconds: %d, maxEntries: %d", windowSeconds, maxEntries)
+}
+
+// deduplicateContainerLogs suppresses the repeated container log lines if the deduplicator is enabled.
+// The rollback is nil if the deduplicator is disabled
+func deduplicateContainerLogs(records []map[interface{}]interface{}) ([]map[interface{}]interface{}, func()) {
+	if ContainerLogDeduplicator == nil {
+		return records, nil
+	}
+	output, suppressedLines, rollback := ContainerLogDeduplicator.Process(records)
+	if suppressedLines > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsDedupSuppressedLinesCount += float64(suppressedLines)
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	return output, rollback
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func timedRecord(stream string, log string, timestamp string) map[interface{}]interface{} {
+	record := criRecord(testContainerLogFilePath, stream, "F", log)
+	record["time"] = []byte(timestamp)
+	return record
+}
+
+func TestLogDeduplicatorSuppressesRepeatsWithinWindow(t *testing.T) {
+	d := NewLogDeduplicator(time.Millisecond, 100)
+	output, suppressed, _ := d.Process([]map[interface{}]interface{}{
+		timedRecord("stdout", "GET /healthz 200", "2024-01-01T00:00:01Z"),
+		timedRecord("stderr", "GET /healthz 200", "2024-01-01T00:00:01Z"),
+		timedRecord("stdout", "GET /healthz 200", "2024-01-01T00:00:02Z"),
+		timedRecord("stdout", "GET /healthz 200", "2024-01-01T00:00:03Z"),
+	})
+	assert.Equal(t, 2, suppressed)
+	assert.Equal(t, 2, len(output))
+	time.Sleep(5 * time.Millisecond)
+
+	output, suppressed, _ = d.Process(nil)
+	assert.Equal(t, 0, suppressed)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "GET /healthz 200", ToString(output[0]["log"]))
+	assert.Equal(t, "2", ToString(output[0][dedupRepeatCountKey]))
+	assert.Equal(t, "2024-01-01T00:00:02Z", ToString(output[0][dedupFirstTimeKey]))
+	assert.Equal(t, "2024-01-01T00:00:03Z", ToString(output[0][dedupLastTimeKey]))
+	assert.Equal(t, 0, d.Len())
+}
+
+func TestLogDeduplicatorPassesThroughWhenFull(t *testing.T) {
+	d := NewLogDeduplicator(time.Minute, 1)
+	output, suppressed, _ := d.Process([]map[interface{}]interface{}{
+		timedRecord("stdout", "a", "2024-01-01T00:00:01Z"),
+		timedRecord("stdout", "b", "2024-01-01T00:00:01Z"),
+		timedRecord("stdout", "b", "2024-01-01T00:00:02Z"),
+	})
+	assert.Equal(t, 0, suppressed)
+	assert.Equal(t, 3, len(output))
+	assert.Equal(t, 1, d.Len())
+}
+
+func TestLogDeduplicatorRollback(t *testing.T) {
+	d := NewLogDeduplicator(time.Minute, 100)
+	d.Process([]map[interface{}]interface{}{timedRecord("stdout", "a", "2024-01-01T00:00:01Z")})
+	_, suppressed, rollback := d.Process([]map[interface{}]interface{}{
+		timedRecord("stdout", "a", "2024-01-01T00:00:02Z"),
+		timedRecord("stdout", "b", "2024-01-01T00:00:02Z"),
+	})
+	assert.Equal(t, 1, suppressed)
+	rollback()
+
+	// the resent records are processed like the first time
+	output, suppressed, _ := d.Process([]map[interface{}]interface{}{
+		timedRecord("stdout", "a", "2024-01-01T00:00:02Z"),
+		timedRecord("stdout", "b", "2024-01-01T00:00:02Z"),
+	})
+	assert.Equal(t, 1, suppressed)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "b", ToString(output[0]["log"]))
+	assert.Equal(t, 1, d.entries[dedupKey("0123456789abcdef", "stdout", "a")].count)
+}
+
+func TestLogDeduplicatorRollbackRestoresExpiredEntries(t *testing.T) {
+	d := NewLogDeduplicator(time.Millisecond, 100)
+	d.Process([]map[interface{}]interface{}{
+		timedRecord("stdout", "a", "2024-01-01T00:00:01Z"),
+		timedRecord("stdout", "a", "2024-01-01T00:00:02Z"),
+	})
+	time.Sleep(5 * time.Millisecond)
+	output, _, rollback := d.Process(nil)
+	assert.Equal(t, 1, len(output))
+	rollback()
+	assert.Equal(t, 1, d.Len())
+
+	output, _, _ = d.Process(nil)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "1", ToString(output[0][dedupRepeatCountKey]))
+}
+
+func TestPostDataHelperSummarizesDuplicatesInContainerLogV1(t *testing.T) {
+	captureSink := setupContainerLogFlush(t, false)
+	ContainerLogSchemaV2, ContainerLogV2ConfigMap = false, false
+	record := timedRecord("stdout", "GET /healthz 200\n", "2024-01-01T00:00:03Z")
+	record[dedupRepeatCountKey] = []byte("2")
+	record[dedupFirstTimeKey] = []byte("2024-01-01T00:00:02Z")
+	record[dedupLastTimeKey] = []byte("2024-01-01T00:00:03Z")
+
+	assert.Equal(t, output.FLB_OK, PostDataHelper([]map[interface{}]interface{}{record}))
+	_, _, sent := readForwardEntries(t, captureSink.lastFrame)
+	assert.Equal(t, "GET /healthz 200 (repeated 2 more times from 2024-01-01T00:00:02Z to 2024-01-01T00:00:03Z)", sent[0]["LogEntry"])
+}
+
+func TestPostDataHelperRetryIsntSuppressed(t *testing.T) {
+	captureSink := setupContainerLogFlush(t, false)
+	deduplicator := ContainerLogDeduplicator
+	defer func() { ContainerLogDeduplicator = deduplicator }()
+	ContainerLogDeduplicator = NewLogDeduplicator(time.Minute, 100)
+	records := append(containerLogRecords(1), containerLogRecords(1)...)
+
+	ContainerLogSink = &fakeSink{connectErr: errors.New("connection refused")}
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+
+	ContainerLogSink = captureSink
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	_, _, sent := readForwardEntries(t, captureSink.lastFrame)
+	assert.Equal(t, 1, len(sent))
+}
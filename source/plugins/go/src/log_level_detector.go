@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// env variables to configure the log level detection (set from log_collection_settings.log_level in the configmap)
+const ContainerLogLevelDetectionEnabledEnv = "AZMON_LOG_LEVEL_DETECTION_ENABLED"
+const ContainerLogLevelDetectorsEnv = "AZMON_LOG_LEVEL_DETECTORS"
+const ContainerLogLevelJSONKeysEnv = "AZMON_LOG_LEVEL_JSON_KEYS"
+
+// base64 encoded json array of regexes with a named capture group "level"
+const ContainerLogLevelCustomPatternsEnv = "AZMON_LOG_LEVEL_CUSTOM_PATTERNS"
+
+// LogLevelColumn is the ContainerLogV2 column for the detected log level
+const LogLevelColumn = "LogLevel"
+
+// built-in log level detectors
+const LogLevelDetectorJSON = "json"
+const LogLevelDetectorLogfmt = "logfmt"
+const LogLevelDetectorKlog = "klog"
+const LogLevelDetectorBracket = "bracket"
+
+const defaultContainerLogLevelDetectors = "json,logfmt,klog,bracket"
+const defaultContainerLogLevelJSONKeys = "level,severity,lvl,loglevel"
+
+// normalized log levels
+const LogLevelCritical = "critical"
+const LogLevelError = "error"
+const LogLevelWarning = "warning"
+const LogLevelInfo = "info"
+const LogLevelDebug = "debug"
+const LogLevelTrace = "trace"
+const LogLevelUnknown = "unknown"
+
+var logLevelAliases = map[string]string{
+	"fatal":       LogLevelCritical,
+	"panic":       LogLevelCritical,
+	"crit":        LogLevelCritical,
+	"critical":    LogLevelCritical,
+	"emerg":       LogLevelCritical,
+	"emergency":   LogLevelCritical,
+	"alert":       LogLevelCritical,
+	"f":           LogLevelCritical,
+	"err":         LogLevelError,
+	"error":       LogLevelError,
+	"e":           LogLevelError,
+	"warn":        LogLevelWarning,
+	"warning":     LogLevelWarning,
+	"w":           LogLevelWarning,
+	"info":        LogLevelInfo,
+	"information": LogLevelInfo,
+	"notice":      LogLevelInfo,
+	"i":           LogLevelInfo,
+	"debug":       LogLevelDebug,
+	"dbg":         LogLevelDebug,
+	"d":           LogLevelDebug,
+	"trace":       LogLevelTrace,
+	"verbose":     LogLevelTrace,
+}
+
+var (
+	logfmtLevelRegex  = regexp.MustCompile(`(?i)(?:^|\s)(?:level|lvl|severity)="?([A-Za-z]+)`)
+	klogLevelRegex    = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}`)
+	bracketLevelRegex = regexp.MustCompile(`(?i)\[(trace|debug|dbg|info|information|notice|warn|warning|err|error|crit|critical|fatal|panic)\]`)
+)
+
+// NormalizeLogLevel maps a level name (or a bunyan/pino numeric level) to one of the normalized log levels, or "" if it is not a known level
+func NormalizeLogLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if normalized, ok := logLevelAliases[level]; ok {
+		return normalized
+	}
+	if number, err := strconv.Atoi(level); err == nil {
+		switch {
+		case number >= 60:
+			return LogLevelCritical
+		case number >= 50:
+			return LogLevelError
+		case number >= 40:
+			return LogLevelWarning
+		case number >= 30:
+			return LogLevelInfo
+		case number >= 20:
+			return LogLevelDebug
+		case number >= 10:
+			return LogLevelTrace
+		}
+	}
+	return ""
+}
+
+// LogLevelDetector detects the severity of log lines
+type LogLevelDetector struct {
+	detectors      map[string]bool
+	jsonKeys       []string
+	customPatterns []*regexp.Regexp
+}
+
+// NewLogLevelDetector creates a detector from the given built-in detectors, json keys & custom patterns
+func NewLogLevelDetector(detectors []string, jsonKeys []string, customPatterns []string) (*LogLevelDetector, error) {
+	d := &LogLevelDetector{detectors: make(map[string]bool)}
+	for _, detector := range detectors {
+		detector = strings.ToLower(strings.TrimSpace(detector))
+		switch detector {
+		case "":
+			continue
+		case LogLevelDetectorJSON, LogLevelDetectorLogfmt, LogLevelDetectorKlog, LogLevelDetectorBracket:
+			d.detectors[detector] = true
+		default:
+			return nil, fmt.Errorf("unsupported log level detector %s", detector)
+		}
+	}
+	for _, key := range jsonKeys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key != "" {
+			d.jsonKeys = append(d.jsonKeys, key)
+		}
+	}
+	for _, customPattern := range customPatterns {
+		pattern, err := regexp.Compile(customPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level pattern %s: %s", customPattern, err.Error())
+		}
+		if pattern.SubexpIndex("level") < 0 {
+			return nil, fmt.Errorf("log level pattern %s has no capture group named level", customPattern)
+		}
+		d.customPatterns = append(d.customPatterns, pattern)
+	}
+	return d, nil
+}
+
+// Detect returns the normalized log level of the log line, or "unknown" if it couldnt be detected
+func (d *LogLevelDetector) Detect(logEntry string) string {
+	return d.DetectParsed(logEntry, nil)
+}
+
+// DetectParsed is Detect for a line the json log parser already parsed, the compacted json is reused instead of parsing the line again.
+// parsedLogMessage is nil if the line wasnt parsed
+func (d *LogLevelDetector) DetectParsed(logEntry string, parsedLogMessage json.RawMessage) string {
+	for _, pattern := range d.customPatterns {
+		if match := pattern.FindStringSubmatch(logEntry); match != nil {
+			if level := NormalizeLogLevel(match[pattern.SubexpIndex("level")]); level != "" {
+				return level
+			}
+		}
+	}
+	line := strings.TrimSpace(logEntry)
+	if d.detectors[LogLevelDetectorJSON] && strings.HasPrefix(line, "{") {
+		if parsedLogMessage == nil {
+			parsedLogMessage = json.RawMessage(line)
+		}
+		if level := d.detectJSONLevel(parsedLogMessage); level != "" {
+			return level
+		}
+	}
+	if d.detectors[LogLevelDetectorLogfmt] {
+		if match := logfmtLevelRegex.FindStringSubmatch(line); match != nil {
+			if level := NormalizeLogLevel(match[1]); level != "" {
+				return level
+			}
+		}
+	}
+	if d.detectors[LogLevelDetectorKlog] {
+		if match := klogLevelRegex.FindStringSubmatch(line); match != nil {
+			return NormalizeLogLevel(match[1])
+		}
+	}
+	if d.detectors[LogLevelDetectorBracket] {
+		if match := bracketLevelRegex.FindStringSubmatch(line); match != nil {
+			return NormalizeLogLevel(match[1])
+		}
+	}
+	return LogLevelUnknown
+}
+
+// detectJSONLevel returns the level of the json object, only the value of the level field is decoded
+func (d *LogLevelDetector) detectJSONLevel(object json.RawMessage) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(object, &fields); err != nil {
+		return ""
+	}
+	for _, key := range d.jsonKeys {
+		for field, rawValue := range fields {
+			if !strings.EqualFold(field, key) {
+				continue
+			}
+			var value interface{}
+			if err := json.Unmarshal(rawValue, &value); err != nil {
+				continue
+			}
+			switch v := value.(type) {
+			case string:
+				return NormalizeLogLevel(v)
+			case float64:
+				return NormalizeLogLevel(strconv.Itoa(int(v)))
+			}
+		}
+	}
+	return ""
+}
+
+// initializeContainerLogLevelDetector creates the log level detector if enabled through the configmap settings
+func initializeContainerLogLevelDetector() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogLevelDetectionEnabledEnv))), "true") != 0 {
+		Log("Container log level detection is disabled")
+		return
+	}
+	detectors := defaultContainerLogLevelDetectors
+	if value, ok := os.LookupEnv(ContainerLogLevelDetectorsEnv); ok {
+		detectors = strings.TrimSpace(value)
+	}
+	jsonKeys := strings.TrimSpace(os.Getenv(ContainerLogLevelJSONKeysEnv))
+	if jsonKeys == "" {
+		jsonKeys = defaultContainerLogLevelJSONKeys
+	}
+	var customPatterns []string
+	if encodedPatterns := strings.TrimSpace(os.Getenv(ContainerLogLevelCustomPatternsEnv)); encodedPatterns != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encodedPatterns)
+		if err == nil {
+			err = json.Unmarshal(decoded, &customPatterns)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Error::loglevel::Unable to parse custom log level patterns, ignoring them: %s", err.Error())
+			Log(message)
+			SendException(message)
+			customPatterns = nil
+		}
+	}
+
+	detector, err := NewLogLevelDetector(strings.Split(detectors, ","), strings.Split(jsonKeys, ","), customPatterns)
+	if err != nil {
+		message := fmt.Sprintf("Error::loglevel::Unable to initialize container log level detection: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	ContainerLogLevelDetector = detector
+	Log("Container log level detection enabled. detectors: %s, jsonKeys: %s, custom patterns: %d", detectors, jsonKeys, len(customPatterns))
+}
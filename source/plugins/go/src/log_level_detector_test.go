@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelDetectorBuiltInFormats(t *testing.T) {
+	d, err := NewLogLevelDetector([]string{"json", "logfmt", "klog", "bracket"}, []string{"level", "severity"}, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, LogLevelError, d.Detect(`{"msg":"failed","Severity":"ERROR"}`))
+	assert.Equal(t, LogLevelWarning, d.Detect(`{"level":40,"msg":"pino warning"}`))
+	assert.Equal(t, LogLevelDebug, d.Detect(`time=2024-01-01T00:00:00Z level=debug msg="cache miss"`))
+	assert.Equal(t, LogLevelError, d.Detect(`E0101 12:00:00.000000       1 controller.go:42] sync failed`))
+	assert.Equal(t, LogLevelInfo, d.Detect(`I0101 12:00:00.000000       1 main.go:10] started`))
+	assert.Equal(t, LogLevelWarning, d.Detect(`2024-01-01 12:00:00 [WARN] disk almost full`))
+	assert.Equal(t, LogLevelCritical, d.Detect(`level=fatal msg="out of memory"`))
+	assert.Equal(t, LogLevelUnknown, d.Detect(`GET /healthz 200`))
+}
+
+func TestLogLevelDetectorReusesParsedJSON(t *testing.T) {
+	d, err := NewLogLevelDetector([]string{"json"}, []string{"level"}, nil)
+	assert.NoError(t, err)
+	p := NewJSONLogParser(JSONLogParsingModeLogMessage, nil, 1024)
+	line := "{ \"level\": \"warn\", \"msg\": { \"text\": \"disk almost full\" } }"
+	parsed, _ := p.ParseLine(line)
+	assert.Equal(t, LogLevelWarning, d.DetectParsed(line, parsed))
+	// the level comes from the parsed json rather than the line
+	assert.Equal(t, LogLevelError, d.DetectParsed(line, json.RawMessage(`{"level":"error"}`)))
+	assert.Equal(t, LogLevelUnknown, d.DetectParsed(`{"msg":"no level"`, nil))
+}
+
+func TestLogLevelDetectorOnlyUsesConfiguredDetectors(t *testing.T) {
+	d, err := NewLogLevelDetector([]string{"klog"}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelUnknown, d.Detect(`[ERROR] failed`))
+	assert.Equal(t, LogLevelError, d.Detect(`E0101 12:00:00.000000       1 controller.go:42] sync failed`))
+}
+
+func TestLogLevelDetectorCustomPatterns(t *testing.T) {
+	d, err := NewLogLevelDetector(nil, nil, []string{`^\S+ \S+ (?P<level>[A-Z]+) `})
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelError, d.Detect(`2024-01-01 12:00:00 ERR payment failed`))
+
+	_, err = NewLogLevelDetector(nil, nil, []string{`^(ERROR|INFO)`})
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// env variables to configure the redaction of container log messages (set from log_collection_settings.redaction in the configmap)
+const ContainerLogRedactionEnabledEnv = "AZMON_LOG_REDACTION_ENABLED"
+const ContainerLogRedactionPresetsEnv = "AZMON_LOG_REDACTION_PRESETS"
+
+// base64 encoded json array of {"name": "...", "pattern": "...", "replacement": "..."}
+const ContainerLogRedactionRulesEnv = "AZMON_LOG_REDACTION_RULES"
+const ContainerLogRedactionReplacementEnv = "AZMON_LOG_REDACTION_REPLACEMENT"
+
+// {rule} in the replacement template is replaced with the name of the rule which matched
+const redactionRuleNamePlaceholder = "{rule}"
+const defaultContainerLogRedactionReplacement = "[REDACTED:{rule}]"
+
+// RedactionRuleConfig is a user supplied redaction rule
+type RedactionRuleConfig struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+type redactionPreset struct {
+	pattern string
+	// validate filters out matches which arent real secrets, optional
+	validate func(match string) bool
+}
+
+// built-in redaction rules
+var redactionPresets = map[string]redactionPreset{
+	"jwt":               {pattern: `eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`},
+	"azure_storage_key": {pattern: `(?i)\b(?:AccountKey|SharedAccessKey)=[A-Za-z0-9+/]+={0,2}|\b[A-Za-z0-9+/]{86}==`},
+	"sas_token":         {pattern: `(?i)\bsig=[A-Za-z0-9%+/=]+`},
+	"credit_card":       {pattern: `\b(?:\d[ -]?){12,18}\d\b`, validate: isLuhnValid},
+	"email":             {pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+}
+
+type redactionRule struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	validate    func(match string) bool
+}
+
+// LogRedactor replaces the parts of log messages which match any of its rules
+type LogRedactor struct {
+	rules []redactionRule
+}
+
+// NewLogRedactor creates a redactor from the given presets & user rules. replacement is the default replacement template
+func NewLogRedactor(presets []string, rules []RedactionRuleConfig, replacement string) (*LogRedactor, error) {
+	r := &LogRedactor{}
+	for _, name := range presets {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		preset, ok := redactionPresets[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported redaction preset %s", name)
+		}
+		r.rules = append(r.rules, redactionRule{
+			name:        name,
+			pattern:     regexp.MustCompile(preset.pattern),
+			replacement: strings.ReplaceAll(replacement, redactionRuleNamePlaceholder, name),
+			validate:    preset.validate,
+		})
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for redaction rule %s: %s", rule.Name, err.Error())
+		}
+		ruleReplacement := replacement
+		if rule.Replacement != "" {
+			ruleReplacement = rule.Replacement
+		}
+		r.rules = append(r.rules, redactionRule{
+			name:        rule.Name,
+			pattern:     pattern,
+			replacement: strings.ReplaceAll(ruleReplacement, redactionRuleNamePlaceholder, rule.Name),
+		})
+	}
+	return r, nil
+}
+
+// Redact returns the message with the matches of all rules replaced. The number of replacements per rule is added to hits
+func (r *LogRedactor) Redact(message string, hits map[string]int) string {
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(message) {
+			continue
+		}
+		message = rule.pattern.ReplaceAllStringFunc(message, func(match string) string {
+			if rule.validate != nil && !rule.validate(match) {
+				return match
+			}
+			hits[rule.name] += 1
+			return rule.replacement
+		})
+	}
+	return message
+}
+
+// isLuhnValid checks the luhn checksum of the digits in s
+func isLuhnValid(s string) bool {
+	sum := 0
+	digits := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits += 1
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// initializeContainerLogRedactor creates the log redactor if enabled through the configmap settings
+func initializeContainerLogRedactor() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogRedactionEnabledEnv))), "true") != 0 {
+		Log("Container log redaction is disabled")
+		return
+	}
+	presets := strings.Split(os.Getenv(ContainerLogRedactionPresetsEnv), ",")
+	replacement := os.Getenv(ContainerLogRedactionReplacementEnv)
+	if replacement == "" {
+		replacement = defaultContainerLogRedactionReplacement
+	}
+	var rules []RedactionRuleConfig
+	if encodedRules := strings.TrimSpace(os.Getenv(ContainerLogRedactionRulesEnv)); encodedRules != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encodedRules)
+		if err == nil {
+			err = json.Unmarshal(decoded, &rules)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Error::redaction::Unable to parse redaction rules, ignoring them: %s", err.Error())
+			Log(message)
+			SendException(message)
+			rules = nil
+		}
+	}
+
+	redactor, err := NewLogRedactor(presets, rules, replacement)
+	if err != nil {
+		message := fmt.Sprintf("Error::redaction::Unable to initialize container log redaction: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	if len(redactor.rules) == 0 {
+		Log("Container log redaction is enabled but has no rules, disabling it")
+		return
+	}
+	ContainerLogRedactor = redactor
+	Log("Container log redaction enabled. presets: %v, rules: %d", presets, len(rules))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// env variables to configure the routing of container log records (set from log_collection_settings.routing in the configmap)
+const ContainerLogRoutingEnabledEnv = "AZMON_LOG_ROUTING_ENABLED"
+
+// base64 encoded json array of LogRoutingRuleConfig
+const ContainerLogRoutingRulesEnv = "AZMON_LOG_ROUTING_RULES"
+
+// LogRoutingRuleConfig is a user supplied routing rule. All the set predicates must match for the rule to match
+type LogRoutingRuleConfig struct {
+	Name string `json:"name"`
+	// namespace names or globs
+	Namespaces []string `json:"namespaces,omitempty"`
+	// kubernetes label selector on the pod labels, e.g. app=payments,tier!=cache
+	PodLabelSelector string `json:"podLabelSelector,omitempty"`
+	// container names or globs
+	Containers []string `json:"containers,omitempty"`
+	// stdout and/or stderr
+	Streams []string `json:"streams,omitempty"`
+	// normalized log levels (see NormalizeLogLevel)
+	LogLevels []string `json:"logLevels,omitempty"`
+	// regex on the log message
+	MessagePattern string `json:"messagePattern,omitempty"`
+	// Tag is the output stream id tag the matching records are sent to
+	Tag string `json:"tag"`
+	// NamedPipe of the output stream on windows, looked up from the ContainerLogV2 extension settings if not set
+	NamedPipe string `json:"namedPipe,omitempty"`
+}
+
+// LogRoutingRule is a compiled routing rule
+type LogRoutingRule struct {
+	Name           string
+	Tag            string
+	NamedPipe      string
+	namespaces     []string
+	podLabels      labels.Selector
+	containers     []string
+	streams        map[string]bool
+	logLevels      map[string]bool
+	messagePattern *regexp.Regexp
+}
+
+// LogRouteInput holds the attributes of a record the rules are evaluated on. The pod labels & log level are resolved lazily
+// since most rules dont use them
+type LogRouteInput struct {
+	Namespace string
+	Container string
+	Stream    string
+	Message   string
+	PodLabels func() labels.Set
+	LogLevel  func() string
+}
+
+// LogRouter sends the records matching a routing rule to the rule's output stream instead of the default one.
+// Rules are evaluated in order and the first matching rule wins
+type LogRouter struct {
+	rules []*LogRoutingRule
+	// usesPodLabels indicates whether any rule has a pod label selector
+	usesPodLabels bool
+	// levelDetector detects the log level for the rules with log levels when the record has no LogLevel
+	levelDetector *LogLevelDetector
+}
+
+var (
+	// ContainerPodLabelsMap holds the pod labels by container id when a routing rule uses them
+	ContainerPodLabelsMap = map[string]map[string]string{}
+	// ContainerPodLabelsMutex read and write mutex access to the ContainerPodLabelsMap
+	ContainerPodLabelsMutex = &sync.RWMutex{}
+)
+
+// NewLogRouter compiles the routing rules
+func NewLogRouter(configs []LogRoutingRuleConfig) (*LogRouter, error) {
+	r := &LogRouter{}
+	for i, config := range configs {
+		name := strings.TrimSpace(config.Name)
+		if name == "" {
+			name = fmt.Sprintf("rule%d", i+1)
+		}
+		rule := &LogRoutingRule{
+			Name:       name,
+			Tag:        strings.TrimSpace(config.Tag),
+			NamedPipe:  strings.TrimSpace(config.NamedPipe),
+			namespaces: trimmedNonEmpty(config.Namespaces, true),
+			containers: trimmedNonEmpty(config.Containers, false),
+			streams:    make(map[string]bool),
+			logLevels:  make(map[string]bool),
+		}
+		if rule.Tag == "" {
+			return nil, fmt.Errorf("routing rule %s has no tag", name)
+		}
+		for _, glob := range append(append([]string{}, rule.namespaces...), rule.containers...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %s of routing rule %s: %s", glob, name, err.Error())
+			}
+		}
+		if selector := strings.TrimSpace(config.PodLabelSelector); selector != "" {
+			podLabels, err := labels.Parse(selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pod label selector of routing rule %s: %s", name, err.Error())
+			}
+			rule.podLabels = podLabels
+			r.usesPodLabels = true
+		}
+		for _, stream := range trimmedNonEmpty(config.Streams, true) {
+			rule.streams[stream] = true
+		}
+		for _, level := range config.LogLevels {
+			normalized := NormalizeLogLevel(level)
+			if normalized == "" {
+				normalized = strings.ToLower(strings.TrimSpace(level))
+				if normalized != LogLevelUnknown {
+					return nil, fmt.Errorf("invalid log level %s of routing rule %s", level, name)
+				}
+			}
+			rule.logLevels[normalized] = true
+		}
+		if len(rule.logLevels) > 0 && r.levelDetector == nil {
+			r.levelDetector, _ = NewLogLevelDetector(strings.Split(defaultContainerLogLevelDetectors, ","), strings.Split(defaultContainerLogLevelJSONKeys, ","), nil)
+		}
+		if pattern := config.MessagePattern; pattern != "" {
+			messagePattern, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid message pattern of routing rule %s: %s", name, err.Error())
+			}
+			rule.messagePattern = messagePattern
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func trimmedNonEmpty(values []string, lower bool) []string {
+	var result []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if lower {
+			value = strings.ToLower(value)
+		}
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func matchesAnyGlob(globs []string, value string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the first rule matching the record, or nil if the record goes to the default stream
+func (r *LogRouter) Route(input *LogRouteInput) *LogRoutingRule {
+	if r == nil {
+		return nil
+	}
+	var podLabels labels.Set
+	logLevel := ""
+	for _, rule := range r.rules {
+		if len(rule.namespaces) > 0 && !matchesAnyGlob(rule.namespaces, strings.ToLower(input.Namespace)) {
+			continue
+		}
+		if len(rule.containers) > 0 && !matchesAnyGlob(rule.containers, input.Container) {
+			continue
+		}
+		if len(rule.streams) > 0 && !rule.streams[strings.ToLower(input.Stream)] {
+			continue
+		}
+		if rule.podLabels != nil {
+			if podLabels == nil && input.PodLabels != nil {
+				podLabels = input.PodLabels()
+			}
+			if !rule.podLabels.Matches(podLabels) {
+				continue
+			}
+		}
+		if len(rule.logLevels) > 0 {
+			if logLevel == "" {
+				logLevel = r.detectLogLevel(input)
+			}
+			if !rule.logLevels[logLevel] {
+				continue
+			}
+		}
+		if rule.messagePattern != nil && !rule.messagePattern.MatchString(input.Message) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func (r *LogRouter) detectLogLevel(input *LogRouteInput) string {
+	if input.LogLevel != nil {
+		if level := input.LogLevel(); level != "" {
+			return level
+		}
+	}
+	if r.levelDetector != nil {
+		return r.levelDetector.Detect(input.Message)
+	}
+	return LogLevelUnknown
+}
+
+// getPodLabels returns the pod labels of the container from the kubernetes metadata of the record, or else from the pods of the node
+func getPodLabels(containerID string, record map[interface{}]interface{}) labels.Set {
+	if kubernetesMetadata, exists := record["kubernetes"]; exists {
+		if kubernetesMetadataMap, err := convertKubernetesMetadata(kubernetesMetadata); err == nil {
+			if labelsMap, ok := kubernetesMetadataMap["labels"].(map[string]interface{}); ok {
+				podLabels := labels.Set{}
+				for key, value := range labelsMap {
+					podLabels[key] = fmt.Sprintf("%v", value)
+				}
+				return podLabels
+			}
+		}
+	}
+	ContainerPodLabelsMutex.RLock()
+	defer ContainerPodLabelsMutex.RUnlock()
+	return labels.Set(ContainerPodLabelsMap[containerID])
+}
+
+// getRoutedContainerLogSinkBatches returns the batches of the records of each routing rule, followed by the batches of the
+// records without a rule
+func getRoutedContainerLogSinkBatches(isContainerLogV2Schema bool, fluentForwardTag string, msgPackEntries []MsgPackEntry, routes []*LogRoutingRule) ([]*SinkBatch, error) {
+	dataType := ContainerLogDataType
+	if isContainerLogV2Schema {
+		dataType = ContainerLogV2DataType
+	}
+	var defaultEntries []MsgPackEntry
+	var batches []*SinkBatch
+	batchByRule := make(map[*LogRoutingRule]*SinkBatch)
+	for i, entry := range msgPackEntries {
+		rule := routes[i]
+		if rule == nil {
+			defaultEntries = append(defaultEntries, entry)
+			continue
+		}
+		batch, ok := batchByRule[rule]
+		if !ok {
+			batch = &SinkBatch{DataType: dataType, Tag: rule.Tag, NamedPipe: rule.NamedPipe}
+			if IsWindows && batch.NamedPipe == "" {
+				_, streamIdNamedPipeMap := getContainerLogV2ExtensionMaps()
+				if batch.NamedPipe, ok = streamIdNamedPipeMap[rule.Tag]; !ok {
+					return nil, fmt.Errorf("Error::routing:: namedPipe is empty for the stream %s of routing rule %s", rule.Tag, rule.Name)
+				}
+			}
+			batchByRule[rule] = batch
+			batches = append(batches, batch)
+		}
+		batch.Entries = append(batch.Entries, entry)
+	}
+	if len(defaultEntries) > 0 {
+		defaultBatches, err := getContainerLogSinkBatches(isContainerLogV2Schema, fluentForwardTag, defaultEntries)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, defaultBatches...)
+	}
+	return batches, nil
+}
+
+// initializeContainerLogRouter creates the log router if enabled through the configmap settings
+func initializeContainerLogRouter() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogRoutingEnabledEnv))), "true") != 0 {
+		Log("Container log routing is disabled")
+		return
+	}
+	if !ContainerLogsRouteV2 {
+		Log("Container log routing is only supported with the v2 (ama) route, disabling it")
+		return
+	}
+	var rules []LogRoutingRuleConfig
+	if encodedRules := strings.TrimSpace(os.Getenv(ContainerLogRoutingRulesEnv)); encodedRules != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encodedRules)
+		if err == nil {
+			err = json.Unmarshal(decoded, &rules)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Error::routing::Unable to parse routing rules, disabling container log routing: %s", err.Error())
+			Log(message)
+			SendException(message)
+			return
+		}
+	}
+
+	router, err := NewLogRouter(rules)
+	if err != nil {
+		message := fmt.Sprintf("Error::routing::Unable to initialize container log routing: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	if len(router.rules) == 0 {
+		Log("Container log routing is enabled but has no rules, disabling it")
+		return
+	}
+	ContainerLogRouter = router
+	Log("Container log routing enabled. rules: %d", len(router.rules))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestLogRouterRoute(t *testing.T) {
+	r, err := NewLogRouter([]LogRoutingRuleConfig{
+		{Name: "audit", MessagePattern: `"audit":\s*true`, Tag: "dcr-1:Custom-AuditLogs"},
+		{Name: "payments-debug", Namespaces: []string{"payments-*"}, PodLabelSelector: "tier=api", LogLevels: []string{"DEBUG"}, Tag: "dcr-1:Custom-Basic"},
+		{Streams: []string{"stderr"}, Containers: []string{"sidecar"}, Tag: "dcr-1:Custom-Sidecar"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, r.usesPodLabels)
+
+	podLabelsLookups := 0
+	input := func(namespace string, container string, stream string, message string) *LogRouteInput {
+		return &LogRouteInput{
+			Namespace: namespace,
+			Container: container,
+			Stream:    stream,
+			Message:   message,
+			PodLabels: func() labels.Set {
+				podLabelsLookups += 1
+				return labels.Set{"tier": "api"}
+			},
+		}
+	}
+
+	assert.Equal(t, "audit", r.Route(input("default", "app", "stdout", `{"audit": true, "user": "a"}`)).Name)
+	assert.Equal(t, 0, podLabelsLookups)
+	assert.Equal(t, "payments-debug", r.Route(input("payments-eu", "app", "stdout", `level=debug msg="cache miss"`)).Name)
+	assert.Nil(t, r.Route(input("payments-eu", "app", "stdout", `level=info msg="served"`)))
+	assert.Equal(t, "rule3", r.Route(input("default", "sidecar", "stderr", "connection reset")).Name)
+	assert.Nil(t, r.Route(input("default", "sidecar", "stdout", "connection reset")))
+
+	var nilRouter *LogRouter
+	assert.Nil(t, nilRouter.Route(input("default", "app", "stdout", "line")))
+}
+
+func TestNewLogRouterInvalidRules(t *testing.T) {
+	_, err := NewLogRouter([]LogRoutingRuleConfig{{Name: "no-tag"}})
+	assert.Error(t, err)
+	_, err = NewLogRouter([]LogRoutingRuleConfig{{MessagePattern: "(", Tag: "t"}})
+	assert.Error(t, err)
+	_, err = NewLogRouter([]LogRoutingRuleConfig{{PodLabelSelector: "app in (a", Tag: "t"}})
+	assert.Error(t, err)
+	_, err = NewLogRouter([]LogRoutingRuleConfig{{LogLevels: []string{"loud"}, Tag: "t"}})
+	assert.Error(t, err)
+}
+
+func TestGetRoutedContainerLogSinkBatches(t *testing.T) {
+	r, _ := NewLogRouter([]LogRoutingRuleConfig{{Name: "audit", Tag: "dcr-1:Custom-AuditLogs"}})
+	entries := []MsgPackEntry{
+		{Record: map[string]string{"LogMessage": "a"}},
+		{Record: map[string]string{"LogMessage": "b"}},
+		{Record: map[string]string{"LogMessage": "c"}},
+	}
+	batches, err := getRoutedContainerLogSinkBatches(true, "default-tag", entries, []*LogRoutingRule{nil, r.rules[0], nil})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(batches))
+	assert.Equal(t, "dcr-1:Custom-AuditLogs", batches[0].Tag)
+	assert.Equal(t, 1, len(batches[0].Entries))
+	assert.Equal(t, "default-tag", batches[1].Tag)
+	assert.Equal(t, 2, len(batches[1].Entries))
+}
+
+func TestPostDataHelperRoutesOnPodLabelsOfTheNode(t *testing.T) {
+	setupContainerLogFlush(t, false)
+	clientSet, router, podLabels := ClientSet, ContainerLogRouter, ContainerPodLabelsMap
+	imageIDMap, nameIDMap := ImageIDMap, NameIDMap
+	defer func() {
+		ClientSet, ContainerLogRouter, ContainerPodLabelsMap = clientSet, router, podLabels
+		ImageIDMap, NameIDMap = imageIDMap, nameIDMap
+	}()
+	sink := &fakeSink{connected: true}
+	ContainerLogSink = sink
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&v1.PodList{Items: []v1.Pod{{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-7d4b9c8f6-00000", UID: "uid", Labels: map[string]string{"tier": "api"}},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+				Name:        "nginx",
+				Image:       "nginx:1.25",
+				ContainerID: "containerd://4f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f80",
+			}}},
+		}}})
+	}))
+	defer server.Close()
+	var err error
+	ClientSet, err = kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+	ContainerLogRouter, err = NewLogRouter([]LogRoutingRuleConfig{{Name: "api", PodLabelSelector: "tier=api", Tag: "dcr-1:Custom-Api"}})
+	assert.NoError(t, err)
+
+	// the records have no kubernetes metadata, so the labels come from the pods of the node
+	assert.True(t, isContainerMetadataRefreshNeeded(false))
+	refreshContainerImageNameMaps()
+	PostDataHelper(containerLogRecords(2))
+	assert.Equal(t, 1, len(sink.lastBatches))
+	assert.Equal(t, "dcr-1:Custom-Api", sink.lastBatches[0].Tag)
+	assert.Equal(t, 2, len(sink.lastBatches[0].Entries))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// out_oms.conf setting with the sampling ratios of container logs, e.g. loadtest:0.1,batch/stdout:0.05
+const containerLogSamplingRatiosConfigKey = "container_log_sampling_ratios"
+
+// env variable to override the sampling ratios of out_oms.conf (set from log_collection_settings.sampling in the configmap)
+const ContainerLogSamplingRatiosEnv = "AZMON_CONTAINER_LOG_SAMPLING_RATIOS"
+
+// SamplingRateColumn is the ContainerLogV2 column with the sampling ratio applied to the record
+const SamplingRateColumn = "SamplingRate"
+
+// trace ids of the w3c traceparent header & of common trace id fields (json or logfmt)
+var traceIDRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`\b[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}\b`),
+	regexp.MustCompile(`(?i)\btrace[_.-]?id["']?\s*[:=]\s*["']?([0-9a-z-]{8,})`),
+}
+
+// LogSampler keeps a fraction of the container logs of a namespace (and optionally stream).
+// The decision is based on a hash of the trace id if the line has one, so all the lines of a traced request are kept or dropped together
+type LogSampler struct {
+	// ratios by namespace and namespace/stream
+	ratios map[string]float64
+}
+
+// NewLogSampler creates a sampler from comma separated namespace[/stream]:ratio entries
+func NewLogSampler(spec string) (*LogSampler, error) {
+	s := &LogSampler{ratios: make(map[string]float64)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		separator := strings.LastIndex(entry, ":")
+		if separator <= 0 {
+			return nil, fmt.Errorf("sampling ratio %s is not in namespace[/stream]:ratio format", entry)
+		}
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(entry[separator+1:]), 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("sampling ratio of %s is not a number between 0 and 1", entry)
+		}
+		s.ratios[strings.ToLower(strings.TrimSpace(entry[:separator]))] = ratio
+	}
+	return s, nil
+}
+
+// Ratio returns the sampling ratio for the namespace & stream, 1 if the logs arent sampled
+func (s *LogSampler) Ratio(k8sNamespace string, stream string) float64 {
+	namespace := strings.ToLower(k8sNamespace)
+	if ratio, ok := s.ratios[namespace+"/"+strings.ToLower(stream)]; ok {
+		return ratio
+	}
+	if ratio, ok := s.ratios[namespace]; ok {
+		return ratio
+	}
+	return 1
+}
+
+// sampleLogLine returns true if the line is kept at the given sampling ratio
+func sampleLogLine(ratio float64, containerID string, timestamp string, logEntry string) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	if traceID := extractTraceID(logEntry); traceID != "" {
+		h.Write([]byte(strings.ToLower(traceID)))
+	} else {
+		h.Write([]byte(containerID))
+		h.Write([]byte(timestamp))
+		h.Write([]byte(logEntry))
+	}
+	return float64(h.Sum64()) < ratio*math.MaxUint64
+}
+
+func extractTraceID(logEntry string) string {
+	for _, regex := range traceIDRegexes {
+		if match := regex.FindStringSubmatch(logEntry); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// initializeContainerLogSampler creates the sampler if sampling ratios are configured in out_oms.conf or the configmap settings
+func initializeContainerLogSampler(pluginConfig map[string]string) {
+	spec := strings.TrimSpace(pluginConfig[containerLogSamplingRatiosConfigKey])
+	if value := strings.TrimSpace(os.Getenv(ContainerLogSamplingRatiosEnv)); value != "" {
+		spec = value
+	}
+	if spec == "" {
+		Log("Container log sampling is disabled")
+		return
+	}
+	sampler, err := NewLogSampler(spec)
+	if err != nil {
+		message := fmt.Sprintf("Error::sampling::Unable to initialize container log sampling: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	ContainerLogSampler = sampler
+	Log("Container log sampling enabled. ratios: %s", spec)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogSamplerParsesRatios(t *testing.T) {
+	s, err := NewLogSampler("loadtest:0.1, batch/stdout:0.05")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, s.Ratio("LoadTest", "stderr"))
+	assert.Equal(t, 0.05, s.Ratio("batch", "stdout"))
+	assert.Equal(t, 1.0, s.Ratio("batch", "stderr"))
+	assert.Equal(t, 1.0, s.Ratio("default", "stdout"))
+
+	_, err = NewLogSampler("loadtest")
+	assert.Error(t, err)
+	_, err = NewLogSampler("loadtest:2")
+	assert.Error(t, err)
+}
+
+func TestSampleLogLineKeepsFractionOfLines(t *testing.T) {
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		if sampleLogLine(0.25, "0123456789abcdef", "2024-01-01T00:00:00Z", fmt.Sprintf("request %d done", i)) {
+			kept++
+		}
+	}
+	assert.InDelta(t, 2500, kept, 250)
+
+	assert.True(t, sampleLogLine(1, "0123456789abcdef", "2024-01-01T00:00:00Z", "request done"))
+	assert.False(t, sampleLogLine(0, "0123456789abcdef", "2024-01-01T00:00:00Z", "request done"))
+}
+
+func TestSampleLogLineKeepsLinesOfTheSameTraceTogether(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprintf("4bf92f3577b34da6a3ce929d0e0e%04d", i)
+		first := sampleLogLine(0.5, "aaaaaaaaaaaa", "2024-01-01T00:00:00Z", fmt.Sprintf(`{"msg":"start","trace_id":"%s"}`, traceID))
+		second := sampleLogLine(0.5, "bbbbbbbbbbbb", "2024-01-01T00:00:05Z", fmt.Sprintf("level=error traceparent=00-%s-00f067aa0ba902b7-01 msg=failed", traceID))
+		assert.Equal(t, first, second, traceID)
+	}
+}
+
+func TestPostDataHelperSamplesContainerLogs(t *testing.T) {
+	captureSink := setupContainerLogFlush(t, false)
+	sampler := ContainerLogSampler
+	defer func() { ContainerLogSampler = sampler }()
+	records := containerLogRecords(1000)
+
+	ContainerLogSampler, _ = NewLogSampler("default/stdout:0.25")
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	_, _, sent := readForwardEntries(t, captureSink.lastFrame)
+	assert.InDelta(t, 250, len(sent), 75)
+	for _, record := range sent {
+		assert.Equal(t, "0.25", record[SamplingRateColumn])
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// env variables to configure the logs ingestion sink (AZMON_CONTAINER_LOGS_SINK=logsingestion)
+// logs ingestion endpoint of the data collection endpoint e.g. https://my-dce-abcd.eastus-1.ingest.monitor.azure.com
+const LogsIngestionEndpointEnv = "AZMON_LOGS_INGESTION_ENDPOINT"
+const LogsIngestionDCRImmutableIdEnv = "AZMON_LOGS_INGESTION_DCR_IMMUTABLE_ID"
+const LogsIngestionStreamNameEnv = "AZMON_LOGS_INGESTION_STREAM_NAME"
+
+// client id of the user assigned identity used for the tokens, the system assigned identity is used if not set
+const LogsIngestionClientIdEnv = "AZMON_LOGS_INGESTION_CLIENT_ID"
+
+const LogsIngestionAPIVersion = "2023-01-01"
+const LogsIngestionTokenResource = "https://monitor.azure.com/"
+
+// logs ingestion api rejects calls larger than 1MB, the batches are split into calls of at most this many json bytes
+const logsIngestionMaxPayloadBytes = 1000000
+
+// tokens are refreshed this long before they expire
+const logsIngestionTokenRefreshMargin = 5 * time.Minute
+
+// default delay after a throttled call without a Retry-After header
+const logsIngestionDefaultRetryAfter = 30 * time.Second
+
+// LogsIngestionSink posts ContainerLogV2 batches to a data collection endpoint using the logs ingestion api with AAD bearer tokens
+type LogsIngestionSink struct {
+	endpoint string
+	client   *http.Client
+	// getToken returns an access token for LogsIngestionTokenResource and its expiration (unix seconds)
+	getToken        func() (string, int64, error)
+	maxPayloadBytes int
+	mutex           sync.Mutex
+	token           string
+	tokenExpiration time.Time
+	// throttledUntil is the end of the Retry-After of the last throttled call. Writes fail without a call until then
+	throttledUntil time.Time
+	now            func() time.Time
+}
+
+// NewLogsIngestionSink creates a sink for the stream of the data collection rule on the data collection endpoint
+func NewLogsIngestionSink(endpoint string, dcrImmutableId string, streamName string, client *http.Client, getToken func() (string, int64, error)) *LogsIngestionSink {
+	return &LogsIngestionSink{
+		endpoint:        fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s", strings.TrimRight(endpoint, "/"), url.PathEscape(dcrImmutableId), url.PathEscape(streamName), LogsIngestionAPIVersion),
+		client:          client,
+		getToken:        getToken,
+		maxPayloadBytes: logsIngestionMaxPayloadBytes,
+		now:             time.Now,
+	}
+}
+
+func (s *LogsIngestionSink) Name() string {
+	return "logsingestion"
+}
+
+// Connect acquires the access token
+func (s *LogsIngestionSink) Connect() error {
+	_, err := s.accessToken()
+	return err
+}
+
+func (s *LogsIngestionSink) accessToken() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" && s.now().Add(logsIngestionTokenRefreshMargin).Before(s.tokenExpiration) {
+		return s.token, nil
+	}
+	token, expiration, err := s.getToken()
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", errors.New("logs ingestion access token is empty")
+	}
+	s.token = token
+	s.tokenExpiration = time.Unix(expiration, 0)
+	return token, nil
+}
+
+func (s *LogsIngestionSink) Write(batch *SinkBatch) (int, error) {
+	if batch.DataType != ContainerLogV2DataType {
+		return 0, &SinkError{Op: "write", Retriable: false, Err: fmt.Errorf("logs ingestion sink only supports %s, not %s", ContainerLogV2DataType, batch.DataType)}
+	}
+	s.mutex.Lock()
+	throttledUntil := s.throttledUntil
+	s.mutex.Unlock()
+	if s.now().Before(throttledUntil) {
+		return 0, &SinkError{Op: "write", StatusCode: http.StatusTooManyRequests, Retriable: true, Err: fmt.Errorf("throttled until %s", throttledUntil.UTC().Format(time.RFC3339))}
+	}
+	token, err := s.accessToken()
+	if err != nil {
+		return 0, newSinkConnectError(err)
+	}
+
+	records := make([]json.RawMessage, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		record, err := json.Marshal(entry.Record)
+		if err != nil {
+			return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		records = append(records, record)
+	}
+	bts := 0
+	deliveredRecords := 0
+	for len(records) > 0 {
+		// split the records into calls below the payload limit
+		size := 2
+		end := 0
+		for end < len(records) && (end == 0 || size+len(records[end])+1 <= s.maxPayloadBytes) {
+			size += len(records[end]) + 1
+			end++
+		}
+		n, posted, err := s.post(token, records[:end])
+		bts += n
+		deliveredRecords += posted
+		if err != nil {
+			// the records which were posted arent retried
+			if sinkErr, ok := err.(*SinkError); ok {
+				sinkErr.DeliveredRecords = deliveredRecords
+			}
+			return bts, err
+		}
+		records = records[end:]
+	}
+	return bts, nil
+}
+
+// post posts the records in one call, and in halves if the call is rejected as too large.
+// Returns the bytes and the number of leading records posted
+func (s *LogsIngestionSink) post(token string, records []json.RawMessage) (int, int, error) {
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return 0, 0, &SinkError{Op: "write", Retriable: false, Err: err}
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(payload)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", s.endpoint, &compressed)
+	if err != nil {
+		return 0, 0, &SinkError{Op: "write", Retriable: false, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", userAgent)
+	reqID := uuid.New().String()
+	req.Header.Set("x-ms-client-request-id", reqID)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, 0, newSinkWriteError(err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	switch {
+	case IsSuccessStatusCode(resp.StatusCode):
+		return len(payload), len(records), nil
+	case resp.StatusCode == http.StatusRequestEntityTooLarge && len(records) > 1:
+		Log("Warn::logsingestion::RequestId %s of %d records was too large, splitting it", reqID, len(records))
+		half := len(records) / 2
+		bts, deliveredRecords, err := s.post(token, records[:half])
+		if err != nil {
+			return bts, deliveredRecords, err
+		}
+		n, posted, err := s.post(token, records[half:])
+		return bts + n, deliveredRecords + posted, err
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter := logsIngestionDefaultRetryAfter
+		if seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		s.mutex.Lock()
+		s.throttledUntil = s.now().Add(retryAfter)
+		s.mutex.Unlock()
+		return 0, 0, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: true, Err: fmt.Errorf("RequestId %s Status %s, retry after %s", reqID, resp.Status, retryAfter)}
+	case resp.StatusCode == http.StatusUnauthorized:
+		// token might be revoked, acquire a new one for the retry
+		s.mutex.Lock()
+		s.token = ""
+		s.mutex.Unlock()
+	}
+	return 0, 0, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: IsRetriableError(resp.StatusCode) || resp.StatusCode == http.StatusUnauthorized, Err: fmt.Errorf("RequestId %s Status %s Status Code %d", reqID, resp.Status, resp.StatusCode)}
+}
+
+func (s *LogsIngestionSink) IsHealthy() bool {
+	return true
+}
+
+func (s *LogsIngestionSink) Close() {
+}
+
+// getLogsIngestionAccessToken gets an access token for the logs ingestion api from IMDS
+func getLogsIngestionAccessToken() (string, int64, error) {
+	responseBytes, err := requestIMDSAccessToken(LogsIngestionTokenResource, strings.TrimSpace(os.Getenv(LogsIngestionClientIdEnv)))
+	if err != nil {
+		return "", 0, err
+	}
+	return parseIMDSResponse(responseBytes)
+}
+
+// createLogsIngestionSink creates the logs ingestion sink from the env settings. Returns nil if the settings are incomplete
+func createLogsIngestionSink() Sink {
+	endpoint := strings.TrimSpace(os.Getenv(LogsIngestionEndpointEnv))
+	dcrImmutableId := strings.TrimSpace(os.Getenv(LogsIngestionDCRImmutableIdEnv))
+	streamName := strings.TrimSpace(os.Getenv(LogsIngestionStreamNameEnv))
+	if endpoint == "" || dcrImmutableId == "" || streamName == "" {
+		message := fmt.Sprintf("Error::logsingestion::%s, %s and %s are required for the logs ingestion sink", LogsIngestionEndpointEnv, LogsIngestionDCRImmutableIdEnv, LogsIngestionStreamNameEnv)
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	transport := &http.Transport{}
+	if ProxyEndpoint != "" {
+		if proxyEndpointUrl, err := url.Parse(ProxyEndpoint); err == nil {
+			transport.Proxy = http.ProxyURL(proxyEndpointUrl)
+		}
+	}
+	Log("Using logs ingestion sink. endpoint: %s, dcr: %s, stream: %s", endpoint, dcrImmutableId, streamName)
+	return NewLogsIngestionSink(endpoint, dcrImmutableId, streamName, &http.Client{Transport: transport, Timeout: 30 * time.Second}, getLogsIngestionAccessToken)
+}
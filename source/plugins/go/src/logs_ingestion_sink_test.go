@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type logsIngestionStandIn struct {
+	calls    int
+	records  []map[string]string
+	statuses []int
+	headers  http.Header
+	path     string
+	query    string
+}
+
+func (s *logsIngestionStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls++
+	s.headers = r.Header
+	s.path = r.URL.Path
+	s.query = r.URL.RawQuery
+	status := http.StatusNoContent
+	if len(s.statuses) > 0 {
+		status = s.statuses[0]
+		s.statuses = s.statuses[1:]
+	}
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "60")
+	}
+	if status == http.StatusNoContent {
+		reader, _ := gzip.NewReader(r.Body)
+		var records []map[string]string
+		json.NewDecoder(reader).Decode(&records)
+		s.records = append(s.records, records...)
+	}
+	w.WriteHeader(status)
+}
+
+func newTestLogsIngestionSink(standIn *logsIngestionStandIn) (*LogsIngestionSink, *httptest.Server, *int) {
+	server := httptest.NewServer(standIn)
+	tokens := 0
+	sink := NewLogsIngestionSink(server.URL+"/", "dcr-0123", "Custom-ContainerLogV2", server.Client(), func() (string, int64, error) {
+		tokens++
+		return "token", time.Now().Add(time.Hour).Unix(), nil
+	})
+	return sink, server, &tokens
+}
+
+func logsIngestionTestBatch(messages ...string) *SinkBatch {
+	batch := &SinkBatch{DataType: ContainerLogV2DataType}
+	for _, message := range messages {
+		batch.Entries = append(batch.Entries, MsgPackEntry{Record: map[string]string{"LogMessage": message, "PodNamespace": "default"}})
+	}
+	return batch
+}
+
+func TestLogsIngestionSinkWrite(t *testing.T) {
+	standIn := &logsIngestionStandIn{}
+	sink, server, tokens := newTestLogsIngestionSink(standIn)
+	defer server.Close()
+
+	_, err := writeToSink(sink, logsIngestionTestBatch("a", "b"))
+	assert.NoError(t, err)
+	_, err = writeToSink(sink, logsIngestionTestBatch("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/dataCollectionRules/dcr-0123/streams/Custom-ContainerLogV2", standIn.path)
+	assert.Equal(t, "api-version="+LogsIngestionAPIVersion, standIn.query)
+	assert.Equal(t, "Bearer token", standIn.headers.Get("Authorization"))
+	assert.Equal(t, "gzip", standIn.headers.Get("Content-Encoding"))
+	assert.Equal(t, 3, len(standIn.records))
+	assert.Equal(t, "a", standIn.records[0]["LogMessage"])
+	assert.Equal(t, 1, *tokens, "token is reused until it expires")
+
+	_, err = sink.Write(&SinkBatch{DataType: ContainerLogDataType})
+	assert.False(t, IsRetriableSinkError(err))
+}
+
+func TestLogsIngestionSinkSplitsLargeBatches(t *testing.T) {
+	standIn := &logsIngestionStandIn{statuses: []int{http.StatusRequestEntityTooLarge}}
+	sink, server, _ := newTestLogsIngestionSink(standIn)
+	defer server.Close()
+	sink.maxPayloadBytes = 100
+
+	_, err := sink.Write(logsIngestionTestBatch("a", "b", "c", "d"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(standIn.records))
+	// 2 calls of 2 records each below the payload limit, the first one rejected & split
+	assert.Equal(t, 4, standIn.calls)
+}
+
+func TestLogsIngestionSinkReportsTheRecordsPostedBeforeAFailure(t *testing.T) {
+	standIn := &logsIngestionStandIn{statuses: []int{http.StatusNoContent, http.StatusInternalServerError}}
+	sink, server, _ := newTestLogsIngestionSink(standIn)
+	defer server.Close()
+	sink.maxPayloadBytes = 100
+
+	batch := logsIngestionTestBatch("a", "b", "c", "d")
+	_, err := writeToSink(sink, batch)
+	assert.Error(t, err)
+	assert.Equal(t, 2, GetSinkErrorDeliveredRecords(err))
+	assert.Equal(t, 2, standIn.calls, "the posted records arent retried")
+	assert.Equal(t, []MsgPackEntry{batch.Entries[2], batch.Entries[3]}, getUndeliveredSinkBatch(batch, GetSinkErrorDeliveredRecords(err)).Entries)
+
+	// the half posted before the split call failed isnt retried either
+	standIn = &logsIngestionStandIn{statuses: []int{http.StatusRequestEntityTooLarge, http.StatusNoContent, http.StatusInternalServerError}}
+	sink, server, _ = newTestLogsIngestionSink(standIn)
+	defer server.Close()
+	sink.maxPayloadBytes = 100
+	_, err = writeToSink(sink, batch)
+	assert.Error(t, err)
+	assert.Equal(t, 1, GetSinkErrorDeliveredRecords(err))
+	assert.Equal(t, 1, len(standIn.records))
+}
+
+func TestLogsIngestionSinkHonoursRetryAfter(t *testing.T) {
+	standIn := &logsIngestionStandIn{statuses: []int{http.StatusTooManyRequests}}
+	sink, server, _ := newTestLogsIngestionSink(standIn)
+	defer server.Close()
+	now := time.Now()
+	sink.now = func() time.Time { return now }
+
+	_, err := writeToSink(sink, logsIngestionTestBatch("a"))
+	assert.True(t, IsRetriableSinkError(err))
+	assert.Equal(t, http.StatusTooManyRequests, GetSinkErrorStatusCode(err))
+	assert.Equal(t, 1, standIn.calls)
+
+	_, err = writeToSink(sink, logsIngestionTestBatch("a"))
+	assert.Error(t, err)
+	assert.Equal(t, 1, standIn.calls, "no calls are made before the Retry-After passed")
+
+	now = now.Add(time.Minute)
+	_, err = writeToSink(sink, logsIngestionTestBatch("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(standIn.records))
+}
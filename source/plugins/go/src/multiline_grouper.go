@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variables to configure multi-line grouping (set from log_collection_settings.multiline_grouping in the configmap)
+const ContainerLogMultilineGroupingEnabledEnv = "AZMON_MULTILINE_GROUPING_ENABLED"
+const ContainerLogMultilineGroupingNamespacesEnv = "AZMON_MULTILINE_GROUPING_NAMESPACES"
+const ContainerLogMultilineGroupingLanguagesEnv = "AZMON_MULTILINE_GROUPING_LANGUAGES"
+
+// base64 encoded json array of start-of-record regexes
+const ContainerLogMultilineGroupingStartPatternsEnv = "AZMON_MULTILINE_GROUPING_START_PATTERNS"
+const ContainerLogMultilineGroupingMaxLinesEnv = "AZMON_MULTILINE_GROUPING_MAX_LINES"
+const ContainerLogMultilineGroupingMaxSizeKBEnv = "AZMON_MULTILINE_GROUPING_MAX_SIZE_KB"
+const ContainerLogMultilineGroupingTimeoutSecondsEnv = "AZMON_MULTILINE_GROUPING_TIMEOUT_SECONDS"
+
+const defaultContainerLogMultilineGroupingLanguages = "go,java,python,dotnet"
+const defaultContainerLogMultilineGroupingMaxLines = 1000
+const defaultContainerLogMultilineGroupingMaxSizeKB = 64
+const defaultContainerLogMultilineGroupingTimeoutSeconds = 5
+
+// states of the stack trace detector
+const multilineStateStart = "start"
+
+// state of the records started by a user supplied start-of-record regex
+const multilineStateCustom = "custom"
+
+// multilineStateEnd ends the group including the matched line
+const multilineStateEnd = "end"
+
+// multilineRule moves the detector from any of the fromStates to toState when the line matches
+type multilineRule struct {
+	fromStates []string
+	pattern    *regexp.Regexp
+	toState    string
+}
+
+func newMultilineRule(fromStates []string, pattern string, toState string) multilineRule {
+	return multilineRule{fromStates: fromStates, pattern: regexp.MustCompile(pattern), toState: toState}
+}
+
+// built-in stack trace rules per language
+var multilineLanguageRules = map[string][]multilineRule{
+	"java": {
+		newMultilineRule([]string{multilineStateStart}, `^[\w$.]+(?:Exception|Error|Throwable)(?::|$)`, "java_start_exception"),
+		newMultilineRule([]string{"java_start_exception", "java_after_exception"}, `^[\t ]+(?:eval )?at `, "java_after_exception"),
+		newMultilineRule([]string{"java_start_exception", "java_after_exception"}, `^[\t ]*(?:Caused by|Suppressed):`, "java_after_exception"),
+		newMultilineRule([]string{"java_start_exception", "java_after_exception"}, `^[\t ]*nested exception is:`, "java_after_exception"),
+		newMultilineRule([]string{"java_after_exception"}, `^[\t ]*\.\.\. \d+ (?:more|common frames omitted)`, "java_after_exception"),
+	},
+	"python": {
+		newMultilineRule([]string{multilineStateStart}, `^Traceback \(most recent call last\):$`, "python"),
+		newMultilineRule([]string{"python"}, `^[\t ]+`, "python"),
+		newMultilineRule([]string{"python"}, `^(?:During handling of the above exception|The above exception was the direct cause)`, "python_chained"),
+		newMultilineRule([]string{"python_chained"}, `^$`, "python_chained"),
+		newMultilineRule([]string{"python_chained"}, `^Traceback \(most recent call last\):$`, "python"),
+		// the exception type & message ends the traceback
+		newMultilineRule([]string{"python"}, `^[\w.]+(?::|$)`, multilineStateEnd),
+	},
+	"go": {
+		newMultilineRule([]string{multilineStateStart}, `^(?:panic|fatal error): `, "go_after_panic"),
+		newMultilineRule([]string{"go_after_panic", "go_frame", "go_after_goroutine"}, `^$`, "go_after_goroutine"),
+		newMultilineRule([]string{"go_after_panic"}, `^\[(?:recovered|signal )`, "go_after_panic"),
+		newMultilineRule([]string{"go_after_panic", "go_after_goroutine"}, `^goroutine \d+ \[[^\]]+\]:$`, "go_frame"),
+		newMultilineRule([]string{"go_frame"}, `^(?:created by )?[\w./*()\[\]-]+\(.*\)(?: in goroutine \d+)?$`, "go_frame"),
+		newMultilineRule([]string{"go_frame"}, `^\t`, "go_frame"),
+		newMultilineRule([]string{"go_frame", "go_after_goroutine"}, `^exit status \d+$`, multilineStateEnd),
+	},
+	"dotnet": {
+		newMultilineRule([]string{multilineStateStart}, `^(?:Unhandled [Ee]xception[.:] )?(?:\w+\.)+\w*Exception\b`, "dotnet_exception"),
+		newMultilineRule([]string{"dotnet_exception"}, `^\s+at `, "dotnet_exception"),
+		newMultilineRule([]string{"dotnet_exception"}, `^\s*---> `, "dotnet_exception"),
+		newMultilineRule([]string{"dotnet_exception"}, `^\s*--- End of (?:inner exception|stack trace from previous location)`, "dotnet_exception"),
+	},
+}
+
+// MultilineGrouper merges the lines of a multi-line record (e.g. a stack trace) into the record of its first line, per container and stream
+type MultilineGrouper struct {
+	// rules of the enabled languages
+	rules []multilineRule
+	// user supplied start-of-record regexes. Lines following a match are grouped until the next match
+	startPatterns []*regexp.Regexp
+	// namespaces for which grouping is enabled, all namespaces if empty
+	namespaces map[string]bool
+	maxLines   int
+	maxSize    int
+	timeout    time.Duration
+	mutex      sync.Mutex
+	pending    map[string]*multilineGroup
+}
+
+type multilineGroup struct {
+	// record of the first line, the grouped lines replace its log
+	record    map[interface{}]interface{}
+	lines     []string
+	size      int
+	state     string
+	firstSeen time.Time
+}
+
+// NewMultilineGrouper creates a grouper for the given languages and start-of-record regexes
+func NewMultilineGrouper(languages []string, startPatterns []string, namespaces []string, maxLines int, maxSize int, timeout time.Duration) (*MultilineGrouper, error) {
+	g := &MultilineGrouper{
+		namespaces: make(map[string]bool),
+		maxLines:   maxLines,
+		maxSize:    maxSize,
+		timeout:    timeout,
+		pending:    make(map[string]*multilineGroup),
+	}
+	for _, language := range languages {
+		language = strings.ToLower(strings.TrimSpace(language))
+		if language == "" {
+			continue
+		}
+		rules, ok := multilineLanguageRules[language]
+		if !ok {
+			return nil, fmt.Errorf("unsupported stack trace language %s", language)
+		}
+		g.rules = append(g.rules, rules...)
+	}
+	for _, startPattern := range startPatterns {
+		pattern, err := regexp.Compile(startPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start pattern %s: %s", startPattern, err.Error())
+		}
+		g.startPatterns = append(g.startPatterns, pattern)
+	}
+	for _, namespace := range namespaces {
+		namespace = strings.ToLower(strings.TrimSpace(namespace))
+		if namespace != "" {
+			g.namespaces[namespace] = true
+		}
+	}
+	return g, nil
+}
+
+// Process returns the records with the lines of multi-line records merged into the record of their first line.
+// Records which may be followed by more lines are held back until a later flush. Groups held back longer than the timeout
+// are flushed ahead of the records of this flush. The rollback restores the pending groups as they were before the call, for the flush to be retried
+func (g *MultilineGrouper) Process(records []map[interface{}]interface{}) (output []map[interface{}]interface{}, groupedLines int, rollback func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	snapshot := g.snapshotLocked()
+	rollback = func() { g.restore(snapshot) }
+	output = make([]map[interface{}]interface{}, 0, len(records))
+	output = g.flushExpiredLocked(output, time.Now())
+
+	for _, record := range records {
+		containerID, k8sNamespace, _, _ := GetContainerIDK8sNamespacePodNameFromFileName(ToString(record["filepath"]))
+		if containerID == "" {
+			output = append(output, record)
+			continue
+		}
+		// the multiline pattern annotation of a pod takes precedence over the cluster settings
+		startPatterns := g.startPatterns
+		if settings := getWorkloadLogSettings(containerID, record); settings != nil && settings.MultilinePattern != nil {
+			startPatterns = []*regexp.Regexp{settings.MultilinePattern}
+		} else if len(g.namespaces) > 0 && !g.namespaces[strings.ToLower(k8sNamespace)] {
+			output = append(output, record)
+			continue
+		}
+		key := containerID + "/" + ToString(record["stream"])
+		line := strings.TrimRight(ToString(record["log"]), "\r\n")
+
+		if group, ok := g.pending[key]; ok {
+			if nextState, isContinuation := g.nextStateLocked(group.state, line, startPatterns); isContinuation && len(group.lines) < g.maxLines && group.size+len(line) <= g.maxSize {
+				group.lines = append(group.lines, line)
+				group.size += len(line)
+				group.state = nextState
+				groupedLines += 1
+				if nextState == multilineStateEnd {
+					output = append(output, group.toRecord())
+					delete(g.pending, key)
+				}
+				continue
+			}
+			output = append(output, group.toRecord())
+			delete(g.pending, key)
+		}
+
+		state := g.startStateLocked(line, startPatterns)
+		if state == multilineStateStart {
+			output = append(output, record)
+			continue
+		}
+		g.pending[key] = &multilineGroup{record: record, lines: []string{line}, size: len(line), state: state, firstSeen: time.Now()}
+	}
+	return output, groupedLines, rollback
+}
+
+// snapshotLocked copies the pending groups, the lines are only ever appended so the copies share them
+func (g *MultilineGrouper) snapshotLocked() map[string]multilineGroup {
+	snapshot := make(map[string]multilineGroup, len(g.pending))
+	for key, group := range g.pending {
+		snapshot[key] = *group
+	}
+	return snapshot
+}
+
+func (g *MultilineGrouper) restore(snapshot map[string]multilineGroup) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pending = make(map[string]*multilineGroup, len(snapshot))
+	for key, group := range snapshot {
+		group := group
+		g.pending[key] = &group
+	}
+}
+
+// startStateLocked returns the state for a line which isnt part of a group
+func (g *MultilineGrouper) startStateLocked(line string, startPatterns []*regexp.Regexp) string {
+	for _, pattern := range startPatterns {
+		if pattern.MatchString(line) {
+			return multilineStateCustom
+		}
+	}
+	if nextState, ok := g.matchRulesLocked(multilineStateStart, line); ok {
+		return nextState
+	}
+	return multilineStateStart
+}
+
+// nextStateLocked returns the next state and true if the line continues the group
+func (g *MultilineGrouper) nextStateLocked(state string, line string, startPatterns []*regexp.Regexp) (string, bool) {
+	if state == multilineStateCustom {
+		for _, pattern := range startPatterns {
+			if pattern.MatchString(line) {
+				return state, false
+			}
+		}
+		return state, true
+	}
+	return g.matchRulesLocked(state, line)
+}
+
+func (g *MultilineGrouper) matchRulesLocked(state string, line string) (string, bool) {
+	for _, rule := range g.rules {
+		for _, fromState := range rule.fromStates {
+			if fromState == state && rule.pattern.MatchString(line) {
+				return rule.toState, true
+			}
+		}
+	}
+	return state, false
+}
+
+func (g *MultilineGrouper) flushExpiredLocked(output []map[interface{}]interface{}, now time.Time) []map[interface{}]interface{} {
+	var expired []string
+	for key, group := range g.pending {
+		if now.Sub(group.firstSeen) >= g.timeout {
+			expired = append(expired, key)
+		}
+	}
+	// flush in the order the groups started
+	sort.Slice(expired, func(i, j int) bool {
+		return g.pending[expired[i]].firstSeen.Before(g.pending[expired[j]].firstSeen)
+	})
+	for _, key := range expired {
+		output = append(output, g.pending[key].toRecord())
+		delete(g.pending, key)
+	}
+	return output
+}
+
+func (group *multilineGroup) toRecord() map[interface{}]interface{} {
+	if len(group.lines) == 1 {
+		return group.record
+	}
+	record := make(map[interface{}]interface{}, len(group.record))
+	for k, v := range group.record {
+		record[k] = v
+	}
+	record["log"] = []byte(strings.Join(group.lines, "\n"))
+	return record
+}
+
+// initializeContainerLogMultilineGrouper creates the multi-line grouper if enabled through the configmap settings
+func initializeContainerLogMultilineGrouper() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogMultilineGroupingEnabledEnv))), "true") != 0 {
+		Log("Container log multi-line grouping is disabled")
+		return
+	}
+	languages := defaultContainerLogMultilineGroupingLanguages
+	if value, ok := os.LookupEnv(ContainerLogMultilineGroupingLanguagesEnv); ok {
+		languages = strings.TrimSpace(value)
+	}
+	var startPatterns []string
+	if encodedStartPatterns := strings.TrimSpace(os.Getenv(ContainerLogMultilineGroupingStartPatternsEnv)); encodedStartPatterns != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encodedStartPatterns)
+		if err == nil {
+			err = json.Unmarshal(decoded, &startPatterns)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Error::multiline::Unable to parse start patterns, ignoring them: %s", err.Error())
+			Log(message)
+			SendException(message)
+			startPatterns = nil
+		}
+	}
+	namespaces := strings.Split(os.Getenv(ContainerLogMultilineGroupingNamespacesEnv), ",")
+	maxLines, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogMultilineGroupingMaxLinesEnv)))
+	if err != nil || maxLines <= 0 {
+		maxLines = defaultContainerLogMultilineGroupingMaxLines
+	}
+	maxSizeKB, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogMultilineGroupingMaxSizeKBEnv)))
+	if err != nil || maxSizeKB <= 0 {
+		maxSizeKB = defaultContainerLogMultilineGroupingMaxSizeKB
+	}
+	timeoutSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogMultilineGroupingTimeoutSecondsEnv)))
+	if err != nil || timeoutSeconds <= 0 {
+		timeoutSeconds = defaultContainerLogMultilineGroupingTimeoutSeconds
+	}
+
+	grouper, err := NewMultilineGrouper(strings.Split(languages, ","), startPatterns, namespaces, maxLines, maxSizeKB*1024, time.Duration(timeoutSeconds)*time.Second)
+	if err != nil {
+		message := fmt.Sprintf("Error::multiline::Unable to initialize container log multi-line grouping: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	ContainerLogMultilineGrouper = grouper
+	Log("Container log multi-line grouping enabled. languages: %s, start patterns: %d, namespaces: %v, maxLines: %d, maxSizeKB: %d, timeoutSeconds: %d", languages, len(startPatterns), namespaces, maxLines, maxSizeKB, timeoutSeconds)
+}
+
+// groupMultilineContainerLogs merges the multi-line records if the grouper is enabled.
+// The rollback is nil if the grouper is disabled
+func groupMultilineContainerLogs(records []map[interface{}]interface{}) ([]map[interface{}]interface{}, func()) {
+	if ContainerLogMultilineGrouper == nil {
+		return records, nil
+	}
+	output, groupedLines, rollback := ContainerLogMultilineGrouper.Process(records)
+	if groupedLines > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsMultilineGroupedLinesCount += float64(groupedLines)
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	return output, rollback
+}
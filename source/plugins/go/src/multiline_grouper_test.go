@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func logRecords(stream string, lines ...string) []map[interface{}]interface{} {
+	records := make([]map[interface{}]interface{}, 0, len(lines))
+	for _, line := range lines {
+		records = append(records, criRecord(testContainerLogFilePath, stream, "F", line))
+	}
+	return records
+}
+
+func TestMultilineGrouperGroupsJavaStackTrace(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"java"}, nil, nil, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, grouped, _ := g.Process(logRecords("stderr",
+		"starting",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.App.run(App.java:10)",
+		"Caused by: java.io.IOException: closed",
+		"\tat com.example.Io.read(Io.java:5)",
+		"\t... 3 more",
+		"next line",
+	))
+	assert.Equal(t, 4, grouped)
+	assert.Equal(t, 3, len(output))
+	assert.Equal(t, "starting", ToString(output[0]["log"]))
+	assert.Equal(t, "java.lang.IllegalStateException: boom\n\tat com.example.App.run(App.java:10)\nCaused by: java.io.IOException: closed\n\tat com.example.Io.read(Io.java:5)\n\t... 3 more", ToString(output[1]["log"]))
+	// lines which dont start a stack trace arent held back
+	assert.Equal(t, "next line", ToString(output[2]["log"]))
+}
+
+func TestMultilineGrouperOnlyStartsJavaStackTraceAtExceptionType(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"java"}, nil, nil, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, grouped, _ := g.Process(logRecords("stderr",
+		"request failed with Error: timeout",
+		"\tat com.example.App.run(App.java:10)",
+	))
+	assert.Equal(t, 0, grouped)
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, 0, len(g.pending))
+}
+
+func TestMultilineGrouperEndsPythonTracebackWithException(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"python"}, nil, nil, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, _, _ := g.Process(logRecords("stderr",
+		"Traceback (most recent call last):",
+		"  File \"app.py\", line 3, in <module>",
+		"    main()",
+		"ValueError: bad value",
+	))
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>\n    main()\nValueError: bad value", ToString(output[0]["log"]))
+}
+
+func TestMultilineGrouperUsesStartPatterns(t *testing.T) {
+	g, err := NewMultilineGrouper(nil, []string{`^\d{4}-\d{2}-\d{2} `}, nil, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, grouped, _ := g.Process(logRecords("stdout",
+		"2024-01-01 first",
+		"  detail",
+		"2024-01-01 second",
+	))
+	assert.Equal(t, 1, grouped)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "2024-01-01 first\n  detail", ToString(output[0]["log"]))
+}
+
+func TestMultilineGrouperSkipsOtherNamespaces(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"java"}, nil, []string{"kube-system"}, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, grouped, _ := g.Process(logRecords("stderr",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.App.run(App.java:10)",
+	))
+	assert.Equal(t, 0, grouped)
+	assert.Equal(t, 2, len(output))
+}
+
+func TestMultilineGrouperFlushesOnTimeout(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"go"}, nil, nil, 100, 1024, time.Millisecond)
+	assert.NoError(t, err)
+	output, _, _ := g.Process(logRecords("stderr", "panic: runtime error", "", "goroutine 1 [running]:"))
+	assert.Equal(t, 0, len(output))
+	time.Sleep(5 * time.Millisecond)
+
+	output, _, _ = g.Process(nil)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "panic: runtime error\n\ngoroutine 1 [running]:", ToString(output[0]["log"]))
+}
+
+func TestNewMultilineGrouperRejectsUnknownLanguage(t *testing.T) {
+	_, err := NewMultilineGrouper([]string{"cobol"}, nil, nil, 100, 1024, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestMultilineGrouperRollback(t *testing.T) {
+	g, err := NewMultilineGrouper([]string{"java"}, nil, nil, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	g.Process(logRecords("stderr", "java.lang.IllegalStateException: boom"))
+	output, _, rollback := g.Process(logRecords("stderr", "\tat com.example.App.run(App.java:10)", "next line"))
+	assert.Equal(t, 2, len(output))
+	// the group flushed by the retried flush is pending again for the resent lines
+	rollback()
+	output, grouped, _ := g.Process(logRecords("stderr", "\tat com.example.App.run(App.java:10)", "next line"))
+	assert.Equal(t, 1, grouped)
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, "java.lang.IllegalStateException: boom\n\tat com.example.App.run(App.java:10)", ToString(output[0]["log"]))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// env variables with the namespace patterns (base64 encoded json arrays) for stdout & stderr log collection.
+// The exact namespace names of the exclude lists are in AZMON_STDOUT_EXCLUDED_NAMESPACES & AZMON_STDERR_EXCLUDED_NAMESPACES
+const StdoutExcludedNamespacePatternsEnv = "AZMON_STDOUT_EXCLUDED_NAMESPACE_PATTERNS"
+const StdoutIncludedNamespacePatternsEnv = "AZMON_STDOUT_INCLUDED_NAMESPACE_PATTERNS"
+const StderrExcludedNamespacePatternsEnv = "AZMON_STDERR_EXCLUDED_NAMESPACE_PATTERNS"
+const StderrIncludedNamespacePatternsEnv = "AZMON_STDERR_INCLUDED_NAMESPACE_PATTERNS"
+
+// prefixes of the regex & namespace label selector patterns. Patterns without a prefix are globs (or exact names)
+const namespacePatternRegexPrefix = "regex:"
+const namespacePatternLabelPrefix = "label:"
+
+const namespaceLabelWatchResyncInterval = 10 * time.Minute
+
+// namespacePattern matches namespaces by name glob, name regex or label selector
+type namespacePattern struct {
+	glob     string
+	regex    *regexp.Regexp
+	selector labels.Selector
+}
+
+func newNamespacePattern(pattern string) (namespacePattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case strings.HasPrefix(pattern, namespacePatternRegexPrefix):
+		regex, err := regexp.Compile(strings.TrimPrefix(pattern, namespacePatternRegexPrefix))
+		if err != nil {
+			return namespacePattern{}, fmt.Errorf("invalid namespace regex %s: %s", pattern, err.Error())
+		}
+		return namespacePattern{regex: regex}, nil
+	case strings.HasPrefix(pattern, namespacePatternLabelPrefix):
+		selector, err := labels.Parse(strings.TrimPrefix(pattern, namespacePatternLabelPrefix))
+		if err != nil {
+			return namespacePattern{}, fmt.Errorf("invalid namespace label selector %s: %s", pattern, err.Error())
+		}
+		return namespacePattern{selector: selector}, nil
+	default:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return namespacePattern{}, fmt.Errorf("invalid namespace glob %s: %s", pattern, err.Error())
+		}
+		return namespacePattern{glob: pattern}, nil
+	}
+}
+
+func (p namespacePattern) matches(namespace string, getLabels func(string) (labels.Set, bool)) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(namespace)
+	case p.selector != nil:
+		namespaceLabels, ok := getLabels(namespace)
+		return ok && p.selector.Matches(namespaceLabels)
+	default:
+		matched, _ := path.Match(p.glob, namespace)
+		return matched
+	}
+}
+
+// NamespaceFilter decides which namespaces logs are collected for from include & exclude patterns.
+// The decision is memoized per namespace, and reset whenever the namespace labels change
+type NamespaceFilter struct {
+	include []namespacePattern
+	exclude []namespacePattern
+	// usesLabels indicates whether any of the patterns is a label selector
+	usesLabels bool
+	getLabels  func(string) (labels.Set, bool)
+	mutex      sync.RWMutex
+	collected  map[string]bool
+}
+
+var (
+	// StdoutNamespaceFilter filters the namespaces of stdout logs by pattern, nil if there are no patterns
+	StdoutNamespaceFilter *NamespaceFilter
+	// StderrNamespaceFilter filters the namespaces of stderr logs by pattern, nil if there are no patterns
+	StderrNamespaceFilter *NamespaceFilter
+	// NamespaceLister lists the namespaces from the namespace watch
+	NamespaceLister listersv1.NamespaceLister
+)
+
+// NewNamespaceFilter creates a filter which collects the namespaces matching any of the include patterns (all if none)
+// and none of the exclude patterns
+func NewNamespaceFilter(include []string, exclude []string, getLabels func(string) (labels.Set, bool)) (*NamespaceFilter, error) {
+	f := &NamespaceFilter{getLabels: getLabels, collected: make(map[string]bool)}
+	var err error
+	if f.include, err = f.newPatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = f.newPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *NamespaceFilter) newPatterns(patterns []string) ([]namespacePattern, error) {
+	var result []namespacePattern
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		p, err := newNamespacePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.usesLabels = f.usesLabels || p.selector != nil
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// IsCollected returns true if the logs of the namespace are collected. A nil filter collects all namespaces
+func (f *NamespaceFilter) IsCollected(namespace string) bool {
+	if f == nil {
+		return true
+	}
+	f.mutex.RLock()
+	collected, ok := f.collected[namespace]
+	f.mutex.RUnlock()
+	if ok {
+		return collected
+	}
+
+	collected = len(f.include) == 0
+	for _, p := range f.include {
+		if p.matches(namespace, f.getLabels) {
+			collected = true
+			break
+		}
+	}
+	for _, p := range f.exclude {
+		if collected && p.matches(namespace, f.getLabels) {
+			collected = false
+		}
+	}
+
+	f.mutex.Lock()
+	f.collected[namespace] = collected
+	f.mutex.Unlock()
+	return collected
+}
+
+// Reset clears the memoized decisions
+func (f *NamespaceFilter) Reset() {
+	if f == nil {
+		return
+	}
+	f.mutex.Lock()
+	f.collected = make(map[string]bool)
+	f.mutex.Unlock()
+}
+
+func decodeNamespacePatterns(envName string) []string {
+	encodedPatterns := strings.TrimSpace(os.Getenv(envName))
+	if encodedPatterns == "" {
+		return nil
+	}
+	var patterns []string
+	decoded, err := base64.StdEncoding.DecodeString(encodedPatterns)
+	if err == nil {
+		err = json.Unmarshal(decoded, &patterns)
+	}
+	if err != nil {
+		message := fmt.Sprintf("Error::namespacefilter::Unable to parse %s, ignoring it: %s", envName, err.Error())
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	return patterns
+}
+
+// createNamespaceFilter creates the filter for the stream from the env settings, or nil if the stream has no namespace patterns
+func createNamespaceFilter(stream string, collectLogsEnv string, includeEnv string, excludeEnv string) *NamespaceFilter {
+	if strings.Compare(os.Getenv(collectLogsEnv), "true") != 0 {
+		return nil
+	}
+	include := decodeNamespacePatterns(includeEnv)
+	exclude := decodeNamespacePatterns(excludeEnv)
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	filter, err := NewNamespaceFilter(include, exclude, getNamespaceLabels)
+	if err != nil {
+		message := fmt.Sprintf("Error::namespacefilter::Unable to create %s namespace filter, ignoring the namespace patterns: %s", stream, err.Error())
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	Log("%s namespace filter enabled. include patterns: %v, exclude patterns: %v", stream, include, exclude)
+	return filter
+}
+
+// getNamespaceLabels returns the labels of the namespace from the namespace watch
+func getNamespaceLabels(namespace string) (labels.Set, bool) {
+	if NamespaceLister == nil {
+		return nil, false
+	}
+	ns, err := NamespaceLister.Get(namespace)
+	if err != nil {
+		return nil, false
+	}
+	return labels.Set(ns.Labels), true
+}
+
+// startNamespaceLabelWatch starts the namespace watch used by the label selector patterns.
+// The memoized decisions of the filters are reset whenever a namespace changes
+func startNamespaceLabelWatch(filters ...*NamespaceFilter) {
+	if ClientSet == nil {
+		Log("Error::namespacefilter::No kube api client, namespace label selectors wont match any namespace")
+		return
+	}
+	factory := informers.NewSharedInformerFactory(ClientSet, namespaceLabelWatchResyncInterval)
+	namespaceInformer := factory.Core().V1().Namespaces()
+	reset := func() {
+		for _, filter := range filters {
+			filter.Reset()
+		}
+	}
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { reset() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNs, oldOk := oldObj.(*corev1.Namespace)
+			newNs, newOk := newObj.(*corev1.Namespace)
+			if !oldOk || !newOk || !labels.Equals(oldNs.Labels, newNs.Labels) {
+				reset()
+			}
+		},
+		DeleteFunc: func(obj interface{}) { reset() },
+	})
+	NamespaceLister = namespaceInformer.Lister()
+	factory.Start(make(chan struct{}))
+	Log("Started namespace watch for namespace label selectors")
+}
+
+// initializeNamespaceFilters creates the stdout & stderr namespace filters and starts the namespace watch if needed
+func initializeNamespaceFilters() {
+	StdoutNamespaceFilter = createNamespaceFilter("stdout", "AZMON_COLLECT_STDOUT_LOGS", StdoutIncludedNamespacePatternsEnv, StdoutExcludedNamespacePatternsEnv)
+	StderrNamespaceFilter = createNamespaceFilter("stderr", "AZMON_COLLECT_STDERR_LOGS", StderrIncludedNamespacePatternsEnv, StderrExcludedNamespacePatternsEnv)
+	if (StdoutNamespaceFilter != nil && StdoutNamespaceFilter.usesLabels) || (StderrNamespaceFilter != nil && StderrNamespaceFilter.usesLabels) {
+		startNamespaceLabelWatch(StdoutNamespaceFilter, StderrNamespaceFilter)
+	}
+}
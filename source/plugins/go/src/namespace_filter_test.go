@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestNamespaceFilterPatterns(t *testing.T) {
+	namespaceLabels := map[string]labels.Set{
+		"payments": {"team": "payments", "env": "prod"},
+		"sandbox":  {"team": "payments", "env": "dev"},
+	}
+	getLabels := func(namespace string) (labels.Set, bool) {
+		l, ok := namespaceLabels[namespace]
+		return l, ok
+	}
+
+	f, err := NewNamespaceFilter(nil, []string{"kube-*", `regex:^pr-\d+$`, "label:env=dev"}, getLabels)
+	assert.NoError(t, err)
+	assert.False(t, f.IsCollected("kube-system"))
+	assert.False(t, f.IsCollected("pr-42"))
+	assert.True(t, f.IsCollected("pr-main"))
+	assert.False(t, f.IsCollected("sandbox"))
+	assert.True(t, f.IsCollected("payments"))
+	assert.True(t, f.usesLabels)
+
+	f, err = NewNamespaceFilter([]string{"label:team=payments", "default"}, []string{"sandbox"}, getLabels)
+	assert.NoError(t, err)
+	assert.True(t, f.IsCollected("payments"))
+	assert.True(t, f.IsCollected("default"))
+	assert.False(t, f.IsCollected("sandbox"))
+	assert.False(t, f.IsCollected("monitoring"))
+
+	var nilFilter *NamespaceFilter
+	assert.True(t, nilFilter.IsCollected("kube-system"))
+}
+
+func TestNamespaceFilterResetAfterLabelChange(t *testing.T) {
+	namespaceLabels := labels.Set{"logs": "off"}
+	getLabels := func(namespace string) (labels.Set, bool) { return namespaceLabels, true }
+
+	f, err := NewNamespaceFilter(nil, []string{"label:logs=off"}, getLabels)
+	assert.NoError(t, err)
+	assert.False(t, f.IsCollected("team-a"))
+
+	namespaceLabels = labels.Set{"logs": "on"}
+	assert.False(t, f.IsCollected("team-a"), "decision is memoized until reset")
+	f.Reset()
+	assert.True(t, f.IsCollected("team-a"))
+}
+
+func TestNamespaceFilterInvalidPatterns(t *testing.T) {
+	_, err := NewNamespaceFilter(nil, []string{"regex:(unclosed"}, nil)
+	assert.Error(t, err)
+	_, err = NewNamespaceFilter([]string{"label:team in (a"}, nil, nil)
+	assert.Error(t, err)
+	_, err = NewNamespaceFilter(nil, []string{"team-["}, nil)
+	assert.Error(t, err)
+}
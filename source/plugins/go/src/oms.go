@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -18,13 +16,13 @@ import (
 	"time"
 
 	"github.com/fluent/fluent-bit-go/output"
-	"github.com/google/uuid"
 
 	"Docker-Provider/source/plugins/go/src/extension"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -131,14 +129,14 @@ var (
 	PluginConfiguration map[string]string
 	// HTTPClient for making POST requests to OMSEndpoint
 	HTTPClient http.Client
-	// Client for MDSD msgp Unix socket
-	MdsdMsgpUnixSocketClient net.Conn
-	// Client for MDSD msgp Unix socket for KubeMon Agent events
-	MdsdKubeMonMsgpUnixSocketClient net.Conn
-	// Client for MDSD msgp Unix socket for Insights Metrics
-	MdsdInsightsMetricsMsgpUnixSocketClient net.Conn
-	// Client for MDSD msgp Unix socket for Input Plugin Records
-	MdsdInputPluginRecordsMsgpUnixSocketClient net.Conn
+	// ContainerLogSink destination for container logs (ODS until the plugin is initialized)
+	ContainerLogSink Sink = NewODSHTTPSink()
+	// KubeMonAgentEventsSink destination for KubeMon Agent events
+	KubeMonAgentEventsSink Sink
+	// InsightsMetricsSink destination for Insights Metrics
+	InsightsMetricsSink Sink
+	// InputPluginRecordsSink destination for Input Plugin Records (nil if not supported)
+	InputPluginRecordsSink Sink
 	// OMSEndpoint ingestion endpoint
 	OMSEndpoint string
 	// Computer (Hostname) when ingesting into ContainerLog table
@@ -195,14 +193,6 @@ var (
 	IsGenevaLogsIntegrationEnabled bool
 	// flag to check whether Geneva Logs ServiceMode enabled or not
 	IsGenevaLogsTelemetryServiceMode bool
-	// named pipe connection to send ContainerLog for AMA
-	ContainerLogNamedPipe net.Conn
-	// named pipe connection to send KubeMonAgentEvents for AMA
-	KubeMonAgentEventsNamedPipe net.Conn
-	// named pipe connection to ContainerInventory for AMA
-	InputPluginNamedPipe net.Conn
-	// named pipe connection to send InsightsMetrics for AMA
-	InsightsMetricsNamedPipe net.Conn
 	// flag to check whether Azure Monitor Multi-tenancy Log Collection enabled or not
 	IsAzMonMultiTenancyLogCollectionEnabled bool
 	// flag to check whether Azure Monitor Multi-tenancy Logs ServiceMode enabled or not
@@ -250,8 +240,34 @@ var (
 	StreamIdNamedPipeMap map[string]string
 	// ContainerLogV2ExtensionMapUpdateMutex read and write mutex access to the NamespaceStreamIdsMap
 	ContainerLogV2ExtensionMapUpdateMutex = &sync.Mutex{}
-	// NamedPipe and namedpipe connection cache for windows
-	NamedPipeConnectionCache map[string]net.Conn
+	// ContainerLogSpillBuffer on-disk buffer for container log batches which couldnt be written to mdsd
+	ContainerLogSpillBuffer *SpillBuffer
+	// ContainerLogPartialReassembler joins CRI partial log lines
+	ContainerLogPartialReassembler *PartialLogReassembler
+	// ContainerLogMultilineGrouper merges multi-line records (e.g. stack traces) into a single record
+	ContainerLogMultilineGrouper *MultilineGrouper
+	// ContainerLogRedactor scrubs secrets & PII from the container log messages
+	ContainerLogRedactor *LogRedactor
+	// ContainerLogJSONParser parses json log lines into structured ContainerLogV2 log messages
+	ContainerLogJSONParser *JSONLogParser
+	// ContainerLogLevelDetector detects the severity of the container log lines for the ContainerLogV2 LogLevel column
+	ContainerLogLevelDetector *LogLevelDetector
+	// ContainerLogDeduplicator suppresses repeated identical container log lines
+	ContainerLogDeduplicator *LogDeduplicator
+	// ContainerLogSampler keeps a fraction of the container logs of the namespaces with a sampling ratio
+	ContainerLogSampler *LogSampler
+	// ContainerLogRouter sends the container log records matching a routing rule to the rule's output stream
+	ContainerLogRouter *LogRouter
+	// ContainerLogBudgetEnforcer drops the container logs of the namespaces which exhausted their ingestion budget
+	ContainerLogBudgetEnforcer *LogBudgetEnforcer
+	// ContainerLogTee mirrors a percentage of the container log batches to a secondary destination
+	ContainerLogTee *LogTee
+	// ContainerLogStreamWriter writes the multi-tenancy streams of the container logs in parallel, nil if they are written one after another
+	ContainerLogStreamWriter *StreamWriter
+	// ContainerLogFrameStreaming is true if the container log records are encoded into the forward message as they are read
+	ContainerLogFrameStreaming bool
+	// ContainerLogDeliveredBatches remembers the container log batches delivered by a retried flush, so its retry doesnt send them again
+	ContainerLogDeliveredBatches = NewDeliveredBatchTracker(deliveredBatchesTTL, maxDeliveredBatches)
 )
 
 var (
@@ -293,16 +309,24 @@ type DataItemLAv1 struct {
 
 // DataItemLAv2 == ContainerLogV2 table in LA
 // Please keep the names same as destination column names, to avoid transforming one to another in the pipeline
+// LogMessage is a string, or json.RawMessage if the log line was parsed as json. ParsedLogMessage is only set if json parsing is in column mode
+// and LogLevel only if log level detection is enabled. SamplingRate is only set for records of sampled namespaces. RepeatCount, FirstTimeGenerated & LastTimeGenerated are only set for the summary records of deduplicated lines
 type DataItemLAv2 struct {
-	TimeGenerated      string `json:"TimeGenerated"`
-	Computer           string `json:"Computer"`
-	ContainerId        string `json:"ContainerId"`
-	ContainerName      string `json:"ContainerName"`
-	PodName            string `json:"PodName"`
-	PodNamespace       string `json:"PodNamespace"`
-	LogMessage         string `json:"LogMessage"`
-	LogSource          string `json:"LogSource"`
-	KubernetesMetadata string `json:"KubernetesMetadata"`
+	TimeGenerated      string          `json:"TimeGenerated"`
+	Computer           string          `json:"Computer"`
+	ContainerId        string          `json:"ContainerId"`
+	ContainerName      string          `json:"ContainerName"`
+	PodName            string          `json:"PodName"`
+	PodNamespace       string          `json:"PodNamespace"`
+	LogMessage         interface{}     `json:"LogMessage"`
+	LogSource          string          `json:"LogSource"`
+	KubernetesMetadata string          `json:"KubernetesMetadata"`
+	ParsedLogMessage   json.RawMessage `json:"ParsedLogMessage,omitempty"`
+	LogLevel           string          `json:"LogLevel,omitempty"`
+	RepeatCount        int             `json:"RepeatCount,omitempty"`
+	FirstTimeGenerated string          `json:"FirstTimeGenerated,omitempty"`
+	LastTimeGenerated  string          `json:"LastTimeGenerated,omitempty"`
+	SamplingRate       float64         `json:"SamplingRate,omitempty"`
 }
 
 // telegraf metric DataItem represents the object corresponding to the json that is sent by fluentbit tail plugin
@@ -341,7 +365,8 @@ type ContainerLogBlobLAv2 struct {
 
 // MsgPackEntry represents the object corresponding to a single messagepack event in the messagepack stream
 type MsgPackEntry struct {
-	Time   int64             `msg:"time"`
+	// Time of the record, the flush time is used if zero
+	Time   time.Time         `msg:"time"`
 	Record map[string]string `msg:"record"`
 }
 
@@ -443,51 +468,95 @@ func createLogger() *log.Logger {
 	return logger
 }
 
+// isContainerMetadataRefreshNeeded returns true if the enrichment, workload settings, routing rules or budgets need the metadata of the pods of the node
+func isContainerMetadataRefreshNeeded(enrichContainerLogs bool) bool {
+	return enrichContainerLogs || WorkloadLogSettingsEnabled ||
+		(ContainerLogRouter != nil && ContainerLogRouter.usesPodLabels) ||
+		(ContainerLogBudgetEnforcer != nil && ContainerLogBudgetEnforcer.usesControllers)
+}
+
 func updateContainerImageNameMaps() {
 	for ; true; <-ContainerImageNameRefreshTicker.C {
-		Log("Updating ImageIDMap and NameIDMap")
+		refreshContainerImageNameMaps()
+	}
+}
 
-		_imageIDMap := make(map[string]string)
-		_nameIDMap := make(map[string]string)
+// refreshContainerImageNameMaps updates the image and name maps, and the workload settings, pod labels & controllers of the containers when used, from the pods of the node
+func refreshContainerImageNameMaps() {
+	Log("Updating ImageIDMap and NameIDMap")
 
-		listOptions := metav1.ListOptions{}
-		listOptions.FieldSelector = fmt.Sprintf("spec.nodeName=%s", Computer)
+	_imageIDMap := make(map[string]string)
+	_nameIDMap := make(map[string]string)
+	_workloadLogSettingsMap := make(map[string]*WorkloadLogSettings)
+	_containerPodLabelsMap := make(map[string]map[string]string)
+	routesOnPodLabels := ContainerLogRouter != nil && ContainerLogRouter.usesPodLabels
+	_containerControllerNameMap := make(map[string]string)
+	budgetsPerController := ContainerLogBudgetEnforcer != nil && ContainerLogBudgetEnforcer.usesControllers
 
-		// Context was added as a parameter, but we want the same behavior as before: see https://pkg.go.dev/context#TODO
-		pods, err := ClientSet.CoreV1().Pods("").List(context.TODO(), listOptions)
+	listOptions := metav1.ListOptions{}
+	listOptions.FieldSelector = fmt.Sprintf("spec.nodeName=%s", Computer)
 
-		if err != nil {
-			message := fmt.Sprintf("Error getting pods %s\nIt is ok to log here and continue, because the logs will be missing image and Name, but the logs will still have the containerID", err.Error())
-			Log(message)
-			continue
-		}
+	// Context was added as a parameter, but we want the same behavior as before: see https://pkg.go.dev/context#TODO
+	pods, err := ClientSet.CoreV1().Pods("").List(context.TODO(), listOptions)
 
-		for _, pod := range pods.Items {
-			podContainerStatuses := pod.Status.ContainerStatuses
+	if err != nil {
+		message := fmt.Sprintf("Error getting pods %s\nIt is ok to log here and continue, because the logs will be missing image and Name, but the logs will still have the containerID", err.Error())
+		Log(message)
+		return
+	}
+
+	for _, pod := range pods.Items {
+		podContainerStatuses := pod.Status.ContainerStatuses
 
-			// Doing this to include init container logs as well
-			podInitContainerStatuses := pod.Status.InitContainerStatuses
-			if (podInitContainerStatuses != nil) && (len(podInitContainerStatuses) > 0) {
-				podContainerStatuses = append(podContainerStatuses, podInitContainerStatuses...)
+		// Doing this to include init container logs as well
+		podInitContainerStatuses := pod.Status.InitContainerStatuses
+		if (podInitContainerStatuses != nil) && (len(podInitContainerStatuses) > 0) {
+			podContainerStatuses = append(podContainerStatuses, podInitContainerStatuses...)
+		}
+		for _, status := range podContainerStatuses {
+			lastSlashIndex := strings.LastIndex(status.ContainerID, "/")
+			containerID := status.ContainerID[lastSlashIndex+1 : len(status.ContainerID)]
+			image := status.Image
+			name := fmt.Sprintf("%s/%s", pod.UID, status.Name)
+			if containerID != "" {
+				_imageIDMap[containerID] = image
+				_nameIDMap[containerID] = name
 			}
-			for _, status := range podContainerStatuses {
-				lastSlashIndex := strings.LastIndex(status.ContainerID, "/")
-				containerID := status.ContainerID[lastSlashIndex+1 : len(status.ContainerID)]
-				image := status.Image
-				name := fmt.Sprintf("%s/%s", pod.UID, status.Name)
-				if containerID != "" {
-					_imageIDMap[containerID] = image
-					_nameIDMap[containerID] = name
-				}
+			if containerID != "" && WorkloadLogSettingsEnabled {
+				_workloadLogSettingsMap[containerID] = getPodAnnotationLogSettings(pod.Name, pod.Annotations)
+			}
+			if containerID != "" && routesOnPodLabels {
+				_containerPodLabelsMap[containerID] = pod.Labels
+			}
+			if containerID != "" && budgetsPerController {
+				_containerControllerNameMap[containerID] = getPodControllerName(&pod)
 			}
 		}
+	}
+
+	Log("Locking to update image and name maps")
+	DataUpdateMutex.Lock()
+	ImageIDMap = _imageIDMap
+	NameIDMap = _nameIDMap
+	DataUpdateMutex.Unlock()
+	Log("Unlocking after updating image and name maps")
+
+	if WorkloadLogSettingsEnabled {
+		WorkloadLogSettingsMutex.Lock()
+		WorkloadLogSettingsMap = _workloadLogSettingsMap
+		WorkloadLogSettingsMutex.Unlock()
+	}
+
+	if routesOnPodLabels {
+		ContainerPodLabelsMutex.Lock()
+		ContainerPodLabelsMap = _containerPodLabelsMap
+		ContainerPodLabelsMutex.Unlock()
+	}
 
-		Log("Locking to update image and name maps")
-		DataUpdateMutex.Lock()
-		ImageIDMap = _imageIDMap
-		NameIDMap = _nameIDMap
-		DataUpdateMutex.Unlock()
-		Log("Unlocking after updating image and name maps")
+	if budgetsPerController {
+		ContainerControllerNameMutex.Lock()
+		ContainerControllerNameMap = _containerControllerNameMap
+		ContainerControllerNameMutex.Unlock()
 	}
 }
 
@@ -707,8 +776,12 @@ func flushKubeMonAgentEventRecords() {
 
 			telemetryDimensions["ConfigErrorEventCount"] = strconv.Itoa(len(ConfigErrorEvent))
 			telemetryDimensions["PromScrapeErrorEventCount"] = strconv.Itoa(len(PromScrapeErrorEvent))
+			budgetEventRecords := getLogBudgetEventRecords(start.Format(time.RFC3339))
+			telemetryDimensions["LogBudgetEventCount"] = strconv.Itoa(len(budgetEventRecords))
+			routeSwitchEventRecords := getRouteSwitchEventRecords(start.Format(time.RFC3339))
+			telemetryDimensions["RouteSwitchEventCount"] = strconv.Itoa(len(routeSwitchEventRecords))
 
-			if (len(ConfigErrorEvent) > 0) || (len(PromScrapeErrorEvent) > 0) {
+			if (len(ConfigErrorEvent) > 0) || (len(PromScrapeErrorEvent) > 0) || (len(budgetEventRecords) > 0) || (len(routeSwitchEventRecords) > 0) {
 				EventHashUpdateMutex.Lock()
 				Log("Locked EventHashUpdateMutex for reading hashes\n")
 				for k, v := range ConfigErrorEvent {
@@ -743,6 +816,7 @@ func flushKubeMonAgentEventRecords() {
 								SendException(message)
 							} else {
 								msgPackEntry := MsgPackEntry{
+									Time:   getRecordEventTime(stringMap, collectionTimeFields...),
 									Record: stringMap,
 								}
 								msgPackEntries = append(msgPackEntries, msgPackEntry)
@@ -782,6 +856,7 @@ func flushKubeMonAgentEventRecords() {
 								SendException(message)
 							} else {
 								msgPackEntry := MsgPackEntry{
+									Time:   getRecordEventTime(stringMap, collectionTimeFields...),
 									Record: stringMap,
 								}
 								msgPackEntries = append(msgPackEntries, msgPackEntry)
@@ -790,6 +865,29 @@ func flushKubeMonAgentEventRecords() {
 					}
 				}
 
+				for _, laKubeMonAgentEventsRecord := range append(budgetEventRecords, routeSwitchEventRecords...) {
+					laKubeMonAgentEventsRecords = append(laKubeMonAgentEventsRecords, laKubeMonAgentEventsRecord)
+					var stringMap map[string]string
+					jsonBytes, err := json.Marshal(&laKubeMonAgentEventsRecord)
+					if err != nil {
+						message := fmt.Sprintf("Error while Marshalling laKubeMonAgentEventsRecord to json bytes: %s", err.Error())
+						Log(message)
+						SendException(message)
+					} else {
+						if err := json.Unmarshal(jsonBytes, &stringMap); err != nil {
+							message := fmt.Sprintf("Error while UnMarhalling json bytes to stringmap: %s", err.Error())
+							Log(message)
+							SendException(message)
+						} else {
+							msgPackEntry := MsgPackEntry{
+								Time:   getRecordEventTime(stringMap, collectionTimeFields...),
+								Record: stringMap,
+							}
+							msgPackEntries = append(msgPackEntries, msgPackEntry)
+						}
+					}
+				}
+
 				//Clearing out the prometheus scrape hash so that it can be rebuilt with the errors in the next hour
 				for k := range PromScrapeErrorEvent {
 					delete(PromScrapeErrorEvent, k)
@@ -831,6 +929,7 @@ func flushKubeMonAgentEventRecords() {
 							SendException(message)
 						} else {
 							msgPackEntry := MsgPackEntry{
+								Time:   getRecordEventTime(stringMap, collectionTimeFields...),
 								Record: stringMap,
 							}
 							msgPackEntries = append(msgPackEntries, msgPackEntry)
@@ -838,7 +937,7 @@ func flushKubeMonAgentEventRecords() {
 					}
 				}
 			}
-			if (IsWindows == false || IsAADMSIAuthMode) && len(msgPackEntries) > 0 { //for linux, mdsd route and Windows MSI auth mode, AMA route
+			if len(msgPackEntries) > 0 {
 				if IsAADMSIAuthMode == true {
 					MdsdKubeMonAgentEventsTagName = getOutputStreamIdTag(KubeMonAgentEventDataType, MdsdKubeMonAgentEventsTagName, &MdsdKubeMonAgentEventsTagRefreshTracker)
 					if MdsdKubeMonAgentEventsTagName == "" {
@@ -847,51 +946,28 @@ func flushKubeMonAgentEventRecords() {
 					}
 				}
 				Log("Info::mdsd:: using mdsdsource name for KubeMonAgentEvents: %s", MdsdKubeMonAgentEventsTagName)
-				msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdKubeMonAgentEventsTagName, msgPackEntries)
-				var er error
-				var bts int
-				if IsWindows == false {
-					if MdsdKubeMonMsgpUnixSocketClient == nil {
-						Log("Error::mdsd::mdsd connection for KubeMonAgentEvents does not exist. re-connecting ...")
-						CreateMDSDClient(KubeMonAgentEvents, ContainerType)
-						if MdsdKubeMonMsgpUnixSocketClient == nil {
-							Log("Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
-							ContainerLogTelemetryMutex.Lock()
-							defer ContainerLogTelemetryMutex.Unlock()
-							KubeMonEventsMDSDClientCreateErrors += 1
-						}
-					}
-					if MdsdKubeMonMsgpUnixSocketClient != nil {
-						deadline := 10 * time.Second
-						MdsdKubeMonMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-						bts, er = MdsdKubeMonMsgpUnixSocketClient.Write(msgpBytes)
-					} else {
-						Log("Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
-					}
-				} else {
-					if EnsureGenevaOr3PNamedPipeExists(&KubeMonAgentEventsNamedPipe, KubeMonAgentEventDataType, &KubeMonEventsWindowsAMAClientCreateErrors, false, &MdsdKubeMonAgentEventsTagRefreshTracker) {
-						deadline := 10 * time.Second
-						KubeMonAgentEventsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-						bts, er = KubeMonAgentEventsNamedPipe.Write(msgpBytes)
-					} else {
-						Log("Error::mdsd::Unable to create ama named pipe for KubeMonAgentEvents. Please check error log.")
-					}
-				}
+				bts, er := writeToSink(KubeMonAgentEventsSink, &SinkBatch{
+					DataType: KubeMonAgentEventDataType,
+					Tag:      MdsdKubeMonAgentEventsTagName,
+					Entries:  msgPackEntries,
+					Payload: KubeMonAgentEventBlob{
+						DataType:  KubeMonAgentEventDataType,
+						IPName:    IPName,
+						DataItems: laKubeMonAgentEventsRecords},
+				})
 				elapsed = time.Since(start)
 				if er != nil {
-					message := fmt.Sprintf("Error::mdsd/ama::Failed to write to kubemonagent %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
-					Log(message)
-					if IsWindows == false {
-						if MdsdKubeMonMsgpUnixSocketClient != nil {
-							MdsdKubeMonMsgpUnixSocketClient.Close()
-							MdsdKubeMonMsgpUnixSocketClient = nil
-						}
-					} else {
-						if KubeMonAgentEventsNamedPipe != nil {
-							KubeMonAgentEventsNamedPipe.Close()
-							KubeMonAgentEventsNamedPipe = nil
+					if IsSinkConnectError(er) {
+						ContainerLogTelemetryMutex.Lock()
+						if IsWindows {
+							KubeMonEventsWindowsAMAClientCreateErrors += 1
+						} else {
+							KubeMonEventsMDSDClientCreateErrors += 1
 						}
+						ContainerLogTelemetryMutex.Unlock()
 					}
+					message := fmt.Sprintf("Error::%s::Failed to write to kubemonagent %d records after %s. Will retry ... error : %s", KubeMonAgentEventsSink.Name(), len(msgPackEntries), elapsed, er.Error())
+					Log(message)
 					SendException(message)
 				} else {
 					numRecords := len(msgPackEntries)
@@ -899,53 +975,6 @@ func flushKubeMonAgentEventRecords() {
 					// Send telemetry to AppInsights resource
 					SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
 				}
-			} else if len(laKubeMonAgentEventsRecords) > 0 { //for windows, ODS direct
-				kubeMonAgentEventEntry := KubeMonAgentEventBlob{
-					DataType:  KubeMonAgentEventDataType,
-					IPName:    IPName,
-					DataItems: laKubeMonAgentEventsRecords}
-
-				marshalled, err := json.Marshal(kubeMonAgentEventEntry)
-
-				if err != nil {
-					message := fmt.Sprintf("Error while marshalling kubemonagentevent entry: %s", err.Error())
-					Log(message)
-					SendException(message)
-				} else {
-					req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
-					req.Header.Set("Content-Type", "application/json")
-					req.Header.Set("User-Agent", userAgent)
-					reqId := uuid.New().String()
-					req.Header.Set("X-Request-ID", reqId)
-					//expensive to do string len for every request, so use a flag
-					if ResourceCentric == true {
-						req.Header.Set("x-ms-AzureResourceId", ResourceID)
-					}
-
-					resp, err := HTTPClient.Do(req)
-					elapsed = time.Since(start)
-
-					if err != nil {
-						message := fmt.Sprintf("Error when sending kubemonagentevent request %s \n", err.Error())
-						Log(message)
-						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
-					} else if resp == nil || resp.StatusCode != 200 {
-						if resp != nil {
-							Log("flushKubeMonAgentEventRecords: RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
-						}
-						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
-					} else {
-						numRecords := len(laKubeMonAgentEventsRecords)
-						Log("FlushKubeMonAgentEventRecords::Info::Successfully flushed %d records in %s", numRecords, elapsed)
-
-						// Send telemetry to AppInsights resource
-						SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
-
-					}
-					if resp != nil && resp.Body != nil {
-						defer resp.Body.Close()
-					}
-				}
 			}
 		} else {
 			// Setting this to false to allow for subsequent flushes after the first hour
@@ -1036,7 +1065,7 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 		Log(message)
 	}
 
-	if IsWindows == false || IsAADMSIAuthMode { //for linux and for windows MSI Auth: mdsd/ama route
+	if !isODSSink(InsightsMetricsSink) { //for linux and for windows MSI Auth: mdsd/ama route
 		var msgPackEntries []MsgPackEntry
 		var i int
 		start := time.Now()
@@ -1064,6 +1093,7 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 						stringMap[strKey] = strValue
 					}
 					msgPackEntry := MsgPackEntry{
+						Time:   getRecordEventTime(stringMap, collectionTimeFields...),
 						Record: stringMap,
 					}
 					msgPackEntries = append(msgPackEntries, msgPackEntry)
@@ -1078,54 +1108,21 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 					return output.FLB_OK
 				}
 			}
-			msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdInsightsMetricsTagName, msgPackEntries)
-			var bts int
-			var er error
-			if IsWindows == false {
-				if MdsdInsightsMetricsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-					CreateMDSDClient(InsightsMetrics, ContainerType)
-					if MdsdInsightsMetricsMsgpUnixSocketClient == nil {
-						Log("Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
-						ContainerLogTelemetryMutex.Lock()
-						defer ContainerLogTelemetryMutex.Unlock()
-						InsightsMetricsMDSDClientCreateErrors += 1
-						return output.FLB_RETRY
-					}
-				}
-
-				deadline := 10 * time.Second
-				MdsdInsightsMetricsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-				bts, er = MdsdInsightsMetricsMsgpUnixSocketClient.Write(msgpBytes)
-			} else {
-				if InsightsMetricsNamedPipe == nil {
-					EnsureGenevaOr3PNamedPipeExists(&InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &MdsdInsightsMetricsTagRefreshTracker)
-					if InsightsMetricsNamedPipe == nil {
-						Log("Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
-						ContainerLogTelemetryMutex.Lock()
-						defer ContainerLogTelemetryMutex.Unlock()
-						InsightsMetricsWindowsAMAClientCreateErrors += 1
-						return output.FLB_RETRY
-					}
-				}
-				deadline := 10 * time.Second
-				InsightsMetricsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-				bts, er = InsightsMetricsNamedPipe.Write(msgpBytes)
-			}
+			bts, er := writeToSink(InsightsMetricsSink, &SinkBatch{DataType: InsightsMetricsDataType, Tag: MdsdInsightsMetricsTagName, Entries: msgPackEntries})
 
 			elapsed = time.Since(start)
 
 			if er != nil {
-				Log("Error::mdsd::Failed to write to ama/mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+				Log("Error::%s::Failed to write to ama/mdsd %d records after %s. Will retry ... error : %s", InsightsMetricsSink.Name(), len(msgPackEntries), elapsed, er.Error())
 				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
-				if MdsdInsightsMetricsMsgpUnixSocketClient != nil {
-					MdsdInsightsMetricsMsgpUnixSocketClient.Close()
-					MdsdInsightsMetricsMsgpUnixSocketClient = nil
-				}
 
 				ContainerLogTelemetryMutex.Lock()
 				defer ContainerLogTelemetryMutex.Unlock()
-				InsightsMetricsMDSDClientCreateErrors += 1
+				if IsWindows && IsSinkConnectError(er) {
+					InsightsMetricsWindowsAMAClientCreateErrors += 1
+				} else {
+					InsightsMetricsMDSDClientCreateErrors += 1
+				}
 				return output.FLB_RETRY
 			} else {
 				numTelegrafMetricsRecords := len(msgPackEntries)
@@ -1152,72 +1149,26 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 			IPName:    IPName,
 			DataItems: metrics}
 
-		jsonBytes, err := json.Marshal(laTelegrafMetrics)
-
-		if err != nil {
-			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:when marshalling json %q", err)
-			Log(message)
-			SendException(message)
-			return output.FLB_OK
-		}
-
 		//Post metrics data to LA
-		req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(jsonBytes))
-
-		//req.URL.Query().Add("api-version","2016-04-01")
-
-		//set headers
-		req.Header.Set("x-ms-date", time.Now().Format(time.RFC3339))
-		req.Header.Set("User-Agent", userAgent)
-		reqID := uuid.New().String()
-		req.Header.Set("X-Request-ID", reqID)
-
-		//expensive to do string len for every request, so use a flag
-		if ResourceCentric == true {
-			req.Header.Set("x-ms-AzureResourceId", ResourceID)
-		}
-		if IsAADMSIAuthMode == true {
-			IngestionAuthTokenUpdateMutex.Lock()
-			ingestionAuthToken := ODSIngestionAuthToken
-			IngestionAuthTokenUpdateMutex.Unlock()
-			if ingestionAuthToken == "" {
-				message := "Error::ODS Ingestion Auth Token is empty. Please check error log."
-				Log(message)
-				return output.FLB_RETRY
-			}
-			// add authorization header to the req
-			req.Header.Set("Authorization", "Bearer "+ingestionAuthToken)
-		}
-
 		start := time.Now()
-		resp, err := HTTPClient.Do(req)
+		_, err := writeToSink(InsightsMetricsSink, &SinkBatch{DataType: InsightsMetricsDataType, Payload: laTelegrafMetrics})
 		elapsed := time.Since(start)
 
 		if err != nil {
-			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:(retriable) when sending %v metrics. duration:%v err:%q \n", len(laMetrics), elapsed, err.Error())
-			Log(message)
-			UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
-			return output.FLB_RETRY
-		}
-
-		if resp != nil && resp.Body != nil {
-			defer resp.Body.Close()
-		}
-
-		if resp == nil || IsRetriableError(resp.StatusCode) {
-			if resp != nil {
-				Log("PostTelegrafMetricsToLA::Error:(retriable) RequestID %s Response Status %v Status Code %v", reqID, resp.Status, resp.StatusCode)
-			}
-			if resp != nil && resp.StatusCode == 429 {
-				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 1, 0)
+			if IsRetriableSinkError(err) {
+				Log("PostTelegrafMetricsToLA::Error:(retriable) when sending %v metrics. duration:%v err:%q \n", len(laMetrics), elapsed, err.Error())
+				if GetSinkErrorStatusCode(err) == 429 {
+					UpdateNumTelegrafMetricsSentTelemetry(0, 1, 1, 0)
+				} else {
+					UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
+				}
+				return output.FLB_RETRY
 			}
-			return output.FLB_RETRY
-		} else if IsSuccessStatusCode(resp.StatusCode) {
+			Log("PostTelegrafMetricsToLA::Error:Failed with non-retriable error::%s", err.Error())
+		} else {
 			numMetrics := len(laMetrics)
 			UpdateNumTelegrafMetricsSentTelemetry(numMetrics, 0, 0, numWinMetricsWithTagsSize64KBorMore)
 			Log("PostTelegrafMetricsToLA::Info:Successfully flushed %v records in %v", numMetrics, elapsed)
-		} else {
-			Log("PostTelegrafMetricsToLA::Error:Failed with non-retriable error::RequestId %s Status %s Status Code %d", reqID, resp.Status, resp.StatusCode)
 		}
 	}
 
@@ -1415,6 +1366,7 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 		for _, message := range messages {
 			stringMap := convertMap(message)
 			msgPackEntry := MsgPackEntry{
+				Time:   getRecordEventTime(stringMap, inputPluginRecordTimeFields...),
 				Record: stringMap,
 			}
 			msgPackEntries = append(msgPackEntries, msgPackEntry)
@@ -1423,58 +1375,21 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 		if len(msgPackEntries) == 0 {
 			continue
 		}
-		var bts int
-		var er error
-		var elapsed time.Duration
-		deadline := 10 * time.Second
-
-		if !IsWindows || (IsWindows && IsAADMSIAuthMode) {
+		if InputPluginRecordsSink != nil {
 			//for linux, mdsd route
 			//for Windows with MSI auth mode, AMA route
 			Log("Info::mdsd/AMA:: using mdsdsource name for input plugin records: %s", tag)
-			msgpBytes := convertMsgPackEntriesToMsgpBytes(tag, msgPackEntries)
-			if !IsWindows {
-				if MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::mdsd connection for input plugin records does not exist. re-connecting ...")
-					CreateMDSDClient(InputPluginRecords, ContainerType)
-				}
-				if MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::Unable to create mdsd client for input plugin records. Please check error log.")
-					ContainerLogTelemetryMutex.Lock()
-					defer ContainerLogTelemetryMutex.Unlock()
-					InputPluginRecordsErrors += 1
-				} else {
-					MdsdInputPluginRecordsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-					bts, er = MdsdInputPluginRecordsMsgpUnixSocketClient.Write(msgpBytes)
-					elapsed = time.Since(start)
-				}
-			} else {
-				if InputPluginNamedPipe == nil {
-					EnsureGenevaOr3PNamedPipeExists(&InputPluginNamedPipe, ContainerInventoryDataType, &ContainerLogsWindowsAMAClientCreateErrors, false, &MdsdContainerLogTagRefreshTracker)
-				}
-				if InputPluginNamedPipe == nil {
-					Log("Error::mdsd::Unable to create AMA client for input plugin records. Please check error log.")
+			bts, er := writeToSink(InputPluginRecordsSink, &SinkBatch{DataType: tag, Tag: tag, Entries: msgPackEntries})
+			elapsed := time.Since(start)
+
+			if er != nil {
+				if IsSinkConnectError(er) {
 					ContainerLogTelemetryMutex.Lock()
-					defer ContainerLogTelemetryMutex.Unlock()
 					InputPluginRecordsErrors += 1
-				} else {
-					InputPluginNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-					bts, er = InputPluginNamedPipe.Write(msgpBytes)
-					elapsed = time.Since(start)
+					ContainerLogTelemetryMutex.Unlock()
 				}
-			}
-
-			if er != nil {
-				message := fmt.Sprintf("Error::mdsd/AMA::Failed to write to input plugin %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+				message := fmt.Sprintf("Error::%s::Failed to write to input plugin %d records after %s. Will retry ... error : %s", InputPluginRecordsSink.Name(), len(msgPackEntries), elapsed, er.Error())
 				Log(message)
-				if MdsdInputPluginRecordsMsgpUnixSocketClient != nil {
-					MdsdInputPluginRecordsMsgpUnixSocketClient.Close()
-					MdsdInputPluginRecordsMsgpUnixSocketClient = nil
-				}
-				if InputPluginNamedPipe != nil {
-					InputPluginNamedPipe.Close()
-					InputPluginNamedPipe = nil
-				}
 				SendException(message)
 			} else {
 				telemetryDimensions := make(map[string]string)
@@ -1500,7 +1415,7 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 }
 
 // PostDataHelper sends data to the ODS endpoint or oneagent or ADX
-func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
+func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) (status int) {
 	start := time.Now()
 	var dataItemsLAv1 []DataItemLAv1
 	var dataItemsLAv2 []DataItemLAv2
@@ -1509,6 +1424,14 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 	var stringMap map[string]string
 	var elapsed time.Duration
 
+	containerLogEncoder := newContainerLogFrameEncoder()
+	recordString := ToString
+	if containerLogEncoder != nil {
+		defer containerLogEncoder.Release()
+		// the streamed records are copied into the forward message, so their values dont need to be copied out of the chunk
+		recordString = toStringView
+	}
+
 	var maxLatency float64
 	var maxLatencyContainer string
 
@@ -1525,6 +1448,46 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 	}
 	DataUpdateMutex.Unlock()
 
+	// the stages keeping state across flushes are rolled back if the flush is retried, since fluent bit resends the same chunk
+	var rollbacks []func()
+	defer func() {
+		if status == output.FLB_RETRY {
+			for i := len(rollbacks) - 1; i >= 0; i-- {
+				rollbacks[i]()
+			}
+		}
+	}()
+	tailPluginRecords, rollback := reassemblePartialContainerLogs(tailPluginRecords)
+	if rollback != nil {
+		rollbacks = append(rollbacks, rollback)
+	}
+	tailPluginRecords, rollback = groupMultilineContainerLogs(tailPluginRecords)
+	if rollback != nil {
+		rollbacks = append(rollbacks, rollback)
+	}
+	tailPluginRecords, rollback = deduplicateContainerLogs(tailPluginRecords)
+	if rollback != nil {
+		rollbacks = append(rollbacks, rollback)
+	}
+	var budgetUndos []func()
+	if ContainerLogBudgetEnforcer != nil {
+		rollbacks = append(rollbacks, func() {
+			for _, undo := range budgetUndos {
+				undo()
+			}
+		})
+	}
+	redactionHits := make(map[string]int)
+	jsonParsedRecords := 0
+	jsonOversizedRecords := 0
+	sampledOutRecords := 0
+	dcrNamespaceFilter := getDataCollectionNamespaceFilter()
+	dcrFilteredRecords := 0
+	budgetDroppedRecords := 0
+	// routing rule of each msgpack entry, nil for the entries sent to the default stream
+	var msgPackEntryRoutes []*LogRoutingRule
+	routedRecords := make(map[string]int)
+
 	for _, record := range tailPluginRecords {
 		containerID, k8sNamespace, k8sPodName, containerName := GetContainerIDK8sNamespacePodNameFromFileName(ToString(record["filepath"]))
 		logEntrySource := ToString(record["stream"])
@@ -1551,7 +1514,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 		}
 
 		if strings.EqualFold(logEntrySource, "stdout") {
-			if containerID == "" || containsKey(StdoutIgnoreNsSet, k8sNamespace) {
+			if containerID == "" || containsKey(StdoutIgnoreNsSet, k8sNamespace) || !StdoutNamespaceFilter.IsCollected(k8sNamespace) {
 				continue
 			}
 			if len(StdoutIncludeSystemNamespaceSet) > 0 && containsKey(StdoutIncludeSystemNamespaceSet, k8sNamespace) {
@@ -1563,7 +1526,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 				}
 			}
 		} else if strings.EqualFold(logEntrySource, "stderr") {
-			if containerID == "" || containsKey(StderrIgnoreNsSet, k8sNamespace) {
+			if containerID == "" || containsKey(StderrIgnoreNsSet, k8sNamespace) || !StderrNamespaceFilter.IsCollected(k8sNamespace) {
 				continue
 			}
 			if len(StderrIncludeSystemNamespaceSet) > 0 && containsKey(StderrIncludeSystemNamespaceSet, k8sNamespace) {
@@ -1576,7 +1539,47 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
-		stringMap = make(map[string]string)
+		if dcrNamespaceFilter.Excludes(k8sPodName, k8sNamespace) {
+			dcrFilteredRecords += 1
+			continue
+		}
+
+		workloadSettings := getWorkloadLogSettings(containerID, record)
+		if workloadSettings.Excludes(logEntrySource) {
+			continue
+		}
+
+		logEntry := recordString(record["log"])
+		samplingRate := 1.0
+		if ContainerLogSampler != nil {
+			samplingRate = ContainerLogSampler.Ratio(k8sNamespace, logEntrySource)
+		}
+		if workloadSettings != nil && workloadSettings.SamplingRate != nil {
+			samplingRate = *workloadSettings.SamplingRate
+		}
+		if samplingRate < 1 && !sampleLogLine(samplingRate, containerID, ToString(record["time"]), logEntry) {
+			sampledOutRecords += 1
+			continue
+		}
+		if ContainerLogBudgetEnforcer != nil {
+			controller := ""
+			if ContainerLogBudgetEnforcer.usesControllers {
+				controller = getContainerControllerName(containerID, k8sPodName)
+			}
+			allowed, undo := ContainerLogBudgetEnforcer.Allow(k8sNamespace, controller, len(logEntry))
+			if undo != nil {
+				budgetUndos = append(budgetUndos, undo)
+			}
+			if !allowed {
+				budgetDroppedRecords += 1
+				continue
+			}
+		}
+		if ContainerLogRedactor != nil {
+			logEntry = ContainerLogRedactor.Redact(logEntry, redactionHits)
+		}
+
+		var columns recordFields
 		//below id & name are used by latency telemetry in both v1 & v2 LA schemas
 		id := ""
 		name := ""
@@ -1584,21 +1587,19 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			//Incase of GenevaLogs Service mode, use the source Computer name from which log line originated
 			// And the ClusterResourceId in the receiving record
 			Computer = ToString(record["Computer"])
-			stringMap["AzureResourceId"] = ToString(record["AzureResourceId"])
+			columns.Set("AzureResourceId", ToString(record["AzureResourceId"]))
 		} else if IsGenevaLogsIntegrationEnabled == true {
-			stringMap["AzureResourceId"] = ResourceID
+			columns.Set("AzureResourceId", ResourceID)
 		} else if IsAzMonMultitenancyLogsServiceMode {
 			Computer = ToString(record["Computer"])
 		}
 
-		logEntry := ToString(record["log"])
-		logEntryTimeStamp := ToString(record["time"])
+		logEntryTimeStamp := recordString(record["time"])
 
 		if !ContainerLogV2ConfigMap && IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled {
-			if !IsWindows && MdsdMsgpUnixSocketClient == nil {
+			if !IsWindows && !ContainerLogSink.IsHealthy() {
 				Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-				CreateMDSDClient(ContainerLogV2, ContainerType)
-				if MdsdMsgpUnixSocketClient == nil {
+				if err := ContainerLogSink.Connect(); err != nil {
 					Log("Error::mdsd::Unable to create mdsd client. Please check error log.")
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
@@ -1610,94 +1611,163 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			ContainerLogSchemaV2 = extension.GetInstance(FLBLogger, ContainerType).IsContainerLogV2(useFromCache)
 		}
 
+		var parsedLogMessage json.RawMessage
+		var jsonParser *JSONLogParser
 		//ADX Schema & LAv2 schema are almost the same (except resourceId)
 		if ContainerLogSchemaV2 == true {
-			stringMap["Computer"] = Computer
-			stringMap["ContainerId"] = containerID
-			stringMap["ContainerName"] = containerName
-			stringMap["PodName"] = k8sPodName
-			stringMap["PodNamespace"] = k8sNamespace
-			stringMap["LogMessage"] = logEntry
-			stringMap["LogSource"] = logEntrySource
-			stringMap["TimeGenerated"] = logEntryTimeStamp
-			stringMap["KubernetesMetadata"] = kubernetesMetadata
+			columns.Set("Computer", Computer)
+			columns.Set("ContainerId", containerID)
+			columns.Set("ContainerName", containerName)
+			columns.Set("PodName", k8sPodName)
+			columns.Set("PodNamespace", k8sNamespace)
+			columns.Set("LogMessage", logEntry)
+			columns.Set("LogSource", logEntrySource)
+			columns.Set("TimeGenerated", logEntryTimeStamp)
+			columns.Set("KubernetesMetadata", kubernetesMetadata)
+			if samplingRate < 1 {
+				columns.Set(SamplingRateColumn, strconv.FormatFloat(samplingRate, 'f', -1, 64))
+			}
+			if repeatCount, ok := record[dedupRepeatCountKey]; ok {
+				columns.Set(RepeatCountColumn, ToString(repeatCount))
+				columns.Set(FirstTimeGeneratedColumn, ToString(record[dedupFirstTimeKey]))
+				columns.Set(LastTimeGeneratedColumn, ToString(record[dedupLastTimeKey]))
+			}
+			jsonParser = getContainerLogJSONParser(k8sNamespace, workloadSettings)
+			if jsonParser != nil {
+				var oversized bool
+				parsedLogMessage, oversized = jsonParser.ParseLine(logEntry)
+				if parsedLogMessage != nil {
+					jsonParsedRecords += 1
+					// the agent (mdsd/ama) route receives the compacted json as text, which is ingested into the dynamic column.
+					// Only the ODS route below posts it as a json object
+					if jsonParser.mode == JSONLogParsingModeColumn {
+						columns.Set(ParsedLogMessageColumn, string(parsedLogMessage))
+					} else {
+						columns.Set("LogMessage", string(parsedLogMessage))
+					}
+				} else if oversized {
+					jsonOversizedRecords += 1
+				}
+			}
+			if ContainerLogLevelDetector != nil {
+				columns.Set(LogLevelColumn, ContainerLogLevelDetector.DetectParsed(logEntry, parsedLogMessage))
+			}
 		} else if ContainerLogsRouteADX == true {
-			stringMap["Computer"] = Computer
-			stringMap["ContainerId"] = containerID
-			stringMap["ContainerName"] = containerName
-			stringMap["PodName"] = k8sPodName
-			stringMap["PodNamespace"] = k8sNamespace
-			stringMap["LogMessage"] = logEntry
-			stringMap["LogSource"] = logEntrySource
-			stringMap["TimeGenerated"] = logEntryTimeStamp
+			columns.Set("Computer", Computer)
+			columns.Set("ContainerId", containerID)
+			columns.Set("ContainerName", containerName)
+			columns.Set("PodName", k8sPodName)
+			columns.Set("PodNamespace", k8sNamespace)
+			columns.Set("LogMessage", logEntry)
+			columns.Set("LogSource", logEntrySource)
+			columns.Set("TimeGenerated", logEntryTimeStamp)
 		} else {
-			stringMap["LogEntry"] = logEntry
-			stringMap["LogEntrySource"] = logEntrySource
-			stringMap["LogEntryTimeStamp"] = logEntryTimeStamp
-			stringMap["SourceSystem"] = "Containers"
-			stringMap["Id"] = containerID
+			columns.Set("LogEntry", logEntry)
+			if repeatCount, ok := record[dedupRepeatCountKey]; ok {
+				columns.Set("LogEntry", getDedupSummaryLogEntry(logEntry, ToString(repeatCount), ToString(record[dedupFirstTimeKey]), ToString(record[dedupLastTimeKey])))
+			}
+			columns.Set("LogEntrySource", logEntrySource)
+			columns.Set("LogEntryTimeStamp", logEntryTimeStamp)
+			columns.Set("SourceSystem", "Containers")
+			columns.Set("Id", containerID)
 
 			if val, ok := imageIDMap[containerID]; ok {
-				stringMap["Image"] = val
+				columns.Set("Image", val)
 			}
 
 			if val, ok := nameIDMap[containerID]; ok {
-				stringMap["Name"] = val
+				columns.Set("Name", val)
 			}
 
-			stringMap["TimeOfCommand"] = start.Format(time.RFC3339)
-			stringMap["Computer"] = Computer
+			columns.Set("TimeOfCommand", start.Format(time.RFC3339))
+			columns.Set("Computer", Computer)
 		}
 		var dataItemLAv1 DataItemLAv1
 		var dataItemLAv2 DataItemLAv2
 		var msgPackEntry MsgPackEntry
 
-		FlushedRecordsSize += float64(len(stringMap["LogEntry"]))
+		FlushedRecordsSize += float64(len(columns.Get("LogEntry")))
 		if KubernetesMetadataEnabled {
-			FlushedMetadataSize += float64(len(stringMap["KubernetesMetadata"]))
+			FlushedMetadataSize += float64(len(columns.Get("KubernetesMetadata")))
 		}
 
 		if ContainerLogsRouteV2 == true {
-			msgPackEntry = MsgPackEntry{
-				// this below time is what mdsd uses in its buffer/expiry calculations. better to be as close to flushtime as possible, so its filled just before flushing for each entry
-				//Time: start.Unix(),
-				//Time: time.Now().Unix(),
-				Record: stringMap,
+			// the time of the log line, unless the flush time is configured since mdsd uses the entry time in its buffer/expiry calculations
+			eventTime := getEventTime(logEntryTimeStamp)
+			if containerLogEncoder != nil {
+				// nothing reads the records of the flush, so the record is encoded straight into the forward message
+				containerLogEncoder.AppendRecord(eventTime, &columns)
+			} else {
+				stringMap = columns.Map()
+				msgPackEntry = MsgPackEntry{
+					Time:   eventTime,
+					Record: stringMap,
+				}
+				msgPackEntries = append(msgPackEntries, msgPackEntry)
+				if ContainerLogRouter != nil {
+					rule := ContainerLogRouter.Route(&LogRouteInput{
+						Namespace: k8sNamespace,
+						Container: containerName,
+						Stream:    logEntrySource,
+						Message:   logEntry,
+						PodLabels: func() labels.Set { return getPodLabels(containerID, record) },
+						LogLevel:  func() string { return stringMap[LogLevelColumn] },
+					})
+					msgPackEntryRoutes = append(msgPackEntryRoutes, rule)
+					if rule != nil {
+						routedRecords[rule.Name] += 1
+					}
+				}
 			}
-			msgPackEntries = append(msgPackEntries, msgPackEntry)
 		} else {
 			if ContainerLogSchemaV2 == true {
 				dataItemLAv2 = DataItemLAv2{
-					TimeGenerated:      stringMap["TimeGenerated"],
-					Computer:           stringMap["Computer"],
-					ContainerId:        stringMap["ContainerId"],
-					ContainerName:      stringMap["ContainerName"],
-					PodName:            stringMap["PodName"],
-					PodNamespace:       stringMap["PodNamespace"],
-					LogMessage:         stringMap["LogMessage"],
-					LogSource:          stringMap["LogSource"],
-					KubernetesMetadata: stringMap["KubernetesMetadata"],
+					TimeGenerated:      columns.Get("TimeGenerated"),
+					Computer:           columns.Get("Computer"),
+					ContainerId:        columns.Get("ContainerId"),
+					ContainerName:      columns.Get("ContainerName"),
+					PodName:            columns.Get("PodName"),
+					PodNamespace:       columns.Get("PodNamespace"),
+					LogMessage:         columns.Get("LogMessage"),
+					LogSource:          columns.Get("LogSource"),
+					KubernetesMetadata: columns.Get("KubernetesMetadata"),
+					LogLevel:           columns.Get(LogLevelColumn),
+					FirstTimeGenerated: columns.Get(FirstTimeGeneratedColumn),
+					LastTimeGenerated:  columns.Get(LastTimeGeneratedColumn),
+				}
+				if repeatCount, err := strconv.Atoi(columns.Get(RepeatCountColumn)); err == nil {
+					dataItemLAv2.RepeatCount = repeatCount
+				}
+				if samplingRate < 1 {
+					dataItemLAv2.SamplingRate = samplingRate
+				}
+				if parsedLogMessage != nil {
+					if jsonParser.mode == JSONLogParsingModeColumn {
+						dataItemLAv2.ParsedLogMessage = parsedLogMessage
+					} else {
+						dataItemLAv2.LogMessage = parsedLogMessage
+					}
 				}
 				//ODS-v2 schema
 				dataItemsLAv2 = append(dataItemsLAv2, dataItemLAv2)
-				name = stringMap["ContainerName"]
-				id = stringMap["ContainerId"]
+				name = columns.Get("ContainerName")
+				id = columns.Get("ContainerId")
 			} else {
 				dataItemLAv1 = DataItemLAv1{
-					ID:                    stringMap["Id"],
-					LogEntry:              stringMap["LogEntry"],
-					LogEntrySource:        stringMap["LogEntrySource"],
-					LogEntryTimeStamp:     stringMap["LogEntryTimeStamp"],
-					LogEntryTimeOfCommand: stringMap["TimeOfCommand"],
-					SourceSystem:          stringMap["SourceSystem"],
-					Computer:              stringMap["Computer"],
-					Image:                 stringMap["Image"],
-					Name:                  stringMap["Name"],
+					ID:                    columns.Get("Id"),
+					LogEntry:              columns.Get("LogEntry"),
+					LogEntrySource:        columns.Get("LogEntrySource"),
+					LogEntryTimeStamp:     columns.Get("LogEntryTimeStamp"),
+					LogEntryTimeOfCommand: columns.Get("TimeOfCommand"),
+					SourceSystem:          columns.Get("SourceSystem"),
+					Computer:              columns.Get("Computer"),
+					Image:                 columns.Get("Image"),
+					Name:                  columns.Get("Name"),
 				}
 				//ODS-v1 schema
 				dataItemsLAv1 = append(dataItemsLAv1, dataItemLAv1)
-				name = stringMap["Name"]
-				id = stringMap["Id"]
+				name = columns.Get("Name")
+				id = columns.Get("Id")
 			}
 		}
 
@@ -1721,6 +1791,22 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 		}
 	}
 
+	if len(redactionHits) > 0 || jsonParsedRecords > 0 || jsonOversizedRecords > 0 || sampledOutRecords > 0 || dcrFilteredRecords > 0 || len(routedRecords) > 0 || budgetDroppedRecords > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		for rule, hits := range redactionHits {
+			ContainerLogsRedactionHitsByRule[rule] += float64(hits)
+		}
+		ContainerLogsJSONParsedRecordsCount += float64(jsonParsedRecords)
+		ContainerLogsJSONParseOversizedRecordsCount += float64(jsonOversizedRecords)
+		ContainerLogsSampledOutRecordsCount += float64(sampledOutRecords)
+		ContainerLogsDCRNamespaceFilteredRecordsCount += float64(dcrFilteredRecords)
+		for rule, records := range routedRecords {
+			ContainerLogsRoutedRecordsByRule[rule] += float64(records)
+		}
+		ContainerLogsBudgetDroppedRecordsCount += float64(budgetDroppedRecords)
+		ContainerLogTelemetryMutex.Unlock()
+	}
+
 	numContainerLogRecords := 0
 
 	if ContainerLogSchemaV2 == true {
@@ -1729,9 +1815,14 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 		MdsdContainerLogTagName = MdsdContainerLogSourceName
 	}
 
-	if len(msgPackEntries) > 0 && ContainerLogsRouteV2 == true {
+	containerLogRecords := len(msgPackEntries)
+	if containerLogEncoder != nil {
+		containerLogRecords = containerLogEncoder.Len()
+	}
+
+	if containerLogRecords > 0 && ContainerLogsRouteV2 == true {
 		//flush to mdsd
-		if IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled {
+		if IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled && isAgentSink(ContainerLogSink) {
 			containerlogDataType := ContainerLogDataType
 			if ContainerLogSchemaV2 == true {
 				containerlogDataType = ContainerLogV2DataType
@@ -1743,67 +1834,110 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
-		if IsWindows {
-			var datatype string
-			if ContainerLogSchemaV2 {
-				datatype = ContainerLogV2DataType
-			} else {
-				datatype = ContainerLogDataType
+		var batches []*SinkBatch
+		var er error
+		if containerLogEncoder != nil {
+			batches = []*SinkBatch{{DataType: ContainerLogV2DataType, Tag: MdsdContainerLogTagName, Frame: containerLogEncoder.Frame(MdsdContainerLogTagName)}}
+		} else if ContainerLogRouter != nil {
+			batches, er = getRoutedContainerLogSinkBatches(ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries, msgPackEntryRoutes)
+		} else {
+			batches, er = getContainerLogSinkBatches(ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries)
+		}
+		if er == nil {
+			// the batches delivered by an earlier attempt of this flush arent sent again
+			var skippedRecords int
+			batches, skippedRecords = ContainerLogDeliveredBatches.Pending(batches)
+			if skippedRecords > 0 {
+				containerLogRecords -= skippedRecords
+				Log("Info::%s::Skipped %d container log records delivered by an earlier attempt of the flush", ContainerLogSink.Name(), skippedRecords)
+				ContainerLogTelemetryMutex.Lock()
+				ContainerLogsResentRecordsSkippedCount += float64(skippedRecords)
+				ContainerLogTelemetryMutex.Unlock()
 			}
-			if EnsureGenevaOr3PNamedPipeExists(&ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &MdsdContainerLogTagRefreshTracker) {
-				Log("Info::AMA::Starting to write container logs to named pipe")
-				n, err := writeMsgPackEntries(ContainerLogNamedPipe, ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries)
-				if err != nil {
-					Log("Error::AMA::Failed to write to AMA %d records. Will retry ... error : %s", len(msgPackEntries), err.Error())
-					if ContainerLogNamedPipe != nil {
-						ContainerLogNamedPipe.Close()
-						ContainerLogNamedPipe = nil
-					}
-					ContainerLogTelemetryMutex.Lock()
-					defer ContainerLogTelemetryMutex.Unlock()
-					ContainerLogsSendErrorsToWindowsAMAFromFluent += 1
-					return output.FLB_RETRY
-				} else {
-					numContainerLogRecords = len(msgPackEntries)
-					Log("Success::AMA::Successfully flushed %d container log records that was %d bytes to AMA ", numContainerLogRecords, n)
+			if len(batches) == 0 {
+				return output.FLB_OK
+			}
+		}
+		if er == nil {
+			// spilled batches are replayed ahead of the current batch to keep the ordering
+			var drained bool
+			drained, er = replayContainerLogSpillBuffer(ContainerLogSink)
+			if er == nil && !drained {
+				// backlog is not yet drained, so queue the current batch behind it
+				if spillContainerLogBatches(batches, containerLogRecords) {
+					return output.FLB_OK
 				}
-			} else {
-				return output.FLB_RETRY
 			}
-		} else {
-			if MdsdMsgpUnixSocketClient == nil {
-				Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-				CreateMDSDClient(ContainerLogV2, ContainerType)
-				if MdsdMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::Unable to create mdsd client. Please check error log.")
-
-					ContainerLogTelemetryMutex.Lock()
-					defer ContainerLogTelemetryMutex.Unlock()
-					ContainerLogsMDSDClientCreateErrors += 1
+		}
 
-					return output.FLB_RETRY
+		bts := 0
+		pendingBatches := batches
+		// leading records of the first pending batch which were delivered, when the sink splits the batch into several calls
+		partiallyDeliveredRecords := 0
+		// a failing stream doesnt prevent the other streams from being written when the streams are written in parallel
+		isolatedStreams := ContainerLogStreamWriter != nil && len(batches) > 1
+		if er == nil {
+			if isolatedStreams {
+				bts, pendingBatches, er = ContainerLogStreamWriter.Write(batches)
+			} else {
+				deliveredBatches := 0
+				bts, deliveredBatches, er = writeBatchesToSink(ContainerLogSink, batches)
+				pendingBatches = batches[deliveredBatches:]
+				if len(pendingBatches) > 0 {
+					partiallyDeliveredRecords = GetSinkErrorDeliveredRecords(er)
 				}
 			}
+		}
+		elapsed = time.Since(start)
 
-			bts, er := writeMsgPackEntries(MdsdMsgpUnixSocketClient, ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries)
-			elapsed = time.Since(start)
-
-			if er != nil {
-				Log("Error::mdsd::Failed to write to mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
-				if MdsdMsgpUnixSocketClient != nil {
-					MdsdMsgpUnixSocketClient.Close()
-					MdsdMsgpUnixSocketClient = nil
+		if er != nil {
+			// only the batches which werent delivered in full are spilled, so the replay doesnt duplicate the delivered ones
+			pendingRecords := containerLogRecords
+			partiallyDelivered := len(pendingBatches) < len(batches) || partiallyDeliveredRecords > 0
+			undeliveredBatches := pendingBatches
+			if partiallyDelivered {
+				if partiallyDeliveredRecords > 0 {
+					undeliveredBatches = append([]*SinkBatch{getUndeliveredSinkBatch(pendingBatches[0], partiallyDeliveredRecords)}, pendingBatches[1:]...)
+				}
+				pendingRecords = 0
+				for _, batch := range undeliveredBatches {
+					pendingRecords += len(batch.Entries)
+				}
+				Log("Info::%s::Delivered %d of %d container log batches and %d records of the failed batch that was %d bytes before the failure", ContainerLogSink.Name(), len(batches)-len(pendingBatches), len(batches), partiallyDeliveredRecords, bts)
+			}
+			Log("Error::%s::Failed to write %d container log records after %s. Will retry ... error : %s", ContainerLogSink.Name(), pendingRecords, elapsed, er.Error())
+			spilled := len(undeliveredBatches) > 0 && spillContainerLogBatches(undeliveredBatches, pendingRecords)
+			if !spilled && partiallyDelivered {
+				// fluent bit resends the whole chunk, so its retry only sends the records which werent delivered
+				ContainerLogDeliveredBatches.Add(getDeliveredSinkBatches(batches, pendingBatches))
+				if partiallyDeliveredRecords > 0 {
+					ContainerLogDeliveredBatches.AddPartial(pendingBatches[0], partiallyDeliveredRecords)
+				}
+			}
+			ContainerLogTelemetryMutex.Lock()
+			defer ContainerLogTelemetryMutex.Unlock()
+			if IsSinkConnectError(er) {
+				if IsWindows {
+					ContainerLogsWindowsAMAClientCreateErrors += 1
+				} else {
+					ContainerLogsMDSDClientCreateErrors += 1
 				}
-
-				ContainerLogTelemetryMutex.Lock()
-				defer ContainerLogTelemetryMutex.Unlock()
-				ContainerLogsSendErrorsToMDSDFromFluent += 1
-
-				return output.FLB_RETRY
 			} else {
-				numContainerLogRecords = len(msgPackEntries)
-				Log("Success::mdsd::Successfully flushed %d container log records that was %d bytes to mdsd in %s ", numContainerLogRecords, bts, elapsed)
+				if IsWindows {
+					ContainerLogsSendErrorsToWindowsAMAFromFluent += 1
+				} else {
+					ContainerLogsSendErrorsToMDSDFromFluent += 1
+				}
+			}
+
+			if spilled {
+				return output.FLB_OK
 			}
+			return output.FLB_RETRY
+		} else {
+			numContainerLogRecords = containerLogRecords
+			Log("Success::%s::Successfully flushed %d container log records that was %d bytes in %s ", ContainerLogSink.Name(), numContainerLogRecords, bts, elapsed)
+			mirrorContainerLogBatches(batches)
 		}
 	} else if (ContainerLogSchemaV2 == true && len(dataItemsLAv2) > 0) || len(dataItemsLAv1) > 0 { //ODS
 		var logEntry interface{}
@@ -1829,53 +1963,19 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
-		marshalled, err := json.Marshal(logEntry)
-		//Log("LogEntry::e %s", marshalled)
-		if err != nil {
-			message := fmt.Sprintf("Error while Marshalling log Entry: %s", err.Error())
-			Log(message)
-			SendException(message)
-			return output.FLB_OK
-		}
-
-		req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", userAgent)
-		reqId := uuid.New().String()
-		req.Header.Set("X-Request-ID", reqId)
-		//expensive to do string len for every request, so use a flag
-		if ResourceCentric == true {
-			req.Header.Set("x-ms-AzureResourceId", ResourceID)
-		}
-
-		resp, err := HTTPClient.Do(req)
+		_, err := writeToSink(ContainerLogSink, &SinkBatch{DataType: recordType, Payload: logEntry})
 		elapsed = time.Since(start)
 
 		if err != nil {
-			message := fmt.Sprintf("Error when sending request %s \n", err.Error())
-			Log(message)
-			// Commenting this out for now. TODO - Add better telemetry for ods errors using aggregation
-			//SendException(message)
-
-			Log("Failed to flush %d records after %s", loglinesCount, elapsed)
-
-			return output.FLB_RETRY
-		}
-
-		if resp != nil && resp.Body != nil {
-			defer resp.Body.Close()
-		}
-
-		if resp == nil || IsRetriableError(resp.StatusCode) {
-			if resp != nil {
-				Log("PostDataHelper::Warn::Failed with retriable error code hence retrying .RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
+			if IsRetriableSinkError(err) {
+				Log("PostDataHelper::Warn::Failed with retriable error hence retrying. error: %s", err.Error())
+				Log("Failed to flush %d records after %s", loglinesCount, elapsed)
+				return output.FLB_RETRY
 			}
-			return output.FLB_RETRY
-		} else if IsSuccessStatusCode(resp.StatusCode) {
+			Log("PostDataHelper::Error:: Failed with non-retriable error::%s", err.Error())
+		} else {
 			numContainerLogRecords = loglinesCount
 			Log("PostDataHelper::Info::Successfully flushed %d %s records to ODS in %s", numContainerLogRecords, recordType, elapsed)
-		} else {
-			Log("PostDataHelper::Error:: Failed with non-retriable error::RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
 		}
 	}
 
@@ -1900,48 +2000,12 @@ func containsKey(currentMap map[string]bool, key string) bool {
 	return c
 }
 
-func writeMsgPackEntriesToNamedPipeConnection(streamTag string, msgPackEntries []MsgPackEntry, streamIdNamedPipeMap map[string]string) (int, error) {
-	var bts int
-	var er error
-	namedPipe, ok := streamIdNamedPipeMap[streamTag]
-	if !ok {
-		return 0, fmt.Errorf("Error::ama:: namedPipe is empty for streamId: %s \n", streamTag)
+// getContainerLogSinkBatches splits the records into one batch per output stream when multi-tenancy is enabled and a single batch otherwise
+func getContainerLogSinkBatches(isContainerLogV2Schema bool, fluentForwardTag string, msgPackEntries []MsgPackEntry) ([]*SinkBatch, error) {
+	dataType := ContainerLogDataType
+	if isContainerLogV2Schema {
+		dataType = ContainerLogV2DataType
 	}
-	namedPipeConn, ok := NamedPipeConnectionCache[namedPipe]
-	if !ok || namedPipeConn == nil {
-		err := CreateWindowsNamedPipeClient(namedPipe, &namedPipeConn)
-		if err != nil {
-			Log("Error::ama:: failed to create namedpipe client for streamId: %s \n", streamTag)
-			return 0, err
-		}
-		NamedPipeConnectionCache[namedPipe] = namedPipeConn
-	}
-	msgpBytes := convertMsgPackEntriesToMsgpBytes(streamTag, msgPackEntries)
-	bts, er = namedPipeConn.Write(msgpBytes)
-	if er != nil {
-		Log("Error::ama:: failed to ingest the logs to namedpipe: %s \n", namedPipe)
-		if namedPipeConn != nil {
-			namedPipeConn.Close()
-			namedPipeConn = nil
-			delete(NamedPipeConnectionCache, namedPipe)
-		}
-	}
-	// clear the cache if its cachesize limit is reached
-	if len(NamedPipeConnectionCache) >= NamedPipeConnectionCacheSize {
-		for np, conn := range NamedPipeConnectionCache {
-			if conn != nil {
-				conn.Close()
-			}
-			delete(NamedPipeConnectionCache, np)
-		}
-	}
-
-	return bts, er
-}
-
-func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluentForwardTag string, msgPackEntries []MsgPackEntry) (totalBytes int, err error) {
-	var bts int
-	var er error
 	if (IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode) && isContainerLogV2Schema && !IsGenevaLogsIntegrationEnabled {
 		namespaceStreamIdsMap, streamIdNamedPipeMap := getContainerLogV2ExtensionMaps()
 		if len(namespaceStreamIdsMap) > 0 {
@@ -1951,59 +2015,46 @@ func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluen
 				streamTagCount += len(streamTags)
 			}
 			ContainerLogV2ExtensionDCRCount = streamTagCount
-			msgPackEntriesByNamespace := getMsgPackEntriesByNamespace(msgPackEntries)
-			totalBytes := 0
-			for namespace, entries := range msgPackEntriesByNamespace {
+			var batches []*SinkBatch
+			for namespace, entries := range getMsgPackEntriesByNamespace(msgPackEntries) {
 				if streamTags, exists := namespaceStreamIdsMap[namespace]; exists {
 					msg := fmt.Sprintf("Info::ama:: namespace : %s streamTags: %s \n", namespace, strings.Join(streamTags, ", "))
 					Log(msg)
 					for _, streamTag := range streamTags {
+						batch := &SinkBatch{DataType: dataType, Tag: streamTag, Entries: entries}
 						if IsWindows {
-							bts, er = writeMsgPackEntriesToNamedPipeConnection(streamTag, entries, streamIdNamedPipeMap)
-						} else {
-							msgpBytes := convertMsgPackEntriesToMsgpBytes(streamTag, entries)
-							deadline := 10 * time.Second
-							connection.SetWriteDeadline(time.Now().Add(deadline))
-							bts, er = connection.Write(msgpBytes)
-						}
-						if er != nil {
-							return bts, er
+							namedPipe, ok := streamIdNamedPipeMap[streamTag]
+							if !ok {
+								return nil, fmt.Errorf("Error::ama:: namedPipe is empty for streamId: %s \n", streamTag)
+							}
+							batch.NamedPipe = namedPipe
 						}
-						totalBytes = totalBytes + bts
+						batches = append(batches, batch)
 					}
 				} else {
 					Log("Info::ama:: streamTag is empty for namespace: %s hence using default workspace stream id: %s \n", namespace, fluentForwardTag)
-					msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, entries)
-					deadline := 10 * time.Second
-					connection.SetWriteDeadline(time.Now().Add(deadline))
-					bts, er = connection.Write(msgpBytes)
-					if er != nil {
-						return bts, er
-					}
-					totalBytes = totalBytes + bts
+					batches = append(batches, &SinkBatch{DataType: dataType, Tag: fluentForwardTag, Entries: entries})
 				}
 			}
-			bts = totalBytes
-		} else {
-			msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, msgPackEntries)
-			deadline := 10 * time.Second
-			connection.SetWriteDeadline(time.Now().Add(deadline))
-			bts, er = connection.Write(msgpBytes)
-			if er != nil {
-				return bts, er
-			}
-		}
-	} else {
-		msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, msgPackEntries)
-		deadline := 10 * time.Second
-		connection.SetWriteDeadline(time.Now().Add(deadline))
-		bts, er = connection.Write(msgpBytes)
-		if er != nil {
-			return bts, er
+			return batches, nil
 		}
 	}
+	return []*SinkBatch{{DataType: dataType, Tag: fluentForwardTag, Entries: msgPackEntries}}, nil
+}
 
-	return bts, er
+// getDeliveredSinkBatches returns the batches which arent pending, in the order they were written
+func getDeliveredSinkBatches(batches []*SinkBatch, pendingBatches []*SinkBatch) []*SinkBatch {
+	pending := make(map[*SinkBatch]bool, len(pendingBatches))
+	for _, batch := range pendingBatches {
+		pending[batch] = true
+	}
+	delivered := make([]*SinkBatch, 0, len(batches)-len(pendingBatches))
+	for _, batch := range batches {
+		if !pending[batch] {
+			delivered = append(delivered, batch)
+		}
+	}
+	return delivered
 }
 
 func getContainerLogV2ExtensionMaps() (map[string][]string, map[string]string) {
@@ -2126,7 +2177,6 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	NameIDMap = make(map[string]string)
 	NamespaceStreamIdsMap = make(map[string][]string)
 	StreamIdNamedPipeMap = make(map[string]string)
-	NamedPipeConnectionCache = make(map[string]net.Conn)
 	// Keeping the two error hashes separate since we need to keep the config error hash for the lifetime of the container
 	// whereas the prometheus scrape error hash needs to be refreshed every hour
 	ConfigErrorEvent = make(map[string]KubeMonAgentEventTags)
@@ -2366,37 +2416,29 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	MdsdInsightsMetricsTagRefreshTracker = time.Now()
 	MdsdContainerLogTagRefreshTracker = time.Now()
 
-	if ContainerLogsRouteV2 == true {
-		if IsWindows {
-			var datatype string
-			if ContainerLogSchemaV2 {
-				datatype = ContainerLogV2DataType
-			} else {
-				datatype = ContainerLogDataType
-			}
-			EnsureGenevaOr3PNamedPipeExists(&ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &MdsdContainerLogTagRefreshTracker)
-		} else {
-			CreateMDSDClient(ContainerLogV2, ContainerType)
-		}
-	}
-	if IsWindows || (!ContainerLogsRouteV2 && !ContainerLogsRouteADX) {
+	initializeAMAForwardEndpoints()
+	initializeAMAForwardAck()
+	initializeForwardEventTime()
+	ContainerLogSink = CreateSink(ContainerLogV2)
+	KubeMonAgentEventsSink = CreateSink(KubeMonAgentEvents)
+	InsightsMetricsSink = CreateSink(InsightsMetrics)
+	InputPluginRecordsSink = CreateSink(InputPluginRecords)
+
+	if IsWindows || (!ContainerLogsRouteV2 && !ContainerLogsRouteADX) || isODSSink(ContainerLogSink) || isODSSink(KubeMonAgentEventsSink) || isODSSink(InsightsMetricsSink) {
 		// windows for both Geneva and 3P for insights metrics and for ContainerLog in legacy auth
 		// configmap configured for direct ODS route
 		Log("Creating HTTP Client since either OS Platform is Windows or configmap configured with fallback option for ODS direct")
 		CreateHTTPClient()
 	}
 
-	if IsWindows == false { // mdsd linux specific
-		Log("Creating MDSD clients for KubeMonAgentEvents & InsightsMetrics")
-		CreateMDSDClient(KubeMonAgentEvents, ContainerType)
-		CreateMDSDClient(InsightsMetrics, ContainerType)
-	} else if IsWindows && IsAADMSIAuthMode { // AMA windows specific
-		Log("Creating AMA client for KubeMonAgentEvents")
-		EnsureGenevaOr3PNamedPipeExists(&KubeMonAgentEventsNamedPipe, KubeMonAgentEventDataType, &KubeMonEventsWindowsAMAClientCreateErrors, false, &MdsdKubeMonAgentEventsTagRefreshTracker)
-		Log("Creating AMA client for InsightsMetrics")
-		EnsureGenevaOr3PNamedPipeExists(&InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &MdsdInsightsMetricsTagRefreshTracker)
+	Log("Creating sink clients for ContainerLogs, KubeMonAgentEvents & InsightsMetrics")
+	for _, sink := range []Sink{ContainerLogSink, KubeMonAgentEventsSink, InsightsMetricsSink} {
+		if sink != nil && !sink.IsHealthy() {
+			sink.Connect()
+		}
 	}
 
+	enrichContainerLogsFromPods := false
 	if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
 		populateExcludedStdoutNamespaces()
 		populateExcludedStderrNamespaces()
@@ -2406,8 +2448,8 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		Log("Included system namespaces set stdout: %v, stderr: %v", StdoutIncludeSystemNamespaceSet, StderrIncludeSystemNamespaceSet)
 		//enrichment not applicable for ADX and v2 schema
 		if enrichContainerLogs == true && ContainerLogsRouteADX != true && ContainerLogSchemaV2 != true {
-			Log("ContainerLogEnrichment=true; starting goroutine to update containerimagenamemaps \n")
-			go updateContainerImageNameMaps()
+			Log("ContainerLogEnrichment=true \n")
+			enrichContainerLogsFromPods = true
 		} else {
 			Log("ContainerLogEnrichment=false \n")
 		}
@@ -2428,4 +2470,36 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	if IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode {
 		go updateContainerLogV2ExtensionMaps(IsWindows)
 	}
+
+	if _, ok := ContainerLogSink.(FrameSink); ok && !IsWindows {
+		initializeContainerLogSpillBuffer()
+	}
+
+	initializeContainerLogPartialReassembler()
+	initializeContainerLogMultilineGrouper()
+	initializeContainerLogRedactor()
+	initializeContainerLogJSONParser()
+	initializeContainerLogLevelDetector()
+	initializeContainerLogDeduplicator()
+	initializeContainerLogSampler(pluginConfig)
+	initializeWorkloadLogSettings()
+	initializeNamespaceFilters()
+	initializeDataCollectionNamespaceFilter()
+	initializeContainerLogRouter()
+	initializeContainerLogBudgetEnforcer()
+	// the workload settings, pod labels of the routing rules & controllers of the budgets are refreshed from the pods of the node
+	// along with the image and name maps, so the refresh is started once they are initialized
+	if isContainerMetadataRefreshNeeded(enrichContainerLogsFromPods) {
+		if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
+			Log("Starting goroutine to update containerimagenamemaps \n")
+			go updateContainerImageNameMaps()
+		} else if ContainerLogRouter != nil && ContainerLogRouter.usesPodLabels {
+			Log("Pod labels of the routing rules are only read from the kubernetes metadata of the records in replicaset")
+		}
+	}
+	initializeContainerLogsFailover()
+	initializeContainerLogStreamWriter()
+	initializeContainerLogTee()
+	initializeAlongsideFileSink()
+	initializeContainerLogFrameStreaming()
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// out_oms.conf settings of the OTLP/HTTP log exporter sink (container_logs_sink=otlp), each can be overridden by its env variable
+const otlpLogsEndpointConfigKey = "otlp_logs_endpoint"
+const otlpLogsProtocolConfigKey = "otlp_logs_protocol"
+const otlpLogsCompressionConfigKey = "otlp_logs_compression"
+const otlpLogsHeadersConfigKey = "otlp_logs_headers"
+const otlpLogsMaxRetriesConfigKey = "otlp_logs_max_retries"
+
+const OTLPLogsEndpointEnv = "AZMON_OTLP_LOGS_ENDPOINT"
+const OTLPLogsProtocolEnv = "AZMON_OTLP_LOGS_PROTOCOL"
+const OTLPLogsCompressionEnv = "AZMON_OTLP_LOGS_COMPRESSION"
+
+// comma separated key=value http headers e.g. authorization tokens of the collector
+const OTLPLogsHeadersEnv = "AZMON_OTLP_LOGS_HEADERS"
+const OTLPLogsMaxRetriesEnv = "AZMON_OTLP_LOGS_MAX_RETRIES"
+
+// OTLP/HTTP protocols
+const OTLPProtocolProtobuf = "http/protobuf"
+const OTLPProtocolJSON = "http/json"
+
+const defaultOTLPLogsMaxRetries = 3
+const otlpLogsPath = "/v1/logs"
+const otlpScopeName = "out_oms"
+
+// retry delays double from the initial delay up to the max delay, unless the collector sends a Retry-After.
+// A longer Retry-After isnt waited for on the flush, the batch is left to the retry of fluent bit
+const otlpInitialRetryDelay = 500 * time.Millisecond
+const otlpMaxRetryDelay = 5 * time.Second
+
+// severity numbers of the OTel log data model by normalized log level
+var otlpSeverityNumbers = map[string]int{
+	LogLevelTrace:    1,
+	LogLevelDebug:    5,
+	LogLevelInfo:     9,
+	LogLevelWarning:  13,
+	LogLevelError:    17,
+	LogLevelCritical: 21,
+}
+
+// OTLPSink exports ContainerLogV2 batches as OTLP/HTTP log records to an OpenTelemetry collector.
+// The records of each container are grouped under a resource with the kubernetes semantic convention attributes
+type OTLPSink struct {
+	endpoint   string
+	protocol   string
+	gzip       bool
+	headers    map[string]string
+	maxRetries int
+	client     *http.Client
+	sleep      func(time.Duration)
+}
+
+// NewOTLPSink creates a sink for the endpoint. /v1/logs is appended to endpoints without a path
+func NewOTLPSink(endpoint string, protocol string, gzip bool, headers map[string]string, maxRetries int, client *http.Client) (*OTLPSink, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP logs endpoint %s", endpoint)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = otlpLogsPath
+	}
+	if protocol != OTLPProtocolProtobuf && protocol != OTLPProtocolJSON {
+		return nil, fmt.Errorf("OTLP logs protocol %s is not %s or %s", protocol, OTLPProtocolProtobuf, OTLPProtocolJSON)
+	}
+	return &OTLPSink{
+		endpoint:   parsed.String(),
+		protocol:   protocol,
+		gzip:       gzip,
+		headers:    headers,
+		maxRetries: maxRetries,
+		client:     client,
+		sleep:      time.Sleep,
+	}, nil
+}
+
+func (s *OTLPSink) Name() string {
+	return "otlp"
+}
+
+func (s *OTLPSink) Connect() error {
+	return nil
+}
+
+func (s *OTLPSink) Write(batch *SinkBatch) (int, error) {
+	if batch.DataType != ContainerLogV2DataType {
+		return 0, &SinkError{Op: "write", Retriable: false, Err: fmt.Errorf("otlp sink only supports %s, not %s", ContainerLogV2DataType, batch.DataType)}
+	}
+	resourceLogs := getOTLPResourceLogs(batch.Entries, time.Now())
+	var payload []byte
+	contentType := "application/x-protobuf"
+	if s.protocol == OTLPProtocolJSON {
+		marshalled, err := json.Marshal(otlpExportLogsRequest{ResourceLogs: resourceLogs})
+		if err != nil {
+			return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		payload = marshalled
+		contentType = "application/json"
+	} else {
+		payload = encodeOTLPExportLogsRequest(resourceLogs)
+	}
+	if s.gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(payload); err != nil {
+			return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		if err := writer.Close(); err != nil {
+			return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		payload = compressed.Bytes()
+	}
+
+	var err error
+	retryDelay := otlpInitialRetryDelay
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = s.post(payload, contentType)
+		if err == nil {
+			return len(payload), nil
+		}
+		if !IsRetriableSinkError(err) || attempt >= s.maxRetries {
+			return 0, err
+		}
+		if retryAfter > otlpMaxRetryDelay {
+			Log("Warn::otlp::Export of %d container log records throttled for %s, leaving it to the retry of the flush. error: %s", len(batch.Entries), retryAfter, err.Error())
+			return 0, err
+		}
+		delay := retryDelay
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		Log("Warn::otlp::Export of %d container log records failed, retrying in %s. error: %s", len(batch.Entries), delay, err.Error())
+		s.sleep(delay)
+		retryDelay *= 2
+		if retryDelay > otlpMaxRetryDelay {
+			retryDelay = otlpMaxRetryDelay
+		}
+	}
+}
+
+// post posts the payload once and returns the Retry-After of a throttled call
+func (s *OTLPSink) post(payload []byte, contentType string) (time.Duration, error) {
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, newSinkWriteError(err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if IsSuccessStatusCode(resp.StatusCode) {
+		return 0, nil
+	}
+	// retriable status codes of the OTLP/HTTP specification
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: true, Err: fmt.Errorf("Status %s", resp.Status)}
+	}
+	return 0, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: false, Err: fmt.Errorf("Status %s", resp.Status)}
+}
+
+func (s *OTLPSink) IsHealthy() bool {
+	return true
+}
+
+func (s *OTLPSink) Close() {
+}
+
+// OTLP json encoding of ExportLogsServiceRequest (https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding)
+type otlpExportLogsRequest struct {
+	ResourceLogs []*otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope        `json:"scope"`
+	LogRecords []*otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64         `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64         `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue holds a string or an array of strings
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+func otlpString(value string) otlpAnyValue {
+	return otlpAnyValue{StringValue: &value}
+}
+
+func appendOTLPAttribute(attributes []otlpKeyValue, key string, value string) []otlpKeyValue {
+	if value == "" {
+		return attributes
+	}
+	return append(attributes, otlpKeyValue{Key: key, Value: otlpString(value)})
+}
+
+// getOTLPResourceAttributes maps the ContainerLogV2 columns of the container onto the kubernetes & container semantic conventions
+func getOTLPResourceAttributes(record map[string]string) []otlpKeyValue {
+	var attributes []otlpKeyValue
+	attributes = appendOTLPAttribute(attributes, "k8s.cluster.name", ResourceName)
+	attributes = appendOTLPAttribute(attributes, "k8s.node.name", record["Computer"])
+	attributes = appendOTLPAttribute(attributes, "k8s.namespace.name", record["PodNamespace"])
+	attributes = appendOTLPAttribute(attributes, "k8s.pod.name", record["PodName"])
+	attributes = appendOTLPAttribute(attributes, "k8s.container.name", record["ContainerName"])
+	attributes = appendOTLPAttribute(attributes, "container.id", record["ContainerId"])
+
+	var kubernetesMetadata map[string]interface{}
+	if record["KubernetesMetadata"] == "" || json.Unmarshal([]byte(record["KubernetesMetadata"]), &kubernetesMetadata) != nil {
+		return attributes
+	}
+	attributes = appendOTLPAttribute(attributes, "k8s.pod.uid", otlpMetadataString(kubernetesMetadata["podUid"]))
+	image := otlpMetadataString(kubernetesMetadata["image"])
+	if repo := otlpMetadataString(kubernetesMetadata["imageRepo"]); repo != "" && image != "" {
+		image = repo + "/" + image
+	}
+	attributes = appendOTLPAttribute(attributes, "container.image.name", image)
+	if tag := otlpMetadataString(kubernetesMetadata["imageTag"]); tag != "" {
+		attributes = append(attributes, otlpKeyValue{Key: "container.image.tags", Value: otlpAnyValue{ArrayValue: &otlpArrayValue{Values: []otlpAnyValue{otlpString(tag)}}}})
+	}
+	attributes = appendOTLPAttribute(attributes, "container.image.id", otlpMetadataString(kubernetesMetadata["imageID"]))
+	for _, prefixed := range []struct{ key, prefix string }{{"podLabels", "k8s.pod.label."}, {"podAnnotations", "k8s.pod.annotation."}} {
+		values, ok := kubernetesMetadata[prefixed.key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			attributes = appendOTLPAttribute(attributes, prefixed.prefix+key, otlpMetadataString(values[key]))
+		}
+	}
+	return attributes
+}
+
+// otlpMetadataString returns the value of the decoded KubernetesMetadata json as string
+func otlpMetadataString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	return fmt.Sprint(value)
+}
+
+// getOTLPResourceLogs groups the records by container and maps them onto OTLP log records
+func getOTLPResourceLogs(entries []MsgPackEntry, observedTime time.Time) []*otlpResourceLogs {
+	var resourceLogs []*otlpResourceLogs
+	byContainer := make(map[string]*otlpResourceLogs)
+	for _, entry := range entries {
+		record := entry.Record
+		key := record["ContainerId"] + "/" + record["PodNamespace"] + "/" + record["PodName"] + "/" + record["ContainerName"]
+		resource, ok := byContainer[key]
+		if !ok {
+			resource = &otlpResourceLogs{
+				Resource:  otlpResource{Attributes: getOTLPResourceAttributes(record)},
+				ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: otlpScopeName}}},
+			}
+			byContainer[key] = resource
+			resourceLogs = append(resourceLogs, resource)
+		}
+
+		logRecord := &otlpLogRecord{
+			ObservedTimeUnixNano: uint64(observedTime.UnixNano()),
+			Body:                 otlpString(record["LogMessage"]),
+			Attributes:           appendOTLPAttribute(nil, "log.iostream", record["LogSource"]),
+		}
+		if timeGenerated, err := time.Parse(time.RFC3339Nano, record["TimeGenerated"]); err == nil {
+			logRecord.TimeUnixNano = uint64(timeGenerated.UnixNano())
+		}
+		if level := NormalizeLogLevel(record[LogLevelColumn]); level != "" {
+			logRecord.SeverityNumber = otlpSeverityNumbers[level]
+			logRecord.SeverityText = strings.ToUpper(level)
+		}
+		resource.ScopeLogs[0].LogRecords = append(resource.ScopeLogs[0].LogRecords, logRecord)
+	}
+	return resourceLogs
+}
+
+// encodeOTLPExportLogsRequest encodes the resource logs as protobuf ExportLogsServiceRequest
+// (opentelemetry/proto/collector/logs/v1/logs_service.proto)
+func encodeOTLPExportLogsRequest(resourceLogs []*otlpResourceLogs) []byte {
+	var request []byte
+	for _, resource := range resourceLogs {
+		var resourceBytes []byte
+		for _, attribute := range resource.Resource.Attributes {
+			resourceBytes = appendOTLPMessage(resourceBytes, 1, encodeOTLPKeyValue(attribute))
+		}
+		resourceLogsBytes := appendOTLPMessage(nil, 1, resourceBytes)
+		for _, scopeLogs := range resource.ScopeLogs {
+			scopeLogsBytes := appendOTLPMessage(nil, 1, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), scopeLogs.Scope.Name))
+			for _, logRecord := range scopeLogs.LogRecords {
+				scopeLogsBytes = appendOTLPMessage(scopeLogsBytes, 2, encodeOTLPLogRecord(logRecord))
+			}
+			resourceLogsBytes = appendOTLPMessage(resourceLogsBytes, 2, scopeLogsBytes)
+		}
+		request = appendOTLPMessage(request, 1, resourceLogsBytes)
+	}
+	return request
+}
+
+func encodeOTLPLogRecord(logRecord *otlpLogRecord) []byte {
+	var b []byte
+	if logRecord.TimeUnixNano > 0 {
+		b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, logRecord.TimeUnixNano)
+	}
+	if logRecord.SeverityNumber > 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(logRecord.SeverityNumber))
+	}
+	if logRecord.SeverityText != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, logRecord.SeverityText)
+	}
+	b = appendOTLPMessage(b, 5, encodeOTLPAnyValue(logRecord.Body))
+	for _, attribute := range logRecord.Attributes {
+		b = appendOTLPMessage(b, 6, encodeOTLPKeyValue(attribute))
+	}
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, logRecord.ObservedTimeUnixNano)
+	return b
+}
+
+func encodeOTLPKeyValue(keyValue otlpKeyValue) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, keyValue.Key)
+	return appendOTLPMessage(b, 2, encodeOTLPAnyValue(keyValue.Value))
+}
+
+func encodeOTLPAnyValue(value otlpAnyValue) []byte {
+	if value.ArrayValue != nil {
+		var arrayBytes []byte
+		for _, element := range value.ArrayValue.Values {
+			arrayBytes = appendOTLPMessage(arrayBytes, 1, encodeOTLPAnyValue(element))
+		}
+		return appendOTLPMessage(nil, 5, arrayBytes)
+	}
+	if value.StringValue != nil {
+		b := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendString(b, *value.StringValue)
+	}
+	return nil
+}
+
+func appendOTLPMessage(b []byte, number protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// getOTLPSetting returns the env variable if set, otherwise the out_oms.conf setting
+func getOTLPSetting(configKey string, env string) string {
+	if value := strings.TrimSpace(os.Getenv(env)); value != "" {
+		return value
+	}
+	return strings.TrimSpace(PluginConfiguration[configKey])
+}
+
+// createOTLPSink creates the OTLP sink from the out_oms.conf & env settings. Returns nil if the settings are invalid
+func createOTLPSink() Sink {
+	endpoint := getOTLPSetting(otlpLogsEndpointConfigKey, OTLPLogsEndpointEnv)
+	protocol := strings.ToLower(getOTLPSetting(otlpLogsProtocolConfigKey, OTLPLogsProtocolEnv))
+	if protocol == "" {
+		protocol = OTLPProtocolProtobuf
+	}
+	compression := strings.ToLower(getOTLPSetting(otlpLogsCompressionConfigKey, OTLPLogsCompressionEnv))
+	maxRetries, err := strconv.Atoi(getOTLPSetting(otlpLogsMaxRetriesConfigKey, OTLPLogsMaxRetriesEnv))
+	if err != nil || maxRetries < 0 {
+		maxRetries = defaultOTLPLogsMaxRetries
+	}
+	headers := make(map[string]string)
+	for _, header := range strings.Split(getOTLPSetting(otlpLogsHeadersConfigKey, OTLPLogsHeadersEnv), ",") {
+		if separator := strings.Index(header, "="); separator > 0 {
+			headers[strings.TrimSpace(header[:separator])] = strings.TrimSpace(header[separator+1:])
+		}
+	}
+
+	transport := &http.Transport{}
+	if ProxyEndpoint != "" {
+		if proxyEndpointUrl, err := url.Parse(ProxyEndpoint); err == nil {
+			transport.Proxy = http.ProxyURL(proxyEndpointUrl)
+		}
+	}
+	sink, err := NewOTLPSink(endpoint, protocol, compression != "none", headers, maxRetries, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+	if err != nil {
+		message := fmt.Sprintf("Error::otlp::Unable to create the OTLP sink: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	Log("Using OTLP sink. endpoint: %s, protocol: %s, gzip: %v, max retries: %d", sink.endpoint, protocol, sink.gzip, maxRetries)
+	return sink
+}
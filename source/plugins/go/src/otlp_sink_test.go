@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func otlpTestBatch() *SinkBatch {
+	record := func(container string, message string, level string) MsgPackEntry {
+		return MsgPackEntry{Record: map[string]string{
+			"Computer":           "aks-node-1",
+			"ContainerId":        "c-" + container,
+			"ContainerName":      container,
+			"PodName":            "web-5d4f8c7b9-abcde",
+			"PodNamespace":       "payments",
+			"LogMessage":         message,
+			"LogSource":          "stdout",
+			"TimeGenerated":      "2024-05-01T10:15:00.5Z",
+			"LogLevel":           level,
+			"KubernetesMetadata": `{"podUid":"uid-1","imageRepo":"mcr.microsoft.com","image":"web","imageTag":"1.2","podLabels":{"app":"web"}}`,
+		}}
+	}
+	return &SinkBatch{DataType: ContainerLogV2DataType, Entries: []MsgPackEntry{
+		record("app", "served", "info"),
+		record("sidecar", "connection reset", "error"),
+		record("app", "cache miss", ""),
+	}}
+}
+
+func TestGetOTLPResourceLogs(t *testing.T) {
+	resourceLogs := getOTLPResourceLogs(otlpTestBatch().Entries, time.Now())
+	assert.Equal(t, 2, len(resourceLogs), "records are grouped by container")
+
+	attributes := map[string]otlpAnyValue{}
+	for _, attribute := range resourceLogs[0].Resource.Attributes {
+		attributes[attribute.Key] = attribute.Value
+	}
+	assert.Equal(t, "payments", *attributes["k8s.namespace.name"].StringValue)
+	assert.Equal(t, "web-5d4f8c7b9-abcde", *attributes["k8s.pod.name"].StringValue)
+	assert.Equal(t, "c-app", *attributes["container.id"].StringValue)
+	assert.Equal(t, "uid-1", *attributes["k8s.pod.uid"].StringValue)
+	assert.Equal(t, "mcr.microsoft.com/web", *attributes["container.image.name"].StringValue)
+	assert.Equal(t, "1.2", *attributes["container.image.tags"].ArrayValue.Values[0].StringValue)
+	assert.Equal(t, "web", *attributes["k8s.pod.label.app"].StringValue)
+
+	logRecords := resourceLogs[0].ScopeLogs[0].LogRecords
+	assert.Equal(t, 2, len(logRecords))
+	assert.Equal(t, uint64(time.Date(2024, 5, 1, 10, 15, 0, 500000000, time.UTC).UnixNano()), logRecords[0].TimeUnixNano)
+	assert.Equal(t, 9, logRecords[0].SeverityNumber)
+	assert.Equal(t, "INFO", logRecords[0].SeverityText)
+	assert.Equal(t, "served", *logRecords[0].Body.StringValue)
+	assert.Equal(t, 0, logRecords[1].SeverityNumber)
+	assert.Equal(t, 17, resourceLogs[1].ScopeLogs[0].LogRecords[0].SeverityNumber)
+}
+
+// otlpTestMessages returns the length delimited fields of the protobuf message with the field number
+func otlpTestMessages(t *testing.T, b []byte, number protowire.Number) [][]byte {
+	var messages [][]byte
+	for len(b) > 0 {
+		fieldNumber, fieldType, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0)
+		b = b[n:]
+		if fieldType == protowire.BytesType {
+			value, m := protowire.ConsumeBytes(b)
+			if fieldNumber == number {
+				messages = append(messages, value)
+			}
+			n = m
+		} else {
+			n = protowire.ConsumeFieldValue(fieldNumber, fieldType, b)
+		}
+		assert.True(t, n > 0)
+		b = b[n:]
+	}
+	return messages
+}
+
+func TestOTLPSinkWriteProtobuf(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		reader, _ := gzip.NewReader(r.Body)
+		body, _ = ioutil.ReadAll(reader)
+	}))
+	defer server.Close()
+	sink, err := NewOTLPSink(server.URL, OTLPProtocolProtobuf, true, map[string]string{"Authorization": "Bearer t"}, 0, server.Client())
+	assert.NoError(t, err)
+
+	_, err = writeToSink(sink, otlpTestBatch())
+	assert.NoError(t, err)
+	assert.Equal(t, "application/x-protobuf", headers.Get("Content-Type"))
+	assert.Equal(t, "Bearer t", headers.Get("Authorization"))
+
+	resourceLogs := otlpTestMessages(t, body, 1)
+	assert.Equal(t, 2, len(resourceLogs))
+	resource := otlpTestMessages(t, resourceLogs[0], 1)[0]
+	firstAttribute := otlpTestMessages(t, resource, 1)[0]
+	assert.Equal(t, "k8s.node.name", string(otlpTestMessages(t, firstAttribute, 1)[0]))
+	scopeLogs := otlpTestMessages(t, resourceLogs[0], 2)[0]
+	logRecords := otlpTestMessages(t, scopeLogs, 2)
+	assert.Equal(t, 2, len(logRecords))
+	logBody := otlpTestMessages(t, logRecords[0], 5)[0]
+	assert.Equal(t, "served", string(otlpTestMessages(t, logBody, 1)[0]))
+}
+
+func TestOTLPSinkWriteJSONWithRetries(t *testing.T) {
+	calls := 0
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+	}))
+	defer server.Close()
+	sink, err := NewOTLPSink(server.URL+"/custom/logs", OTLPProtocolJSON, false, nil, 2, server.Client())
+	assert.NoError(t, err)
+	var delays []time.Duration
+	sink.sleep = func(delay time.Duration) { delays = append(delays, delay) }
+
+	_, err = sink.Write(otlpTestBatch())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []time.Duration{otlpInitialRetryDelay}, delays)
+	assert.Equal(t, 2, len(request["resourceLogs"].([]interface{})))
+
+	sink.maxRetries = 0
+	calls = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	_, err = sink.Write(otlpTestBatch())
+	assert.False(t, IsRetriableSinkError(err))
+	assert.Equal(t, 1, calls)
+}
+
+func TestOTLPSinkDoesntWaitForALongRetryAfter(t *testing.T) {
+	calls := 0
+	retryAfter := "2"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	sink, err := NewOTLPSink(server.URL, OTLPProtocolJSON, false, nil, 1, server.Client())
+	assert.NoError(t, err)
+	var delays []time.Duration
+	sink.sleep = func(delay time.Duration) { delays = append(delays, delay) }
+
+	_, err = sink.Write(otlpTestBatch())
+	assert.True(t, IsRetriableSinkError(err))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []time.Duration{2 * time.Second}, delays)
+
+	calls, delays, retryAfter = 0, nil, "3600"
+	_, err = sink.Write(otlpTestBatch())
+	assert.True(t, IsRetriableSinkError(err), "the batch is left to the retry of the flush")
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, delays)
+}
+
+func TestNewOTLPSinkInvalidSettings(t *testing.T) {
+	_, err := NewOTLPSink("collector:4318", OTLPProtocolProtobuf, true, nil, 3, http.DefaultClient)
+	assert.Error(t, err)
+	_, err = NewOTLPSink("http://collector:4318", "grpc", true, nil, 3, http.DefaultClient)
+	assert.Error(t, err)
+}
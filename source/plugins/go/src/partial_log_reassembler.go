@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variables to configure the reassembly of CRI partial log lines
+const ContainerLogPartialReassemblyEnabledEnv = "AZMON_CONTAINER_LOG_PARTIAL_REASSEMBLY_ENABLED"
+const ContainerLogPartialReassemblyMaxSizeKBEnv = "AZMON_CONTAINER_LOG_PARTIAL_REASSEMBLY_MAX_SIZE_KB"
+const ContainerLogPartialReassemblyTimeoutSecondsEnv = "AZMON_CONTAINER_LOG_PARTIAL_REASSEMBLY_TIMEOUT_SECONDS"
+
+const defaultContainerLogPartialReassemblyMaxSizeKB = 256
+const defaultContainerLogPartialReassemblyTimeoutSeconds = 5
+
+// CRI log tags (first field of the logtag column)
+const criLogTagPartial = "P"
+const criLogTagFull = "F"
+
+// PartialLogReassembler joins the partial (P) chunks which containerd & CRI-O write for long lines
+// with the final (F) chunk, per container and stream.
+type PartialLogReassembler struct {
+	maxSize int
+	timeout time.Duration
+	mutex   sync.Mutex
+	pending map[string]*partialLogLine
+}
+
+type partialLogLine struct {
+	// record of the first chunk, the joined line replaces its log
+	record    map[interface{}]interface{}
+	chunks    []string
+	size      int
+	firstSeen time.Time
+}
+
+// NewPartialLogReassembler creates a reassembler which flushes a line once it reaches maxSize bytes
+// or if its final chunk doesnt show up within timeout
+func NewPartialLogReassembler(maxSize int, timeout time.Duration) *PartialLogReassembler {
+	return &PartialLogReassembler{
+		maxSize: maxSize,
+		timeout: timeout,
+		pending: make(map[string]*partialLogLine),
+	}
+}
+
+// Process returns the records with the partial chunks joined into complete lines.
+// Chunks of lines which arent complete yet are held back until a later flush.
+// Lines held back longer than the timeout are flushed (as is) ahead of the records of this flush.
+// The rollback restores the pending lines as they were before the call, for the flush to be retried
+func (r *PartialLogReassembler) Process(records []map[interface{}]interface{}) (output []map[interface{}]interface{}, reassembledLines int, incompleteLines int, rollback func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	snapshot := r.snapshotLocked()
+	rollback = func() { r.restore(snapshot) }
+	output = make([]map[interface{}]interface{}, 0, len(records))
+	output, incompleteLines = r.flushExpiredLocked(output, time.Now())
+
+	for _, record := range records {
+		logTag := ToString(record["logtag"])
+		if logTag == "" {
+			output = append(output, record)
+			continue
+		}
+		containerID, _, _, _ := GetContainerIDK8sNamespacePodNameFromFileName(ToString(record["filepath"]))
+		if containerID == "" {
+			output = append(output, record)
+			continue
+		}
+		key := containerID + "/" + ToString(record["stream"])
+		line, isPending := r.pending[key]
+		isPartial := strings.Compare(strings.SplitN(logTag, ":", 2)[0], criLogTagPartial) == 0
+
+		if !isPending {
+			if !isPartial {
+				output = append(output, record)
+				continue
+			}
+			line = &partialLogLine{record: record, firstSeen: time.Now()}
+			r.pending[key] = line
+		}
+
+		chunk := ToString(record["log"])
+		if line.size > 0 && line.size+len(chunk) > r.maxSize {
+			// line is too large, so flush what is buffered and start over with this chunk
+			output = append(output, line.toRecord())
+			incompleteLines += 1
+			line = &partialLogLine{record: record, firstSeen: time.Now()}
+			r.pending[key] = line
+		}
+		line.chunks = append(line.chunks, chunk)
+		line.size += len(chunk)
+
+		if !isPartial {
+			output = append(output, line.toRecord())
+			delete(r.pending, key)
+			if len(line.chunks) > 1 {
+				reassembledLines += 1
+			}
+		}
+	}
+	return output, reassembledLines, incompleteLines, rollback
+}
+
+// snapshotLocked copies the pending lines, the chunks are only ever appended so the copies share them
+func (r *PartialLogReassembler) snapshotLocked() map[string]partialLogLine {
+	snapshot := make(map[string]partialLogLine, len(r.pending))
+	for key, line := range r.pending {
+		snapshot[key] = *line
+	}
+	return snapshot
+}
+
+func (r *PartialLogReassembler) restore(snapshot map[string]partialLogLine) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending = make(map[string]*partialLogLine, len(snapshot))
+	for key, line := range snapshot {
+		line := line
+		r.pending[key] = &line
+	}
+}
+
+// Len returns the number of lines waiting for their final chunk
+func (r *PartialLogReassembler) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pending)
+}
+
+func (r *PartialLogReassembler) flushExpiredLocked(output []map[interface{}]interface{}, now time.Time) ([]map[interface{}]interface{}, int) {
+	var expired []string
+	for key, line := range r.pending {
+		if now.Sub(line.firstSeen) >= r.timeout {
+			expired = append(expired, key)
+		}
+	}
+	// flush in the order the lines started
+	sort.Slice(expired, func(i, j int) bool {
+		return r.pending[expired[i]].firstSeen.Before(r.pending[expired[j]].firstSeen)
+	})
+	for _, key := range expired {
+		output = append(output, r.pending[key].toRecord())
+		delete(r.pending, key)
+	}
+	return output, len(expired)
+}
+
+func (line *partialLogLine) toRecord() map[interface{}]interface{} {
+	record := make(map[interface{}]interface{}, len(line.record))
+	for k, v := range line.record {
+		record[k] = v
+	}
+	record["log"] = []byte(strings.Join(line.chunks, ""))
+	record["logtag"] = []byte(criLogTagFull)
+	return record
+}
+
+// initializeContainerLogPartialReassembler creates the partial log reassembler if enabled through the env settings
+func initializeContainerLogPartialReassembler() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogPartialReassemblyEnabledEnv))), "true") != 0 {
+		Log("Container log partial line reassembly is disabled")
+		return
+	}
+	maxSizeKB, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogPartialReassemblyMaxSizeKBEnv)))
+	if err != nil || maxSizeKB <= 0 {
+		maxSizeKB = defaultContainerLogPartialReassemblyMaxSizeKB
+	}
+	timeoutSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogPartialReassemblyTimeoutSecondsEnv)))
+	if err != nil || timeoutSeconds <= 0 {
+		timeoutSeconds = defaultContainerLogPartialReassemblyTimeoutSeconds
+	}
+	ContainerLogPartialReassembler = NewPartialLogReassembler(maxSizeKB*1024, time.Duration(timeoutSeconds)*time.Second)
+	Log("Container log partial line reassembly enabled. maxSizeKB: %d, timeoutSeconds: %d", maxSizeKB, timeoutSeconds)
+}
+
+// reassemblePartialContainerLogs joins the CRI partial chunks of the records if the reassembler is enabled.
+// The rollback is nil if the reassembler is disabled
+func reassemblePartialContainerLogs(records []map[interface{}]interface{}) ([]map[interface{}]interface{}, func()) {
+	if ContainerLogPartialReassembler == nil {
+		return records, nil
+	}
+	output, reassembledLines, incompleteLines, rollback := ContainerLogPartialReassembler.Process(records)
+	if reassembledLines > 0 || incompleteLines > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsPartialLinesReassembledCount += float64(reassembledLines)
+		ContainerLogsPartialLinesFlushedIncompleteCount += float64(incompleteLines)
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	return output, rollback
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerLogFilePath = "/var/log/containers/app-5d4f8_default_app-0123456789abcdef.log"
+
+func criRecord(filePath string, stream string, logTag string, log string) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"filepath": []byte(filePath),
+		"stream":   []byte(stream),
+		"logtag":   []byte(logTag),
+		"log":      []byte(log),
+		"time":     []byte("2024-01-01T00:00:00.000000000Z"),
+	}
+}
+
+func TestPartialLogReassemblerJoinsChunks(t *testing.T) {
+	r := NewPartialLogReassembler(1024, time.Minute)
+	output, reassembled, incomplete, _ := r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "{\"msg\":"),
+		criRecord(testContainerLogFilePath, "stderr", "F", "stderr line"),
+		criRecord(testContainerLogFilePath, "stdout", "P", "\"hello "),
+	})
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "stderr line", ToString(output[0]["log"]))
+	assert.Equal(t, 0, reassembled)
+	assert.Equal(t, 0, incomplete)
+	assert.Equal(t, 1, r.Len())
+
+	output, reassembled, _, _ = r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "F", "world\"}"),
+	})
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "{\"msg\":\"hello world\"}", ToString(output[0]["log"]))
+	assert.Equal(t, "F", ToString(output[0]["logtag"]))
+	assert.Equal(t, 1, reassembled)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestPartialLogReassemblerPassesThroughRecordsWithoutLogTag(t *testing.T) {
+	r := NewPartialLogReassembler(1024, time.Minute)
+	record := map[interface{}]interface{}{"log": []byte("docker line"), "filepath": []byte(testContainerLogFilePath)}
+	output, _, _, _ := r.Process([]map[interface{}]interface{}{record})
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "docker line", ToString(output[0]["log"]))
+}
+
+func TestPartialLogReassemblerFlushesAtMaxSize(t *testing.T) {
+	r := NewPartialLogReassembler(8, time.Minute)
+	output, _, incomplete, _ := r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "12345"),
+		criRecord(testContainerLogFilePath, "stdout", "P", "67890"),
+		criRecord(testContainerLogFilePath, "stdout", "F", "ab"),
+	})
+	assert.Equal(t, 1, incomplete)
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, "12345", ToString(output[0]["log"]))
+	assert.Equal(t, "67890ab", ToString(output[1]["log"]))
+}
+
+func TestPartialLogReassemblerFlushesOnTimeout(t *testing.T) {
+	r := NewPartialLogReassembler(1024, time.Millisecond)
+	output, _, _, _ := r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "never finished"),
+	})
+	assert.Equal(t, 0, len(output))
+	time.Sleep(5 * time.Millisecond)
+
+	output, _, incomplete, _ := r.Process(nil)
+	assert.Equal(t, 1, incomplete)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "never finished", ToString(output[0]["log"]))
+}
+
+func TestPartialLogReassemblerRollback(t *testing.T) {
+	r := NewPartialLogReassembler(1024, time.Minute)
+	_, _, _, rollback := r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "hello "),
+	})
+	// the flush buffering the chunk is retried, so the resent chunk isnt buffered twice
+	rollback()
+	assert.Equal(t, 0, r.Len())
+	r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "hello "),
+	})
+
+	// the flush joining the chunks is retried, so the buffered chunk is kept for the resent final chunk
+	output, _, _, rollback := r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "F", "world"),
+	})
+	assert.Equal(t, "hello world", ToString(output[0]["log"]))
+	rollback()
+	assert.Equal(t, 1, r.Len())
+	output, _, _, _ = r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "F", "world"),
+	})
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "hello world", ToString(output[0]["log"]))
+}
+
+func TestPartialLogReassemblerRollbackRestoresTimedOutLines(t *testing.T) {
+	r := NewPartialLogReassembler(1024, time.Millisecond)
+	r.Process([]map[interface{}]interface{}{
+		criRecord(testContainerLogFilePath, "stdout", "P", "never finished"),
+	})
+	time.Sleep(5 * time.Millisecond)
+	output, _, _, rollback := r.Process(nil)
+	assert.Equal(t, 1, len(output))
+	rollback()
+
+	output, _, _, _ = r.Process(nil)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "never finished", ToString(output[0]["log"]))
+}
+
+func TestInitializeContainerLogPartialReassemblerIsOptIn(t *testing.T) {
+	reassembler := ContainerLogPartialReassembler
+	defer func() { ContainerLogPartialReassembler = reassembler }()
+
+	ContainerLogPartialReassembler = nil
+	t.Setenv(ContainerLogPartialReassemblyEnabledEnv, "")
+	initializeContainerLogPartialReassembler()
+	assert.Nil(t, ContainerLogPartialReassembler)
+
+	t.Setenv(ContainerLogPartialReassemblyEnabledEnv, "true")
+	initializeContainerLogPartialReassembler()
+	assert.NotNil(t, ContainerLogPartialReassembler)
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Sink types which can be configured per data type
+const (
+	UnixSocketSinkType    = "unixsocket"
+	NamedPipeSinkType     = "namedpipe"
+	ODSSinkType           = "ods"
+	LogsIngestionSinkType = "logsingestion"
+	OTLPSinkType          = "otlp"
+	FileSinkType          = "file"
+)
+
+// env variables to override the sink selected by default for each data type
+const ContainerLogsSinkEnv = "AZMON_CONTAINER_LOGS_SINK"
+const KubeMonAgentEventsSinkEnv = "AZMON_KUBE_MON_AGENT_EVENTS_SINK"
+const InsightsMetricsSinkEnv = "AZMON_INSIGHTS_METRICS_SINK"
+const InputPluginRecordsSinkEnv = "AZMON_INPUT_PLUGIN_RECORDS_SINK"
+
+// out_oms.conf setting of the container logs sink, the AZMON_CONTAINER_LOGS_SINK env variable takes precedence
+const containerLogsSinkConfigKey = "container_logs_sink"
+
+const sinkWriteDeadline = 10 * time.Second
+const sinkDialTimeout = 10 * time.Second
+
+// Sink is a destination for flushed batches of records
+type Sink interface {
+	// Name of the sink used in logs
+	Name() string
+	// Connect establishes the connection to the destination
+	Connect() error
+	// Write writes the batch and returns the number of bytes written
+	Write(batch *SinkBatch) (int, error)
+	// IsHealthy returns false if the sink needs to be (re)connected before the next write
+	IsHealthy() bool
+	// Close releases the connection of the sink
+	Close()
+}
+
+// FrameSink is implemented by the sinks which can write pre-encoded msgpack forward frames
+type FrameSink interface {
+	Sink
+	WriteFrame(frame []byte) (int, error)
+}
+
+// SinkBatch is a batch of records of a single data type handed to a sink
+type SinkBatch struct {
+	// DataType of the records e.g. CONTAINERINSIGHTS_CONTAINERLOGV2
+	DataType string
+	// Tag fluent forward tag or output stream id of the records
+	Tag string
+	// NamedPipe overrides the named pipe of the sink (used for the multi-tenancy streams on windows)
+	NamedPipe string
+	// Entries records of the batch
+	Entries []MsgPackEntry
+	// Frame msgpack forward message of the records encoded while they were read, written as is by the agent sinks instead of Entries
+	Frame []byte
+	// Payload json object posted by the ODS sink. Entries are posted as DataItems when not set
+	Payload interface{}
+}
+
+// SinkError wraps the errors returned by the sinks
+type SinkError struct {
+	// Op is either connect or write
+	Op string
+	// StatusCode http response status code for the http sinks
+	StatusCode int
+	// Retriable is false if the batch shouldnt be retried
+	Retriable bool
+	// DeliveredRecords number of leading records of the batch which were delivered before the failure, by sinks splitting a batch into several calls
+	DeliveredRecords int
+	Err              error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+func newSinkConnectError(err error) error {
+	return &SinkError{Op: "connect", Retriable: true, Err: err}
+}
+
+func newSinkWriteError(err error) error {
+	return &SinkError{Op: "write", Retriable: true, Err: err}
+}
+
+// IsSinkConnectError returns true if the write failed since the sink couldnt be connected
+func IsSinkConnectError(err error) bool {
+	var sinkErr *SinkError
+	return errors.As(err, &sinkErr) && sinkErr.Op == "connect"
+}
+
+// IsRetriableSinkError returns true if the batch can be retried
+func IsRetriableSinkError(err error) bool {
+	var sinkErr *SinkError
+	if errors.As(err, &sinkErr) {
+		return sinkErr.Retriable
+	}
+	return err != nil
+}
+
+// GetSinkErrorStatusCode returns the http status code of the failed write, 0 if not applicable
+func GetSinkErrorStatusCode(err error) int {
+	var sinkErr *SinkError
+	if errors.As(err, &sinkErr) {
+		return sinkErr.StatusCode
+	}
+	return 0
+}
+
+// GetSinkErrorDeliveredRecords returns the number of leading records of the batch which were delivered before the write failed
+func GetSinkErrorDeliveredRecords(err error) int {
+	var sinkErr *SinkError
+	if errors.As(err, &sinkErr) {
+		return sinkErr.DeliveredRecords
+	}
+	return 0
+}
+
+// getUndeliveredSinkBatch returns the batch of the records which werent delivered
+func getUndeliveredSinkBatch(batch *SinkBatch, deliveredRecords int) *SinkBatch {
+	undelivered := *batch
+	undelivered.Entries = batch.Entries[deliveredRecords:]
+	return &undelivered
+}
+
+// writeToSink is the reconnect/retry policy shared by all the flush paths.
+// The sink is connected if needed before the write. If the write fails on a connection established by an earlier flush
+// (e.g. mdsd got restarted), the sink is reconnected and the write retried once. Otherwise the sink is closed so that the next flush reconnects.
+// Writes rejected by the destination with a status code are left to fluent-bit's retry.
+// Successful writes are also written to the alongside file sink if enabled
+func writeToSink(sink Sink, batch *SinkBatch) (int, error) {
+	bts, err := writeToSinkWithRetry(sink, batch)
+	if err == nil {
+		mirrorBatchToFile(sink, batch)
+	}
+	return bts, err
+}
+
+func writeToSinkWithRetry(sink Sink, batch *SinkBatch) (int, error) {
+	connected := false
+	if !sink.IsHealthy() {
+		Log("Error::%s::connection for %s does not exist. re-connecting ...", sink.Name(), batch.DataType)
+		if err := sink.Connect(); err != nil {
+			Log("Error::%s::Unable to connect for %s. error: %s", sink.Name(), batch.DataType, err.Error())
+			return 0, newSinkConnectError(err)
+		}
+		connected = true
+	}
+	bts, err := sink.Write(batch)
+	if err == nil || !IsRetriableSinkError(err) {
+		return bts, err
+	}
+	sink.Close()
+	if connected || GetSinkErrorStatusCode(err) != 0 || GetSinkErrorDeliveredRecords(err) > 0 {
+		return bts, err
+	}
+	Log("Error::%s::Write for %s failed on an existing connection, re-connecting and retrying once. error: %s", sink.Name(), batch.DataType, err.Error())
+	if connectErr := sink.Connect(); connectErr != nil {
+		return 0, newSinkConnectError(connectErr)
+	}
+	bts, err = sink.Write(batch)
+	if err != nil && IsRetriableSinkError(err) {
+		sink.Close()
+	}
+	return bts, err
+}
+
+// writeBatchesToSink writes the batches in order and stops at the first failure.
+// Returns the bytes and the number of batches delivered in full, a batch which failed mid-frame isnt counted
+func writeBatchesToSink(sink Sink, batches []*SinkBatch) (int, int, error) {
+	totalBytes := 0
+	for i, batch := range batches {
+		bts, err := writeToSink(sink, batch)
+		if err != nil {
+			return totalBytes, i, err
+		}
+		totalBytes += bts
+	}
+	return totalBytes, len(batches), nil
+}
+
+// getSinkBatchFrame returns the msgpack forward message of the batch, encoding its entries unless it was streamed
+func getSinkBatchFrame(batch *SinkBatch) []byte {
+	if batch.Frame != nil {
+		return batch.Frame
+	}
+	return convertMsgPackEntriesToMsgpBytes(batch.Tag, batch.Entries)
+}
+
+// writeFullFrame writes the parts of the frame to the connection, continuing after short writes until the frame is complete or the
+// write deadline passes. Returns the number of bytes written, if the write failed after a part of the frame was written
+// the connection holds a truncated frame and must be discarded
+func writeFullFrame(conn net.Conn, frame ...[]byte) (int, error) {
+	conn.SetWriteDeadline(time.Now().Add(sinkWriteDeadline)) //this is based of clock time, so cannot reuse
+	written := 0
+	for _, part := range frame {
+		partWritten := 0
+		for partWritten < len(part) {
+			n, err := conn.Write(part[partWritten:])
+			partWritten += n
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if n == 0 {
+				return written, io.ErrShortWrite
+			}
+		}
+	}
+	return written, nil
+}
+
+// ForwardSocketSink writes msgpack forward messages to mdsd's unix socket or a tcp endpoint of AMA.
+// When ackTimeout is set, each message carries a chunk id and the write only succeeds once the agent acks it
+type ForwardSocketSink struct {
+	address    string
+	security   *ForwardSecurity
+	ackTimeout time.Duration
+	mutex      sync.Mutex
+	conn       net.Conn
+	// reader of the acks on conn
+	reader *msgp.Reader
+}
+
+// NewForwardSocketSink creates a sink for the unix socket path or tcp://host:port endpoint at the given address
+func NewForwardSocketSink(address string) *ForwardSocketSink {
+	return &ForwardSocketSink{address: address, security: AMAForwardSecurity, ackTimeout: AMAForwardAckTimeout}
+}
+
+// Name includes the endpoint, since the sinks of the data types may write to different agent endpoints
+func (s *ForwardSocketSink) Name() string {
+	return fmt.Sprintf("mdsd(%s)", s.address)
+}
+
+func (s *ForwardSocketSink) Connect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeConn()
+	conn, err := dialForwardEndpoint(s.address, s.security)
+	if err != nil {
+		Log("Error::mdsd::Unable to open MDSD msgp socket connection %s: %s", s.address, err.Error())
+		return err
+	}
+	Log("Successfully created MDSD msgp socket connection: %s", s.address)
+	s.conn = conn
+	s.reader = msgp.NewReader(conn)
+	return nil
+}
+
+func (s *ForwardSocketSink) Write(batch *SinkBatch) (int, error) {
+	return s.WriteFrame(getSinkBatchFrame(batch))
+}
+
+func (s *ForwardSocketSink) WriteFrame(frame []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return 0, newSinkWriteError(errors.New("mdsd connection does not exist"))
+	}
+	chunk := ""
+	parts := [][]byte{frame}
+	if s.ackTimeout > 0 {
+		var err error
+		var option []byte
+		if chunk, err = newForwardChunkId(); err == nil {
+			option, err = forwardChunkOption(frame, chunk)
+		}
+		if err != nil {
+			return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+		}
+		// the header & the option are written around the frame instead of copying it
+		parts = [][]byte{forwardMessageWithOptionHeader, frame[1:], option}
+	}
+	bts, err := writeFullFrame(s.conn, parts...)
+	if err != nil {
+		if bts > 0 {
+			// a truncated frame would corrupt the stream for the next frames, so the frame is resent whole on a new connection
+			Log("Error::mdsd::Discarding the connection after writing %d bytes of the %d bytes frame", bts, len(frame))
+			s.closeConn()
+		}
+		return 0, newSinkWriteError(err)
+	}
+	if chunk != "" {
+		s.conn.SetReadDeadline(time.Now().Add(s.ackTimeout))
+		if err := readForwardAck(s.reader, chunk); err != nil {
+			// the connection is dropped so that a late ack isnt read as the ack of the next chunk
+			s.closeConn()
+			ContainerLogTelemetryMutex.Lock()
+			AMAForwardAckFailuresCount += 1
+			ContainerLogTelemetryMutex.Unlock()
+			return bts, newSinkWriteError(fmt.Errorf("chunk %s not acknowledged: %s", chunk, err.Error()))
+		}
+	}
+	return bts, nil
+}
+
+func (s *ForwardSocketSink) IsHealthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn != nil
+}
+
+func (s *ForwardSocketSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeConn()
+}
+
+func (s *ForwardSocketSink) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.reader = nil
+	}
+}
+
+// NamedPipeSink writes msgpack forward messages to windows AMA's named pipes
+type NamedPipeSink struct {
+	// getDataType returns the data type used to look up the output named pipe from the extension config
+	getDataType                    func() string
+	isGenevaLogsIntegrationEnabled bool
+	refreshTracker                 *time.Time
+	// namedPipe is the named pipe of the sink when set instead of the one of the data type (used for the per stream sinks of the multi-tenancy streams)
+	namedPipe string
+	mutex     sync.Mutex
+	conn      net.Conn
+	// connections to the named pipes of the multi-tenancy streams
+	pipeConnections map[string]net.Conn
+}
+
+// NewNamedPipeSink creates a sink for the named pipe of the data type
+func NewNamedPipeSink(getDataType func() string, isGenevaLogsIntegrationEnabled bool, refreshTracker *time.Time) *NamedPipeSink {
+	return &NamedPipeSink{
+		getDataType:                    getDataType,
+		isGenevaLogsIntegrationEnabled: isGenevaLogsIntegrationEnabled,
+		refreshTracker:                 refreshTracker,
+		pipeConnections:                make(map[string]net.Conn),
+	}
+}
+
+func (s *NamedPipeSink) Name() string {
+	return "ama"
+}
+
+func (s *NamedPipeSink) Connect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	namedPipe := s.namedPipe
+	if namedPipe == "" {
+		if s.isGenevaLogsIntegrationEnabled {
+			namedPipe = getGenevaWindowsNamedPipeName()
+		} else {
+			namedPipe = GetOutputNamedPipe(s.getDataType(), s.refreshTracker)
+		}
+	}
+	var conn net.Conn
+	if err := CreateWindowsNamedPipeClient(namedPipe, &conn); err != nil {
+		Log("Error::AMA::Cannot create the named pipe connection for %s.", s.getDataType())
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *NamedPipeSink) Write(batch *SinkBatch) (int, error) {
+	frame := getSinkBatchFrame(batch)
+	if batch.NamedPipe != "" && batch.NamedPipe != s.namedPipe {
+		return s.writeFrameToNamedPipe(batch.NamedPipe, frame)
+	}
+	return s.WriteFrame(frame)
+}
+
+func (s *NamedPipeSink) WriteFrame(frame []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return 0, newSinkWriteError(errors.New("named pipe connection does not exist"))
+	}
+	bts, err := writeFullFrame(s.conn, frame)
+	if err != nil {
+		if bts > 0 {
+			// a truncated frame would corrupt the stream for the next frames, so the frame is resent whole on a new connection
+			Log("Error::ama::Discarding the named pipe connection after writing %d of %d bytes of the frame", bts, len(frame))
+			s.conn.Close()
+			s.conn = nil
+		}
+		return 0, newSinkWriteError(err)
+	}
+	return bts, nil
+}
+
+// writeFrameToNamedPipe writes to a named pipe other than the sink's default one using a cached connection
+func (s *NamedPipeSink) writeFrameToNamedPipe(namedPipe string, frame []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namedPipeConn, ok := s.pipeConnections[namedPipe]
+	if !ok || namedPipeConn == nil {
+		if err := CreateWindowsNamedPipeClient(namedPipe, &namedPipeConn); err != nil {
+			Log("Error::ama:: failed to create namedpipe client for namedpipe: %s \n", namedPipe)
+			return 0, newSinkWriteError(err)
+		}
+		s.pipeConnections[namedPipe] = namedPipeConn
+	}
+	bts, err := writeFullFrame(namedPipeConn, frame)
+	if err != nil {
+		// the connection is dropped from the cache, including after a truncated frame
+		Log("Error::ama:: failed to ingest the logs to namedpipe: %s after %d of %d bytes \n", namedPipe, bts, len(frame))
+		bts = 0
+		namedPipeConn.Close()
+		delete(s.pipeConnections, namedPipe)
+	}
+	// clear the cache if its cachesize limit is reached
+	if len(s.pipeConnections) >= NamedPipeConnectionCacheSize {
+		for np, conn := range s.pipeConnections {
+			if conn != nil {
+				conn.Close()
+			}
+			delete(s.pipeConnections, np)
+		}
+	}
+	if err != nil {
+		return bts, newSinkWriteError(err)
+	}
+	return bts, nil
+}
+
+func (s *NamedPipeSink) IsHealthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn != nil
+}
+
+func (s *NamedPipeSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// ODSHTTPSink posts the batches as json to OMSEndpoint
+type ODSHTTPSink struct {
+}
+
+// odsPayload is posted when the batch has no Payload of its own
+type odsPayload struct {
+	DataType  string              `json:"DataType"`
+	IPName    string              `json:"IPName"`
+	DataItems []map[string]string `json:"DataItems"`
+}
+
+// NewODSHTTPSink creates a sink for OMSEndpoint using HTTPClient
+func NewODSHTTPSink() *ODSHTTPSink {
+	return &ODSHTTPSink{}
+}
+
+func (s *ODSHTTPSink) Name() string {
+	return "ods"
+}
+
+func (s *ODSHTTPSink) Connect() error {
+	return nil
+}
+
+func (s *ODSHTTPSink) Write(batch *SinkBatch) (int, error) {
+	payload := batch.Payload
+	if payload == nil {
+		dataItems := make([]map[string]string, 0, len(batch.Entries))
+		for _, entry := range batch.Entries {
+			dataItems = append(dataItems, entry.Record)
+		}
+		payload = odsPayload{DataType: batch.DataType, IPName: IPName, DataItems: dataItems}
+	}
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		return 0, &SinkError{Op: "write", Retriable: false, Err: err}
+	}
+
+	req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-ms-date", time.Now().Format(time.RFC3339))
+	req.Header.Set("User-Agent", userAgent)
+	reqID := uuid.New().String()
+	req.Header.Set("X-Request-ID", reqID)
+	//expensive to do string len for every request, so use a flag
+	if ResourceCentric == true {
+		req.Header.Set("x-ms-AzureResourceId", ResourceID)
+	}
+	if IsAADMSIAuthMode == true {
+		IngestionAuthTokenUpdateMutex.Lock()
+		ingestionAuthToken := ODSIngestionAuthToken
+		IngestionAuthTokenUpdateMutex.Unlock()
+		if ingestionAuthToken == "" {
+			return 0, newSinkWriteError(errors.New("ODS Ingestion Auth Token is empty. Please check error log."))
+		}
+		// add authorization header to the req
+		req.Header.Set("Authorization", "Bearer "+ingestionAuthToken)
+	}
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return 0, newSinkWriteError(err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if IsRetriableError(resp.StatusCode) {
+		return 0, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: true, Err: fmt.Errorf("RequestId %s Status %s Status Code %d", reqID, resp.Status, resp.StatusCode)}
+	} else if !IsSuccessStatusCode(resp.StatusCode) {
+		return 0, &SinkError{Op: "write", StatusCode: resp.StatusCode, Retriable: false, Err: fmt.Errorf("RequestId %s Status %s Status Code %d", reqID, resp.Status, resp.StatusCode)}
+	}
+	return len(marshalled), nil
+}
+
+func (s *ODSHTTPSink) IsHealthy() bool {
+	return true
+}
+
+func (s *ODSHTTPSink) Close() {
+}
+
+// getMdsdFluentSocketPath returns the mdsd fluent socket of the data type
+func getMdsdFluentSocketPath(dataType DataType, containerType string) string {
+	mdsdfluentSocket := "/var/run/mdsd-ci/default_fluent.socket"
+	if containerType != "" && strings.Compare(strings.ToLower(containerType), "prometheussidecar") == 0 {
+		mdsdfluentSocket = fmt.Sprintf("/var/run/mdsd-%s/default_fluent.socket", containerType)
+	}
+	// incase of geneva logs integration mode, all data types other than container logs are ingested via sidecar container socket
+	if dataType != ContainerLogV2 && IsGenevaLogsIntegrationEnabled {
+		mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
+	}
+	return mdsdfluentSocket
+}
+
+func getSinkEnvForDataType(dataType DataType) string {
+	switch dataType {
+	case ContainerLogV2:
+		return ContainerLogsSinkEnv
+	case KubeMonAgentEvents:
+		return KubeMonAgentEventsSinkEnv
+	case InsightsMetrics:
+		return InsightsMetricsSinkEnv
+	case InputPluginRecords:
+		return InputPluginRecordsSinkEnv
+	}
+	return ""
+}
+
+// getDefaultSinkType returns the sink type based on the OS, auth mode and container logs route
+func getDefaultSinkType(dataType DataType) string {
+	switch dataType {
+	case ContainerLogV2:
+		if !ContainerLogsRouteV2 {
+			return ODSSinkType
+		}
+	case InputPluginRecords:
+		if IsWindows && !IsAADMSIAuthMode {
+			// input plugin records arent supported for windows legacy auth
+			return ""
+		}
+	default:
+		if IsWindows && !IsAADMSIAuthMode {
+			return ODSSinkType
+		}
+	}
+	if IsWindows {
+		return NamedPipeSinkType
+	}
+	return UnixSocketSinkType
+}
+
+// CreateSink creates the sink of the data type. Returns nil if the data type has no destination
+func CreateSink(dataType DataType) Sink {
+	defaultSinkType := getDefaultSinkType(dataType)
+	configuredSinkType := strings.TrimSpace(strings.ToLower(os.Getenv(getSinkEnvForDataType(dataType))))
+	if configuredSinkType == "" && dataType == ContainerLogV2 {
+		configuredSinkType = strings.TrimSpace(strings.ToLower(PluginConfiguration[containerLogsSinkConfigKey]))
+	}
+	if configuredSinkType != "" && configuredSinkType != defaultSinkType {
+		if sink := createSinkOfType(configuredSinkType, dataType); sink != nil {
+			Log("Using configured sink %s instead of %s for data type %d", configuredSinkType, defaultSinkType, dataType)
+			return sink
+		}
+		message := fmt.Sprintf("Error::Unsupported sink type %s for data type %d. Using %s", configuredSinkType, dataType, defaultSinkType)
+		Log(message)
+		SendException(message)
+	}
+	return createSinkOfType(defaultSinkType, dataType)
+}
+
+func createSinkOfType(sinkType string, dataType DataType) Sink {
+	switch sinkType {
+	case UnixSocketSinkType:
+		return NewForwardSocketSink(getAMAEndpoint(dataType, ContainerType))
+	case NamedPipeSinkType:
+		switch dataType {
+		case ContainerLogV2:
+			return NewNamedPipeSink(getContainerLogDataType, IsGenevaLogsIntegrationEnabled, &MdsdContainerLogTagRefreshTracker)
+		case KubeMonAgentEvents:
+			return NewNamedPipeSink(func() string { return KubeMonAgentEventDataType }, false, &MdsdKubeMonAgentEventsTagRefreshTracker)
+		case InsightsMetrics:
+			return NewNamedPipeSink(func() string { return InsightsMetricsDataType }, false, &MdsdInsightsMetricsTagRefreshTracker)
+		case InputPluginRecords:
+			return NewNamedPipeSink(func() string { return ContainerInventoryDataType }, false, &MdsdContainerLogTagRefreshTracker)
+		}
+	case ODSSinkType:
+		return NewODSHTTPSink()
+	case LogsIngestionSinkType:
+		if dataType == ContainerLogV2 {
+			return createLogsIngestionSink()
+		}
+	case OTLPSinkType:
+		if dataType == ContainerLogV2 {
+			return createOTLPSink()
+		}
+	case FileSinkType:
+		return getFileSink()
+	}
+	return nil
+}
+
+func getContainerLogDataType() string {
+	if ContainerLogSchemaV2 {
+		return ContainerLogV2DataType
+	}
+	return ContainerLogDataType
+}
+
+// isAgentSink returns true if the records are sent to the agent (mdsd or ama) rather than directly to a service
+func isAgentSink(sink Sink) bool {
+	switch sink := sink.(type) {
+	case *ForwardSocketSink, *NamedPipeSink:
+		return true
+	case *FailoverSink:
+		return isAgentSink(sink.primary)
+	}
+	return false
+}
+
+// isODSSink returns true if the sink posts json payloads instead of msgpack records
+func isODSSink(sink Sink) bool {
+	_, ok := sink.(*ODSHTTPSink)
+	return ok
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+type fakeSink struct {
+	connected   bool
+	connectErr  error
+	writeErrs   []error
+	connects    int
+	writes      int
+	closes      int
+	lastBatches []*SinkBatch
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Connect() error {
+	s.connects++
+	if s.connectErr != nil {
+		return s.connectErr
+	}
+	s.connected = true
+	return nil
+}
+
+func (s *fakeSink) Write(batch *SinkBatch) (int, error) {
+	s.writes++
+	s.lastBatches = append(s.lastBatches, batch)
+	if len(s.writeErrs) > 0 {
+		err := s.writeErrs[0]
+		s.writeErrs = s.writeErrs[1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(batch.Entries), nil
+}
+
+func (s *fakeSink) IsHealthy() bool { return s.connected }
+
+func (s *fakeSink) Close() {
+	s.closes++
+	s.connected = false
+}
+
+func TestWriteToSinkConnectsWhenNotHealthy(t *testing.T) {
+	sink := &fakeSink{}
+	bts, err := writeToSink(sink, &SinkBatch{Entries: make([]MsgPackEntry, 3)})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, bts)
+	assert.Equal(t, 1, sink.connects)
+}
+
+func TestWriteToSinkReturnsConnectError(t *testing.T) {
+	sink := &fakeSink{connectErr: errors.New("no such file")}
+	_, err := writeToSink(sink, &SinkBatch{})
+	assert.True(t, IsSinkConnectError(err))
+	assert.Equal(t, 0, sink.writes)
+}
+
+func TestWriteToSinkRetriesOnceOnStaleConnection(t *testing.T) {
+	sink := &fakeSink{connected: true, writeErrs: []error{newSinkWriteError(errors.New("broken pipe"))}}
+	_, err := writeToSink(sink, &SinkBatch{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sink.writes)
+	assert.Equal(t, 1, sink.connects)
+}
+
+func TestWriteToSinkDoesNotRetryOnNewConnection(t *testing.T) {
+	sink := &fakeSink{writeErrs: []error{newSinkWriteError(errors.New("broken pipe"))}}
+	_, err := writeToSink(sink, &SinkBatch{})
+	assert.Error(t, err)
+	assert.False(t, IsSinkConnectError(err))
+	assert.Equal(t, 1, sink.writes)
+	assert.False(t, sink.IsHealthy())
+}
+
+func TestWriteToSinkDoesNotRetryRejectedWrites(t *testing.T) {
+	sink := &fakeSink{connected: true, writeErrs: []error{&SinkError{Op: "write", StatusCode: 429, Retriable: true, Err: errors.New("throttled")}}}
+	_, err := writeToSink(sink, &SinkBatch{})
+	assert.Equal(t, 429, GetSinkErrorStatusCode(err))
+	assert.True(t, IsRetriableSinkError(err))
+	assert.Equal(t, 1, sink.writes)
+}
+
+func TestForwardSocketSinkWritesForwardMessage(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "fluent.socket")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	sink := NewForwardSocketSink(socketPath)
+	batch := &SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}}}
+	bts, err := writeToSink(sink, batch)
+	assert.NoError(t, err)
+	sink.Close()
+
+	data := <-received
+	assert.Equal(t, bts, len(data))
+	size, rest, err := msgp.ReadArrayHeaderBytes(data)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), size)
+	tag, rest, err := msgp.ReadStringBytes(rest)
+	assert.NoError(t, err)
+	assert.Equal(t, "ContainerLogV2Source", tag)
+	entries, _, err := msgp.ReadArrayHeaderBytes(rest)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), entries)
+}
+
+func TestForwardSocketSinkNameIncludesEndpoint(t *testing.T) {
+	assert.Equal(t, "mdsd(tcp://ama:24224)", NewForwardSocketSink("tcp://ama:24224").Name())
+	assert.Equal(t, "mdsd(/var/run/mdsd-ci/default_fluent.socket)", NewForwardSocketSink("/var/run/mdsd-ci/default_fluent.socket").Name())
+}
+
+func TestCreateSinkUsesConfiguredSinkType(t *testing.T) {
+	isWindows, containerLogsRouteV2 := IsWindows, ContainerLogsRouteV2
+	defer func() { IsWindows, ContainerLogsRouteV2 = isWindows, containerLogsRouteV2 }()
+	IsWindows = false
+	ContainerLogsRouteV2 = true
+	t.Setenv(ContainerLogsSinkEnv, "ods")
+	assert.True(t, isODSSink(CreateSink(ContainerLogV2)))
+
+	t.Setenv(ContainerLogsSinkEnv, "unknown")
+	_, ok := CreateSink(ContainerLogV2).(*ForwardSocketSink)
+	assert.True(t, ok)
+}
+
+// shortWriteConn writes at most limit bytes per call and fails once failAfter bytes were written
+type shortWriteConn struct {
+	net.Conn
+	limit     int
+	failAfter int
+	written   []byte
+	closed    bool
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	n := len(b)
+	if n > c.limit {
+		n = c.limit
+	}
+	if c.failAfter > 0 && len(c.written)+n > c.failAfter {
+		n = c.failAfter - len(c.written)
+		c.written = append(c.written, b[:n]...)
+		return n, errors.New("i/o timeout")
+	}
+	c.written = append(c.written, b[:n]...)
+	return n, nil
+}
+
+func (c *shortWriteConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *shortWriteConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWriteFullFrameContinuesShortWrites(t *testing.T) {
+	conn := &shortWriteConn{limit: 3}
+	frame := convertMsgPackEntriesToMsgpBytes("ContainerLogV2Source", []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}})
+	bts, err := writeFullFrame(conn, frame)
+	assert.NoError(t, err)
+	assert.Equal(t, len(frame), bts)
+	assert.Equal(t, frame, conn.written)
+}
+
+func TestForwardSocketSinkDiscardsConnectionAfterTruncatedFrame(t *testing.T) {
+	conn := &shortWriteConn{limit: 1024, failAfter: 10}
+	sink := &ForwardSocketSink{conn: conn}
+	bts, err := sink.Write(&SinkBatch{Tag: "ContainerLogV2Source", Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}}})
+	assert.True(t, IsRetriableSinkError(err))
+	assert.Equal(t, 0, bts, "the bytes of the truncated frame arent reported as delivered")
+	assert.True(t, conn.closed)
+	assert.False(t, sink.IsHealthy())
+}
+
+func TestWriteBatchesToSinkReportsDeliveredBatches(t *testing.T) {
+	sink := &fakeSink{connected: true, writeErrs: []error{nil, &SinkError{Op: "write", StatusCode: 503, Retriable: true, Err: errors.New("unavailable")}}}
+	batches := []*SinkBatch{
+		{Entries: []MsgPackEntry{{}, {}}},
+		{Entries: []MsgPackEntry{{}}},
+		{Entries: []MsgPackEntry{{}}},
+	}
+	bts, delivered, err := writeBatchesToSink(sink, batches)
+	assert.Error(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 2, bts)
+	assert.Equal(t, 2, sink.writes, "the batches after the failed one arent written")
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// env variables to configure the container log spill buffer
+const ContainerLogSpillBufferEnabledEnv = "AZMON_CONTAINER_LOG_SPILL_BUFFER_ENABLED"
+const ContainerLogSpillBufferDirEnv = "AZMON_CONTAINER_LOG_SPILL_BUFFER_DIR"
+const ContainerLogSpillBufferMaxSizeMBEnv = "AZMON_CONTAINER_LOG_SPILL_BUFFER_MAX_SIZE_MB"
+const ContainerLogSpillBufferMaxAgeMinutesEnv = "AZMON_CONTAINER_LOG_SPILL_BUFFER_MAX_AGE_MINUTES"
+
+const defaultContainerLogSpillBufferDir = "/var/opt/microsoft/docker-cimprov/state/containerlogspill"
+const defaultContainerLogSpillBufferMaxSizeMB = 512
+const defaultContainerLogSpillBufferMaxAgeMinutes = 60
+
+// max number of spilled batches replayed in a single flush so that a large backlog doesnt stall fluent-bit
+const spillBufferMaxReplayBatchesPerFlush = 20
+
+const spillBufferFileExtension = ".frames"
+const spillBufferTempFileExtension = ".tmp"
+
+// batches spilled before the frames were length prefixed, their frames are concatenated
+const legacySpillBufferFileExtension = ".msgpk"
+
+// size of the prefix of each frame of a spill file, the length and the number of records of the frame as big endian uint32s
+const spillFramePrefixSize = 8
+
+// SpillBuffer is a bounded on-disk FIFO of msgpack forward frames.
+// Each spilled batch is stored as one file named <unixnano>-<seq>-<records>.frames so that
+// the directory listing gives the replay order and the age & record count of every batch.
+// The frames of a batch are stored length prefixed, so that they are replayed and acked one at a time
+type SpillBuffer struct {
+	dir        string
+	maxBytes   int64
+	maxAge     time.Duration
+	mutex      sync.Mutex
+	batches    []spillBatch
+	totalBytes int64
+	seq        uint64
+}
+
+type spillBatch struct {
+	fileName  string
+	size      int64
+	records   int
+	spilledAt time.Time
+}
+
+// SpillFrame is a msgpack forward frame and the number of records in it
+type SpillFrame struct {
+	Data    []byte
+	Records int
+}
+
+// NewSpillBuffer creates the spill directory if needed and loads batches left over from a previous run
+func NewSpillBuffer(dir string, maxBytes int64, maxAge time.Duration) (*SpillBuffer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sb := &SpillBuffer{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), spillBufferTempFileExtension) {
+			// incomplete write from a previous run
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		batch, ok := parseSpillBatchFileName(file.Name())
+		if !ok {
+			continue
+		}
+		batch.size = file.Size()
+		sb.batches = append(sb.batches, batch)
+		sb.totalBytes += batch.size
+	}
+	sort.Slice(sb.batches, func(i, j int) bool {
+		return sb.batches[i].fileName < sb.batches[j].fileName
+	})
+	return sb, nil
+}
+
+func parseSpillBatchFileName(fileName string) (spillBatch, bool) {
+	batch := spillBatch{fileName: fileName}
+	extension := filepath.Ext(fileName)
+	if extension != spillBufferFileExtension && extension != legacySpillBufferFileExtension {
+		return batch, false
+	}
+	parts := strings.Split(strings.TrimSuffix(fileName, extension), "-")
+	if len(parts) != 3 {
+		return batch, false
+	}
+	spilledAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return batch, false
+	}
+	records, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return batch, false
+	}
+	batch.spilledAt = time.Unix(0, spilledAt)
+	batch.records = records
+	return batch, true
+}
+
+// Len returns the number of batches waiting to be replayed
+func (sb *SpillBuffer) Len() int {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return len(sb.batches)
+}
+
+// Enqueue persists the msgpack forward frames of a batch at the tail of the buffer.
+// Oldest batches are dropped to make room when the size cap is reached. Returns the number of records dropped
+func (sb *SpillBuffer) Enqueue(frames []SpillFrame) (droppedRecords int, err error) {
+	var size int64
+	records := 0
+	for _, frame := range frames {
+		size += int64(spillFramePrefixSize + len(frame.Data))
+		records += frame.Records
+	}
+
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	droppedRecords = sb.dropExpiredLocked()
+	if size > sb.maxBytes {
+		return droppedRecords + records, fmt.Errorf("batch of %d bytes exceeds spill buffer size cap of %d bytes", size, sb.maxBytes)
+	}
+	for len(sb.batches) > 0 && sb.totalBytes+size > sb.maxBytes {
+		droppedRecords += sb.removeHeadLocked()
+	}
+
+	now := time.Now()
+	sb.seq++
+	fileName := fmt.Sprintf("%020d-%06d-%d%s", now.UnixNano(), sb.seq%1000000, records, spillBufferFileExtension)
+	if err = sb.writeFramesLocked(fileName, frames); err != nil {
+		return droppedRecords + records, err
+	}
+
+	sb.batches = append(sb.batches, spillBatch{fileName: fileName, size: size, records: records, spilledAt: now})
+	sb.totalBytes += size
+	return droppedRecords, nil
+}
+
+// writeFramesLocked writes the length prefixed frames to the file through a temp file, so that a crash doesnt leave a partial file
+func (sb *SpillBuffer) writeFramesLocked(fileName string, frames []SpillFrame) error {
+	tempPath := filepath.Join(sb.dir, fileName+spillBufferTempFileExtension)
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, spillFramePrefixSize)
+	for _, frame := range frames {
+		binary.BigEndian.PutUint32(prefix[0:4], uint32(len(frame.Data)))
+		binary.BigEndian.PutUint32(prefix[4:8], uint32(frame.Records))
+		if _, err = file.Write(prefix); err != nil {
+			break
+		}
+		if _, err = file.Write(frame.Data); err != nil {
+			break
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filepath.Join(sb.dir, fileName))
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// readSpillFrames reads the frames of a spilled batch
+func readSpillFrames(path string, batch spillBatch) ([]SpillFrame, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var frames []SpillFrame
+	if filepath.Ext(batch.fileName) == legacySpillBufferFileExtension {
+		// the concatenated frames are split on the msgpack message boundaries, the records are counted on the last frame
+		for len(data) > 0 {
+			rest, err := msgp.Skip(data)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, SpillFrame{Data: data[:len(data)-len(rest)]})
+			data = rest
+		}
+		if len(frames) > 0 {
+			frames[len(frames)-1].Records = batch.records
+		}
+		return frames, nil
+	}
+	for len(data) > 0 {
+		if len(data) < spillFramePrefixSize {
+			return nil, errors.New("truncated frame prefix")
+		}
+		length, records := binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8])
+		data = data[spillFramePrefixSize:]
+		if uint32(len(data)) < length {
+			return nil, fmt.Errorf("truncated frame of %d bytes", length)
+		}
+		frames = append(frames, SpillFrame{Data: data[:length], Records: int(records)})
+		data = data[length:]
+	}
+	return frames, nil
+}
+
+// Replay writes up to maxBatches spilled batches in FIFO order using the write func, one frame at a time, and removes them once written.
+// Replay stops at the first write error and leaves the frames of the failed batch which werent written at the head of the buffer.
+// drained is true when no batches are left in the buffer
+func (sb *SpillBuffer) Replay(write func(frame []byte) error, maxBatches int) (replayedRecords int, droppedRecords int, drained bool, err error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	droppedRecords = sb.dropExpiredLocked()
+	for i := 0; i < maxBatches && len(sb.batches) > 0; i++ {
+		head := sb.batches[0]
+		frames, readErr := readSpillFrames(filepath.Join(sb.dir, head.fileName), head)
+		if readErr != nil {
+			Log("Error::spill::Unable to read spilled batch %s, dropping it: %s", head.fileName, readErr.Error())
+			droppedRecords += sb.removeHeadLocked()
+			continue
+		}
+		for j, frame := range frames {
+			if err = write(frame.Data); err != nil {
+				if j > 0 {
+					sb.replaceHeadLocked(frames[j:])
+				}
+				return replayedRecords, droppedRecords, false, err
+			}
+			replayedRecords += frame.Records
+		}
+		sb.removeHeadLocked()
+	}
+	return replayedRecords, droppedRecords, len(sb.batches) == 0, nil
+}
+
+// replaceHeadLocked replaces the head batch with its frames which werent replayed yet, so that the replayed frames arent sent again
+func (sb *SpillBuffer) replaceHeadLocked(frames []SpillFrame) {
+	head := sb.batches[0]
+	var size int64
+	records := 0
+	for _, frame := range frames {
+		size += int64(spillFramePrefixSize + len(frame.Data))
+		records += frame.Records
+	}
+	// the timestamp & sequence of the name are kept to keep the batch at the head of the buffer
+	parts := strings.Split(strings.TrimSuffix(head.fileName, filepath.Ext(head.fileName)), "-")
+	fileName := fmt.Sprintf("%s-%s-%d%s", parts[0], parts[1], records, spillBufferFileExtension)
+	if err := sb.writeFramesLocked(fileName, frames); err != nil {
+		Log("Error::spill::Unable to remove the replayed frames from spilled batch %s, they will be replayed again: %s", head.fileName, err.Error())
+		return
+	}
+	if fileName != head.fileName {
+		os.Remove(filepath.Join(sb.dir, head.fileName))
+	}
+	sb.totalBytes += size - head.size
+	sb.batches[0] = spillBatch{fileName: fileName, size: size, records: records, spilledAt: head.spilledAt}
+}
+
+func (sb *SpillBuffer) dropExpiredLocked() int {
+	droppedRecords := 0
+	if sb.maxAge <= 0 {
+		return droppedRecords
+	}
+	cutoff := time.Now().Add(-sb.maxAge)
+	for len(sb.batches) > 0 && sb.batches[0].spilledAt.Before(cutoff) {
+		droppedRecords += sb.removeHeadLocked()
+	}
+	return droppedRecords
+}
+
+func (sb *SpillBuffer) removeHeadLocked() int {
+	head := sb.batches[0]
+	if err := os.Remove(filepath.Join(sb.dir, head.fileName)); err != nil && !os.IsNotExist(err) {
+		Log("Error::spill::Unable to remove spilled batch %s: %s", head.fileName, err.Error())
+	}
+	sb.batches = sb.batches[1:]
+	sb.totalBytes -= head.size
+	return head.records
+}
+
+// initializeContainerLogSpillBuffer creates the container log spill buffer if enabled through the env settings
+func initializeContainerLogSpillBuffer() {
+	if strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(ContainerLogSpillBufferEnabledEnv))), "true") != 0 {
+		Log("Container log spill buffer is disabled")
+		return
+	}
+	dir := strings.TrimSpace(os.Getenv(ContainerLogSpillBufferDirEnv))
+	if dir == "" {
+		dir = defaultContainerLogSpillBufferDir
+	}
+	maxSizeMB, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogSpillBufferMaxSizeMBEnv)))
+	if err != nil || maxSizeMB <= 0 {
+		maxSizeMB = defaultContainerLogSpillBufferMaxSizeMB
+	}
+	maxAgeMinutes, err := strconv.Atoi(strings.TrimSpace(os.Getenv(ContainerLogSpillBufferMaxAgeMinutesEnv)))
+	if err != nil || maxAgeMinutes <= 0 {
+		maxAgeMinutes = defaultContainerLogSpillBufferMaxAgeMinutes
+	}
+	spillBuffer, err := NewSpillBuffer(dir, int64(maxSizeMB)*1024*1024, time.Duration(maxAgeMinutes)*time.Minute)
+	if err != nil {
+		message := fmt.Sprintf("Error::spill::Unable to initialize container log spill buffer in %s: %s", dir, err.Error())
+		Log(message)
+		SendException(message)
+		return
+	}
+	ContainerLogSpillBuffer = spillBuffer
+	Log("Container log spill buffer enabled. dir: %s, maxSizeMB: %d, maxAgeMinutes: %d, pending batches: %d", dir, maxSizeMB, maxAgeMinutes, spillBuffer.Len())
+}
+
+// spillContainerLogBatches saves the batches to the spill buffer. Returns false if the batches couldnt be spilled
+func spillContainerLogBatches(batches []*SinkBatch, records int) bool {
+	if ContainerLogSpillBuffer == nil {
+		return false
+	}
+	frames := make([]SpillFrame, 0, len(batches))
+	for _, batch := range batches {
+		frameRecords := len(batch.Entries)
+		if batch.Frame != nil {
+			// the streamed records are written as a single batch
+			frameRecords = records
+		}
+		frames = append(frames, SpillFrame{Data: getSinkBatchFrame(batch), Records: frameRecords})
+	}
+	droppedRecords, err := ContainerLogSpillBuffer.Enqueue(frames)
+	updateContainerLogSpillBufferTelemetry(0, 0, droppedRecords)
+	if err != nil {
+		Log("Error::spill::Failed to spill %d container log records: %s", records, err.Error())
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsSpillBufferWriteErrors += 1
+		ContainerLogTelemetryMutex.Unlock()
+		return false
+	}
+	if droppedRecords > 0 {
+		Log("Warn::spill::Dropped %d container log records from spill buffer due to size or age cap", droppedRecords)
+	}
+	updateContainerLogSpillBufferTelemetry(records, 0, 0)
+	Log("Info::spill::Spilled %d container log records to disk", records)
+	return true
+}
+
+// replayContainerLogSpillBuffer replays spilled container log batches to the sink. Returns true when the backlog is drained
+func replayContainerLogSpillBuffer(sink Sink) (bool, error) {
+	if ContainerLogSpillBuffer == nil || ContainerLogSpillBuffer.Len() == 0 {
+		return true, nil
+	}
+	if failoverSink, ok := sink.(*FailoverSink); ok {
+		// spilled frames can only be replayed to the agent, they wait for the failback
+		sink = failoverSink.Active()
+	}
+	frameSink, ok := sink.(FrameSink)
+	if !ok {
+		return true, nil
+	}
+	if !frameSink.IsHealthy() {
+		if err := frameSink.Connect(); err != nil {
+			return false, newSinkConnectError(err)
+		}
+	}
+	replayedRecords, droppedRecords, drained, err := ContainerLogSpillBuffer.Replay(func(data []byte) error {
+		_, er := frameSink.WriteFrame(data)
+		return er
+	}, spillBufferMaxReplayBatchesPerFlush)
+	updateContainerLogSpillBufferTelemetry(0, replayedRecords, droppedRecords)
+	if replayedRecords > 0 {
+		Log("Info::spill::Replayed %d spilled container log records to %s", replayedRecords, frameSink.Name())
+	}
+	if err != nil {
+		Log("Error::spill::Failed to replay spilled container log records to %s: %s", frameSink.Name(), err.Error())
+		frameSink.Close()
+	}
+	return drained, err
+}
+
+func updateContainerLogSpillBufferTelemetry(spilledRecords int, replayedRecords int, droppedRecords int) {
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsSpilledRecordsCount += float64(spilledRecords)
+	ContainerLogsSpillReplayedRecordsCount += float64(replayedRecords)
+	ContainerLogsSpillDroppedRecordsCount += float64(droppedRecords)
+	ContainerLogTelemetryMutex.Unlock()
+}
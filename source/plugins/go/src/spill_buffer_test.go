@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpillBufferReplayInOrder(t *testing.T) {
+	sb, err := NewSpillBuffer(t.TempDir(), 1024, time.Hour)
+	assert.NoError(t, err)
+
+	_, err = sb.Enqueue([]SpillFrame{{Data: []byte("a1"), Records: 1}, {Data: []byte("a2"), Records: 1}})
+	assert.NoError(t, err)
+	_, err = sb.Enqueue([]SpillFrame{{Data: []byte("b"), Records: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sb.Len())
+
+	var written []string
+	replayed, dropped, drained, err := sb.Replay(func(data []byte) error {
+		written = append(written, string(data))
+		return nil
+	}, 10)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, []string{"a1", "a2", "b"}, written, "the frames of a batch are replayed one at a time")
+	assert.Equal(t, 0, sb.Len())
+}
+
+func TestSpillBufferReplayStopsOnError(t *testing.T) {
+	sb, err := NewSpillBuffer(t.TempDir(), 1024, time.Hour)
+	assert.NoError(t, err)
+	sb.Enqueue([]SpillFrame{{Data: []byte("a"), Records: 1}})
+	sb.Enqueue([]SpillFrame{{Data: []byte("b"), Records: 1}})
+
+	replayed, _, drained, err := sb.Replay(func(data []byte) error {
+		return errors.New("socket closed")
+	}, 10)
+	assert.Error(t, err)
+	assert.False(t, drained)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, 2, sb.Len())
+}
+
+func TestSpillBufferDropsOldestWhenFull(t *testing.T) {
+	// each frame takes its 8 bytes prefix on top of its data
+	sb, err := NewSpillBuffer(t.TempDir(), 20, time.Hour)
+	assert.NoError(t, err)
+
+	dropped, err := sb.Enqueue([]SpillFrame{{Data: []byte("123456"), Records: 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	dropped, err = sb.Enqueue([]SpillFrame{{Data: []byte("7890ab"), Records: 4}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, dropped)
+	assert.Equal(t, 1, sb.Len())
+
+	dropped, err = sb.Enqueue([]SpillFrame{{Data: []byte("this batch is too large"), Records: 5}})
+	assert.Error(t, err)
+	assert.Equal(t, 5, dropped)
+}
+
+func TestSpillBufferDropsExpiredBatches(t *testing.T) {
+	sb, err := NewSpillBuffer(t.TempDir(), 1024, time.Millisecond)
+	assert.NoError(t, err)
+	sb.Enqueue([]SpillFrame{{Data: []byte("a"), Records: 2}})
+	time.Sleep(5 * time.Millisecond)
+
+	replayed, dropped, drained, err := sb.Replay(func(data []byte) error { return nil }, 10)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, 2, dropped)
+}
+
+func TestSpillBufferReloadsPendingBatches(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := NewSpillBuffer(dir, 1024, time.Hour)
+	assert.NoError(t, err)
+	sb.Enqueue([]SpillFrame{{Data: []byte("first"), Records: 1}})
+	sb.Enqueue([]SpillFrame{{Data: []byte("second"), Records: 1}})
+
+	reloaded, err := NewSpillBuffer(dir, 1024, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reloaded.Len())
+
+	var written []string
+	reloaded.Replay(func(data []byte) error {
+		written = append(written, string(data))
+		return nil
+	}, 10)
+	assert.Equal(t, []string{"first", "second"}, written)
+}
+
+func TestSpillBufferKeepsTheFramesNotReplayed(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := NewSpillBuffer(dir, 1024, time.Hour)
+	assert.NoError(t, err)
+	sb.Enqueue([]SpillFrame{{Data: []byte("a1"), Records: 2}, {Data: []byte("a2"), Records: 3}, {Data: []byte("a3"), Records: 4}})
+
+	var written []string
+	replayed, _, drained, err := sb.Replay(func(frame []byte) error {
+		if string(frame) == "a2" {
+			return errors.New("socket closed")
+		}
+		written = append(written, string(frame))
+		return nil
+	}, 10)
+	assert.Error(t, err)
+	assert.False(t, drained)
+	assert.Equal(t, 2, replayed)
+
+	reloaded, err := NewSpillBuffer(dir, 1024, time.Hour)
+	assert.NoError(t, err)
+	replayed, _, drained, err = reloaded.Replay(func(frame []byte) error {
+		written = append(written, string(frame))
+		return nil
+	}, 10)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+	assert.Equal(t, 7, replayed)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, written, "the replayed frame isnt sent again")
+}
+
+func TestSpillBufferSplitsLegacyBatches(t *testing.T) {
+	dir := t.TempDir()
+	first := convertMsgPackEntriesToMsgpBytes("dcr-1", []MsgPackEntry{{Record: map[string]string{"LogMessage": "a"}}})
+	second := convertMsgPackEntriesToMsgpBytes("dcr-2", []MsgPackEntry{{Record: map[string]string{"LogMessage": "b"}}})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000001-000001-2"+legacySpillBufferFileExtension), append(append([]byte{}, first...), second...), 0600))
+
+	sb, err := NewSpillBuffer(dir, 1024*1024, 0)
+	assert.NoError(t, err)
+	var written [][]byte
+	replayed, _, _, err := sb.Replay(func(frame []byte) error {
+		written = append(written, frame)
+		return nil
+	}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, [][]byte{first, second}, written)
+}
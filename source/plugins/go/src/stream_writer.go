@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// env variable of the max number of multi-tenancy streams written in parallel, 1 writes the streams one after another on a single connection
+const MultiTenancyMaxParallelWritesEnv = "AZMON_MULTI_TENANCY_MAX_PARALLEL_WRITES"
+
+const defaultMultiTenancyMaxParallelWrites = 8
+
+// StreamWriter writes the batches of the output streams of a flush in parallel, each stream on its own connection to the agent.
+// A failing stream doesnt prevent the other streams from being delivered
+type StreamWriter struct {
+	// sink the streams are written to, its batches are also mirrored to the alongside file sink
+	sink              Sink
+	maxParallelWrites int
+	// newStreamSink creates the sink of the stream of the batch
+	newStreamSink func(batch *SinkBatch) Sink
+	mutex         sync.Mutex
+	// sinks by stream
+	streamSinks map[string]Sink
+}
+
+// NewStreamWriter creates a writer of the streams of the agent sink. Returns nil if the sink has no per stream connections
+func NewStreamWriter(sink Sink, maxParallelWrites int) *StreamWriter {
+	var newStreamSink func(batch *SinkBatch) Sink
+	switch sink := sink.(type) {
+	case *ForwardSocketSink:
+		newStreamSink = func(batch *SinkBatch) Sink {
+			return &ForwardSocketSink{address: sink.address, security: sink.security, ackTimeout: sink.ackTimeout}
+		}
+	case *NamedPipeSink:
+		newStreamSink = func(batch *SinkBatch) Sink {
+			streamSink := NewNamedPipeSink(sink.getDataType, sink.isGenevaLogsIntegrationEnabled, sink.refreshTracker)
+			streamSink.namedPipe = batch.NamedPipe
+			return streamSink
+		}
+	default:
+		return nil
+	}
+	return &StreamWriter{
+		sink:              sink,
+		maxParallelWrites: maxParallelWrites,
+		newStreamSink:     newStreamSink,
+		streamSinks:       make(map[string]Sink),
+	}
+}
+
+// streamSink returns the sink of the stream of the batch, the sinks of the batches of the same stream are shared
+func (w *StreamWriter) streamSink(batch *SinkBatch) Sink {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	key := batch.Tag + "|" + batch.NamedPipe
+	if sink, ok := w.streamSinks[key]; ok {
+		return sink
+	}
+	// the streams of removed DCRs arent tracked, so the connections are released once the cache is full
+	if len(w.streamSinks) >= NamedPipeConnectionCacheSize {
+		for streamKey, sink := range w.streamSinks {
+			sink.Close()
+			delete(w.streamSinks, streamKey)
+		}
+	}
+	sink := w.newStreamSink(batch)
+	w.streamSinks[key] = sink
+	return sink
+}
+
+// Write writes the batches with at most maxParallelWrites streams in flight. The batches sharing a stream sink are written
+// one after another in order, since they share its connection. Returns the bytes written and the batches which failed
+// along with the error of the first of them
+func (w *StreamWriter) Write(batches []*SinkBatch) (int, []*SinkBatch, error) {
+	// indexes of the batches per stream sink, e.g. the namespaces falling back to the default stream share its sink
+	var streamSinks []Sink
+	var streamBatches [][]int
+	streamIndexes := make(map[Sink]int)
+	for i, batch := range batches {
+		sink := w.streamSink(batch)
+		index, ok := streamIndexes[sink]
+		if !ok {
+			index = len(streamSinks)
+			streamIndexes[sink] = index
+			streamSinks = append(streamSinks, sink)
+			streamBatches = append(streamBatches, nil)
+		}
+		streamBatches[index] = append(streamBatches[index], i)
+	}
+
+	bytesWritten := make([]int, len(batches))
+	errs := make([]error, len(batches))
+	semaphore := make(chan struct{}, w.maxParallelWrites)
+	var wg sync.WaitGroup
+	for s := range streamSinks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(s int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			sink := streamSinks[s]
+			var err error
+			for _, i := range streamBatches[s] {
+				batch := batches[i]
+				// the batches after a failed one arent written, so the stream isnt written out of order
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				bytesWritten[i], err = writeToSinkWithRetry(sink, batch)
+				if err != nil {
+					errs[i] = err
+					Log("Error::%s::Failed to write %d records of stream %s. error: %s", sink.Name(), len(batch.Entries), batch.Tag, err.Error())
+					continue
+				}
+				mirrorBatchToFile(w.sink, batch)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	totalBytes := 0
+	var failedBatches []*SinkBatch
+	var err error
+	for i, batch := range batches {
+		if errs[i] != nil {
+			failedBatches = append(failedBatches, batch)
+			if err == nil {
+				err = errs[i]
+			}
+			continue
+		}
+		totalBytes += bytesWritten[i]
+	}
+	if len(failedBatches) > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsStreamWriteErrorsCount += float64(len(failedBatches))
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	return totalBytes, failedBatches, err
+}
+
+// initializeContainerLogStreamWriter enables the parallel writes of the multi-tenancy streams
+func initializeContainerLogStreamWriter() {
+	if !(IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode) || IsGenevaLogsIntegrationEnabled || ContainerLogSink == nil {
+		return
+	}
+	maxParallelWrites := defaultMultiTenancyMaxParallelWrites
+	if value := strings.TrimSpace(os.Getenv(MultiTenancyMaxParallelWritesEnv)); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			message := fmt.Sprintf("Error::ama::Invalid %s value %s, using %d", MultiTenancyMaxParallelWritesEnv, value, defaultMultiTenancyMaxParallelWrites)
+			Log(message)
+			SendException(message)
+		} else {
+			maxParallelWrites = parsed
+		}
+	}
+	if maxParallelWrites <= 1 {
+		Log("Multi-tenancy streams are written one after another")
+		return
+	}
+	ContainerLogStreamWriter = NewStreamWriter(ContainerLogSink, maxParallelWrites)
+	if ContainerLogStreamWriter == nil {
+		Log("Multi-tenancy streams are written one after another since the %s sink has no per stream connections", ContainerLogSink.Name())
+		return
+	}
+	Log("Multi-tenancy streams are written in parallel. maxParallelWrites: %d", maxParallelWrites)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+// concurrentSink records the max number of writes in flight across the sinks sharing inFlight
+type concurrentSink struct {
+	fakeSink
+	mutex       sync.Mutex
+	inFlight    *int32
+	maxInFlight *int32
+}
+
+func (s *concurrentSink) Write(batch *SinkBatch) (int, error) {
+	current := atomic.AddInt32(s.inFlight, 1)
+	defer atomic.AddInt32(s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(s.maxInFlight)
+		if current <= max || atomic.CompareAndSwapInt32(s.maxInFlight, max, current) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fakeSink.Write(batch)
+}
+
+func streamWriterTestBatches(tags ...string) []*SinkBatch {
+	var batches []*SinkBatch
+	for _, tag := range tags {
+		batches = append(batches, &SinkBatch{DataType: ContainerLogV2DataType, Tag: tag, Entries: []MsgPackEntry{{Record: map[string]string{"LogMessage": tag}}}})
+	}
+	return batches
+}
+
+func TestStreamWriterIsolatesFailingStreams(t *testing.T) {
+	var inFlight, maxInFlight int32
+	sinks := map[string]*concurrentSink{}
+	writer := &StreamWriter{sink: &fakeSink{}, maxParallelWrites: 2, streamSinks: make(map[string]Sink)}
+	writer.newStreamSink = func(batch *SinkBatch) Sink {
+		sink := &concurrentSink{fakeSink: fakeSink{connected: true}, inFlight: &inFlight, maxInFlight: &maxInFlight}
+		if batch.Tag == "dcr-2" {
+			sink.writeErrs = []error{&SinkError{Op: "write", Retriable: false, Err: errors.New("stream opted out")}}
+		}
+		sinks[batch.Tag] = sink
+		return sink
+	}
+
+	bts, failedBatches, err := writer.Write(streamWriterTestBatches("dcr-1", "dcr-2", "dcr-3", "dcr-4", "dcr-1"))
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(failedBatches))
+	assert.Equal(t, "dcr-2", failedBatches[0].Tag)
+	assert.Equal(t, 4, bts)
+	assert.Equal(t, 4, len(sinks), "the batches of a stream share its sink")
+	assert.Equal(t, 2, sinks["dcr-1"].writes)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestStreamWriterSerializesBatchesSharingASink(t *testing.T) {
+	var inFlight, maxInFlight int32
+	sink := &concurrentSink{fakeSink: fakeSink{connected: true}, inFlight: &inFlight, maxInFlight: &maxInFlight}
+	writer := &StreamWriter{sink: &fakeSink{}, maxParallelWrites: 4, streamSinks: make(map[string]Sink)}
+	writer.newStreamSink = func(batch *SinkBatch) Sink { return sink }
+
+	batches := streamWriterTestBatches("ns-1", "ns-2", "ns-3", "ns-4")
+	_, failedBatches, err := writer.Write(batches)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(failedBatches))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxInFlight))
+	assert.Equal(t, batches, sink.lastBatches)
+}
+
+func TestPostDataHelperRetriesFailedStreams(t *testing.T) {
+	sink := &fakeSink{connected: true}
+	records := setupMultiTenantContainerLogFlush(t, sink)
+	streamWriter := ContainerLogStreamWriter
+	defer func() { ContainerLogStreamWriter = streamWriter }()
+	streamSinks := map[string]*fakeSink{}
+	ContainerLogStreamWriter = &StreamWriter{sink: sink, maxParallelWrites: 2, streamSinks: make(map[string]Sink)}
+	ContainerLogStreamWriter.newStreamSink = func(batch *SinkBatch) Sink {
+		streamSink := &fakeSink{connected: true}
+		if batch.Tag == "dcr-default" {
+			streamSink.writeErrs = []error{&SinkError{Op: "write", Retriable: false, Err: errors.New("stream opted out")}}
+		}
+		streamSinks[batch.Tag] = streamSink
+		return streamSink
+	}
+
+	// the records of the failed stream arent dropped, the retry only writes them
+	assert.Equal(t, output.FLB_RETRY, PostDataHelper(records))
+	assert.Equal(t, 2, len(streamSinks))
+	assert.Equal(t, output.FLB_OK, PostDataHelper(records))
+	assert.Equal(t, 1, len(sink.lastBatches))
+	assert.Equal(t, "dcr-default", sink.lastBatches[0].Tag)
+	assert.Equal(t, streamSinks["dcr-default"].lastBatches[0].Entries, sink.lastBatches[0].Entries)
+}
+
+func TestNewStreamWriter(t *testing.T) {
+	assert.Nil(t, NewStreamWriter(NewODSHTTPSink(), 8))
+
+	sink := NewForwardSocketSink("tcp://ama:24224")
+	sink.ackTimeout = time.Second
+	writer := NewStreamWriter(sink, 8)
+	first := writer.streamSink(&SinkBatch{Tag: "dcr-1"})
+	assert.True(t, first == writer.streamSink(&SinkBatch{Tag: "dcr-1"}))
+	assert.True(t, first != writer.streamSink(&SinkBatch{Tag: "dcr-2"}), "each stream has its own connection")
+	assert.Equal(t, "tcp://ama:24224", first.(*ForwardSocketSink).address)
+	assert.Equal(t, time.Second, first.(*ForwardSocketSink).ackTimeout)
+
+	namedPipeWriter := NewStreamWriter(NewNamedPipeSink(getContainerLogDataType, false, &MdsdContainerLogTagRefreshTracker), 8)
+	streamSink := namedPipeWriter.streamSink(&SinkBatch{Tag: "dcr-1", NamedPipe: "CAgentStream_dcr-1"})
+	assert.Equal(t, "CAgentStream_dcr-1", streamSink.(*NamedPipeSink).namedPipe)
+}
@@ -47,6 +47,50 @@ var (
 	ContainerLogsSendErrorsToMDSDFromFluent float64
 	//Tracks the number of mdsd client create errors for containerlogs (uses ContainerLogTelemetryTicker)
 	ContainerLogsMDSDClientCreateErrors float64
+	//Tracks the number of container log records spilled to disk when mdsd is unavailable (uses ContainerLogTelemetryTicker)
+	ContainerLogsSpilledRecordsCount float64
+	//Tracks the number of spilled container log records replayed to mdsd (uses ContainerLogTelemetryTicker)
+	ContainerLogsSpillReplayedRecordsCount float64
+	//Tracks the number of spilled container log records dropped due to spill buffer size or age cap (uses ContainerLogTelemetryTicker)
+	ContainerLogsSpillDroppedRecordsCount float64
+	//Tracks the number of errors writing container log batches to the spill buffer (uses ContainerLogTelemetryTicker)
+	ContainerLogsSpillBufferWriteErrors float64
+	//Tracks the number of container log lines joined from CRI partial chunks (uses ContainerLogTelemetryTicker)
+	ContainerLogsPartialLinesReassembledCount float64
+	//Tracks the number of container log lines flushed before their final CRI chunk due to size cap or timeout (uses ContainerLogTelemetryTicker)
+	ContainerLogsPartialLinesFlushedIncompleteCount float64
+	//Tracks the number of container log lines merged into the record of a preceding line by multi-line grouping (uses ContainerLogTelemetryTicker)
+	ContainerLogsMultilineGroupedLinesCount float64
+	//Tracks the number of redactions in container log messages per redaction rule (uses ContainerLogTelemetryTicker)
+	ContainerLogsRedactionHitsByRule = map[string]float64{}
+	//Tracks the number of container log lines parsed as json (uses ContainerLogTelemetryTicker)
+	ContainerLogsJSONParsedRecordsCount float64
+	//Tracks the number of json container log lines sent unparsed because they exceed the size limit (uses ContainerLogTelemetryTicker)
+	ContainerLogsJSONParseOversizedRecordsCount float64
+	//Tracks the number of repeated container log lines suppressed by deduplication (uses ContainerLogTelemetryTicker)
+	ContainerLogsDedupSuppressedLinesCount float64
+	//Tracks the number of container log lines dropped by sampling (uses ContainerLogTelemetryTicker)
+	ContainerLogsSampledOutRecordsCount float64
+	//Tracks the number of container log lines dropped by the namespace filtering of the DCR (uses ContainerLogTelemetryTicker)
+	ContainerLogsDCRNamespaceFilteredRecordsCount float64
+	//Tracks the number of container log lines routed by each routing rule (uses ContainerLogTelemetryTicker)
+	ContainerLogsRoutedRecordsByRule = map[string]float64{}
+	//Tracks the number of container log lines dropped because the ingestion budget of their namespace was exhausted (uses ContainerLogTelemetryTicker)
+	ContainerLogsBudgetDroppedRecordsCount float64
+	//Tracks the number of container log batches mirrored to the secondary destination of the tee (uses ContainerLogTelemetryTicker)
+	ContainerLogsTeeBatchesCount float64
+	//Tracks the number of container log batch mirroring failures or skips of the tee (uses ContainerLogTelemetryTicker)
+	ContainerLogsTeeErrorsCount float64
+	//Tracks the number of container log lines sent to ODS while failed over from the agent (uses ContainerLogTelemetryTicker)
+	ContainerLogsFailoverRecordsCount float64
+	//Tracks the number of container log route switches by the route switched to (uses ContainerLogTelemetryTicker)
+	ContainerLogsRouteSwitchesByRoute = map[string]float64{}
+	//Tracks the number of multi-tenancy stream batches which failed while written in parallel (uses ContainerLogTelemetryTicker)
+	ContainerLogsStreamWriteErrorsCount float64
+	//Tracks the number of container log lines not sent again by the retry of a flush since they were delivered by its earlier attempt (uses ContainerLogTelemetryTicker)
+	ContainerLogsResentRecordsSkippedCount float64
+	//Tracks the number of writes to the agent which werent acknowledged (uses ContainerLogTelemetryTicker)
+	AMAForwardAckFailuresCount float64
 	//Tracks the number of write/send errors to windows ama for containerlogs (uses ContainerLogTelemetryTicker)
 	ContainerLogsSendErrorsToWindowsAMAFromFluent float64
 	//Tracks the number of windows ama client create errors for containerlogs (uses ContainerLogTelemetryTicker)
@@ -112,6 +156,28 @@ const (
 	metricNameNumberofWinTelegrafMetricsWithTagsSize64KBorMore        = "WinTelegrafMetricsCountWithTagsSize64KBorMore"
 	metricNameErrorCountContainerLogsSendErrorsToMDSDFromFluent       = "ContainerLogs2MdsdSendErrorCount"
 	metricNameErrorCountContainerLogsMDSDClientCreateError            = "ContainerLogsMdsdClientCreateErrorCount"
+	metricNameContainerLogsSpilledRecordsCount                        = "ContainerLogsSpilledRecordsCount"
+	metricNameContainerLogsSpillReplayedRecordsCount                  = "ContainerLogsSpillReplayedRecordsCount"
+	metricNameContainerLogsSpillDroppedRecordsCount                   = "ContainerLogsSpillDroppedRecordsCount"
+	metricNameErrorCountContainerLogsSpillBufferWriteError            = "ContainerLogsSpillBufferWriteErrorCount"
+	metricNameContainerLogsPartialLinesReassembledCount               = "ContainerLogsPartialLinesReassembledCount"
+	metricNameContainerLogsPartialLinesFlushedIncompleteCount         = "ContainerLogsPartialLinesFlushedIncompleteCount"
+	metricNameContainerLogsMultilineGroupedLinesCount                 = "ContainerLogsMultilineGroupedLinesCount"
+	metricNameContainerLogsRedactionHitCount                          = "ContainerLogsRedactionHitCount"
+	metricNameContainerLogsJSONParsedRecordsCount                     = "ContainerLogsJSONParsedRecordsCount"
+	metricNameContainerLogsJSONParseOversizedRecordsCount             = "ContainerLogsJSONParseOversizedRecordsCount"
+	metricNameContainerLogsDedupSuppressedLinesCount                  = "ContainerLogsDedupSuppressedLinesCount"
+	metricNameContainerLogsSampledOutRecordsCount                     = "ContainerLogsSampledOutRecordsCount"
+	metricNameContainerLogsDCRNamespaceFilteredRecordsCount           = "ContainerLogsDCRNamespaceFilteredRecordsCount"
+	metricNameContainerLogsRoutedRecordsCount                         = "ContainerLogsRoutedRecordsCount"
+	metricNameContainerLogsBudgetDroppedRecordsCount                  = "ContainerLogsBudgetDroppedRecordsCount"
+	metricNameContainerLogsTeeBatchesCount                            = "ContainerLogsTeeBatchesCount"
+	metricNameContainerLogsTeeErrorsCount                             = "ContainerLogsTeeErrorsCount"
+	metricNameContainerLogsFailoverRecordsCount                       = "ContainerLogsFailoverRecordsCount"
+	metricNameContainerLogsRouteSwitchCount                           = "ContainerLogsRouteSwitchCount"
+	metricNameContainerLogsStreamWriteErrorsCount                     = "ContainerLogsStreamWriteErrorsCount"
+	metricNameContainerLogsResentRecordsSkippedCount                  = "ContainerLogsResentRecordsSkippedCount"
+	metricNameAMAForwardAckFailuresCount                              = "AMAForwardAckFailuresCount"
 	metricNameErrorCountInsightsMetricsMDSDClientCreateError          = "InsightsMetricsMDSDClientCreateErrorsCount"
 	metricNameErrorCountContainerLogsSendErrorsToWindowsAMAFromFluent = "ContainerLogsSendErrorsToWindowsAMAFromFluent"
 	metricNameErrorCountContainerLogsWindowsAMAClientCreateError      = "ContainerLogsWindowsAMAClientCreateErrors"
@@ -157,6 +223,28 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 		winTelegrafMetricsCountWithTagsSize64KBorMore := WinTelegrafMetricsCountWithTagsSize64KBorMore
 		containerLogsSendErrorsToMDSDFromFluent := ContainerLogsSendErrorsToMDSDFromFluent
 		containerLogsMDSDClientCreateErrors := ContainerLogsMDSDClientCreateErrors
+		containerLogsSpilledRecordsCount := ContainerLogsSpilledRecordsCount
+		containerLogsSpillReplayedRecordsCount := ContainerLogsSpillReplayedRecordsCount
+		containerLogsSpillDroppedRecordsCount := ContainerLogsSpillDroppedRecordsCount
+		containerLogsSpillBufferWriteErrors := ContainerLogsSpillBufferWriteErrors
+		containerLogsPartialLinesReassembledCount := ContainerLogsPartialLinesReassembledCount
+		containerLogsPartialLinesFlushedIncompleteCount := ContainerLogsPartialLinesFlushedIncompleteCount
+		containerLogsMultilineGroupedLinesCount := ContainerLogsMultilineGroupedLinesCount
+		containerLogsRedactionHitsByRule := ContainerLogsRedactionHitsByRule
+		containerLogsJSONParsedRecordsCount := ContainerLogsJSONParsedRecordsCount
+		containerLogsJSONParseOversizedRecordsCount := ContainerLogsJSONParseOversizedRecordsCount
+		containerLogsDedupSuppressedLinesCount := ContainerLogsDedupSuppressedLinesCount
+		containerLogsSampledOutRecordsCount := ContainerLogsSampledOutRecordsCount
+		containerLogsDCRNamespaceFilteredRecordsCount := ContainerLogsDCRNamespaceFilteredRecordsCount
+		containerLogsRoutedRecordsByRule := ContainerLogsRoutedRecordsByRule
+		containerLogsBudgetDroppedRecordsCount := ContainerLogsBudgetDroppedRecordsCount
+		containerLogsTeeBatchesCount := ContainerLogsTeeBatchesCount
+		containerLogsTeeErrorsCount := ContainerLogsTeeErrorsCount
+		containerLogsFailoverRecordsCount := ContainerLogsFailoverRecordsCount
+		containerLogsRouteSwitchesByRoute := ContainerLogsRouteSwitchesByRoute
+		containerLogsStreamWriteErrorsCount := ContainerLogsStreamWriteErrorsCount
+		containerLogsResentRecordsSkippedCount := ContainerLogsResentRecordsSkippedCount
+		amaForwardAckFailuresCount := AMAForwardAckFailuresCount
 		containerLogsSendErrorsToADXFromFluent := ContainerLogsSendErrorsToADXFromFluent
 		containerLogsADXClientCreateErrors := ContainerLogsADXClientCreateErrors
 		containerLogsSendErrorsToWindowsAMAFromFluent := ContainerLogsSendErrorsToWindowsAMAFromFluent
@@ -190,6 +278,28 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 		AgentLogProcessingMaxLatencyMsContainer = ""
 		ContainerLogsSendErrorsToMDSDFromFluent = 0.0
 		ContainerLogsMDSDClientCreateErrors = 0.0
+		ContainerLogsSpilledRecordsCount = 0.0
+		ContainerLogsSpillReplayedRecordsCount = 0.0
+		ContainerLogsSpillDroppedRecordsCount = 0.0
+		ContainerLogsSpillBufferWriteErrors = 0.0
+		ContainerLogsPartialLinesReassembledCount = 0.0
+		ContainerLogsPartialLinesFlushedIncompleteCount = 0.0
+		ContainerLogsMultilineGroupedLinesCount = 0.0
+		ContainerLogsRedactionHitsByRule = map[string]float64{}
+		ContainerLogsJSONParsedRecordsCount = 0.0
+		ContainerLogsJSONParseOversizedRecordsCount = 0.0
+		ContainerLogsDedupSuppressedLinesCount = 0.0
+		ContainerLogsSampledOutRecordsCount = 0.0
+		ContainerLogsDCRNamespaceFilteredRecordsCount = 0.0
+		ContainerLogsRoutedRecordsByRule = map[string]float64{}
+		ContainerLogsBudgetDroppedRecordsCount = 0.0
+		ContainerLogsTeeBatchesCount = 0.0
+		ContainerLogsTeeErrorsCount = 0.0
+		ContainerLogsFailoverRecordsCount = 0.0
+		ContainerLogsRouteSwitchesByRoute = map[string]float64{}
+		ContainerLogsStreamWriteErrorsCount = 0.0
+		ContainerLogsResentRecordsSkippedCount = 0.0
+		AMAForwardAckFailuresCount = 0.0
 		ContainerLogsSendErrorsToWindowsAMAFromFluent = 0.0
 		ContainerLogsWindowsAMAClientCreateErrors = 0.0
 		ContainerLogsSendErrorsToADXFromFluent = 0.0
@@ -341,6 +451,78 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 		if containerLogsMDSDClientCreateErrors > 0.0 {
 			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsMDSDClientCreateError, containerLogsMDSDClientCreateErrors))
 		}
+		if containerLogsSpilledRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsSpilledRecordsCount, containerLogsSpilledRecordsCount))
+		}
+		if containerLogsSpillReplayedRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsSpillReplayedRecordsCount, containerLogsSpillReplayedRecordsCount))
+		}
+		if containerLogsSpillDroppedRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsSpillDroppedRecordsCount, containerLogsSpillDroppedRecordsCount))
+		}
+		if containerLogsSpillBufferWriteErrors > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSpillBufferWriteError, containerLogsSpillBufferWriteErrors))
+		}
+		if containerLogsPartialLinesReassembledCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsPartialLinesReassembledCount, containerLogsPartialLinesReassembledCount))
+		}
+		if containerLogsPartialLinesFlushedIncompleteCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsPartialLinesFlushedIncompleteCount, containerLogsPartialLinesFlushedIncompleteCount))
+		}
+		if containerLogsMultilineGroupedLinesCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsMultilineGroupedLinesCount, containerLogsMultilineGroupedLinesCount))
+		}
+		for rule, hits := range containerLogsRedactionHitsByRule {
+			redactionMetric := appinsights.NewMetricTelemetry(metricNameContainerLogsRedactionHitCount, hits)
+			redactionMetric.Properties["Rule"] = rule
+			TelemetryClient.Track(redactionMetric)
+		}
+		for rule, records := range containerLogsRoutedRecordsByRule {
+			routingMetric := appinsights.NewMetricTelemetry(metricNameContainerLogsRoutedRecordsCount, records)
+			routingMetric.Properties["Rule"] = rule
+			TelemetryClient.Track(routingMetric)
+		}
+		if containerLogsJSONParsedRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsJSONParsedRecordsCount, containerLogsJSONParsedRecordsCount))
+		}
+		if containerLogsJSONParseOversizedRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsJSONParseOversizedRecordsCount, containerLogsJSONParseOversizedRecordsCount))
+		}
+		if containerLogsDedupSuppressedLinesCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsDedupSuppressedLinesCount, containerLogsDedupSuppressedLinesCount))
+		}
+		if containerLogsSampledOutRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsSampledOutRecordsCount, containerLogsSampledOutRecordsCount))
+		}
+		if containerLogsDCRNamespaceFilteredRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsDCRNamespaceFilteredRecordsCount, containerLogsDCRNamespaceFilteredRecordsCount))
+		}
+		if containerLogsBudgetDroppedRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsBudgetDroppedRecordsCount, containerLogsBudgetDroppedRecordsCount))
+		}
+		if containerLogsTeeBatchesCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsTeeBatchesCount, containerLogsTeeBatchesCount))
+		}
+		if containerLogsTeeErrorsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsTeeErrorsCount, containerLogsTeeErrorsCount))
+		}
+		if containerLogsFailoverRecordsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsFailoverRecordsCount, containerLogsFailoverRecordsCount))
+		}
+		for route, switches := range containerLogsRouteSwitchesByRoute {
+			routeSwitchMetric := appinsights.NewMetricTelemetry(metricNameContainerLogsRouteSwitchCount, switches)
+			routeSwitchMetric.Properties["Route"] = route
+			TelemetryClient.Track(routeSwitchMetric)
+		}
+		if containerLogsStreamWriteErrorsCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsStreamWriteErrorsCount, containerLogsStreamWriteErrorsCount))
+		}
+		if containerLogsResentRecordsSkippedCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogsResentRecordsSkippedCount, containerLogsResentRecordsSkippedCount))
+		}
+		if amaForwardAckFailuresCount > 0.0 {
+			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameAMAForwardAckFailuresCount, amaForwardAckFailuresCount))
+		}
 		if containerLogsSendErrorsToWindowsAMAFromFluent > 0.0 {
 			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToWindowsAMAFromFluent, containerLogsSendErrorsToWindowsAMAFromFluent))
 		}
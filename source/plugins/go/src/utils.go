@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -119,87 +118,6 @@ func ToString(s interface{}) string {
 	}
 }
 
-// mdsdSocketClient to write msgp messages
-func CreateMDSDClient(dataType DataType, containerType string) {
-	mdsdfluentSocket := "/var/run/mdsd-ci/default_fluent.socket"
-	if containerType != "" && strings.Compare(strings.ToLower(containerType), "prometheussidecar") == 0 {
-		mdsdfluentSocket = fmt.Sprintf("/var/run/mdsd-%s/default_fluent.socket", containerType)
-	}
-	switch dataType {
-	case ContainerLogV2:
-		if MdsdMsgpUnixSocketClient != nil {
-			MdsdMsgpUnixSocketClient.Close()
-			MdsdMsgpUnixSocketClient = nil
-		}
-		/*conn, err := fluent.New(fluent.Config{FluentNetwork:"unix",
-		FluentSocketPath:"/var/run/mdsd-ci/default_fluent.socket",
-		WriteTimeout: 5 * time.Second,
-		RequestAck: true}) */
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for ContainerLogV2 %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for ContainerLogV2: %s", mdsdfluentSocket)
-			MdsdMsgpUnixSocketClient = conn
-		}
-	case KubeMonAgentEvents:
-		// incase of geneva logs integration mode, KubeMonAgentEvents ingested via sidecar container socket
-		if IsGenevaLogsIntegrationEnabled {
-			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
-		}
-		if MdsdKubeMonMsgpUnixSocketClient != nil {
-			MdsdKubeMonMsgpUnixSocketClient.Close()
-			MdsdKubeMonMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for KubeMon events %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for KubeMon events:%s", mdsdfluentSocket)
-			MdsdKubeMonMsgpUnixSocketClient = conn
-		}
-	case InsightsMetrics:
-		// incase of geneva logs integration mode, InsightsMetrics ingested via sidecar container socket
-		if IsGenevaLogsIntegrationEnabled {
-			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
-		}
-		if MdsdInsightsMetricsMsgpUnixSocketClient != nil {
-			MdsdInsightsMetricsMsgpUnixSocketClient.Close()
-			MdsdInsightsMetricsMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for insights metrics %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for Insights metrics %s", mdsdfluentSocket)
-			MdsdInsightsMetricsMsgpUnixSocketClient = conn
-		}
-	case InputPluginRecords:
-		// incase of geneva logs integration mode, InsightsMetrics ingested via sidecar container socket
-		if IsGenevaLogsIntegrationEnabled {
-			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
-		}
-		if MdsdInputPluginRecordsMsgpUnixSocketClient != nil {
-			MdsdInputPluginRecordsMsgpUnixSocketClient.Close()
-			MdsdInputPluginRecordsMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for input plugin records %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for input plugin records %s", mdsdfluentSocket)
-			MdsdInputPluginRecordsMsgpUnixSocketClient = conn
-		}
-	}
-}
-
 func ReadFileContents(fullPathToFileName string) (string, error) {
 	return ReadFileContentsImpl(fullPathToFileName, ioutil.ReadFile)
 }
@@ -239,7 +157,7 @@ func convertMsgPackEntriesToMsgpBytes(fluentForwardTag string, msgPackEntries []
 	//determine the size of msgp message
 	msgpSize := 1 + msgp.StringPrefixSize + len(fluentForward.Tag) + msgp.ArrayHeaderSize
 	for i := range fluentForward.Entries {
-		msgpSize += 1 + msgp.Int64Size + msgp.GuessSize(fluentForward.Entries[i].Record)
+		msgpSize += 1 + eventTimeSize + msgp.GuessSize(fluentForward.Entries[i].Record)
 	}
 
 	//allocate buffer for msgp message
@@ -249,10 +167,14 @@ func convertMsgPackEntriesToMsgpBytes(fluentForwardTag string, msgPackEntries []
 	msgpBytes = append(msgpBytes, 0x92)
 	msgpBytes = msgp.AppendString(msgpBytes, fluentForward.Tag)
 	msgpBytes = msgp.AppendArrayHeader(msgpBytes, uint32(len(fluentForward.Entries)))
-	batchTime := time.Now().Unix()
+	flushTime := time.Now()
 	for entry := range fluentForward.Entries {
+		entryTime := fluentForward.Entries[entry].Time
+		if entryTime.IsZero() {
+			entryTime = flushTime
+		}
 		msgpBytes = append(msgpBytes, 0x92)
-		msgpBytes = msgp.AppendInt64(msgpBytes, batchTime)
+		msgpBytes = appendEventTime(msgpBytes, entryTime)
 		msgpBytes = msgp.AppendMapStrStr(msgpBytes, fluentForward.Entries[entry].Record)
 	}
 
@@ -7,19 +7,12 @@ import (
 	"net"
 	"os/exec"
 	"strings"
-	"time"
 )
 
 func CreateWindowsNamedPipeClient(namedPipe string, namedPipeConnection *net.Conn) error {
 	return errors.New("Error::CreateWindowsNamedPipeClient not implemented for Linux")
 }
 
-func EnsureGenevaOr3PNamedPipeExists(namedPipeConnection *net.Conn, datatype string, errorCount *float64, isGenevaLogsIntegrationEnabled bool, refreshTracker *time.Time) bool {
-	//function unimplemented
-	Log("Error::EnsureGenevaOr3PNamedPipeExists not implemented for Linux")
-	return false
-}
-
 func isProcessRunning(processName string) (string, error) {
 	cmd := exec.Command("pgrep", processName)
 	output, err := cmd.Output()
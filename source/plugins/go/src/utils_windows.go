@@ -35,27 +35,6 @@ func CreateWindowsNamedPipeClient(namedPipe string, namedPipeConnection *net.Con
 	return nil
 }
 
-func EnsureGenevaOr3PNamedPipeExists(namedPipeConnection *net.Conn, datatype string, errorCount *float64, isGenevaLogsIntegrationEnabled bool, refreshTracker *time.Time) bool {
-	if *namedPipeConnection == nil {
-		Log("Error::AMA:: The connection to named pipe was nil. re-connecting...")
-		var err error
-		if isGenevaLogsIntegrationEnabled {
-			err = CreateWindowsNamedPipeClient(getGenevaWindowsNamedPipeName(), namedPipeConnection)
-		} else {
-			err = CreateWindowsNamedPipeClient(GetOutputNamedPipe(datatype, refreshTracker), namedPipeConnection)
-		}
-
-		if err != nil || namedPipeConnection == nil {
-			Log("Error::AMA::Cannot create the named pipe connection for %s.", datatype)
-			ContainerLogTelemetryMutex.Lock()
-			defer ContainerLogTelemetryMutex.Unlock()
-			*errorCount += 1
-			return false
-		}
-	}
-	return true
-}
-
 func isProcessRunning(processName string) (string, error) {
 	cmd := exec.Command("tasklist", "/FI", fmt.Sprintf("IMAGENAME eq %s", processName))
 	output, err := cmd.Output()
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variable to enable the pod annotation based log collection settings (set from log_collection_settings.pod_annotation_settings in the configmap)
+const PodAnnotationLogSettingsEnabledEnv = "AZMON_POD_ANNOTATION_LOG_SETTINGS_ENABLED"
+
+// pod annotations for the per workload log collection settings
+const podAnnotationLogSettingsPrefix = "logs.monitor.azure.com/"
+const podAnnotationExcludeStdout = podAnnotationLogSettingsPrefix + "exclude-stdout"
+const podAnnotationExcludeStderr = podAnnotationLogSettingsPrefix + "exclude-stderr"
+const podAnnotationParser = podAnnotationLogSettingsPrefix + "parser"
+const podAnnotationSamplingRate = podAnnotationLogSettingsPrefix + "sampling-rate"
+const podAnnotationMultilinePattern = podAnnotationLogSettingsPrefix + "multiline-pattern"
+
+// values of the parser annotation
+const WorkloadLogParserJSON = "json"
+const WorkloadLogParserRaw = "raw"
+
+// WorkloadLogSettings are the log collection settings of a pod from its annotations
+type WorkloadLogSettings struct {
+	ExcludeStdout bool
+	ExcludeStderr bool
+	// json to parse the log lines as json, raw to never parse them, empty to use the cluster settings
+	Parser string
+	// nil to use the cluster settings
+	SamplingRate *float64
+	// start-of-record regex for multi-line grouping, nil to use the cluster settings
+	MultilinePattern *regexp.Regexp
+}
+
+var (
+	// WorkloadLogSettingsEnabled indicates whether the pod annotation based log collection settings are honoured
+	WorkloadLogSettingsEnabled bool
+	// WorkloadLogSettingsMap holds the settings by container id, nil for containers without settings
+	WorkloadLogSettingsMap = map[string]*WorkloadLogSettings{}
+	// WorkloadLogSettingsMutex read and write mutex access to the WorkloadLogSettingsMap
+	WorkloadLogSettingsMutex = &sync.RWMutex{}
+	// WorkloadJSONLogParser parses the log lines of workloads annotated with the json parser if json parsing is not enabled cluster wide
+	WorkloadJSONLogParser *JSONLogParser
+)
+
+// parseWorkloadLogSettings returns the settings from the pod annotations, or nil if the pod has none of the annotations
+func parseWorkloadLogSettings(annotations map[string]string) (*WorkloadLogSettings, error) {
+	var settings *WorkloadLogSettings
+	get := func(key string) (string, bool) {
+		value, ok := annotations[key]
+		if ok && settings == nil {
+			settings = &WorkloadLogSettings{}
+		}
+		return strings.TrimSpace(value), ok
+	}
+
+	if value, ok := get(podAnnotationExcludeStdout); ok {
+		settings.ExcludeStdout = strings.EqualFold(value, "true")
+	}
+	if value, ok := get(podAnnotationExcludeStderr); ok {
+		settings.ExcludeStderr = strings.EqualFold(value, "true")
+	}
+	if value, ok := get(podAnnotationParser); ok {
+		parser := strings.ToLower(value)
+		if parser != WorkloadLogParserJSON && parser != WorkloadLogParserRaw {
+			return nil, fmt.Errorf("unsupported value %s for annotation %s", value, podAnnotationParser)
+		}
+		settings.Parser = parser
+	}
+	if value, ok := get(podAnnotationSamplingRate); ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("value %s for annotation %s is not a number between 0 and 1", value, podAnnotationSamplingRate)
+		}
+		settings.SamplingRate = &rate
+	}
+	if value, ok := get(podAnnotationMultilinePattern); ok && value != "" {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("value %s for annotation %s is not a valid regex: %s", value, podAnnotationMultilinePattern, err.Error())
+		}
+		settings.MultilinePattern = pattern
+	}
+	return settings, nil
+}
+
+// getPodAnnotationLogSettings parses the settings from the pod annotations, logging invalid annotations
+func getPodAnnotationLogSettings(podName string, annotations map[string]string) *WorkloadLogSettings {
+	settings, err := parseWorkloadLogSettings(annotations)
+	if err != nil {
+		Log("Error::annotations::Ignoring log collection annotations of pod %s: %s", podName, err.Error())
+		return nil
+	}
+	return settings
+}
+
+// getWorkloadLogSettings returns the settings of the container of the record. The settings are looked up in the map refreshed
+// from the pods of the node, and otherwise read from the kubernetes metadata of the record
+func getWorkloadLogSettings(containerID string, record map[interface{}]interface{}) *WorkloadLogSettings {
+	if !WorkloadLogSettingsEnabled || containerID == "" {
+		return nil
+	}
+	WorkloadLogSettingsMutex.RLock()
+	settings, ok := WorkloadLogSettingsMap[containerID]
+	WorkloadLogSettingsMutex.RUnlock()
+	if ok {
+		return settings
+	}
+
+	kubernetesMetadata, exists := record["kubernetes"]
+	if !exists {
+		return nil
+	}
+	kubernetesMetadataMap, err := convertKubernetesMetadata(kubernetesMetadata)
+	if err != nil {
+		return nil
+	}
+	annotations := make(map[string]string)
+	if annotationsMap, ok := kubernetesMetadataMap["annotations"].(map[string]interface{}); ok {
+		for key, value := range annotationsMap {
+			if strings.HasPrefix(key, podAnnotationLogSettingsPrefix) {
+				annotations[key] = fmt.Sprintf("%v", value)
+			}
+		}
+	}
+	podName, _ := kubernetesMetadataMap["pod_name"].(string)
+	settings = getPodAnnotationLogSettings(podName, annotations)
+
+	// cache until the next refresh of the map
+	WorkloadLogSettingsMutex.Lock()
+	WorkloadLogSettingsMap[containerID] = settings
+	WorkloadLogSettingsMutex.Unlock()
+	return settings
+}
+
+// Excludes returns true if the logs of the stream shouldnt be collected
+func (s *WorkloadLogSettings) Excludes(stream string) bool {
+	if s == nil {
+		return false
+	}
+	return (s.ExcludeStdout && strings.EqualFold(stream, "stdout")) || (s.ExcludeStderr && strings.EqualFold(stream, "stderr"))
+}
+
+// initializeWorkloadLogSettings enables the pod annotation based log collection settings if enabled through the configmap settings
+func initializeWorkloadLogSettings() {
+	WorkloadLogSettingsEnabled = strings.Compare(strings.ToLower(strings.TrimSpace(os.Getenv(PodAnnotationLogSettingsEnabledEnv))), "true") == 0
+	if !WorkloadLogSettingsEnabled {
+		Log("Pod annotation based log collection settings are disabled")
+		return
+	}
+	WorkloadJSONLogParser = ContainerLogJSONParser
+	if WorkloadJSONLogParser == nil {
+		WorkloadJSONLogParser = NewJSONLogParser(JSONLogParsingModeLogMessage, nil, defaultContainerLogJSONParsingMaxSizeKB*1024)
+	}
+	if ContainerLogMultilineGrouper == nil {
+		// grouper without any rules, so only the lines of annotated pods are grouped
+		ContainerLogMultilineGrouper, _ = NewMultilineGrouper(nil, nil, nil, defaultContainerLogMultilineGroupingMaxLines, defaultContainerLogMultilineGroupingMaxSizeKB*1024, defaultContainerLogMultilineGroupingTimeoutSeconds*time.Second)
+	}
+	Log("Pod annotation based log collection settings are enabled")
+}
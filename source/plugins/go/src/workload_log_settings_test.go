@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWorkloadLogSettings(t *testing.T) {
+	settings, err := parseWorkloadLogSettings(map[string]string{"app": "web"})
+	assert.NoError(t, err)
+	assert.Nil(t, settings)
+
+	settings, err = parseWorkloadLogSettings(map[string]string{
+		podAnnotationExcludeStdout:    "true",
+		podAnnotationParser:           "JSON",
+		podAnnotationSamplingRate:     "0.2",
+		podAnnotationMultilinePattern: `^\d{4}-`,
+	})
+	assert.NoError(t, err)
+	assert.True(t, settings.Excludes("stdout"))
+	assert.False(t, settings.Excludes("stderr"))
+	assert.Equal(t, WorkloadLogParserJSON, settings.Parser)
+	assert.Equal(t, 0.2, *settings.SamplingRate)
+	assert.True(t, settings.MultilinePattern.MatchString("2024-01-01 started"))
+
+	_, err = parseWorkloadLogSettings(map[string]string{podAnnotationSamplingRate: "half"})
+	assert.Error(t, err)
+	_, err = parseWorkloadLogSettings(map[string]string{podAnnotationParser: "xml"})
+	assert.Error(t, err)
+}
+
+func TestGetWorkloadLogSettingsFromRecordMetadata(t *testing.T) {
+	enabled, settingsMap := WorkloadLogSettingsEnabled, WorkloadLogSettingsMap
+	defer func() { WorkloadLogSettingsEnabled, WorkloadLogSettingsMap = enabled, settingsMap }()
+	WorkloadLogSettingsEnabled = true
+	WorkloadLogSettingsMap = map[string]*WorkloadLogSettings{}
+
+	record := criRecord(testContainerLogFilePath, "stderr", "F", "line")
+	record["kubernetes"] = map[interface{}]interface{}{
+		"pod_name": []byte("app-5d4f8"),
+		"annotations": map[interface{}]interface{}{
+			podAnnotationExcludeStderr: []byte("true"),
+		},
+	}
+	settings := getWorkloadLogSettings("0123456789abcdef", record)
+	assert.True(t, settings.Excludes("stderr"))
+	assert.Contains(t, WorkloadLogSettingsMap, "0123456789abcdef")
+
+	var nilSettings *WorkloadLogSettings
+	assert.False(t, nilSettings.Excludes("stdout"))
+}
+
+func TestMultilineGrouperUsesPodMultilinePattern(t *testing.T) {
+	enabled, settingsMap := WorkloadLogSettingsEnabled, WorkloadLogSettingsMap
+	defer func() { WorkloadLogSettingsEnabled, WorkloadLogSettingsMap = enabled, settingsMap }()
+	settings, _ := parseWorkloadLogSettings(map[string]string{podAnnotationMultilinePattern: `^\[`})
+	WorkloadLogSettingsEnabled = true
+	WorkloadLogSettingsMap = map[string]*WorkloadLogSettings{"0123456789abcdef": settings}
+
+	g, err := NewMultilineGrouper(nil, nil, []string{"kube-system"}, 100, 1024, time.Minute)
+	assert.NoError(t, err)
+	output, grouped, _ := g.Process(logRecords("stdout", "[INFO] request", "  header: a", "[INFO] next"))
+	assert.Equal(t, 1, grouped)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "[INFO] request\n  header: a", ToString(output[0]["log"]))
+}